@@ -18,10 +18,12 @@ import (
 	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	_ "net/http/pprof" // Comment this line to disable pprof endpoint.
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"text/template"
 	"time"
@@ -40,6 +42,7 @@ import (
 	"github.com/prometheus/prometheus/storage/remote"
 	"github.com/prometheus/prometheus/version"
 	"github.com/prometheus/prometheus/web"
+	"github.com/prometheus/prometheus/web/api/v1"
 )
 
 func main() {
@@ -57,14 +60,44 @@ var (
 		Name:      "config_last_reload_success_timestamp_seconds",
 		Help:      "Timestamp of the last successful configuration reload.",
 	})
+	configReloadDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "prometheus",
+		Name:      "config_reload_duration_seconds",
+		Help:      "The duration of configuration reload attempts in seconds.",
+	})
+	draining = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "prometheus",
+		Name:      "draining",
+		Help:      "Whether the server is draining, i.e. has stopped scraping and rule evaluation while still serving queries.",
+	})
 )
 
 // Main manages the startup and shutdown lifecycle of the entire Prometheus server.
 func Main() int {
+	start := time.Now()
 	if err := parse(os.Args[1:]); err != nil {
 		return 2
 	}
 
+	// On fatal startup errors, do not exit before the minimum shutdown
+	// duration has passed, backing off further after consecutive failures,
+	// so that crash-loops are slow enough for supervisors to back off.
+	failStartup := func() int {
+		if cfg.minShutdownDuration <= 0 {
+			return 1
+		}
+		delay := recordFailedStartup(cfg.storage.PersistenceStoragePath, cfg.minShutdownDuration) - time.Since(start)
+		if delay > 0 {
+			log.Warnf("Startup failed, waiting %v before exiting...", delay)
+			time.Sleep(delay)
+		}
+		return 1
+	}
+
+	if cfg.checkConfig {
+		return checkConfig(os.Stdout, os.Stderr, cfg.configFile, cfg.configLoad)
+	}
+
 	printVersion()
 	if cfg.printVersion {
 		return 0
@@ -75,30 +108,52 @@ func Main() int {
 	var (
 		memStorage     = local.NewMemorySeriesStorage(&cfg.storage)
 		remoteStorage  = remote.New(&cfg.remote)
-		sampleAppender = storage.Fanout{memStorage}
+		sampleAppender = storage.Fanout{{Name: "local", Appender: memStorage, Policy: storage.Required}}
 	)
 	if remoteStorage != nil {
-		sampleAppender = append(sampleAppender, remoteStorage)
+		sampleAppender = append(sampleAppender, storage.FanoutBranch{
+			Name:     "remote",
+			Appender: remoteStorage,
+			Policy:   cfg.remoteFanoutPolicy,
+		})
 		reloadables = append(reloadables, remoteStorage)
 	}
 
+	cfg.queryEngine.RemoteReader = remote.NewReader(&cfg.remote)
+
 	var (
 		notificationHandler = notification.NewNotificationHandler(&cfg.notification)
-		targetManager       = retrieval.NewTargetManager(sampleAppender)
+		targetManager       = retrieval.NewTargetManager(sampleAppender, cfg.targetConflictPolicy)
 		queryEngine         = promql.NewEngine(memStorage, &cfg.queryEngine)
+		ruleQueryEngine     = queryEngine
 	)
+	if cfg.rulesIgnoreQueryConcurrency {
+		ruleQueryEngine = promql.NewEngine(memStorage, &promql.EngineOptions{
+			Timeout:      cfg.queryEngine.Timeout,
+			RemoteReader: cfg.queryEngine.RemoteReader,
+		})
+		defer ruleQueryEngine.Stop()
+	}
 
 	ruleManager := rules.NewManager(&rules.ManagerOptions{
 		SampleAppender:      sampleAppender,
 		NotificationHandler: notificationHandler,
-		QueryEngine:         queryEngine,
+		QueryEngine:         ruleQueryEngine,
 		ExternalURL:         cfg.web.ExternalURL,
+		ForGracePeriod:      cfg.forGracePeriod,
+		EvaluationDelay:     cfg.evaluationDelay,
+
+		MaxConcurrentEvaluations: cfg.maxConcurrentEvaluations,
+		WatchdogAlert:            cfg.watchdogAlert,
+		WatchdogLabels:           cfg.watchdogLabelSet,
 	})
 
 	flags := map[string]string{}
 	cfg.fs.VisitAll(func(f *flag.Flag) {
 		flags[f.Name] = f.Value.String()
 	})
+	// The alert manager URLs may contain basic authentication credentials.
+	flags["alertmanager.url"] = stripURLCredentials(cfg.alertmanagerURLs)
 
 	status := &web.PrometheusStatus{
 		TargetPools: targetManager.Pools,
@@ -107,35 +162,61 @@ func Main() int {
 		Birth:       time.Now(),
 	}
 
+	if remoteStorage != nil {
+		cfg.web.RemoteClients = remoteStorage.Clients()
+	}
+	if cfg.queryLogFile != "" {
+		queryLog, err := v1.NewQueryLog(cfg.queryLogFile, cfg.querySlowThreshold)
+		if err != nil {
+			log.Errorf("Error opening query log: %s", err)
+			return failStartup()
+		}
+		defer queryLog.Close()
+		cfg.web.QueryLog = queryLog
+	}
 	webHandler := web.New(memStorage, queryEngine, ruleManager, status, &cfg.web)
+	// The web server is started right away so that health checks can
+	// reach it during crash recovery. It only becomes ready once all
+	// components have been started below.
+	go webHandler.Run()
 
 	reloadables = append(reloadables, status, targetManager, ruleManager, webHandler, notificationHandler)
 
-	if !reloadConfig(cfg.configFile, reloadables...) {
-		return 1
+	if err := reloadConfig(cfg.configFile, cfg.configLoad, reloadables...); err != nil {
+		return failStartup()
 	}
 
 	// Wait for reload or termination signals. Start the handler for SIGHUP as
 	// early as possible, but ignore it until we are ready to handle reloading
 	// our config.
-	hup := make(chan os.Signal)
+	// The channel is buffered so that a SIGHUP received during a reload
+	// triggers another one instead of being dropped.
+	hup := make(chan os.Signal, 1)
 	hupReady := make(chan bool)
 	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
 		<-hupReady
+		// Reloads are serialized by handling them one after another.
 		for {
 			select {
 			case <-hup:
-			case <-webHandler.Reload():
+				// Reopen the query log so that it can be rotated.
+				if cfg.web.QueryLog != nil {
+					if err := cfg.web.QueryLog.Reopen(); err != nil {
+						log.Errorf("Error reopening query log: %s", err)
+					}
+				}
+				reloadConfig(cfg.configFile, cfg.configLoad, reloadables...)
+			case rc := <-webHandler.Reload():
+				rc <- reloadConfig(cfg.configFile, cfg.configLoad, reloadables...)
 			}
-			reloadConfig(cfg.configFile, reloadables...)
 		}
 	}()
 
 	// Start all components.
 	if err := memStorage.Start(); err != nil {
 		log.Errorln("Error opening memory series storage:", err)
-		return 1
+		return failStartup()
 	}
 	defer func() {
 		if err := memStorage.Stop(); err != nil {
@@ -154,23 +235,52 @@ func Main() int {
 	prometheus.MustRegister(notificationHandler)
 	prometheus.MustRegister(configSuccess)
 	prometheus.MustRegister(configSuccessTime)
+	prometheus.MustRegister(configReloadDuration)
+	prometheus.MustRegister(draining)
 
 	go ruleManager.Run()
-	defer ruleManager.Stop()
 
 	go notificationHandler.Run()
 	defer notificationHandler.Stop()
 
 	go targetManager.Run()
-	defer targetManager.Stop()
 
-	defer queryEngine.Stop()
+	// Scraping and rule evaluation are stopped either when draining or on
+	// shutdown, whichever happens first.
+	var stopIngestionOnce sync.Once
+	stopIngestion := func() {
+		stopIngestionOnce.Do(func() {
+			targetManager.Stop()
+			ruleManager.Stop()
+		})
+	}
+	defer stopIngestion()
 
-	go webHandler.Run()
+	drain := make(chan os.Signal, 1)
+	signal.Notify(drain, syscall.SIGUSR1)
+	go func() {
+		select {
+		case <-drain:
+			log.Warn("Received SIGUSR1, draining...")
+		case <-webHandler.Drain():
+			log.Warn("Received drain request via web service, draining...")
+		}
+		stopIngestion()
+		draining.Set(1)
+		log.Info("Drained. Scraping and rule evaluation stopped, still serving queries.")
+	}()
+
+	defer queryEngine.Stop()
 
 	// Wait for reload or termination signals.
 	close(hupReady) // Unblock SIGHUP handler.
 
+	webHandler.SetReady()
+
+	if cfg.minShutdownDuration > 0 {
+		clearFailedStartups(cfg.storage.PersistenceStoragePath)
+	}
+
 	term := make(chan os.Signal)
 	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
 	select {
@@ -192,10 +302,34 @@ type Reloadable interface {
 	ApplyConfig(*config.Config) bool
 }
 
-func reloadConfig(filename string, rls ...Reloadable) (success bool) {
+// checkConfig loads the given configuration file and the rule files it
+// references, writes all errors found to errOut, and returns the exit code.
+// It neither opens the storage nor starts any other component.
+func checkConfig(out, errOut io.Writer, filename string, o config.LoadOptions) int {
+	conf, err := config.LoadFile(filename, o)
+	if err != nil {
+		fmt.Fprintf(errOut, "Error loading configuration file %s: %s\n", filename, err)
+		return 1
+	}
+	errs := rules.CheckRuleFiles(conf)
+	for _, err := range errs {
+		fmt.Fprintf(errOut, "Error checking rule files of %s: %s\n", filename, err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Fprintf(out, "Configuration file %s and its rule files are valid.\n", filename)
+	return 0
+}
+
+// reloadConfig loads the configuration file and applies it to all reloadables.
+// If the file can't be loaded, the reloadables keep their configuration.
+func reloadConfig(filename string, o config.LoadOptions, rls ...Reloadable) (err error) {
 	log.Infof("Loading configuration file %s", filename)
+	start := time.Now()
 	defer func() {
-		if success {
+		configReloadDuration.Observe(time.Since(start).Seconds())
+		if err == nil {
 			configSuccess.Set(1)
 			configSuccessTime.Set(float64(time.Now().Unix()))
 		} else {
@@ -203,21 +337,24 @@ func reloadConfig(filename string, rls ...Reloadable) (success bool) {
 		}
 	}()
 
-	conf, err := config.LoadFile(filename)
+	conf, err := config.LoadFile(filename, o)
 	if err != nil {
 		log.Errorf("Couldn't load configuration (-config.file=%s): %v", filename, err)
 		// TODO(julius): Remove this notice when releasing 0.17.0 or 0.18.0.
 		if err.Error() == "unknown fields in global config: labels" {
 			log.Errorf("NOTE: The 'labels' setting in the global configuration section has been renamed to 'external_labels' and now has changed semantics (see release notes at https://github.com/prometheus/prometheus/blob/master/CHANGELOG.md). Please update your configuration file accordingly.")
 		}
-		return false
+		return fmt.Errorf("couldn't load configuration (-config.file=%s): %v", filename, err)
 	}
-	success = true
 
+	success := true
 	for _, rl := range rls {
 		success = success && rl.ApplyConfig(conf)
 	}
-	return success
+	if !success {
+		return fmt.Errorf("one or more errors occurred while applying the new configuration (-config.file=%s)", filename)
+	}
+	return nil
 }
 
 var versionInfoTmpl = `
@@ -0,0 +1,71 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+const (
+	// failedStartupsFileName is the name of the file in the storage
+	// directory counting consecutive failed startups.
+	failedStartupsFileName = "FAILED_STARTUPS"
+	// maxStartupBackoffFactor caps the growth of the minimum shutdown
+	// duration after consecutive failed startups.
+	maxStartupBackoffFactor = 32
+)
+
+// recordFailedStartup increments the number of consecutive failed startups
+// recorded in dir and returns how long the failed process should have run
+// before exiting. That is minDuration, doubled for every consecutive failed
+// startup before this one, up to maxStartupBackoffFactor times minDuration.
+func recordFailedStartup(dir string, minDuration time.Duration) time.Duration {
+	path := filepath.Join(dir, failedStartupsFileName)
+
+	failures := 0
+	if b, err := ioutil.ReadFile(path); err == nil {
+		failures, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+	}
+	failures++
+
+	err := os.MkdirAll(dir, 0700)
+	if err == nil {
+		err = ioutil.WriteFile(path, []byte(strconv.Itoa(failures)), 0644)
+	}
+	if err != nil {
+		log.Warnf("Error recording failed startup in %s: %s", path, err)
+	}
+
+	factor := time.Duration(1)
+	for i := 1; i < failures && factor < maxStartupBackoffFactor; i++ {
+		factor *= 2
+	}
+	return factor * minDuration
+}
+
+// clearFailedStartups removes the record of consecutive failed startups from
+// dir after a successful startup.
+func clearFailedStartups(dir string) {
+	path := filepath.Join(dir, failedStartupsFileName)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Error clearing failed startups in %s: %s", path, err)
+	}
+}
@@ -80,13 +80,18 @@ func checkConfig(t cli.Term, filename string) ([]string, error) {
 		return nil, fmt.Errorf("is a directory")
 	}
 
-	cfg, err := config.LoadFile(filename)
+	cfg, err := config.LoadFile(filename, config.LoadOptions{})
 	if err != nil {
 		return nil, err
 	}
 
+	patterns := append([]string{}, cfg.RuleFiles...)
+	for _, rg := range cfg.RuleGroups {
+		patterns = append(patterns, rg.RuleFiles...)
+	}
+
 	var ruleFiles []string
-	for _, rf := range cfg.RuleFiles {
+	for _, rf := range patterns {
 		rfs, err := filepath.Glob(rf)
 		if err != nil {
 			return nil, err
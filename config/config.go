@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/url"
+	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -36,6 +37,18 @@ var (
 	patAuthLine   = regexp.MustCompile(`((?:password|bearer_token|secret_key):\s+)(".+"|'.+'|[^\s]+)`)
 )
 
+// LoadOptions control how LoadFile reads configuration files.
+type LoadOptions struct {
+	// ExpandEnv makes LoadFile expand references to environment variables
+	// in the form of ${VAR} or $VAR in configuration files before parsing
+	// them. Unset variables expand to the empty string. A literal $ has to
+	// be written as $$, including in relabeling replacements.
+	ExpandEnv bool
+	// ExpandEnvRequireSet makes LoadFile fail if ExpandEnv is set and a
+	// configuration file references an unset environment variable.
+	ExpandEnvRequireSet bool
+}
+
 // Load parses the YAML input s into a Config.
 func Load(s string) (*Config, error) {
 	cfg := &Config{}
@@ -53,8 +66,8 @@ func Load(s string) (*Config, error) {
 }
 
 // LoadFile parses the given YAML file into a Config.
-func LoadFile(filename string) (*Config, error) {
-	content, err := ioutil.ReadFile(filename)
+func LoadFile(filename string, o LoadOptions) (*Config, error) {
+	content, err := o.readFile(filename)
 	if err != nil {
 		return nil, err
 	}
@@ -63,9 +76,229 @@ func LoadFile(filename string) (*Config, error) {
 		return nil, err
 	}
 	resolveFilepaths(filepath.Dir(filename), cfg)
+	if err := cfg.loadIncludedFiles(filename, o); err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
 
+// readFile reads the named configuration file and expands references to
+// environment variables in it if ExpandEnv is set.
+func (o LoadOptions) readFile(filename string) ([]byte, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil || !o.ExpandEnv {
+		return content, err
+	}
+	return expandEnv(content, o.ExpandEnvRequireSet)
+}
+
+// expandEnv replaces ${VAR} and $VAR in b by the values of the respective
+// environment variables and $$ by $. If requireSet is true, referencing an
+// unset variable is an error.
+func expandEnv(b []byte, requireSet bool) ([]byte, error) {
+	var (
+		unset []string
+		seen  = map[string]bool{}
+	)
+	expanded := os.Expand(string(b), func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		v, ok := os.LookupEnv(name)
+		if !ok && requireSet && !seen[name] {
+			unset = append(unset, name)
+			seen[name] = true
+		}
+		return v
+	})
+	if len(unset) > 0 {
+		return nil, fmt.Errorf("unset environment variables referenced: %s", strings.Join(unset, ", "))
+	}
+	return []byte(expanded), nil
+}
+
+// scrapeConfigFile is the content of a file referenced by scrape_config_files.
+type scrapeConfigFile struct {
+	ScrapeConfigs []*ScrapeConfig `yaml:"scrape_configs,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// includeFile is the content of a file referenced by include_files.
+type includeFile struct {
+	RuleFiles     []string           `yaml:"rule_files,omitempty"`
+	RuleGroups    []*RuleGroupConfig `yaml:"rule_groups,omitempty"`
+	ScrapeConfigs []*ScrapeConfig    `yaml:"scrape_configs,omitempty"`
+	// Patterns of further files to include.
+	IncludeFiles []string `yaml:"include_files,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// includeLoader merges the content of included files into a Config.
+type includeLoader struct {
+	cfg  *Config
+	opts LoadOptions
+	// The files the merged jobs and rule groups are defined in, by name.
+	jobFiles, groupFiles map[string]string
+	// The absolute names of the files currently being included, to detect
+	// cycles.
+	including map[string]bool
+}
+
+// loadIncludedFiles merges the scrape configs of all files matching the
+// patterns in ScrapeConfigFiles as well as the rule files, rule groups, and
+// scrape configs of all files matching the patterns in IncludeFiles, which are
+// loaded recursively, into c. The patterns must have been resolved against
+// the directory of the configuration file filename already. They are cleared
+// once merged, so that the string representation of c loads into the same
+// configuration again.
+func (c *Config) loadIncludedFiles(filename string, o LoadOptions) error {
+	if len(c.ScrapeConfigFiles) == 0 && len(c.IncludeFiles) == 0 {
+		return nil
+	}
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	l := &includeLoader{
+		cfg:        c,
+		opts:       o,
+		jobFiles:   map[string]string{},
+		groupFiles: map[string]string{},
+		including:  map[string]bool{abs: true},
+	}
+	for _, scfg := range c.ScrapeConfigs {
+		l.jobFiles[scfg.JobName] = "the main configuration file"
+	}
+	for _, rg := range c.RuleGroups {
+		l.groupFiles[rg.Name] = "the main configuration file"
+	}
+
+	for _, pat := range c.ScrapeConfigFiles {
+		files, err := filepath.Glob(pat)
+		if err != nil {
+			// The only error can be a bad pattern.
+			return fmt.Errorf("invalid scrape config file pattern %q: %s", pat, err)
+		}
+		for _, fn := range files {
+			content, err := o.readFile(fn)
+			if err != nil {
+				return err
+			}
+			scf := &scrapeConfigFile{}
+			if err := yaml.Unmarshal(content, scf); err != nil {
+				return fmt.Errorf("error parsing %s: %s", fn, err)
+			}
+			if err := checkOverflow(scf.XXX, "scrape config file "+fn); err != nil {
+				return err
+			}
+			resolveFilepaths(filepath.Dir(fn), &Config{ScrapeConfigs: scf.ScrapeConfigs})
+			if err := l.addScrapeConfigs(fn, scf.ScrapeConfigs); err != nil {
+				return err
+			}
+		}
+	}
+	if err := l.include(c.IncludeFiles); err != nil {
+		return err
+	}
+
+	c.ScrapeConfigFiles = nil
+	c.IncludeFiles = nil
+	// The original input does not contain the included configuration, so
+	// the merged configuration is marshalled by String.
+	c.original = ""
+	return nil
+}
+
+// include merges the files matching the given patterns.
+func (l *includeLoader) include(patterns []string) error {
+	for _, pat := range patterns {
+		files, err := filepath.Glob(pat)
+		if err != nil {
+			// The only error can be a bad pattern.
+			return fmt.Errorf("invalid include file pattern %q: %s", pat, err)
+		}
+		for _, fn := range files {
+			if err := l.includeFile(fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// includeFile merges the given file and the files included by it.
+func (l *includeLoader) includeFile(fn string) error {
+	abs, err := filepath.Abs(fn)
+	if err != nil {
+		return err
+	}
+	if l.including[abs] {
+		return fmt.Errorf("cyclic include of %s", fn)
+	}
+	l.including[abs] = true
+	defer delete(l.including, abs)
+
+	content, err := l.opts.readFile(fn)
+	if err != nil {
+		return err
+	}
+	inc := &includeFile{}
+	if err := yaml.Unmarshal(content, inc); err != nil {
+		return fmt.Errorf("error parsing %s: %s", fn, err)
+	}
+	if err := checkOverflow(inc.XXX, "include file "+fn); err != nil {
+		return err
+	}
+	for _, rf := range inc.RuleFiles {
+		if !patRulePath.MatchString(rf) {
+			return fmt.Errorf("invalid rule file path %q in %s", rf, fn)
+		}
+	}
+	incCfg := &Config{
+		RuleFiles:     inc.RuleFiles,
+		RuleGroups:    inc.RuleGroups,
+		ScrapeConfigs: inc.ScrapeConfigs,
+		IncludeFiles:  inc.IncludeFiles,
+	}
+	resolveFilepaths(filepath.Dir(fn), incCfg)
+
+	l.cfg.RuleFiles = append(l.cfg.RuleFiles, incCfg.RuleFiles...)
+	for _, rg := range incCfg.RuleGroups {
+		if other, ok := l.groupFiles[rg.Name]; ok {
+			return fmt.Errorf("found multiple rule groups with name %q in %s and %s", rg.Name, other, fn)
+		}
+		l.groupFiles[rg.Name] = fn
+		if rg.EvaluationInterval == 0 {
+			rg.EvaluationInterval = l.cfg.GlobalConfig.EvaluationInterval
+		}
+		l.cfg.RuleGroups = append(l.cfg.RuleGroups, rg)
+	}
+	if err := l.addScrapeConfigs(fn, incCfg.ScrapeConfigs); err != nil {
+		return err
+	}
+	return l.include(incCfg.IncludeFiles)
+}
+
+// addScrapeConfigs appends the scrape configs read from the file fn.
+func (l *includeLoader) addScrapeConfigs(fn string, scfgs []*ScrapeConfig) error {
+	for _, scfg := range scfgs {
+		if other, ok := l.jobFiles[scfg.JobName]; ok {
+			return fmt.Errorf("found multiple scrape configs with job name %q in %s and %s", scfg.JobName, other, fn)
+		}
+		l.jobFiles[scfg.JobName] = fn
+		l.cfg.GlobalConfig.setScrapeDefaults(scfg)
+		if err := scfg.checkScrapeTimeout(); err != nil {
+			return fmt.Errorf("%s in %s", err, fn)
+		}
+		l.cfg.ScrapeConfigs = append(l.cfg.ScrapeConfigs, scfg)
+	}
+	return nil
+}
+
 // The defaults applied before parsing the respective config sections.
 var (
 	// DefaultConfig is the default top-level configuration.
@@ -168,9 +401,15 @@ func (u URL) MarshalYAML() (interface{}, error) {
 
 // Config is the top-level configuration for Prometheus's config files.
 type Config struct {
-	GlobalConfig  GlobalConfig    `yaml:"global"`
-	RuleFiles     []string        `yaml:"rule_files,omitempty"`
-	ScrapeConfigs []*ScrapeConfig `yaml:"scrape_configs,omitempty"`
+	GlobalConfig  GlobalConfig       `yaml:"global"`
+	RuleFiles     []string           `yaml:"rule_files,omitempty"`
+	RuleGroups    []*RuleGroupConfig `yaml:"rule_groups,omitempty"`
+	ScrapeConfigs []*ScrapeConfig    `yaml:"scrape_configs,omitempty"`
+	// Patterns of files to read more scrape configs from.
+	ScrapeConfigFiles []string `yaml:"scrape_config_files,omitempty"`
+	// Patterns of files to read more rule files, rule groups, and scrape
+	// configs from.
+	IncludeFiles []string `yaml:"include_files,omitempty"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline"`
@@ -192,15 +431,32 @@ func resolveFilepaths(baseDir string, cfg *Config) {
 	for i, rf := range cfg.RuleFiles {
 		cfg.RuleFiles[i] = join(rf)
 	}
+	for _, rg := range cfg.RuleGroups {
+		for i, rf := range rg.RuleFiles {
+			rg.RuleFiles[i] = join(rf)
+		}
+	}
+	for i, sf := range cfg.ScrapeConfigFiles {
+		cfg.ScrapeConfigFiles[i] = join(sf)
+	}
+	for i, inf := range cfg.IncludeFiles {
+		cfg.IncludeFiles[i] = join(inf)
+	}
 
 	for _, scfg := range cfg.ScrapeConfigs {
 		scfg.BearerTokenFile = join(scfg.BearerTokenFile)
+		if scfg.BasicAuth != nil {
+			scfg.BasicAuth.PasswordFile = join(scfg.BasicAuth.PasswordFile)
+		}
 		scfg.TLSConfig.CAFile = join(scfg.TLSConfig.CAFile)
 		scfg.TLSConfig.CertFile = join(scfg.TLSConfig.CertFile)
 		scfg.TLSConfig.KeyFile = join(scfg.TLSConfig.KeyFile)
 
 		for _, kcfg := range scfg.KubernetesSDConfigs {
 			kcfg.BearerTokenFile = join(kcfg.BearerTokenFile)
+			if kcfg.BasicAuth != nil {
+				kcfg.BasicAuth.PasswordFile = join(kcfg.BasicAuth.PasswordFile)
+			}
 			kcfg.TLSConfig.CAFile = join(kcfg.TLSConfig.CAFile)
 			kcfg.TLSConfig.CertFile = join(kcfg.TLSConfig.CertFile)
 			kcfg.TLSConfig.KeyFile = join(kcfg.TLSConfig.KeyFile)
@@ -254,14 +510,22 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 			return fmt.Errorf("invalid rule file path %q", rf)
 		}
 	}
+	groupNames := map[string]struct{}{}
+	for _, rg := range c.RuleGroups {
+		if rg.EvaluationInterval == 0 {
+			rg.EvaluationInterval = c.GlobalConfig.EvaluationInterval
+		}
+		if _, ok := groupNames[rg.Name]; ok {
+			return fmt.Errorf("found multiple rule groups with name %q", rg.Name)
+		}
+		groupNames[rg.Name] = struct{}{}
+	}
 	// Do global overrides and validate unique names.
 	jobNames := map[string]struct{}{}
 	for _, scfg := range c.ScrapeConfigs {
-		if scfg.ScrapeInterval == 0 {
-			scfg.ScrapeInterval = c.GlobalConfig.ScrapeInterval
-		}
-		if scfg.ScrapeTimeout == 0 {
-			scfg.ScrapeTimeout = c.GlobalConfig.ScrapeTimeout
+		c.GlobalConfig.setScrapeDefaults(scfg)
+		if err := scfg.checkScrapeTimeout(); err != nil {
+			return err
 		}
 
 		if _, ok := jobNames[scfg.JobName]; ok {
@@ -272,6 +536,42 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return checkOverflow(c.XXX, "config")
 }
 
+// setScrapeDefaults sets the unset values of the scrape config to their
+// global defaults. An inherited scrape timeout is capped at the scrape
+// interval of the scrape config.
+func (c *GlobalConfig) setScrapeDefaults(scfg *ScrapeConfig) {
+	if scfg.ScrapeInterval == 0 {
+		scfg.ScrapeInterval = c.ScrapeInterval
+	}
+	if scfg.ScrapeTimeout == 0 {
+		scfg.ScrapeTimeout = c.ScrapeTimeout
+		if scfg.ScrapeTimeout > scfg.ScrapeInterval {
+			scfg.ScrapeTimeout = scfg.ScrapeInterval
+		}
+	}
+	if scfg.DialTimeout == 0 {
+		scfg.DialTimeout = c.DialTimeout
+	}
+	if scfg.ResponseTimeout == 0 {
+		scfg.ResponseTimeout = c.ResponseTimeout
+	}
+}
+
+// checkScrapeTimeout returns an error if a scrape of the config could take
+// longer than its interval. It must be called after the global defaults have
+// been applied, so that it only fails for a timeout set in the scrape config.
+func (c *ScrapeConfig) checkScrapeTimeout() error {
+	if c.ScrapeTimeout > c.ScrapeInterval {
+		return fmt.Errorf(
+			"scrape timeout %s greater than scrape interval %s for scrape config with job name %q",
+			strutil.DurationToString(time.Duration(c.ScrapeTimeout)),
+			strutil.DurationToString(time.Duration(c.ScrapeInterval)),
+			c.JobName,
+		)
+	}
+	return nil
+}
+
 // GlobalConfig configures values that are used across other configuration
 // objects.
 type GlobalConfig struct {
@@ -279,6 +579,12 @@ type GlobalConfig struct {
 	ScrapeInterval Duration `yaml:"scrape_interval,omitempty"`
 	// The default timeout when scraping targets.
 	ScrapeTimeout Duration `yaml:"scrape_timeout,omitempty"`
+	// The default timeout for connecting to targets. Unset means only the
+	// scrape timeout applies.
+	DialTimeout Duration `yaml:"dial_timeout,omitempty"`
+	// The default timeout for reading the response of targets once connected.
+	// Unset means only the scrape timeout applies.
+	ResponseTimeout Duration `yaml:"response_timeout,omitempty"`
 	// How frequently to evaluate rules by default.
 	EvaluationInterval Duration `yaml:"evaluation_interval,omitempty"`
 	// The labels to add to any timeseries that this Prometheus instance scrapes.
@@ -303,9 +609,57 @@ func (c *GlobalConfig) isZero() bool {
 	return c.ExternalLabels == nil &&
 		c.ScrapeInterval == 0 &&
 		c.ScrapeTimeout == 0 &&
+		c.DialTimeout == 0 &&
+		c.ResponseTimeout == 0 &&
 		c.EvaluationInterval == 0
 }
 
+// DefaultRuleGroupName is the name of the group of the rules loaded from
+// the top-level rule files.
+const DefaultRuleGroupName = "default"
+
+// RuleGroupConfig configures a group of rules. The rules of a group are
+// evaluated one after another in the order of their files, so that rules can
+// use the results of earlier rules of the same group.
+type RuleGroupConfig struct {
+	// The name of the group. It must be unique.
+	Name string `yaml:"name"`
+	// How frequently to evaluate the rules of the group. The global
+	// evaluation interval, if unset.
+	EvaluationInterval Duration `yaml:"evaluation_interval,omitempty"`
+	// Patterns of the files to load the rules of the group from.
+	RuleFiles []string `yaml:"rule_files,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *RuleGroupConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain RuleGroupConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if err := checkOverflow(c.XXX, "rule_group"); err != nil {
+		return err
+	}
+	if c.Name == "" {
+		return fmt.Errorf("rule group name must not be empty")
+	}
+	if c.Name == DefaultRuleGroupName {
+		return fmt.Errorf("rule group name %q is reserved for the top-level rule files", c.Name)
+	}
+	if c.EvaluationInterval < 0 {
+		return fmt.Errorf("evaluation interval of rule group %q must be positive", c.Name)
+	}
+	for _, rf := range c.RuleFiles {
+		if !patRulePath.MatchString(rf) {
+			return fmt.Errorf("invalid rule file path %q", rf)
+		}
+	}
+	return nil
+}
+
 // TLSConfig configures the options for TLS connections.
 type TLSConfig struct {
 	// The CA cert to use for the targets.
@@ -314,6 +668,8 @@ type TLSConfig struct {
 	CertFile string `yaml:"cert_file,omitempty"`
 	// The client key file for the targets.
 	KeyFile string `yaml:"key_file,omitempty"`
+	// Used to verify the hostname for the targets and sent as SNI.
+	ServerName string `yaml:"server_name,omitempty"`
 	// Disable target certificate validation.
 	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
 
@@ -334,7 +690,13 @@ func (c *TLSConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 type ScrapeConfig struct {
 	// The job name to which the job label is set by default.
 	JobName string `yaml:"job_name"`
-	// Indicator whether the scraped metrics should remain unmodified.
+	// Whether labels exposed by the targets take precedence over the labels
+	// of the targets, i.e. the labels resulting from the relabel configs.
+	// If false, the labels of the target win, and conflicting exposed
+	// labels are kept with the "exported_" prefix. If true, the exposed
+	// labels win, and an exposed label with an empty value removes the
+	// respective label of the target. The metric relabel configs are
+	// applied to the result of this merge.
 	HonorLabels bool `yaml:"honor_labels,omitempty"`
 	// A set of query parameters with which the target is scraped.
 	Params url.Values `yaml:"params,omitempty"`
@@ -342,6 +704,21 @@ type ScrapeConfig struct {
 	ScrapeInterval Duration `yaml:"scrape_interval,omitempty"`
 	// The timeout for scraping targets of this config.
 	ScrapeTimeout Duration `yaml:"scrape_timeout,omitempty"`
+	// The timeout for connecting to targets of this config.
+	DialTimeout Duration `yaml:"dial_timeout,omitempty"`
+	// The timeout for reading the response of targets of this config once
+	// connected.
+	ResponseTimeout Duration `yaml:"response_timeout,omitempty"`
+	// The period after creation of a target in which failed scrapes do not
+	// mark it as unhealthy until it was scraped successfully once.
+	InitialScrapeGrace Duration `yaml:"initial_scrape_grace,omitempty"`
+	// The number of consecutive failed scrapes of a target for which the
+	// samples of its last successful scrape are re-emitted at the time of
+	// the failed scrape. Zero disables it. This bridges brief outages of a
+	// target so that they do not leave gaps, but it also hides real
+	// outages for as long, as the re-emitted samples look like fresh data.
+	// The series are marked stale only once no more samples are re-emitted.
+	StaleExtendScrapes int `yaml:"stale_extend_scrapes,omitempty"`
 	// The HTTP resource path on which to fetch metrics from targets.
 	MetricsPath string `yaml:"metrics_path,omitempty"`
 	// The URL scheme with which to fetch metrics from targets.
@@ -352,10 +729,13 @@ type ScrapeConfig struct {
 	BearerToken string `yaml:"bearer_token,omitempty"`
 	// The bearer token file for the targets.
 	BearerTokenFile string `yaml:"bearer_token_file,omitempty"`
-	// HTTP proxy server to use to connect to the targets.
+	// HTTP proxy server to use to connect to the targets. Taken from the
+	// HTTP_PROXY, HTTPS_PROXY, and NO_PROXY environment variables, if unset.
 	ProxyURL URL `yaml:"proxy_url,omitempty"`
 	// TLSConfig to use to connect to the targets.
 	TLSConfig TLSConfig `yaml:"tls_config,omitempty"`
+	// The User-Agent header to send with scrape requests.
+	UserAgent string `yaml:"user_agent,omitempty"`
 
 	// List of labeled target groups for this job.
 	TargetGroups []*TargetGroup `yaml:"target_groups,omitempty"`
@@ -378,6 +758,17 @@ type ScrapeConfig struct {
 	RelabelConfigs []*RelabelConfig `yaml:"relabel_configs,omitempty"`
 	// List of metric relabel configurations.
 	MetricRelabelConfigs []*RelabelConfig `yaml:"metric_relabel_configs,omitempty"`
+	// A prefix removed from the names of all scraped metrics before metric
+	// relabeling. A simpler alternative to a relabel configuration for
+	// exporters that add a vendor prefix to all their metrics.
+	MetricNamePrefixStrip string `yaml:"metric_name_prefix_strip,omitempty"`
+	// Whether a scrape returning an empty or whitespace-only body fails
+	// instead of succeeding without samples.
+	FailOnEmptyBody bool `yaml:"fail_on_empty_body,omitempty"`
+	// The maximum number of samples a single scrape may yield after metric
+	// relabeling. Scrapes exceeding it fail and none of their samples are
+	// ingested. Unlimited, if zero.
+	SampleLimit uint `yaml:"sample_limit,omitempty"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline"`
@@ -400,6 +791,9 @@ func (c *ScrapeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if c.BasicAuth != nil && (len(c.BearerToken) > 0 || len(c.BearerTokenFile) > 0) {
 		return fmt.Errorf("at most one of basic_auth, bearer_token & bearer_token_file must be configured")
 	}
+	if c.StaleExtendScrapes < 0 {
+		return fmt.Errorf("stale_extend_scrapes must not be negative, got %d", c.StaleExtendScrapes)
+	}
 	// Check for users putting URLs in target groups.
 	if len(c.RelabelConfigs) == 0 {
 		for _, tg := range c.TargetGroups {
@@ -425,7 +819,10 @@ func CheckTargetAddress(address model.LabelValue) error {
 // BasicAuth contains basic HTTP authentication credentials.
 type BasicAuth struct {
 	Username string `yaml:"username"`
-	Password string `yaml:"password"`
+	Password string `yaml:"password,omitempty"`
+	// The file to read the password from. Surrounding whitespace such as
+	// a trailing newline is ignored.
+	PasswordFile string `yaml:"password_file,omitempty"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline"`
@@ -447,9 +844,25 @@ func (a *BasicAuth) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err != nil {
 		return err
 	}
+	if len(a.Password) > 0 && len(a.PasswordFile) > 0 {
+		return fmt.Errorf("at most one of basic_auth password & password_file must be configured")
+	}
 	return checkOverflow(a.XXX, "basic_auth")
 }
 
+// ReadPassword returns the configured password, reading it from the password
+// file if one is set.
+func (a *BasicAuth) ReadPassword() (string, error) {
+	if len(a.PasswordFile) == 0 {
+		return a.Password, nil
+	}
+	b, err := ioutil.ReadFile(a.PasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("unable to read basic auth password file %s: %s", a.PasswordFile, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
 // TargetGroup is a set of targets with a common label set.
 type TargetGroup struct {
 	// Targets is a list of targets identified by a label set. Each target is
@@ -596,6 +1009,9 @@ type ConsulSDConfig struct {
 	// The list of services for which targets are discovered.
 	// Defaults to all services if empty.
 	Services []string `yaml:"services"`
+	// Whether only service instances passing all their health checks are
+	// discovered.
+	PassingOnly bool `yaml:"passing_only,omitempty"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline"`
@@ -747,6 +1163,10 @@ const (
 	RelabelHashMod RelabelAction = "hashmod"
 	// RelabelLabelMap copies labels to other labelnames based on a regex.
 	RelabelLabelMap RelabelAction = "labelmap"
+	// RelabelLabelDrop drops labels whose names match the regex.
+	RelabelLabelDrop RelabelAction = "labeldrop"
+	// RelabelLabelKeep drops labels whose names do not match the regex.
+	RelabelLabelKeep RelabelAction = "labelkeep"
 )
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
@@ -756,7 +1176,7 @@ func (a *RelabelAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 	switch act := RelabelAction(strings.ToLower(s)); act {
-	case RelabelReplace, RelabelKeep, RelabelDrop, RelabelHashMod, RelabelLabelMap:
+	case RelabelReplace, RelabelKeep, RelabelDrop, RelabelHashMod, RelabelLabelMap, RelabelLabelDrop, RelabelLabelKeep:
 		*a = act
 		return nil
 	}
@@ -17,6 +17,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/url"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
@@ -44,6 +45,19 @@ var expectedConf = &Config{
 		"testdata/my/*.rules",
 	},
 
+	RuleGroups: []*RuleGroupConfig{
+		{
+			Name:               "expensive",
+			EvaluationInterval: Duration(5 * time.Minute),
+			RuleFiles:          []string{"testdata/expensive.rules"},
+		},
+		{
+			Name:               "fast",
+			EvaluationInterval: Duration(30 * time.Second),
+			RuleFiles:          []string{"testdata/fast/*.rules"},
+		},
+	},
+
 	ScrapeConfigs: []*ScrapeConfig{
 		{
 			JobName: "prometheus",
@@ -108,8 +122,12 @@ var expectedConf = &Config{
 		{
 			JobName: "service-x",
 
-			ScrapeInterval: Duration(50 * time.Second),
-			ScrapeTimeout:  Duration(5 * time.Second),
+			ScrapeInterval:     Duration(50 * time.Second),
+			ScrapeTimeout:      Duration(5 * time.Second),
+			DialTimeout:        Duration(1 * time.Second),
+			ResponseTimeout:    Duration(4 * time.Second),
+			InitialScrapeGrace: Duration(2 * time.Minute),
+			StaleExtendScrapes: 2,
 
 			BasicAuth: &BasicAuth{
 				Username: "admin_name",
@@ -117,6 +135,7 @@ var expectedConf = &Config{
 			},
 			MetricsPath: "/my_path",
 			Scheme:      "https",
+			UserAgent:   "prometheus-service-x",
 
 			DNSSDConfigs: []*DNSSDConfig{
 				{
@@ -175,7 +194,16 @@ var expectedConf = &Config{
 					Replacement:  DefaultRelabelConfig.Replacement,
 					Action:       RelabelDrop,
 				},
+				{
+					Regex:       MustNewRegexp("(__name__|instance|job|code)"),
+					Separator:   ";",
+					Replacement: DefaultRelabelConfig.Replacement,
+					Action:      RelabelLabelKeep,
+				},
 			},
+			MetricNamePrefixStrip: "vendor_",
+			FailOnEmptyBody:       true,
+			SampleLimit:           1000,
 		},
 		{
 			JobName: "service-y",
@@ -186,12 +214,18 @@ var expectedConf = &Config{
 			MetricsPath: DefaultScrapeConfig.MetricsPath,
 			Scheme:      DefaultScrapeConfig.Scheme,
 
+			BasicAuth: &BasicAuth{
+				Username:     "service_y_user",
+				PasswordFile: "testdata/valid_password_file",
+			},
+
 			ConsulSDConfigs: []*ConsulSDConfig{
 				{
 					Server:       "localhost:1234",
 					Services:     []string{"nginx", "cache", "mysql"},
 					TagSeparator: DefaultConsulSDConfig.TagSeparator,
 					Scheme:       DefaultConsulSDConfig.Scheme,
+					PassingOnly:  true,
 				},
 			},
 		},
@@ -205,8 +239,9 @@ var expectedConf = &Config{
 			Scheme:      "http",
 
 			TLSConfig: TLSConfig{
-				CertFile: "testdata/valid_cert_file",
-				KeyFile:  "testdata/valid_key_file",
+				CertFile:   "testdata/valid_cert_file",
+				KeyFile:    "testdata/valid_key_file",
+				ServerName: "metrics.example.org",
 			},
 
 			BearerToken: "avalidtoken",
@@ -277,11 +312,11 @@ var expectedConf = &Config{
 func TestLoadConfig(t *testing.T) {
 	// Parse a valid file that sets a global scrape timeout. This tests whether parsing
 	// an overwritten default field in the global config permanently changes the default.
-	if _, err := LoadFile("testdata/global_timeout.good.yml"); err != nil {
+	if _, err := LoadFile("testdata/global_timeout.good.yml", LoadOptions{}); err != nil {
 		t.Errorf("Error parsing %s: %s", "testdata/conf.good.yml", err)
 	}
 
-	c, err := LoadFile("testdata/conf.good.yml")
+	c, err := LoadFile("testdata/conf.good.yml", LoadOptions{})
 	if err != nil {
 		t.Fatalf("Error parsing %s: %s", "testdata/conf.good.yml", err)
 	}
@@ -318,6 +353,9 @@ var expectedErrors = []struct {
 	}, {
 		filename: "jobname_dup.bad.yml",
 		errMsg:   `found multiple scrape configs with job name "prometheus"`,
+	}, {
+		filename: "scrape_timeout.bad.yml",
+		errMsg:   `scrape timeout 1m greater than scrape interval 30s for scrape config with job name "prometheus"`,
 	}, {
 		filename: "labelname.bad.yml",
 		errMsg:   `"not$allowed" is not a valid label name`,
@@ -333,15 +371,30 @@ var expectedErrors = []struct {
 	}, {
 		filename: "rules.bad.yml",
 		errMsg:   "invalid rule file path",
+	}, {
+		filename: "rule_group_name_missing.bad.yml",
+		errMsg:   "rule group name must not be empty",
+	}, {
+		filename: "rule_group_name_dup.bad.yml",
+		errMsg:   `found multiple rule groups with name "expensive"`,
+	}, {
+		filename: "rule_group_name_default.bad.yml",
+		errMsg:   `rule group name "default" is reserved for the top-level rule files`,
 	}, {
 		filename: "unknown_attr.bad.yml",
 		errMsg:   "unknown fields in scrape_config: consult_sd_configs",
 	}, {
 		filename: "bearertoken.bad.yml",
 		errMsg:   "at most one of bearer_token & bearer_token_file must be configured",
+	}, {
+		filename: "basicauth_password_file.bad.yml",
+		errMsg:   "at most one of basic_auth password & password_file must be configured",
 	}, {
 		filename: "bearertoken_basicauth.bad.yml",
 		errMsg:   "at most one of basic_auth, bearer_token & bearer_token_file must be configured",
+	}, {
+		filename: "stale_extend_scrapes.bad.yml",
+		errMsg:   "stale_extend_scrapes must not be negative",
 	}, {
 		filename: "kubernetes_bearertoken.bad.yml",
 		errMsg:   "at most one of bearer_token & bearer_token_file must be configured",
@@ -354,12 +407,175 @@ var expectedErrors = []struct {
 	}, {
 		filename: "url_in_targetgroup.bad.yml",
 		errMsg:   "\"http://bad\" is not a valid hostname",
+	}, {
+		filename: "scrape_config_files_dup.bad.yml",
+		errMsg:   `found multiple scrape configs with job name "team-a" in testdata/scrape_configs/team_a.yml and testdata/scrape_configs_dup/team_c.yml`,
+	}, {
+		filename: "scrape_config_files_unknown_attr.bad.yml",
+		errMsg:   "unknown fields in scrape config file testdata/scrape_configs_unknown_attr/team_d.yml: global",
+	}, {
+		filename: "include_cycle.bad.yml",
+		errMsg:   "cyclic include of testdata/include_cycle/a.yml",
+	}, {
+		filename: "include_dup.bad.yml",
+		errMsg:   `found multiple scrape configs with job name "team-b" in the main configuration file and testdata/include/nested/team_b.yml`,
 	},
 }
 
+func TestScrapeConfigFiles(t *testing.T) {
+	c, err := LoadFile("testdata/scrape_config_files.good.yml", LoadOptions{})
+	if err != nil {
+		t.Fatalf("Error parsing %s: %s", "testdata/scrape_config_files.good.yml", err)
+	}
+
+	expected := []struct {
+		jobName         string
+		scrapeInterval  Duration
+		bearerTokenFile string
+	}{
+		{"prometheus", Duration(30 * time.Second), ""},
+		{"team-a", Duration(30 * time.Second), "testdata/scrape_configs/valid_token_file"},
+		{"team-b", Duration(15 * time.Second), ""},
+		{"team-b-canary", Duration(30 * time.Second), ""},
+	}
+	if len(c.ScrapeConfigs) != len(expected) {
+		t.Fatalf("Expected %d scrape configs, got %d", len(expected), len(c.ScrapeConfigs))
+	}
+	for i, e := range expected {
+		scfg := c.ScrapeConfigs[i]
+		if scfg.JobName != e.jobName {
+			t.Errorf("%d. Expected job name %q, got %q", i, e.jobName, scfg.JobName)
+		}
+		if scfg.ScrapeInterval != e.scrapeInterval {
+			t.Errorf("%d. Expected scrape interval %v, got %v", i, e.scrapeInterval, scfg.ScrapeInterval)
+		}
+		if scfg.ScrapeTimeout != DefaultGlobalConfig.ScrapeTimeout {
+			t.Errorf("%d. Expected scrape timeout %v, got %v", i, DefaultGlobalConfig.ScrapeTimeout, scfg.ScrapeTimeout)
+		}
+		if scfg.BearerTokenFile != e.bearerTokenFile {
+			t.Errorf("%d. Expected bearer token file %q, got %q", i, e.bearerTokenFile, scfg.BearerTokenFile)
+		}
+	}
+
+	// The string representation contains the merged scrape configs.
+	s := c.String()
+	for _, e := range expected {
+		if !strings.Contains(s, "job_name: "+e.jobName+"\n") {
+			t.Errorf("Config string does not contain job %q:\n%s", e.jobName, s)
+		}
+	}
+}
+
+func TestIncludeFiles(t *testing.T) {
+	c, err := LoadFile("testdata/include.good.yml", LoadOptions{})
+	if err != nil {
+		t.Fatalf("Error parsing %s: %s", "testdata/include.good.yml", err)
+	}
+
+	expectedJobs := []struct {
+		jobName         string
+		scrapeInterval  Duration
+		bearerTokenFile string
+	}{
+		{"prometheus", Duration(30 * time.Second), ""},
+		{"team-a", Duration(30 * time.Second), "testdata/include/valid_token_file"},
+		{"team-b", Duration(15 * time.Second), ""},
+	}
+	if len(c.ScrapeConfigs) != len(expectedJobs) {
+		t.Fatalf("Expected %d scrape configs, got %d", len(expectedJobs), len(c.ScrapeConfigs))
+	}
+	for i, e := range expectedJobs {
+		scfg := c.ScrapeConfigs[i]
+		if scfg.JobName != e.jobName {
+			t.Errorf("%d. Expected job name %q, got %q", i, e.jobName, scfg.JobName)
+		}
+		if scfg.ScrapeInterval != e.scrapeInterval {
+			t.Errorf("%d. Expected scrape interval %v, got %v", i, e.scrapeInterval, scfg.ScrapeInterval)
+		}
+		if scfg.BearerTokenFile != e.bearerTokenFile {
+			t.Errorf("%d. Expected bearer token file %q, got %q", i, e.bearerTokenFile, scfg.BearerTokenFile)
+		}
+	}
+
+	expectedRuleFiles := []string{"testdata/first.rules", "testdata/include/team_a.rules"}
+	if !reflect.DeepEqual(c.RuleFiles, expectedRuleFiles) {
+		t.Errorf("Expected rule files %v, got %v", expectedRuleFiles, c.RuleFiles)
+	}
+	expectedGroups := []*RuleGroupConfig{{
+		Name:               "team-a",
+		EvaluationInterval: Duration(time.Minute),
+		RuleFiles:          []string{"testdata/include/team_a/*.rules"},
+	}}
+	if !reflect.DeepEqual(c.RuleGroups, expectedGroups) {
+		t.Errorf("Expected rule groups %v, got %v", expectedGroups, c.RuleGroups)
+	}
+
+	// The string representation is the merged configuration.
+	if c.IncludeFiles != nil {
+		t.Errorf("Expected include files to be cleared once merged, got %v", c.IncludeFiles)
+	}
+	reloaded, err := Load(c.String())
+	if err != nil {
+		t.Fatalf("Error parsing string representation of merged config: %s", err)
+	}
+	reloaded.original = ""
+	if !reflect.DeepEqual(c, reloaded) {
+		t.Errorf("Expected string representation to load into the merged config:\n%s", c)
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	defer os.Unsetenv("TEST_REGION")
+	defer os.Unsetenv("TEST_HOST")
+
+	const filename = "testdata/expand_env.good.yml"
+	os.Setenv("TEST_REGION", "eu-west")
+	os.Unsetenv("TEST_HOST")
+
+	// Without expansion, references are taken literally.
+	c, err := LoadFile(filename, LoadOptions{})
+	if err != nil {
+		t.Fatalf("Error parsing %s: %s", filename, err)
+	}
+	if got := c.GlobalConfig.ExternalLabels["region"]; got != "${TEST_REGION}" {
+		t.Errorf("Expected unexpanded region label, got %q", got)
+	}
+
+	o := LoadOptions{ExpandEnv: true}
+	c, err = LoadFile(filename, o)
+	if err != nil {
+		t.Fatalf("Error parsing %s: %s", filename, err)
+	}
+	if got := c.GlobalConfig.ExternalLabels["region"]; got != "eu-west" {
+		t.Errorf("Expected region label %q, got %q", "eu-west", got)
+	}
+	if got := c.GlobalConfig.ExternalLabels["cost"]; got != "$5" {
+		t.Errorf("Expected escaped cost label %q, got %q", "$5", got)
+	}
+	if got := c.ScrapeConfigs[0].RelabelConfigs[0].Replacement; got != "${1}" {
+		t.Errorf("Expected escaped replacement %q, got %q", "${1}", got)
+	}
+	if got := c.ScrapeConfigs[0].TargetGroups[0].Targets[0][model.AddressLabel]; got != ":9090" {
+		t.Errorf("Expected unset variable to expand to the empty string, got target %q", got)
+	}
+
+	o.ExpandEnvRequireSet = true
+	if _, err := LoadFile(filename, o); err == nil || !strings.Contains(err.Error(), "TEST_HOST") {
+		t.Errorf("Expected error about unset variable TEST_HOST, got %v", err)
+	}
+	os.Setenv("TEST_HOST", "localhost")
+	c, err = LoadFile(filename, o)
+	if err != nil {
+		t.Fatalf("Error parsing %s: %s", filename, err)
+	}
+	if got := c.ScrapeConfigs[0].TargetGroups[0].Targets[0][model.AddressLabel]; got != "localhost:9090" {
+		t.Errorf("Expected target %q, got %q", "localhost:9090", got)
+	}
+}
+
 func TestBadConfigs(t *testing.T) {
 	for _, ee := range expectedErrors {
-		_, err := LoadFile("testdata/" + ee.filename)
+		_, err := LoadFile("testdata/"+ee.filename, LoadOptions{})
 		if err == nil {
 			t.Errorf("Expected error parsing %s but got none", ee.filename)
 			continue
@@ -407,6 +623,58 @@ func TestEmptyGlobalBlock(t *testing.T) {
 	}
 }
 
+func TestGlobalScrapeTimeouts(t *testing.T) {
+	c, err := Load(`
+global:
+  dial_timeout:     2s
+  response_timeout: 8s
+scrape_configs:
+- job_name: default
+- job_name: override
+  dial_timeout: 1s
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing config: %s", err)
+	}
+	expected := map[string][2]Duration{
+		"default":  {Duration(2 * time.Second), Duration(8 * time.Second)},
+		"override": {Duration(1 * time.Second), Duration(8 * time.Second)},
+	}
+	for _, scfg := range c.ScrapeConfigs {
+		want := expected[scfg.JobName]
+		if got := [2]Duration{scfg.DialTimeout, scfg.ResponseTimeout}; got != want {
+			t.Errorf("%s: expected dial and response timeouts %v, got %v", scfg.JobName, want, got)
+		}
+	}
+}
+
+func TestInheritedScrapeTimeout(t *testing.T) {
+	c, err := Load(`
+global:
+  scrape_interval: 5s
+scrape_configs:
+- job_name: default
+- job_name: short_interval
+  scrape_interval: 2s
+- job_name: long_interval
+  scrape_interval: 1m
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing config: %s", err)
+	}
+	// Timeouts not set in the scrape config are capped at its interval.
+	expected := map[string]Duration{
+		"default":        Duration(5 * time.Second),
+		"short_interval": Duration(2 * time.Second),
+		"long_interval":  Duration(10 * time.Second),
+	}
+	for _, scfg := range c.ScrapeConfigs {
+		if want := expected[scfg.JobName]; scfg.ScrapeTimeout != want {
+			t.Errorf("%s: expected scrape timeout %v, got %v", scfg.JobName, want, scfg.ScrapeTimeout)
+		}
+	}
+}
+
 func kubernetesSDHostURL() URL {
 	tURL, _ := url.Parse("https://localhost:1234")
 	return URL{URL: tURL}
@@ -15,12 +15,16 @@ package notification
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -32,16 +36,65 @@ import (
 )
 
 const (
-	alertmanagerAPIEventsPath = "/api/alerts"
-	contentTypeJSON           = "application/json"
+	alertmanagerAPIEventsPath   = "/api/alerts"
+	alertmanagerAPIV2AlertsPath = "/api/v1/alerts"
+	contentTypeJSON             = "application/json"
+
+	// The maximum number of alerts sent to the alert manager in one request.
+	maxBatchSize = 64
+
+	// The bounds of the exponential backoff between attempts to send
+	// notifications that could not be delivered.
+	minRetryBackoff = time.Second
+	maxRetryBackoff = time.Minute
 )
 
 // String constants for instrumentation.
 const (
 	namespace = "prometheus"
 	subsystem = "notifications"
+
+	alertmanagerLabel = "alertmanager"
+)
+
+// APIVersion selects the notification payload format and endpoint of the
+// alert manager API.
+type APIVersion int
+
+// Possible values for APIVersion.
+const (
+	// APIv1 posts alerts with summary, description, runbook and payload to
+	// /api/alerts, as understood by older alert managers.
+	APIv1 APIVersion = iota
+	// APIv2 posts alerts with labels, annotations and a start time to
+	// /api/v1/alerts.
+	APIv2
 )
 
+// String implements flag.Value.
+func (v APIVersion) String() string {
+	switch v {
+	case APIv1:
+		return "v1"
+	case APIv2:
+		return "v2"
+	}
+	return "<unknown>"
+}
+
+// Set implements flag.Value.
+func (v *APIVersion) Set(s string) error {
+	switch s {
+	case "v1":
+		*v = APIv1
+	case "v2":
+		*v = APIv2
+	default:
+		return fmt.Errorf("invalid alert manager API version: %s", s)
+	}
+	return nil
+}
+
 // NotificationReq is a request for sending a notification to the alert manager
 // for a single alert vector element.
 type NotificationReq struct {
@@ -72,59 +125,149 @@ type httpPoster interface {
 	Post(url string, bodyType string, body io.Reader) (*http.Response, error)
 }
 
-// NotificationHandler is responsible for dispatching alert notifications to an
-// alert manager service.
+// alertmanager is an alert manager notifications are sent to.
+type alertmanager struct {
+	// The URL to send notifications to. Basic authentication credentials
+	// in it are sent along by the HTTP client.
+	url string
+	// The URL without credentials, to be used in logs and metrics.
+	name string
+}
+
+// newAlertmanager returns the alert manager for the given URL.
+func newAlertmanager(rawurl string) alertmanager {
+	rawurl = strings.TrimRight(rawurl, "/")
+	am := alertmanager{url: rawurl, name: rawurl}
+	if u, err := url.Parse(rawurl); err == nil && u.User != nil {
+		u.User = nil
+		am.name = u.String()
+	}
+	return am
+}
+
+// NotificationHandler is responsible for dispatching alert notifications to
+// alert manager services.
 type NotificationHandler struct {
-	// The URL of the alert manager to send notifications to.
-	alertmanagerURL string
-	// Buffer of notifications that have not yet been sent.
-	pendingNotifications chan NotificationReqs
+	// The alert managers to send notifications to. Each of them receives
+	// all notifications.
+	alertmanagers []alertmanager
+	// The API version determining payload format and endpoint path.
+	apiVersion APIVersion
+	// Notifications that have not yet been sent, by alert identity. Only
+	// the latest state of an alert is kept. The order slice holds the
+	// fingerprints of pending alerts, oldest first.
+	queueCapacity int
+	pending       map[model.Fingerprint]*NotificationReq
+	order         []model.Fingerprint
+	queueMtx      sync.Mutex
+	// Signals Run that there are pending notifications.
+	more chan struct{}
+	// The bounds of the backoff between retries of failed deliveries.
+	minRetryBackoff, maxRetryBackoff time.Duration
 	// HTTP client with custom timeout settings.
 	httpClient httpPoster
 
-	notificationLatency        prometheus.Summary
-	notificationErrors         prometheus.Counter
-	notificationDropped        prometheus.Counter
-	notificationsQueueLength   prometheus.Gauge
-	notificationsQueueCapacity prometheus.Metric
+	notificationLatency             *prometheus.SummaryVec
+	notificationsSent               *prometheus.CounterVec
+	notificationErrors              *prometheus.CounterVec
+	notificationDropped             prometheus.Counter
+	notificationsRetried            prometheus.Counter
+	notificationsEvicted            prometheus.Counter
+	notificationsQueueLength        prometheus.Gauge
+	notificationsQueueLengthByAlert *prometheus.GaugeVec
+	notificationsQueueCapacity      prometheus.Metric
 
 	externalLabels model.LabelSet
 	mtx            sync.RWMutex
+	quit           chan struct{}
 	stopped        chan struct{}
 }
 
 // NotificationHandlerOptions are the configurable parameters of a NotificationHandler.
 type NotificationHandlerOptions struct {
-	AlertmanagerURL string
-	QueueCapacity   int
-	Deadline        time.Duration
+	// The URLs of the alert managers. Basic authentication credentials
+	// can be given per alert manager as the user info of its URL. They are
+	// never logged or exposed in metrics.
+	AlertmanagerURLs []string
+	APIVersion       APIVersion
+	QueueCapacity    int
+	Deadline         time.Duration
+	// The TLS configuration for connections to the alert managers. The
+	// shared TLS settings only, if nil.
+	TLSConfig *tls.Config
+	// The basic authentication credentials sent to the alert managers
+	// whose URLs do not contain credentials. None, if the username is
+	// empty.
+	BasicAuthUsername string
+	BasicAuthPassword string
 }
 
 // NewNotificationHandler constructs a new NotificationHandler.
 func NewNotificationHandler(o *NotificationHandlerOptions) *NotificationHandler {
+	ams := make([]alertmanager, 0, len(o.AlertmanagerURLs))
+	for _, u := range o.AlertmanagerURLs {
+		ams = append(ams, newAlertmanager(u))
+	}
+
 	return &NotificationHandler{
-		alertmanagerURL:      strings.TrimRight(o.AlertmanagerURL, "/"),
-		pendingNotifications: make(chan NotificationReqs, o.QueueCapacity),
+		alertmanagers:   ams,
+		apiVersion:      o.APIVersion,
+		queueCapacity:   o.QueueCapacity,
+		pending:         map[model.Fingerprint]*NotificationReq{},
+		more:            make(chan struct{}, 1),
+		minRetryBackoff: minRetryBackoff,
+		maxRetryBackoff: maxRetryBackoff,
 
-		httpClient: httputil.NewDeadlineClient(o.Deadline, nil),
+		httpClient: httputil.NewDeadlineClientWithOptions(o.Deadline, nil, httputil.ClientOptions{
+			TLSConfig:         o.TLSConfig,
+			BasicAuthUsername: o.BasicAuthUsername,
+			BasicAuthPassword: o.BasicAuthPassword,
+		}),
 
-		notificationLatency: prometheus.NewSummary(prometheus.SummaryOpts{
+		notificationLatency: prometheus.NewSummaryVec(
+			prometheus.SummaryOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "latency_milliseconds",
+				Help:      "Latency quantiles for sending alert notifications (not including dropped notifications).",
+			},
+			[]string{alertmanagerLabel},
+		),
+		notificationsSent: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "sent_total",
+				Help:      "Total number of alert notifications sent.",
+			},
+			[]string{alertmanagerLabel},
+		),
+		notificationErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "errors_total",
+				Help:      "Total number of alert notifications that could not be sent.",
+			},
+			[]string{alertmanagerLabel},
+		),
+		notificationDropped: prometheus.NewCounter(prometheus.CounterOpts{
 			Namespace: namespace,
 			Subsystem: subsystem,
-			Name:      "latency_milliseconds",
-			Help:      "Latency quantiles for sending alert notifications (not including dropped notifications).",
+			Name:      "dropped_total",
+			Help:      "Total number of alert notifications dropped due to alert manager missing in configuration.",
 		}),
-		notificationErrors: prometheus.NewCounter(prometheus.CounterOpts{
+		notificationsRetried: prometheus.NewCounter(prometheus.CounterOpts{
 			Namespace: namespace,
 			Subsystem: subsystem,
-			Name:      "errors_total",
-			Help:      "Total number of errors sending alert notifications.",
+			Name:      "retries_total",
+			Help:      "Total number of alert notifications queued again after no alert manager accepted them.",
 		}),
-		notificationDropped: prometheus.NewCounter(prometheus.CounterOpts{
+		notificationsEvicted: prometheus.NewCounter(prometheus.CounterOpts{
 			Namespace: namespace,
 			Subsystem: subsystem,
-			Name:      "dropped_total",
-			Help:      "Total number of alert notifications dropped due to alert manager missing in configuration.",
+			Name:      "evicted_total",
+			Help:      "Total number of alert notifications evicted from the full queue before being sent.",
 		}),
 		notificationsQueueLength: prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace: namespace,
@@ -132,6 +275,15 @@ func NewNotificationHandler(o *NotificationHandlerOptions) *NotificationHandler
 			Name:      "queue_length",
 			Help:      "The number of alert notifications in the queue.",
 		}),
+		notificationsQueueLengthByAlert: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "queue_length_by_alertname",
+				Help:      "The number of alert notifications in the queue by alert name.",
+			},
+			[]string{string(model.AlertNameLabel)},
+		),
 		notificationsQueueCapacity: prometheus.MustNewConstMetric(
 			prometheus.NewDesc(
 				prometheus.BuildFQName(namespace, subsystem, "queue_capacity"),
@@ -141,6 +293,7 @@ func NewNotificationHandler(o *NotificationHandlerOptions) *NotificationHandler
 			prometheus.GaugeValue,
 			float64(o.QueueCapacity),
 		),
+		quit:    make(chan struct{}),
 		stopped: make(chan struct{}),
 	}
 }
@@ -155,18 +308,67 @@ func (n *NotificationHandler) ApplyConfig(conf *config.Config) bool {
 	return true
 }
 
-// Send a list of notifications to the configured alert manager.
-func (n *NotificationHandler) sendNotifications(reqs NotificationReqs) error {
+// encodeNotifications returns the payload for a list of notifications and the
+// API path to send it to.
+func (n *NotificationHandler) encodeNotifications(reqs NotificationReqs) ([]byte, string, error) {
 	n.mtx.RLock()
 	defer n.mtx.RUnlock()
 
-	alerts := make([]map[string]interface{}, 0, len(reqs))
+	// The labels of the queued requests identify their alerts and must
+	// not be modified, as the requests may be queued again.
+	withExternal := make(NotificationReqs, 0, len(reqs))
 	for _, req := range reqs {
+		r := *req
+		r.Labels = req.Labels.Clone()
 		for ln, lv := range n.externalLabels {
-			if _, ok := req.Labels[ln]; !ok {
-				req.Labels[ln] = lv
+			if _, ok := r.Labels[ln]; !ok {
+				r.Labels[ln] = lv
 			}
 		}
+		withExternal = append(withExternal, &r)
+	}
+	reqs = withExternal
+
+	var (
+		alerts []map[string]interface{}
+		path   string
+	)
+	switch n.apiVersion {
+	case APIv2:
+		alerts, path = alertsV2(reqs), alertmanagerAPIV2AlertsPath
+	default:
+		alerts, path = alertsV1(reqs), alertmanagerAPIEventsPath
+	}
+	buf, err := json.Marshal(alerts)
+	if err != nil {
+		return nil, "", err
+	}
+	return buf, path, nil
+}
+
+// sendNotifications posts an encoded list of notifications to the given URL.
+func (n *NotificationHandler) sendNotifications(url string, buf []byte) error {
+	log.Debugln("Sending notifications to alertmanager:", string(buf))
+	resp, err := n.httpClient.Post(url, contentTypeJSON, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("bad response status %s", resp.Status)
+	}
+	return nil
+}
+
+// alertsV1 converts notification requests into the v1 alert manager payload.
+func alertsV1(reqs NotificationReqs) []map[string]interface{} {
+	alerts := make([]map[string]interface{}, 0, len(reqs))
+	for _, req := range reqs {
 		alerts = append(alerts, map[string]interface{}{
 			"summary":     req.Summary,
 			"description": req.Description,
@@ -180,60 +382,197 @@ func (n *NotificationHandler) sendNotifications(reqs NotificationReqs) error {
 			},
 		})
 	}
-	buf, err := json.Marshal(alerts)
-	if err != nil {
-		return err
+	return alerts
+}
+
+// alertsV2 converts notification requests into the v2 alert manager payload.
+// Summary, description and runbook become annotations, omitted if empty.
+func alertsV2(reqs NotificationReqs) []map[string]interface{} {
+	alerts := make([]map[string]interface{}, 0, len(reqs))
+	for _, req := range reqs {
+		annotations := model.LabelSet{}
+		if req.Summary != "" {
+			annotations["summary"] = model.LabelValue(req.Summary)
+		}
+		if req.Description != "" {
+			annotations["description"] = model.LabelValue(req.Description)
+		}
+		if req.Runbook != "" {
+			annotations["runbook"] = model.LabelValue(req.Runbook)
+		}
+		alerts = append(alerts, map[string]interface{}{
+			"labels":       req.Labels,
+			"annotations":  annotations,
+			"startsAt":     req.ActiveSince,
+			"generatorURL": req.GeneratorURL,
+		})
 	}
-	log.Debugln("Sending notifications to alertmanager:", string(buf))
-	resp, err := n.httpClient.Post(
-		n.alertmanagerURL+alertmanagerAPIEventsPath,
-		contentTypeJSON,
-		bytes.NewBuffer(buf),
-	)
-	if err != nil {
-		return err
+	return alerts
+}
+
+// Run dispatches notifications continuously. Notifications that no alert
+// manager accepted are queued again and retried with exponential backoff.
+// After Stop has been called, it tries to send the remaining pending
+// notifications once and returns.
+func (n *NotificationHandler) Run() {
+	defer close(n.stopped)
+
+	stopping := false
+	for !stopping {
+		select {
+		case <-n.more:
+		case <-n.quit:
+			stopping = true
+		}
+
+		var backoff time.Duration
+		for reqs := n.nextBatch(); len(reqs) > 0; reqs = n.nextBatch() {
+			if n.dispatch(reqs) || stopping {
+				backoff = 0
+				continue
+			}
+			n.requeue(reqs)
+
+			if backoff == 0 {
+				backoff = n.minRetryBackoff
+			} else if backoff *= 2; backoff > n.maxRetryBackoff {
+				backoff = n.maxRetryBackoff
+			}
+			log.Warnf("No alert manager accepted %d notifications, retrying in %v", len(reqs), backoff)
+			select {
+			case <-time.After(backoff):
+			case <-n.quit:
+				stopping = true
+			}
+		}
 	}
-	defer resp.Body.Close()
+}
 
-	_, err = ioutil.ReadAll(resp.Body)
+// dispatch sends a batch of notifications to all alert managers concurrently
+// and records the outcome per alert manager. It returns once all alert
+// managers have been handled. The result is false if the notifications
+// should be retried as no alert manager accepted them.
+func (n *NotificationHandler) dispatch(reqs NotificationReqs) bool {
+	if len(n.alertmanagers) == 0 {
+		log.Warn("No alert manager configured, not dispatching notification")
+		n.notificationDropped.Inc()
+		return true
+	}
+
+	buf, path, err := n.encodeNotifications(reqs)
 	if err != nil {
-		return err
+		// Retrying cannot fix the encoding.
+		log.Error("Error encoding notifications: ", err)
+		return true
 	}
-	// BUG: Do we need to check the response code?
-	return nil
+
+	var (
+		wg        sync.WaitGroup
+		delivered int32
+	)
+	for _, am := range n.alertmanagers {
+		wg.Add(1)
+		go func(am alertmanager) {
+			defer wg.Done()
+
+			begin := time.Now()
+			if err := n.sendNotifications(am.url+path, buf); err != nil {
+				log.With("alertmanager", am.name).Error("Error sending notification: ", err)
+				n.notificationErrors.WithLabelValues(am.name).Add(float64(len(reqs)))
+			} else {
+				n.notificationsSent.WithLabelValues(am.name).Add(float64(len(reqs)))
+				atomic.StoreInt32(&delivered, 1)
+			}
+			n.notificationLatency.WithLabelValues(am.name).Observe(float64(time.Since(begin) / time.Millisecond))
+		}(am)
+	}
+	wg.Wait()
+
+	return delivered == 1
 }
 
-// Run dispatches notifications continuously.
-func (n *NotificationHandler) Run() {
-	for reqs := range n.pendingNotifications {
-		if n.alertmanagerURL == "" {
-			log.Warn("No alert manager configured, not dispatching notification")
-			n.notificationDropped.Inc()
+// requeue puts notifications that could not be delivered back at the front
+// of the queue, unless a newer notification for the same alert has been
+// queued in the meantime. If the queue is full, the oldest pending
+// notifications are evicted.
+func (n *NotificationHandler) requeue(reqs NotificationReqs) {
+	n.queueMtx.Lock()
+	defer n.queueMtx.Unlock()
+
+	fps := make([]model.Fingerprint, 0, len(reqs)+len(n.order))
+	for _, req := range reqs {
+		fp := req.Labels.Fingerprint()
+		if _, ok := n.pending[fp]; ok {
 			continue
 		}
+		n.pending[fp] = req
+		fps = append(fps, fp)
+	}
+	n.notificationsRetried.Add(float64(len(fps)))
+	n.order = append(fps, n.order...)
 
-		begin := time.Now()
-		err := n.sendNotifications(reqs)
+	for len(n.order) > n.queueCapacity {
+		delete(n.pending, n.order[0])
+		n.order = n.order[1:]
+		n.notificationsEvicted.Inc()
+	}
+}
 
-		if err != nil {
-			log.Error("Error sending notification: ", err)
-			n.notificationErrors.Inc()
-		}
+// nextBatch removes up to maxBatchSize of the oldest pending notifications
+// from the queue and returns them.
+func (n *NotificationHandler) nextBatch() NotificationReqs {
+	n.queueMtx.Lock()
+	defer n.queueMtx.Unlock()
 
-		n.notificationLatency.Observe(float64(time.Since(begin) / time.Millisecond))
+	num := len(n.order)
+	if num > maxBatchSize {
+		num = maxBatchSize
+	}
+	reqs := make(NotificationReqs, 0, num)
+	for _, fp := range n.order[:num] {
+		reqs = append(reqs, n.pending[fp])
+		delete(n.pending, fp)
 	}
-	close(n.stopped)
+	n.order = n.order[num:]
+	return reqs
 }
 
-// SubmitReqs queues the given notification requests for processing.
+// SubmitReqs queues the given notification requests for processing. A request
+// for an alert that is still pending replaces the pending one, keeping its
+// position in the queue. If the queue is full, the oldest pending alerts are
+// evicted to make room for new ones.
 func (n *NotificationHandler) SubmitReqs(reqs NotificationReqs) {
-	n.pendingNotifications <- reqs
+	n.queueMtx.Lock()
+	for _, req := range reqs {
+		fp := req.Labels.Fingerprint()
+		if _, ok := n.pending[fp]; ok {
+			n.pending[fp] = req
+			continue
+		}
+		for len(n.order) > 0 && len(n.order) >= n.queueCapacity {
+			delete(n.pending, n.order[0])
+			n.order = n.order[1:]
+			n.notificationsEvicted.Inc()
+		}
+		if n.queueCapacity <= 0 {
+			n.notificationsEvicted.Inc()
+			continue
+		}
+		n.pending[fp] = req
+		n.order = append(n.order, fp)
+	}
+	n.queueMtx.Unlock()
+
+	select {
+	case n.more <- struct{}{}:
+	default:
+	}
 }
 
 // Stop shuts down the notification handler.
 func (n *NotificationHandler) Stop() {
 	log.Info("Stopping notification handler...")
-	close(n.pendingNotifications)
+	close(n.quit)
 	<-n.stopped
 	log.Info("Notification handler stopped.")
 }
@@ -241,14 +580,33 @@ func (n *NotificationHandler) Stop() {
 // Describe implements prometheus.Collector.
 func (n *NotificationHandler) Describe(ch chan<- *prometheus.Desc) {
 	n.notificationLatency.Describe(ch)
+	n.notificationsSent.Describe(ch)
+	n.notificationErrors.Describe(ch)
+	ch <- n.notificationDropped.Desc()
+	ch <- n.notificationsRetried.Desc()
+	ch <- n.notificationsEvicted.Desc()
 	ch <- n.notificationsQueueLength.Desc()
+	n.notificationsQueueLengthByAlert.Describe(ch)
 	ch <- n.notificationsQueueCapacity.Desc()
 }
 
 // Collect implements prometheus.Collector.
 func (n *NotificationHandler) Collect(ch chan<- prometheus.Metric) {
+	n.queueMtx.Lock()
+	n.notificationsQueueLength.Set(float64(len(n.order)))
+	n.notificationsQueueLengthByAlert.Reset()
+	for _, req := range n.pending {
+		n.notificationsQueueLengthByAlert.WithLabelValues(string(req.Labels[model.AlertNameLabel])).Inc()
+	}
+	n.queueMtx.Unlock()
+
 	n.notificationLatency.Collect(ch)
-	n.notificationsQueueLength.Set(float64(len(n.pendingNotifications)))
+	n.notificationsSent.Collect(ch)
+	n.notificationErrors.Collect(ch)
+	ch <- n.notificationDropped
+	ch <- n.notificationsRetried
+	ch <- n.notificationsEvicted
 	ch <- n.notificationsQueueLength
+	n.notificationsQueueLengthByAlert.Collect(ch)
 	ch <- n.notificationsQueueCapacity
 }
@@ -15,16 +15,25 @@ package notification
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
 )
 
 type testHTTPPoster struct {
+	url          string
 	message      string
 	receivedPost chan<- bool
 }
@@ -32,14 +41,18 @@ type testHTTPPoster struct {
 func (p *testHTTPPoster) Post(url string, bodyType string, body io.Reader) (*http.Response, error) {
 	var buf bytes.Buffer
 	buf.ReadFrom(body)
+	p.url = url
 	p.message = buf.String()
 	p.receivedPost <- true
 	return &http.Response{
-		Body: ioutil.NopCloser(&bytes.Buffer{}),
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(&bytes.Buffer{}),
 	}, nil
 }
 
 type testNotificationScenario struct {
+	apiVersion  APIVersion
+	url         string
 	description string
 	summary     string
 	message     string
@@ -48,9 +61,10 @@ type testNotificationScenario struct {
 
 func (s *testNotificationScenario) test(i int, t *testing.T) {
 	h := NewNotificationHandler(&NotificationHandlerOptions{
-		AlertmanagerURL: "alertmanager_url",
-		QueueCapacity:   0,
-		Deadline:        10 * time.Second,
+		AlertmanagerURLs: []string{"alertmanager_url"},
+		APIVersion:       s.apiVersion,
+		QueueCapacity:    10,
+		Deadline:         10 * time.Second,
 	})
 	defer h.Stop()
 
@@ -76,6 +90,9 @@ func (s *testNotificationScenario) test(i int, t *testing.T) {
 	})
 
 	<-receivedPost
+	if poster.url != s.url {
+		t.Fatalf("%d. Expected URL '%s', received '%s'", i, s.url, poster.url)
+	}
 	if poster.message != s.message {
 		t.Fatalf("%d. Expected '%s', received '%s'", i, s.message, poster.message)
 	}
@@ -85,14 +102,381 @@ func TestNotificationHandler(t *testing.T) {
 	scenarios := []testNotificationScenario{
 		{
 			// Correct message.
+			apiVersion:  APIv1,
+			url:         "alertmanager_url/api/alerts",
 			summary:     "Summary",
 			description: "Description",
 			runbook:     "Runbook",
 			message:     `[{"description":"Description","labels":{"instance":"testinstance"},"payload":{"activeSince":"0001-01-01T00:00:00Z","alertingRule":"Test rule string","generatorURL":"prometheus_url","value":"0.3333333333333333"},"runbook":"Runbook","summary":"Summary"}]`,
 		},
+		{
+			// Correct v2 message.
+			apiVersion:  APIv2,
+			url:         "alertmanager_url/api/v1/alerts",
+			summary:     "Summary",
+			description: "Description",
+			runbook:     "Runbook",
+			message:     `[{"annotations":{"description":"Description","runbook":"Runbook","summary":"Summary"},"generatorURL":"prometheus_url","labels":{"instance":"testinstance"},"startsAt":"0001-01-01T00:00:00Z"}]`,
+		},
+		{
+			// Empty annotations are omitted in v2.
+			apiVersion: APIv2,
+			url:        "alertmanager_url/api/v1/alerts",
+			summary:    "Summary",
+			message:    `[{"annotations":{"summary":"Summary"},"generatorURL":"prometheus_url","labels":{"instance":"testinstance"},"startsAt":"0001-01-01T00:00:00Z"}]`,
+		},
 	}
 
 	for i, s := range scenarios {
 		s.test(i, t)
 	}
 }
+
+func TestAPIVersionSet(t *testing.T) {
+	for s, want := range map[string]APIVersion{"v1": APIv1, "v2": APIv2} {
+		var v APIVersion
+		if err := v.Set(s); err != nil {
+			t.Fatalf("Unexpected error setting %q: %s", s, err)
+		}
+		if v != want {
+			t.Fatalf("Expected %v for %q, got %v", want, s, v)
+		}
+		if v.String() != s {
+			t.Fatalf("Expected String() to return %q, got %q", s, v.String())
+		}
+	}
+	var v APIVersion
+	if err := v.Set("v3"); err == nil {
+		t.Fatalf("Expected error setting invalid API version")
+	}
+}
+
+type blockingHTTPPoster struct {
+	messages chan<- string
+	release  <-chan struct{}
+}
+
+func (p *blockingHTTPPoster) Post(url string, bodyType string, body io.Reader) (*http.Response, error) {
+	var buf bytes.Buffer
+	buf.ReadFrom(body)
+	p.messages <- buf.String()
+	<-p.release
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(&bytes.Buffer{}),
+	}, nil
+}
+
+func TestNotificationQueueCoalescing(t *testing.T) {
+	h := NewNotificationHandler(&NotificationHandlerOptions{
+		AlertmanagerURLs: []string{"alertmanager_url"},
+		QueueCapacity:    10,
+		Deadline:         10 * time.Second,
+	})
+
+	var (
+		messages = make(chan string, 10)
+		release  = make(chan struct{})
+	)
+	h.httpClient = &blockingHTTPPoster{messages: messages, release: release}
+
+	go h.Run()
+	defer h.Stop()
+
+	alert := func(name string, v model.SampleValue) *NotificationReq {
+		return &NotificationReq{
+			Labels: model.LabelSet{model.AlertNameLabel: model.LabelValue(name)},
+			Value:  v,
+		}
+	}
+
+	// The first notification is picked up right away and blocks the
+	// handler, so all following ones have to queue up.
+	h.SubmitReqs(NotificationReqs{alert("flapping", 0)})
+	<-messages
+
+	for i := 1; i <= 5; i++ {
+		h.SubmitReqs(NotificationReqs{alert("flapping", model.SampleValue(i))})
+	}
+	h.SubmitReqs(NotificationReqs{alert("other", 1)})
+
+	expectedLengths := map[string]int{"flapping": 1, "other": 1}
+	h.queueMtx.Lock()
+	if len(h.order) != 2 {
+		t.Errorf("Expected 2 pending notifications, got %d", len(h.order))
+	}
+	got := map[string]int{}
+	for _, req := range h.pending {
+		got[string(req.Labels[model.AlertNameLabel])]++
+	}
+	h.queueMtx.Unlock()
+	for name, exp := range expectedLengths {
+		if got[name] != exp {
+			t.Errorf("Expected %d pending notifications for %q, got %d", exp, name, got[name])
+		}
+	}
+
+	release <- struct{}{}
+	msg := <-messages
+	close(release)
+
+	for _, want := range []string{`"alertname":"flapping"`, `"value":"5"`, `"alertname":"other"`} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Expected %s in notification, got %s", want, msg)
+		}
+	}
+	if strings.Count(msg, `"alertname":"flapping"`) != 1 {
+		t.Errorf("Expected updates to coalesce into a single notification, got %s", msg)
+	}
+}
+
+func TestNotificationQueueEviction(t *testing.T) {
+	h := NewNotificationHandler(&NotificationHandlerOptions{
+		QueueCapacity: 2,
+	})
+
+	h.SubmitReqs(NotificationReqs{
+		{Labels: model.LabelSet{model.AlertNameLabel: "a"}},
+		{Labels: model.LabelSet{model.AlertNameLabel: "b"}},
+		{Labels: model.LabelSet{model.AlertNameLabel: "c"}},
+	})
+
+	reqs := h.nextBatch()
+	if len(reqs) != 2 {
+		t.Fatalf("Expected 2 pending notifications, got %d", len(reqs))
+	}
+	for i, name := range []model.LabelValue{"b", "c"} {
+		if reqs[i].Labels[model.AlertNameLabel] != name {
+			t.Errorf("%d. Expected alert %q, got %q", i, name, reqs[i].Labels[model.AlertNameLabel])
+		}
+	}
+}
+
+func TestNotificationFanOut(t *testing.T) {
+	received := make(chan string, 10)
+	newServer := func(code int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			received <- string(b)
+			w.WriteHeader(code)
+		}))
+	}
+	ok1, ok2, failing := newServer(http.StatusOK), newServer(http.StatusOK), newServer(http.StatusInternalServerError)
+	defer ok1.Close()
+	defer ok2.Close()
+	defer failing.Close()
+
+	// An unreachable alert manager must not keep the others from receiving
+	// notifications.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := "http://" + l.Addr().String()
+	l.Close()
+
+	h := NewNotificationHandler(&NotificationHandlerOptions{
+		AlertmanagerURLs: []string{ok1.URL, ok2.URL + "/", failing.URL, unreachable},
+		QueueCapacity:    10,
+		Deadline:         time.Second,
+	})
+	h.dispatch(NotificationReqs{
+		{Labels: model.LabelSet{model.AlertNameLabel: "a"}},
+		{Labels: model.LabelSet{model.AlertNameLabel: "b"}},
+	})
+
+	if len(received) != 3 {
+		t.Fatalf("Expected 3 alert managers to receive notifications, got %d", len(received))
+	}
+	for i := 0; i < 3; i++ {
+		if msg := <-received; !strings.Contains(msg, `"alertname":"a"`) || !strings.Contains(msg, `"alertname":"b"`) {
+			t.Errorf("Expected both alerts in notification, got %s", msg)
+		}
+	}
+
+	counterValue := func(c interface {
+		Write(*dto.Metric) error
+	}) float64 {
+		var m dto.Metric
+		if err := c.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	expected := map[string]struct{ sent, errors float64 }{
+		ok1.URL:     {sent: 2},
+		ok2.URL:     {sent: 2},
+		failing.URL: {errors: 2},
+		unreachable: {errors: 2},
+	}
+	for u, exp := range expected {
+		if got := counterValue(h.notificationsSent.WithLabelValues(u)); got != exp.sent {
+			t.Errorf("%s: expected %v sent notifications, got %v", u, exp.sent, got)
+		}
+		if got := counterValue(h.notificationErrors.WithLabelValues(u)); got != exp.errors {
+			t.Errorf("%s: expected %v notification errors, got %v", u, exp.errors, got)
+		}
+	}
+}
+
+func TestNotificationRetry(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		attempts int
+	)
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		attempts++
+		fail := attempts <= 2
+		mtx.Unlock()
+
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		received <- string(b)
+	}))
+	defer server.Close()
+
+	h := NewNotificationHandler(&NotificationHandlerOptions{
+		AlertmanagerURLs: []string{server.URL},
+		QueueCapacity:    10,
+		Deadline:         time.Second,
+	})
+	h.minRetryBackoff = time.Millisecond
+	h.maxRetryBackoff = 10 * time.Millisecond
+	go h.Run()
+	defer h.Stop()
+
+	h.SubmitReqs(NotificationReqs{{Labels: model.LabelSet{model.AlertNameLabel: "a"}}})
+
+	select {
+	case msg := <-received:
+		if !strings.Contains(msg, `"alertname":"a"`) {
+			t.Errorf("Expected alert in notification, got %s", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notification was not delivered after retrying")
+	}
+
+	var m dto.Metric
+	if err := h.notificationsRetried.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetCounter().GetValue(); got != 2 {
+		t.Errorf("Expected 2 retried notifications, got %v", got)
+	}
+}
+
+func TestNotificationRequeue(t *testing.T) {
+	h := NewNotificationHandler(&NotificationHandlerOptions{
+		QueueCapacity: 3,
+	})
+
+	failed := NotificationReqs{
+		{Labels: model.LabelSet{model.AlertNameLabel: "a"}, Value: 1},
+		{Labels: model.LabelSet{model.AlertNameLabel: "b"}, Value: 1},
+	}
+	// Newer updates queued while the failed batch was being sent.
+	h.SubmitReqs(NotificationReqs{
+		{Labels: model.LabelSet{model.AlertNameLabel: "b"}, Value: 2},
+		{Labels: model.LabelSet{model.AlertNameLabel: "c"}, Value: 2},
+		{Labels: model.LabelSet{model.AlertNameLabel: "d"}, Value: 2},
+	})
+	h.requeue(failed)
+
+	// The requeued alert a is the oldest and evicted, the newer update of b
+	// takes precedence over the requeued one.
+	reqs := h.nextBatch()
+	expected := []struct {
+		name  model.LabelValue
+		value model.SampleValue
+	}{{"b", 2}, {"c", 2}, {"d", 2}}
+	if len(reqs) != len(expected) {
+		t.Fatalf("Expected %d pending notifications, got %d", len(expected), len(reqs))
+	}
+	for i, exp := range expected {
+		if reqs[i].Labels[model.AlertNameLabel] != exp.name || reqs[i].Value != exp.value {
+			t.Errorf("%d. Expected alert %q with value %v, got %q with value %v", i, exp.name, exp.value, reqs[i].Labels[model.AlertNameLabel], reqs[i].Value)
+		}
+	}
+
+	var m dto.Metric
+	if err := h.notificationsEvicted.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetCounter().GetValue(); got != 1 {
+		t.Errorf("Expected 1 evicted notification, got %v", got)
+	}
+}
+
+func TestNotificationAuthAndTLS(t *testing.T) {
+	authorized := make(chan string, 3)
+	newServer := func(user, password string) *httptest.Server {
+		return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u, p, ok := r.BasicAuth()
+			if !ok || u != user || p != password {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			authorized <- u
+		}))
+	}
+	s1, s2 := newServer("user1", "secret1"), newServer("user2", "secret2")
+	defer s1.Close()
+	defer s2.Close()
+	// Credentials in URLs take precedence over the configured ones.
+	s3 := newServer("user3", "secret3")
+	defer s3.Close()
+
+	withCredentials := func(s *httptest.Server, user, password string) string {
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.User = url.UserPassword(user, password)
+		return u.String()
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s1.Certificate())
+	roots.AddCert(s2.Certificate())
+	roots.AddCert(s3.Certificate())
+
+	h := NewNotificationHandler(&NotificationHandlerOptions{
+		AlertmanagerURLs: []string{
+			withCredentials(s1, "user1", "secret1"),
+			withCredentials(s2, "user2", "secret2"),
+			s3.URL,
+		},
+		QueueCapacity:     10,
+		Deadline:          time.Second,
+		TLSConfig:         &tls.Config{RootCAs: roots},
+		BasicAuthUsername: "user3",
+		BasicAuthPassword: "secret3",
+	})
+	if !h.dispatch(NotificationReqs{{Labels: model.LabelSet{model.AlertNameLabel: "a"}}}) {
+		t.Fatal("Expected notification to be delivered")
+	}
+	if len(authorized) != 3 {
+		t.Fatalf("Expected all alert managers to authorize the notification, got %d", len(authorized))
+	}
+
+	// Metrics are labeled with the URLs without credentials.
+	for _, s := range []*httptest.Server{s1, s2, s3} {
+		var m dto.Metric
+		if err := h.notificationsSent.WithLabelValues(s.URL).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.GetCounter().GetValue(); got != 1 {
+			t.Errorf("%s: expected 1 sent notification, got %v", s.URL, got)
+		}
+	}
+	for _, am := range h.alertmanagers {
+		if strings.Contains(am.name, "secret") {
+			t.Errorf("Expected credentials to be stripped from alert manager name, got %s", am.name)
+		}
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/prometheus/common/model"
 	"golang.org/x/net/context"
 
+	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/storage/local"
 )
 
@@ -28,6 +29,9 @@ import (
 type Analyzer struct {
 	// The storage from which to query data.
 	Storage local.Storage
+	// The remote storage from which to query data in addition to Storage.
+	// Optional.
+	RemoteReader storage.Reader
 	// The expression being analyzed.
 	Expr Expr
 	// The time range for evaluation of Expr.
@@ -35,6 +39,16 @@ type Analyzer struct {
 
 	// The preload times for different query time offsets.
 	offsetPreloadTimes map[time.Duration]preloadTimes
+	// The staleness deltas of series deviating from StalenessDelta.
+	stalenessDeltas map[model.Fingerprint]time.Duration
+	// Non-fatal errors that occurred while preloading, i.e. chunks that
+	// could not be decoded and are missing from the query result.
+	warnings []error
+
+	// The samples read from the remote storage by the fingerprint of
+	// their metric, and the oldest time they were read for.
+	remoteSamples map[model.Fingerprint][]model.SamplePair
+	remoteFrom    model.Time
 }
 
 // preloadTimes tracks which instants or ranges to preload for a set of
@@ -55,6 +69,9 @@ type preloadTimes struct {
 // AST nodes that are later used to preload the data from the storage.
 func (a *Analyzer) Analyze(ctx context.Context) error {
 	a.offsetPreloadTimes = map[time.Duration]preloadTimes{}
+	a.stalenessDeltas = map[model.Fingerprint]time.Duration{}
+	a.remoteSamples = map[model.Fingerprint][]model.SamplePair{}
+	a.remoteFrom = a.Start
 
 	getPreloadTimes := func(offset time.Duration) preloadTimes {
 		if _, ok := a.offsetPreloadTimes[offset]; !ok {
@@ -75,6 +92,7 @@ func (a *Analyzer) Analyze(ctx context.Context) error {
 			n.iterators = make(map[model.Fingerprint]local.SeriesIterator, len(n.metrics))
 
 			pt := getPreloadTimes(n.Offset)
+			maxStalenessDelta := StalenessDelta
 			for fp := range n.metrics {
 				// Only add the fingerprint to the instants if not yet present in the
 				// ranges. Ranges always contain more points and span more time than
@@ -82,7 +100,17 @@ func (a *Analyzer) Analyze(ctx context.Context) error {
 				if _, alreadyInRanges := pt.ranges[fp]; !alreadyInRanges {
 					pt.instants[fp] = struct{}{}
 				}
+				if SeriesStalenessFactor > 0 {
+					d := seriesStalenessDelta(a.Storage.SampleIntervalForFingerprint(fp))
+					a.stalenessDeltas[fp] = d
+					if d > maxStalenessDelta {
+						maxStalenessDelta = d
+					}
+				}
 			}
+			n.stalenessDeltas = a.stalenessDeltas
+			start := a.Start.Add(-n.Offset - maxStalenessDelta)
+			a.readRemote(ctx, n.LabelMatchers, n.metrics, start, a.End.Add(-n.Offset))
 		case *MatrixSelector:
 			n.metrics = a.Storage.MetricsForLabelMatchers(n.LabelMatchers...)
 			n.iterators = make(map[model.Fingerprint]local.SeriesIterator, len(n.metrics))
@@ -97,6 +125,8 @@ func (a *Analyzer) Analyze(ctx context.Context) error {
 					delete(pt.instants, fp)
 				}
 			}
+			start := a.Start.Add(-n.Offset - n.Range)
+			a.readRemote(ctx, n.LabelMatchers, n.metrics, start, a.End.Add(-n.Offset))
 		}
 		return true
 	})
@@ -106,6 +136,55 @@ func (a *Analyzer) Analyze(ctx context.Context) error {
 	return nil
 }
 
+// Estimate returns the number of distinct series and of chunks that Prepare
+// would preload for the analyzed expression. Chunks are counted from the chunk
+// meta-data in memory without reading any series file. Chunks that are only on
+// disk and whose number is unknown are counted as one. Chunks needed for one
+// series at several offsets are counted repeatedly.
+func (a *Analyzer) Estimate() (series, chunks int, err error) {
+	if a.offsetPreloadTimes == nil {
+		return 0, 0, errors.New("analysis must be performed before estimating")
+	}
+
+	fps := map[model.Fingerprint]struct{}{}
+	count := func(fp model.Fingerprint, from, through model.Time) error {
+		fps[fp] = struct{}{}
+		ranges, err := a.Storage.ChunkRangesForFingerprint(fp)
+		if err != nil {
+			return err
+		}
+		stalenessDelta := a.stalenessDelta(fp)
+		from, through = from.Add(-stalenessDelta), through.Add(stalenessDelta)
+		for _, r := range ranges {
+			if r.LastTime.Before(from) || r.FirstTime.After(through) {
+				continue
+			}
+			if r.NumChunks == 0 {
+				chunks++
+			} else {
+				chunks += r.NumChunks
+			}
+		}
+		return nil
+	}
+
+	for offset, pt := range a.offsetPreloadTimes {
+		start := a.Start.Add(-offset)
+		end := a.End.Add(-offset)
+		for fp, rangeDuration := range pt.ranges {
+			if err := count(fp, start.Add(-rangeDuration), end); err != nil {
+				return 0, 0, err
+			}
+		}
+		for fp := range pt.instants {
+			if err := count(fp, start, end); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	return len(fps), chunks, nil
+}
+
 // Prepare the expression evaluation by preloading all required chunks from the storage
 // and setting the respective storage iterators in the AST nodes.
 func (a *Analyzer) Prepare(ctx context.Context) (local.Preloader, error) {
@@ -132,7 +211,11 @@ func (a *Analyzer) Prepare(ctx context.Context) (local.Preloader, error) {
 			if err = contextDone(ctx, env); err != nil {
 				return nil, err
 			}
-			err = p.PreloadRange(fp, start.Add(-rangeDuration), end, StalenessDelta)
+			err = p.PreloadRange(fp, start.Add(-rangeDuration), end, a.stalenessDelta(fp))
+			if de, ok := err.(*local.ChunkDecodeError); ok {
+				a.warnings = append(a.warnings, de)
+				err = nil
+			}
 			if err != nil {
 				return nil, err
 			}
@@ -141,7 +224,11 @@ func (a *Analyzer) Prepare(ctx context.Context) (local.Preloader, error) {
 			if err = contextDone(ctx, env); err != nil {
 				return nil, err
 			}
-			err = p.PreloadRange(fp, start, end, StalenessDelta)
+			err = p.PreloadRange(fp, start, end, a.stalenessDelta(fp))
+			if de, ok := err.(*local.ChunkDecodeError); ok {
+				a.warnings = append(a.warnings, de)
+				err = nil
+			}
 			if err != nil {
 				return nil, err
 			}
@@ -152,12 +239,12 @@ func (a *Analyzer) Prepare(ctx context.Context) (local.Preloader, error) {
 	Inspect(a.Expr, func(node Node) bool {
 		switch n := node.(type) {
 		case *VectorSelector:
-			for fp := range n.metrics {
-				n.iterators[fp] = a.Storage.NewIterator(fp)
+			for fp, m := range n.metrics {
+				n.iterators[fp] = a.newIterator(fp, m)
 			}
 		case *MatrixSelector:
-			for fp := range n.metrics {
-				n.iterators[fp] = a.Storage.NewIterator(fp)
+			for fp, m := range n.metrics {
+				n.iterators[fp] = a.newIterator(fp, m)
 			}
 		}
 		return true
@@ -165,3 +252,12 @@ func (a *Analyzer) Prepare(ctx context.Context) (local.Preloader, error) {
 
 	return p, nil
 }
+
+// stalenessDelta returns the staleness delta of the series with the given
+// fingerprint.
+func (a *Analyzer) stalenessDelta(fp model.Fingerprint) time.Duration {
+	if d, ok := a.stalenessDeltas[fp]; ok {
+		return d
+	}
+	return StalenessDelta
+}
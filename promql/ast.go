@@ -105,6 +105,7 @@ type Expressions []Expr
 type AggregateExpr struct {
 	Op              itemType         // The used aggregation operation.
 	Expr            Expr             // The vector expression over which is aggregated.
+	Param           Expr             // Parameter used by some aggregators.
 	Grouping        model.LabelNames // The labels by which to group the vector.
 	KeepExtraLabels bool             // Whether to keep extra labels common among result elements.
 }
@@ -172,6 +173,8 @@ type VectorSelector struct {
 	// The series iterators are populated at query analysis time.
 	iterators map[model.Fingerprint]local.SeriesIterator
 	metrics   map[model.Fingerprint]metric.Metric
+	// The staleness deltas of series deviating from StalenessDelta.
+	stalenessDeltas map[model.Fingerprint]time.Duration
 }
 
 func (e *AggregateExpr) Type() model.ValueType  { return model.ValVector }
@@ -274,6 +277,9 @@ func Walk(v Visitor, node Node) {
 			Walk(v, e)
 		}
 	case *AggregateExpr:
+		if n.Param != nil {
+			Walk(v, n.Param)
+		}
 		Walk(v, n.Expr)
 
 	case *BinaryExpr:
@@ -18,12 +18,14 @@ import (
 	"math"
 	"runtime"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
 	"golang.org/x/net/context"
 
+	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/storage/local"
 	"github.com/prometheus/prometheus/storage/metric"
 	"github.com/prometheus/prometheus/util/stats"
@@ -84,6 +86,9 @@ func (mat matrix) value() model.Matrix {
 type Result struct {
 	Err   error
 	Value model.Value
+	// Warnings are non-fatal errors that occurred during execution, e.g.
+	// chunks that could not be decoded and are missing from Value.
+	Warnings []error
 }
 
 // Vector returns a vector if the result value is one. An error is returned if
@@ -154,7 +159,9 @@ type Query interface {
 	Statement() Statement
 	// Stats returns statistics about the lifetime of the query.
 	Stats() *stats.TimerGroup
-	// Cancel signals that a running query execution should be aborted.
+	// Cancel signals that a running query execution should be aborted. A
+	// query canceled before its execution has started is aborted once it
+	// starts.
 	Cancel()
 }
 
@@ -166,11 +173,19 @@ type query struct {
 	stmt Statement
 	// Timer stats for the query execution.
 	stats *stats.TimerGroup
+	// Protects cancel and canceled, which may be accessed concurrently
+	// with execution.
+	mtx sync.Mutex
 	// Cancelation function for the query.
 	cancel func()
+	// Whether Cancel has been called. A query canceled before its
+	// execution has started is canceled as soon as it starts.
+	canceled bool
 
 	// The engine against which the query is executed.
 	ng *Engine
+	// Non-fatal errors that occurred during execution.
+	warnings []error
 }
 
 // Statement implements the Query interface.
@@ -185,15 +200,31 @@ func (q *query) Stats() *stats.TimerGroup {
 
 // Cancel implements the Query interface.
 func (q *query) Cancel() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.canceled = true
 	if q.cancel != nil {
 		q.cancel()
 	}
 }
 
+// setCancel sets the cancelation function of the query. If the query has
+// already been canceled, the function is called right away.
+func (q *query) setCancel(cancel func()) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.cancel = cancel
+	if q.canceled {
+		cancel()
+	}
+}
+
 // Exec implements the Query interface.
 func (q *query) Exec() *Result {
 	res, err := q.ng.exec(q)
-	return &Result{Err: err, Value: res}
+	return &Result{Err: err, Value: res, Warnings: q.warnings}
 }
 
 // contextDone returns an error if the context was canceled or timed out.
@@ -224,6 +255,7 @@ type Engine struct {
 	baseCtx       context.Context
 	cancelQueries func()
 	// The gate limiting the maximum number of concurrent and waiting queries.
+	// Unlimited, if nil.
 	gate *queryGate
 
 	options *EngineOptions
@@ -235,19 +267,28 @@ func NewEngine(storage local.Storage, o *EngineOptions) *Engine {
 		o = DefaultEngineOptions
 	}
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Engine{
+	ng := &Engine{
 		storage:       storage,
 		baseCtx:       ctx,
 		cancelQueries: cancel,
-		gate:          newQueryGate(o.MaxConcurrentQueries),
 		options:       o,
 	}
+	if o.MaxConcurrentQueries > 0 {
+		ng.gate = newQueryGate(o.MaxConcurrentQueries)
+	}
+	return ng
 }
 
 // EngineOptions contains configuration parameters for an Engine.
 type EngineOptions struct {
+	// MaxConcurrentQueries is the maximum number of queries executed at
+	// the same time, further ones wait for their turn. Unlimited, if not
+	// positive.
 	MaxConcurrentQueries int
 	Timeout              time.Duration
+	// RemoteReader is the remote storage queried in addition to the local
+	// storage. Optional.
+	RemoteReader storage.Reader
 }
 
 // DefaultEngineOptions are the default engine options.
@@ -328,19 +369,21 @@ func (ng *Engine) newTestQuery(f func(context.Context) error) Query {
 // statements are not handled by the Engine.
 func (ng *Engine) exec(q *query) (model.Value, error) {
 	ctx, cancel := context.WithTimeout(q.ng.baseCtx, ng.options.Timeout)
-	q.cancel = cancel
+	q.setCancel(cancel)
 
 	queueTimer := q.stats.GetTimer(stats.ExecQueueTime).Start()
 
-	if err := ng.gate.Start(ctx); err != nil {
-		return nil, err
+	if ng.gate != nil {
+		if err := ng.gate.Start(ctx); err != nil {
+			return nil, err
+		}
+		defer ng.gate.Done()
 	}
-	defer ng.gate.Done()
 
 	queueTimer.Stop()
 
 	// Cancel when execution is done or an error was raised.
-	defer q.cancel()
+	defer cancel()
 
 	const env = "query execution"
 
@@ -369,10 +412,11 @@ func (ng *Engine) execEvalStmt(ctx context.Context, query *query, s *EvalStmt) (
 
 	// Only one execution statement per query is allowed.
 	analyzer := &Analyzer{
-		Storage: ng.storage,
-		Expr:    s.Expr,
-		Start:   s.Start,
-		End:     s.End,
+		Storage:      ng.storage,
+		RemoteReader: ng.options.RemoteReader,
+		Expr:         s.Expr,
+		Start:        s.Start,
+		End:          s.End,
 	}
 	err := analyzer.Analyze(ctx)
 	if err != nil {
@@ -390,6 +434,7 @@ func (ng *Engine) execEvalStmt(ctx context.Context, query *query, s *EvalStmt) (
 		return nil, err
 	}
 	defer closer.Close()
+	query.warnings = analyzer.warnings
 
 	preloadTimer.Stop()
 	prepareTimer.Stop()
@@ -618,8 +663,12 @@ func (ev *evaluator) eval(expr Expr) model.Value {
 
 	switch e := expr.(type) {
 	case *AggregateExpr:
+		var param *model.Scalar
+		if e.Param != nil {
+			param = ev.evalScalar(e.Param)
+		}
 		vector := ev.evalVector(e.Expr)
-		return ev.aggregation(e.Op, e.Grouping, e.KeepExtraLabels, vector)
+		return ev.aggregation(e.Op, e.Grouping, e.KeepExtraLabels, param, vector)
 
 	case *BinaryExpr:
 		lhs := ev.evalOneOf(e.LHS, model.ValScalar, model.ValVector)
@@ -686,15 +735,32 @@ func (ev *evaluator) eval(expr Expr) model.Value {
 
 // vectorSelector evaluates a *VectorSelector expression.
 func (ev *evaluator) vectorSelector(node *VectorSelector) vector {
+	return ev.selectVector(node, false)
+}
+
+// selectVector returns the samples selected by a *VectorSelector. The samples
+// have the evaluation timestamp unless keepTimestamps is true, in which case
+// they have the timestamps they were stored with.
+func (ev *evaluator) selectVector(node *VectorSelector, keepTimestamps bool) vector {
 	vec := vector{}
+	refTime := ev.Timestamp.Add(-node.Offset)
 	for fp, it := range node.iterators {
-		sampleCandidates := it.ValueAtTime(ev.Timestamp.Add(-node.Offset))
-		samplePair := chooseClosestBefore(sampleCandidates, ev.Timestamp.Add(-node.Offset))
-		if samplePair != nil {
+		stalenessDelta := StalenessDelta
+		if d, ok := node.stalenessDeltas[fp]; ok {
+			stalenessDelta = d
+		}
+		sampleCandidates := it.ValueAtTime(refTime)
+		samplePair := chooseClosestBefore(sampleCandidates, refTime, stalenessDelta)
+		// A staleness marker ends the series right away.
+		if samplePair != nil && !metric.IsStaleNaN(samplePair.Value) {
+			ts := ev.Timestamp
+			if keepTimestamps {
+				ts = samplePair.Timestamp
+			}
 			vec = append(vec, &sample{
 				Metric:    node.metrics[fp],
 				Value:     samplePair.Value,
-				Timestamp: ev.Timestamp,
+				Timestamp: ts,
 			})
 		}
 	}
@@ -710,7 +776,7 @@ func (ev *evaluator) matrixSelector(node *MatrixSelector) matrix {
 
 	sampleStreams := make([]*sampleStream, 0, len(node.iterators))
 	for fp, it := range node.iterators {
-		samplePairs := it.RangeValues(interval)
+		samplePairs := removeStaleMarkers(it.RangeValues(interval))
 		if len(samplePairs) == 0 {
 			continue
 		}
@@ -730,6 +796,18 @@ func (ev *evaluator) matrixSelector(node *MatrixSelector) matrix {
 	return matrix(sampleStreams)
 }
 
+// removeStaleMarkers removes the staleness markers from the given sample pairs
+// in place.
+func removeStaleMarkers(samplePairs []model.SamplePair) []model.SamplePair {
+	res := samplePairs[:0]
+	for _, sp := range samplePairs {
+		if !metric.IsStaleNaN(sp.Value) {
+			res = append(res, sp)
+		}
+	}
+	return res
+}
+
 // matrixSelectorBounds evaluates the boundaries of a *MatrixSelector.
 func (ev *evaluator) matrixSelectorBounds(node *MatrixSelector) matrix {
 	interval := metric.Interval{
@@ -739,7 +817,7 @@ func (ev *evaluator) matrixSelectorBounds(node *MatrixSelector) matrix {
 
 	sampleStreams := make([]*sampleStream, 0, len(node.iterators))
 	for fp, it := range node.iterators {
-		samplePairs := it.BoundaryValues(interval)
+		samplePairs := removeStaleMarkers(it.BoundaryValues(interval))
 		if len(samplePairs) == 0 {
 			continue
 		}
@@ -1036,10 +1114,19 @@ type groupedAggregation struct {
 	value            model.SampleValue
 	valuesSquaredSum model.SampleValue
 	groupCount       int
+	values           []float64 // Only collected for quantiles.
 }
 
-// aggregation evaluates an aggregation operation on a vector.
-func (ev *evaluator) aggregation(op itemType, grouping model.LabelNames, keepExtra bool, vec vector) vector {
+// aggregation evaluates an aggregation operation on a vector. param is only
+// used by aggregators taking a parameter and nil otherwise.
+func (ev *evaluator) aggregation(op itemType, grouping model.LabelNames, keepExtra bool, param *model.Scalar, vec vector) vector {
+	var phi float64
+	if op == itemQuantile {
+		phi = float64(param.Value)
+		if phi < 0 || phi > 1 {
+			log.Warnf("Quantile %v out of range [0, 1] at %v, returning NaN", phi, ev.Timestamp)
+		}
+	}
 
 	result := map[uint64]*groupedAggregation{}
 
@@ -1070,6 +1157,9 @@ func (ev *evaluator) aggregation(op itemType, grouping model.LabelNames, keepExt
 				valuesSquaredSum: sample.Value * sample.Value,
 				groupCount:       1,
 			}
+			if op == itemQuantile {
+				result[groupingKey].values = []float64{float64(sample.Value)}
+			}
 			continue
 		}
 		// Add the sample to the existing group.
@@ -1097,6 +1187,8 @@ func (ev *evaluator) aggregation(op itemType, grouping model.LabelNames, keepExt
 			groupedResult.value += sample.Value
 			groupedResult.valuesSquaredSum += sample.Value * sample.Value
 			groupedResult.groupCount++
+		case itemQuantile:
+			groupedResult.values = append(groupedResult.values, float64(sample.Value))
 		default:
 			panic(fmt.Errorf("expected aggregation operator but got %q", op))
 		}
@@ -1117,6 +1209,8 @@ func (ev *evaluator) aggregation(op itemType, grouping model.LabelNames, keepExt
 		case itemStddev:
 			avg := float64(aggr.value) / float64(aggr.groupCount)
 			aggr.value = model.SampleValue(math.Sqrt(float64(aggr.valuesSquaredSum)/float64(aggr.groupCount) - avg*avg))
+		case itemQuantile:
+			aggr.value = model.SampleValue(valueQuantile(phi, aggr.values))
 		default:
 			// For other aggregations, we already have the right value.
 		}
@@ -1149,19 +1243,45 @@ func shouldDropMetricName(op itemType) bool {
 	}
 }
 
-// StalenessDelta determines the time since the last sample after which a time
-// series is considered stale.
-var StalenessDelta = 5 * time.Minute
+var (
+	// StalenessDelta determines the time since the last sample after which a
+	// time series is considered stale.
+	StalenessDelta = 5 * time.Minute
+
+	// SeriesStalenessFactor enables per-series staleness if positive. A time
+	// series is then considered stale once the time since its last sample
+	// exceeds the interval between the last two samples ingested for it
+	// multiplied by the factor. Series whose interval is not known by the
+	// storage fall back to StalenessDelta.
+	SeriesStalenessFactor float64
+	// MaxSeriesStalenessDelta bounds the per-series staleness delta.
+	MaxSeriesStalenessDelta = 1 * time.Hour
+)
+
+// seriesStalenessDelta returns the staleness delta of a series whose samples
+// have been ingested at the given interval. An interval of 0 means that it is
+// not known.
+func seriesStalenessDelta(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return StalenessDelta
+	}
+	delta := time.Duration(float64(interval) * SeriesStalenessFactor)
+	if delta > MaxSeriesStalenessDelta {
+		delta = MaxSeriesStalenessDelta
+	}
+	return delta
+}
 
 // chooseClosestBefore chooses the closest sample of a list of samples
-// before or at a given target time.
-func chooseClosestBefore(samples []model.SamplePair, timestamp model.Time) *model.SamplePair {
+// before or at a given target time that is at most stalenessDelta older than
+// the target time.
+func chooseClosestBefore(samples []model.SamplePair, timestamp model.Time, stalenessDelta time.Duration) *model.SamplePair {
 	for _, candidate := range samples {
 		delta := candidate.Timestamp.Sub(timestamp)
 		// Samples before or at target time.
 		if delta <= 0 {
 			// Ignore samples outside of staleness policy window.
-			if -delta > StalenessDelta {
+			if -delta > stalenessDelta {
 				continue
 			}
 			return &candidate
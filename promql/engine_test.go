@@ -1,11 +1,15 @@
 package promql
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 	"time"
 
+	"github.com/prometheus/common/model"
 	"golang.org/x/net/context"
+
+	"github.com/prometheus/prometheus/storage/metric"
 )
 
 var noop = testStmt(func(context.Context) error {
@@ -62,6 +66,40 @@ func TestQueryConcurrency(t *testing.T) {
 	}
 }
 
+func TestQueryConcurrencyUnlimited(t *testing.T) {
+	engine := NewEngine(nil, &EngineOptions{
+		Timeout:              time.Minute,
+		MaxConcurrentQueries: 0,
+	})
+	defer engine.Stop()
+
+	block := make(chan struct{})
+	processing := make(chan struct{})
+
+	f := func(context.Context) error {
+		processing <- struct{}{}
+		<-block
+		return nil
+	}
+
+	const n = 50
+	for i := 0; i < n; i++ {
+		q := engine.newTestQuery(f)
+		go q.Exec()
+		select {
+		case <-processing:
+			// Expected.
+		case <-time.After(20 * time.Millisecond):
+			t.Fatalf("Query %d not being executed without concurrency limit", i)
+		}
+	}
+
+	// Terminate all queries.
+	for i := 0; i < n; i++ {
+		block <- struct{}{}
+	}
+}
+
 func TestQueryTimeout(t *testing.T) {
 	engine := NewEngine(nil, &EngineOptions{
 		Timeout:              5 * time.Millisecond,
@@ -116,15 +154,16 @@ func TestQueryCancel(t *testing.T) {
 		t.Fatalf("expected error %q, got %q", ee, res.Err)
 	}
 
-	// Canceling a query before starting it must have no effect.
+	// Canceling a query before starting it must cancel it once it starts.
 	query2 := engine.newTestQuery(func(ctx context.Context) error {
-		return contextDone(ctx, "test statement execution")
+		t.Fatalf("canceled query2 must not be executed")
+		return nil
 	})
 
 	query2.Cancel()
 	res = query2.Exec()
-	if res.Err != nil {
-		t.Fatalf("unexpeceted error on executing query2: %s", res.Err)
+	if _, ok := res.Err.(ErrQueryCanceled); !ok {
+		t.Fatalf("expected cancellation error for query2 but got %v", res.Err)
 	}
 }
 
@@ -210,3 +249,236 @@ func TestRecoverEvaluatorError(t *testing.T) {
 
 	panic(e)
 }
+
+func TestSeriesStaleness(t *testing.T) {
+	const load = `
+load 1m
+	fast 0+1x10
+
+load 10m
+	slow 0+1x3
+`
+	tests := []struct {
+		factor float64
+		evals  string
+	}{
+		{
+			// The global staleness delta applies to all series.
+			factor: 0,
+			evals: `
+eval instant at 13m fast
+	fast 10
+
+eval instant at 37m slow
+
+eval instant at 33m slow
+	slow 3
+`,
+		},
+		{
+			// The staleness delta is derived from the interval of each series.
+			factor: 2,
+			evals: `
+eval instant at 11m fast
+	fast 10
+
+eval instant at 13m fast
+
+eval instant at 37m slow
+	slow 3
+
+eval instant at 51m slow
+`,
+		},
+	}
+
+	defer func(factor float64) { SeriesStalenessFactor = factor }(SeriesStalenessFactor)
+
+	for i, test := range tests {
+		SeriesStalenessFactor = test.factor
+
+		suite, err := NewTest(t, load+test.evals)
+		if err != nil {
+			t.Fatalf("%d. error creating test: %s", i, err)
+		}
+		if err := suite.Run(); err != nil {
+			t.Errorf("%d. error running test: %s", i, err)
+		}
+		suite.Close()
+	}
+}
+
+func TestStaleMarkers(t *testing.T) {
+	suite, err := NewTest(t, `
+load 1m
+	metric 0+1x5
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+	if err := suite.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The series disappears from its target after the last sample.
+	suite.Storage().Append(&model.Sample{
+		Metric:    model.Metric{model.MetricNameLabel: "metric"},
+		Value:     metric.StaleNaN,
+		Timestamp: testStartTime.Add(5*time.Minute + 30*time.Second),
+	})
+	suite.Storage().WaitForIndexing()
+
+	tests := []struct {
+		expr  string
+		ts    time.Duration
+		value model.SampleValue
+		empty bool
+	}{
+		{expr: "metric", ts: 5 * time.Minute, value: 5},
+		// The marker ends the series before the staleness delta passed.
+		{expr: "metric", ts: 6 * time.Minute, empty: true},
+		// Markers are not part of range vectors.
+		{expr: "count_over_time(metric[10m])", ts: 6 * time.Minute, value: 6},
+		{expr: "max_over_time(metric[10m])", ts: 6 * time.Minute, value: 5},
+	}
+
+	for _, test := range tests {
+		q, err := suite.QueryEngine().NewInstantQuery(test.expr, testStartTime.Add(test.ts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vec, err := q.Exec().Vector()
+		if err != nil {
+			t.Fatalf("%s at %s: %s", test.expr, test.ts, err)
+		}
+		if test.empty {
+			if len(vec) != 0 {
+				t.Errorf("%s at %s: expected empty result, got %v", test.expr, test.ts, vec)
+			}
+			continue
+		}
+		if len(vec) != 1 || vec[0].Value != test.value {
+			t.Errorf("%s at %s: expected value %v, got %v", test.expr, test.ts, test.value, vec)
+		}
+	}
+}
+
+// testReader is a storage.Reader returning the series of a matrix that match
+// the label matchers, or an error.
+type testReader struct {
+	matrix model.Matrix
+	err    error
+}
+
+func (r testReader) Read(from, through model.Time, matchers metric.LabelMatchers) (model.Matrix, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	var res model.Matrix
+	for _, ss := range r.matrix {
+		matches := true
+		for _, m := range matchers {
+			matches = matches && m.Match(ss.Metric[m.Name])
+		}
+		if !matches {
+			continue
+		}
+		var values []model.SamplePair
+		for _, sp := range ss.Values {
+			if !sp.Timestamp.Before(from) && !sp.Timestamp.After(through) {
+				values = append(values, sp)
+			}
+		}
+		res = append(res, &model.SampleStream{Metric: ss.Metric, Values: values})
+	}
+	return res, nil
+}
+
+func TestRemoteRead(t *testing.T) {
+	suite, err := NewTest(t, `
+load 1m
+	metric 0+1x5
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+	if err := suite.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := testReader{matrix: model.Matrix{
+		{
+			Metric: model.Metric{model.MetricNameLabel: "metric"},
+			Values: []model.SamplePair{
+				{Timestamp: testStartTime.Add(-2 * time.Minute), Value: 10},
+				{Timestamp: testStartTime.Add(-time.Minute), Value: 11},
+				// Local samples take precedence.
+				{Timestamp: testStartTime, Value: 100},
+				{Timestamp: testStartTime.Add(time.Minute), Value: 101},
+			},
+		},
+		{
+			Metric: model.Metric{model.MetricNameLabel: "metric", "source": "remote"},
+			Values: []model.SamplePair{
+				{Timestamp: testStartTime.Add(time.Minute), Value: 7},
+			},
+		},
+	}}
+	engine := NewEngine(suite.Storage(), &EngineOptions{
+		MaxConcurrentQueries: 20,
+		Timeout:              time.Minute,
+		RemoteReader:         reader,
+	})
+	defer engine.Stop()
+
+	tests := []struct {
+		expr  string
+		ts    time.Duration
+		value model.SampleValue
+	}{
+		{expr: `metric{source=""}`, ts: -time.Minute, value: 11},
+		{expr: `metric{source=""}`, ts: time.Minute, value: 1},
+		{expr: `sum_over_time(metric{source=""}[3m])`, ts: time.Minute, value: 10 + 11 + 0 + 1},
+		{expr: `metric{source="remote"}`, ts: time.Minute, value: 7},
+		{expr: `count(metric)`, ts: time.Minute, value: 2},
+	}
+
+	for _, test := range tests {
+		q, err := engine.NewInstantQuery(test.expr, testStartTime.Add(test.ts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vec, err := q.Exec().Vector()
+		if err != nil {
+			t.Fatalf("%s at %s: %s", test.expr, test.ts, err)
+		}
+		if len(vec) != 1 || vec[0].Value != test.value {
+			t.Errorf("%s at %s: expected value %v, got %v", test.expr, test.ts, test.value, vec)
+		}
+	}
+
+	// Failing to read from the remote storage results in a warning.
+	engine = NewEngine(suite.Storage(), &EngineOptions{
+		MaxConcurrentQueries: 20,
+		Timeout:              time.Minute,
+		RemoteReader:         testReader{err: errors.New("remote storage unavailable")},
+	})
+	defer engine.Stop()
+	q, err := engine.NewInstantQuery("metric", testStartTime.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := q.Exec()
+	vec, err := res.Vector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vec) != 1 || vec[0].Value != 1 {
+		t.Errorf("Expected local value 1, got %v", vec)
+	}
+	if len(res.Warnings) != 1 {
+		t.Errorf("Expected 1 warning, got %v", res.Warnings)
+	}
+}
@@ -44,6 +44,24 @@ func funcTime(ev *evaluator, args Expressions) model.Value {
 	}
 }
 
+// === timestamp(vector model.ValVector) Vector ===
+func funcTimestamp(ev *evaluator, args Expressions) model.Value {
+	// Only samples selected directly from storage have timestamps of their
+	// own. The results of any other expression have the evaluation time.
+	var vec vector
+	if vs, ok := args[0].(*VectorSelector); ok {
+		vec = ev.selectVector(vs, true)
+	} else {
+		vec = ev.evalVector(args[0])
+	}
+	for _, el := range vec {
+		el.Metric.Del(model.MetricNameLabel)
+		el.Value = model.SampleValue(float64(el.Timestamp) / 1000)
+		el.Timestamp = ev.Timestamp
+	}
+	return vec
+}
+
 // === delta(matrix model.ValMatrix) Vector ===
 func funcDelta(ev *evaluator, args Expressions) model.Value {
 	// This function still takes a 2nd argument for use by rate() and increase().
@@ -424,12 +442,35 @@ func funcAbsent(ev *evaluator, args Expressions) model.Value {
 	if len(ev.evalVector(args[0])) > 0 {
 		return vector{}
 	}
-	m := model.Metric{}
+	var matchers metric.LabelMatchers
 	if vs, ok := args[0].(*VectorSelector); ok {
-		for _, matcher := range vs.LabelMatchers {
-			if matcher.Type == metric.Equal && matcher.Name != model.MetricNameLabel {
-				m[matcher.Name] = matcher.Value
-			}
+		matchers = vs.LabelMatchers
+	}
+	return absentVector(ev, matchers)
+}
+
+// === absent_over_time(matrix model.ValMatrix) Vector ===
+func funcAbsentOverTime(ev *evaluator, args Expressions) model.Value {
+	for _, el := range ev.evalMatrix(args[0]) {
+		if len(el.Values) > 0 {
+			return vector{}
+		}
+	}
+	var matchers metric.LabelMatchers
+	if ms, ok := args[0].(*MatrixSelector); ok {
+		matchers = ms.LabelMatchers
+	}
+	return absentVector(ev, matchers)
+}
+
+// absentVector returns a single-element vector with value 1. Its labels are
+// derived from the equality matchers in the given matchers, except for the
+// metric name.
+func absentVector(ev *evaluator, matchers metric.LabelMatchers) vector {
+	m := model.Metric{}
+	for _, matcher := range matchers {
+		if matcher.Type == metric.Equal && matcher.Name != model.MetricNameLabel {
+			m[matcher.Name] = matcher.Value
 		}
 	}
 	return vector{
@@ -743,6 +784,12 @@ var functions = map[string]*Function{
 		ReturnType: model.ValVector,
 		Call:       funcAbsent,
 	},
+	"absent_over_time": {
+		Name:       "absent_over_time",
+		ArgTypes:   []model.ValueType{model.ValMatrix},
+		ReturnType: model.ValVector,
+		Call:       funcAbsentOverTime,
+	},
 	"increase": {
 		Name:       "increase",
 		ArgTypes:   []model.ValueType{model.ValMatrix},
@@ -936,6 +983,12 @@ var functions = map[string]*Function{
 		ReturnType: model.ValScalar,
 		Call:       funcTime,
 	},
+	"timestamp": {
+		Name:       "timestamp",
+		ArgTypes:   []model.ValueType{model.ValVector},
+		ReturnType: model.ValVector,
+		Call:       funcTimestamp,
+	},
 	"topk": {
 		Name:       "topk",
 		ArgTypes:   []model.ValueType{model.ValScalar, model.ValVector},
@@ -956,6 +1009,23 @@ func getFunction(name string) (*Function, bool) {
 	return function, ok
 }
 
+// Functions returns all functions supported by the query language, sorted by
+// name. The returned functions must not be modified.
+func Functions() []*Function {
+	fs := make([]*Function, 0, len(functions))
+	for _, f := range functions {
+		fs = append(fs, f)
+	}
+	sort.Sort(functionsByName(fs))
+	return fs
+}
+
+type functionsByName []*Function
+
+func (s functionsByName) Len() int           { return len(s) }
+func (s functionsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s functionsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
 type vectorByValueHeap vector
 
 func (s vectorByValueHeap) Len() int {
@@ -0,0 +1,65 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestFunctions(t *testing.T) {
+	fs := Functions()
+	if len(fs) != len(functions) {
+		t.Fatalf("expected %d functions, got %d", len(functions), len(fs))
+	}
+	if !sort.IsSorted(functionsByName(fs)) {
+		t.Errorf("functions are not sorted by name")
+	}
+
+	byName := map[string]*Function{}
+	for _, f := range fs {
+		byName[f.Name] = f
+	}
+
+	expected := []struct {
+		name         string
+		argTypes     []model.ValueType
+		optionalArgs int
+		returnType   model.ValueType
+	}{
+		{"rate", []model.ValueType{model.ValMatrix}, 0, model.ValVector},
+		{"sum_over_time", []model.ValueType{model.ValMatrix}, 0, model.ValVector},
+		{"round", []model.ValueType{model.ValVector, model.ValScalar}, 1, model.ValVector},
+		{"time", []model.ValueType{}, 0, model.ValScalar},
+	}
+	for _, e := range expected {
+		f, ok := byName[e.name]
+		if !ok {
+			t.Errorf("function %q not listed", e.name)
+			continue
+		}
+		if !reflect.DeepEqual(f.ArgTypes, e.argTypes) {
+			t.Errorf("function %q: expected argument types %v, got %v", e.name, e.argTypes, f.ArgTypes)
+		}
+		if f.OptionalArgs != e.optionalArgs {
+			t.Errorf("function %q: expected %d optional arguments, got %d", e.name, e.optionalArgs, f.OptionalArgs)
+		}
+		if f.ReturnType != e.returnType {
+			t.Errorf("function %q: expected return type %v, got %v", e.name, e.returnType, f.ReturnType)
+		}
+	}
+}
@@ -56,6 +56,10 @@ func (i itemType) isOperator() bool { return i > operatorsStart && i < operators
 // Returns false otherwise
 func (i itemType) isAggregator() bool { return i > aggregatorsStart && i < aggregatorsEnd }
 
+// isAggregatorWithParam returns true if the item is an aggregator that takes a
+// parameter. Returns false otherwise.
+func (i itemType) isAggregatorWithParam() bool { return i == itemQuantile }
+
 // isKeyword returns true if the item corresponds to a keyword.
 // Returns false otherwise.
 func (i itemType) isKeyword() bool { return i > keywordsStart && i < keywordsEnd }
@@ -146,6 +150,7 @@ const (
 	itemMax
 	itemStddev
 	itemStdvar
+	itemQuantile
 	aggregatorsEnd
 
 	keywordsStart
@@ -173,13 +178,14 @@ var key = map[string]itemType{
 	"or":  itemLOR,
 
 	// Aggregators.
-	"sum":    itemSum,
-	"avg":    itemAvg,
-	"count":  itemCount,
-	"min":    itemMin,
-	"max":    itemMax,
-	"stddev": itemStddev,
-	"stdvar": itemStdvar,
+	"sum":      itemSum,
+	"avg":      itemAvg,
+	"count":    itemCount,
+	"min":      itemMin,
+	"max":      itemMax,
+	"stddev":   itemStddev,
+	"stdvar":   itemStdvar,
+	"quantile": itemQuantile,
 
 	// Keywords.
 	"alert":         itemAlert,
@@ -220,6 +220,9 @@ var tests = []struct {
 	}, {
 		input:    `stddev`,
 		expected: []item{{itemStddev, 0, `stddev`}},
+	}, {
+		input:    `quantile`,
+		expected: []item{{itemQuantile, 0, `quantile`}},
 	},
 	// Test keywords.
 	{
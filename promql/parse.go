@@ -696,7 +696,11 @@ func (p *parser) labels() model.LabelNames {
 
 	labels := model.LabelNames{}
 	for {
-		id := p.expect(itemIdentifier, ctx)
+		id := p.next()
+		// Aggregators like "quantile" are valid label names, too.
+		if id.typ != itemIdentifier && !id.typ.isAggregator() {
+			p.errorf("unexpected %s in %s, expected %s", id.desc(), ctx, itemIdentifier.desc())
+		}
 		labels = append(labels, model.LabelName(id.val))
 
 		if p.peek().typ != itemComma {
@@ -711,8 +715,8 @@ func (p *parser) labels() model.LabelNames {
 
 // aggrExpr parses an aggregation expression.
 //
-//		<aggr_op> (<vector_expr>) [by <labels>] [keep_common]
-//		<aggr_op> [by <labels>] [keep_common] (<vector_expr>)
+//		<aggr_op> ([<param>,] <vector_expr>) [by <labels>] [keep_common]
+//		<aggr_op> [by <labels>] [keep_common] ([<param>,] <vector_expr>)
 //
 func (p *parser) aggrExpr() *AggregateExpr {
 	const ctx = "aggregation"
@@ -738,6 +742,11 @@ func (p *parser) aggrExpr() *AggregateExpr {
 	}
 
 	p.expect(itemLeftParen, ctx)
+	var param Expr
+	if agop.typ.isAggregatorWithParam() {
+		param = p.expr()
+		p.expect(itemComma, ctx)
+	}
 	e := p.expr()
 	p.expect(itemRightParen, ctx)
 
@@ -758,6 +767,7 @@ func (p *parser) aggrExpr() *AggregateExpr {
 	return &AggregateExpr{
 		Op:              agop.typ,
 		Expr:            e,
+		Param:           param,
 		Grouping:        grouping,
 		KeepExtraLabels: keepExtra,
 	}
@@ -1042,6 +1052,9 @@ func (p *parser) checkType(node Node) (typ model.ValueType) {
 			p.errorf("aggregation operator expected in aggregation expression but got %q", n.Op)
 		}
 		p.expectType(n.Expr, model.ValVector, "aggregation expression")
+		if n.Op.isAggregatorWithParam() {
+			p.expectType(n.Param, model.ValScalar, "aggregation parameter")
+		}
 
 	case *BinaryExpr:
 		lt := p.checkType(n.LHS)
@@ -884,6 +884,39 @@ var testExpr = []struct {
 			},
 			Grouping: model.LabelNames{"foo"},
 		},
+	}, {
+		input: "quantile by (foo) (0.9, some_metric)",
+		expected: &AggregateExpr{
+			Op:    itemQuantile,
+			Param: &NumberLiteral{0.9},
+			Expr: &VectorSelector{
+				Name: "some_metric",
+				LabelMatchers: metric.LabelMatchers{
+					{Type: metric.Equal, Name: model.MetricNameLabel, Value: "some_metric"},
+				},
+			},
+			Grouping: model.LabelNames{"foo"},
+		},
+	}, {
+		input: "sum by (quantile) (some_metric)",
+		expected: &AggregateExpr{
+			Op: itemSum,
+			Expr: &VectorSelector{
+				Name: "some_metric",
+				LabelMatchers: metric.LabelMatchers{
+					{Type: metric.Equal, Name: model.MetricNameLabel, Value: "some_metric"},
+				},
+			},
+			Grouping: model.LabelNames{"quantile"},
+		},
+	}, {
+		input:  `quantile(some_metric)`,
+		fail:   true,
+		errMsg: "unexpected \")\" in aggregation, expected \",\"",
+	}, {
+		input:  `quantile(some_metric, some_metric)`,
+		fail:   true,
+		errMsg: "expected type scalar in aggregation parameter, got vector",
 	}, {
 		input:  `sum some_metric by (test)`,
 		fail:   true,
@@ -65,6 +65,9 @@ func tree(node Node, level string) string {
 			t += tree(e, level)
 		}
 	case *AggregateExpr:
+		if n.Param != nil {
+			t += tree(n.Param, level)
+		}
 		t += tree(n.Expr, level)
 
 	case *BinaryExpr:
@@ -135,7 +138,11 @@ func (es Expressions) String() (s string) {
 }
 
 func (node *AggregateExpr) String() string {
-	aggrString := fmt.Sprintf("%s(%s)", node.Op, node.Expr)
+	aggrString := fmt.Sprintf("%s(", node.Op)
+	if node.Param != nil {
+		aggrString += fmt.Sprintf("%s, ", node.Param)
+	}
+	aggrString += fmt.Sprintf("%s)", node.Expr)
 	if len(node.Grouping) > 0 {
 		format := "%s BY (%s)"
 		if node.KeepExtraLabels {
@@ -106,3 +106,19 @@ func quantile(q model.SampleValue, buckets buckets) float64 {
 	}
 	return bucketStart + (bucketEnd-bucketStart)*float64(rank/count)
 }
+
+// valueQuantile calculates the q-quantile of the given values, interpolating
+// linearly between the two closest ranks. values is sorted in place. If q is
+// not within [0, 1] or no values are given, NaN is returned.
+func valueQuantile(q float64, values []float64) float64 {
+	if len(values) == 0 || q < 0 || q > 1 {
+		return math.NaN()
+	}
+	sort.Float64s(values)
+
+	rank := q * float64(len(values)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	weight := rank - float64(lower)
+	return values[lower]*(1-weight) + values[upper]*weight
+}
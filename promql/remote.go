@@ -0,0 +1,166 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"sort"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// readRemote reads the series matching the label matchers between from and
+// through from the remote storage, if any, and adds the ones not in the local
+// storage to metrics. Failing to read is not fatal, the query is answered
+// from the local storage only then.
+func (a *Analyzer) readRemote(ctx context.Context, matchers metric.LabelMatchers, metrics map[model.Fingerprint]metric.Metric, from, through model.Time) {
+	if a.RemoteReader == nil {
+		return
+	}
+	if err := contextDone(ctx, "query analysis"); err != nil {
+		a.warnings = append(a.warnings, err)
+		return
+	}
+	matrix, err := a.RemoteReader.Read(from, through, matchers)
+	if err != nil {
+		a.warnings = append(a.warnings, err)
+		return
+	}
+	if from.Before(a.remoteFrom) {
+		a.remoteFrom = from
+	}
+
+	// The local storage maps the fingerprints of colliding metrics, so
+	// the local series are looked up by metric.
+	byMetric := make(map[model.Fingerprint]model.Fingerprint, len(metrics))
+	for fp, m := range metrics {
+		byMetric[m.Metric.Fingerprint()] = fp
+	}
+	for _, ss := range matrix {
+		if len(ss.Values) == 0 {
+			continue
+		}
+		key := ss.Metric.Fingerprint()
+		if fp, ok := byMetric[key]; !ok || !metrics[fp].Metric.Equal(ss.Metric) {
+			fp = ss.Metric.FastFingerprint()
+			for _, taken := metrics[fp]; taken; _, taken = metrics[fp] {
+				fp++
+			}
+			metrics[fp] = metric.Metric{Metric: ss.Metric}
+		}
+		a.remoteSamples[key] = mergeSamples(a.remoteSamples[key], ss.Values)
+	}
+}
+
+// newIterator returns an iterator over the samples of the series with the
+// given fingerprint and metric. Samples read from the remote storage are only
+// used before the oldest sample in the local storage within the query range,
+// which takes precedence over the remote storage.
+func (a *Analyzer) newIterator(fp model.Fingerprint, m metric.Metric) local.SeriesIterator {
+	remote, ok := a.remoteSamples[m.Metric.Fingerprint()]
+	if !ok {
+		return a.Storage.NewIterator(fp)
+	}
+	if !a.Storage.MetricForFingerprint(fp).Metric.Equal(m.Metric) {
+		// Only in the remote storage.
+		return sampleSliceIterator(remote)
+	}
+
+	it := a.Storage.NewIterator(fp)
+	localSamples := it.RangeValues(metric.Interval{
+		OldestInclusive: a.remoteFrom,
+		NewestInclusive: a.End,
+	})
+	n := len(remote)
+	if len(localSamples) > 0 {
+		n = sort.Search(len(remote), func(i int) bool {
+			return !remote[i].Timestamp.Before(localSamples[0].Timestamp)
+		})
+	}
+	if n == 0 {
+		return it
+	}
+	return sampleSliceIterator(append(remote[:n:n], localSamples...))
+}
+
+// mergeSamples merges two lists of sample pairs sorted by timestamp into one.
+// Of samples with the same timestamp, the one of a is kept.
+func mergeSamples(a, b []model.SamplePair) []model.SamplePair {
+	res := make([]model.SamplePair, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0].Timestamp.Before(b[0].Timestamp):
+			res = append(res, a[0])
+			a = a[1:]
+		case b[0].Timestamp.Before(a[0].Timestamp):
+			res = append(res, b[0])
+			b = b[1:]
+		default:
+			res = append(res, a[0])
+			a, b = a[1:], b[1:]
+		}
+	}
+	res = append(res, a...)
+	return append(res, b...)
+}
+
+// sampleSliceIterator implements local.SeriesIterator over sample pairs
+// sorted by timestamp.
+type sampleSliceIterator []model.SamplePair
+
+// ValueAtTime implements local.SeriesIterator.
+func (it sampleSliceIterator) ValueAtTime(t model.Time) []model.SamplePair {
+	if len(it) == 0 {
+		return nil
+	}
+	i := sort.Search(len(it), func(i int) bool {
+		return !it[i].Timestamp.Before(t)
+	})
+	switch {
+	case i == len(it):
+		return []model.SamplePair{it[i-1]}
+	case i == 0 || it[i].Timestamp.Equal(t):
+		return []model.SamplePair{it[i]}
+	}
+	return []model.SamplePair{it[i-1], it[i]}
+}
+
+// BoundaryValues implements local.SeriesIterator.
+func (it sampleSliceIterator) BoundaryValues(in metric.Interval) []model.SamplePair {
+	values := it.RangeValues(in)
+	if len(values) <= 1 {
+		return values
+	}
+	return []model.SamplePair{values[0], values[len(values)-1]}
+}
+
+// RangeValues implements local.SeriesIterator.
+func (it sampleSliceIterator) RangeValues(in metric.Interval) []model.SamplePair {
+	i := sort.Search(len(it), func(i int) bool {
+		return !it[i].Timestamp.Before(in.OldestInclusive)
+	})
+	j := sort.Search(len(it), func(j int) bool {
+		return it[j].Timestamp.After(in.NewestInclusive)
+	})
+	if i >= j {
+		return []model.SamplePair{}
+	}
+	// The caller may modify the returned sample pairs.
+	values := make([]model.SamplePair, j-i)
+	copy(values, it[i:j])
+	return values
+}
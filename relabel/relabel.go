@@ -11,7 +11,8 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package retrieval
+// Package relabel applies relabeling configurations to label sets.
+package relabel
 
 import (
 	"crypto/md5"
@@ -23,10 +24,10 @@ import (
 	"github.com/prometheus/prometheus/config"
 )
 
-// Relabel returns a relabeled copy of the given label set. The relabel configurations
+// Process returns a relabeled copy of the given label set. The relabel configurations
 // are applied in order of input.
 // If a label set is dropped, nil is returned.
-func Relabel(labels model.LabelSet, cfgs ...*config.RelabelConfig) (model.LabelSet, error) {
+func Process(labels model.LabelSet, cfgs ...*config.RelabelConfig) (model.LabelSet, error) {
 	out := model.LabelSet{}
 	for ln, lv := range labels {
 		out[ln] = lv
@@ -87,8 +88,20 @@ func relabel(labels model.LabelSet, cfg *config.RelabelConfig) (model.LabelSet,
 			}
 		}
 		labels = out
+	case config.RelabelLabelDrop:
+		for ln := range labels {
+			if cfg.Regex.MatchString(string(ln)) {
+				delete(labels, ln)
+			}
+		}
+	case config.RelabelLabelKeep:
+		for ln := range labels {
+			if !cfg.Regex.MatchString(string(ln)) {
+				delete(labels, ln)
+			}
+		}
 	default:
-		panic(fmt.Errorf("retrieval.relabel: unknown relabel action type %q", cfg.Action))
+		panic(fmt.Errorf("relabel: unknown relabel action type %q", cfg.Action))
 	}
 	return labels, nil
 }
@@ -11,7 +11,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package retrieval
+package relabel
 
 import (
 	"reflect"
@@ -263,10 +263,43 @@ func TestRelabel(t *testing.T) {
 				"my_baz":        "bbb",
 			},
 		},
+		{
+			input: model.LabelSet{
+				"a":  "foo",
+				"b1": "bar",
+				"b2": "baz",
+			},
+			relabel: []*config.RelabelConfig{
+				{
+					Regex:  config.MustNewRegexp("b.*"),
+					Action: config.RelabelLabelDrop,
+				},
+			},
+			output: model.LabelSet{
+				"a": "foo",
+			},
+		},
+		{
+			input: model.LabelSet{
+				"a":  "foo",
+				"b1": "bar",
+				"b2": "baz",
+			},
+			relabel: []*config.RelabelConfig{
+				{
+					Regex:  config.MustNewRegexp("b.*"),
+					Action: config.RelabelLabelKeep,
+				},
+			},
+			output: model.LabelSet{
+				"b1": "bar",
+				"b2": "baz",
+			},
+		},
 	}
 
 	for i, test := range tests {
-		res, err := Relabel(test.input, test.relabel...)
+		res, err := Process(test.input, test.relabel...)
 		if err != nil {
 			t.Errorf("Test %d: error relabeling: %s", i+1, err)
 		}
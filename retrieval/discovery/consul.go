@@ -26,6 +26,7 @@ import (
 	"github.com/prometheus/common/model"
 
 	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/util/httputil"
 )
 
 const (
@@ -58,6 +59,7 @@ type ConsulDiscovery struct {
 	clientDatacenter string
 	tagSeparator     string
 	scrapedServices  map[string]struct{}
+	passingOnly      bool
 
 	mu       sync.RWMutex
 	services map[string]*consulService
@@ -84,6 +86,7 @@ func NewConsulDiscovery(conf *config.ConsulSDConfig) *ConsulDiscovery {
 			Username: conf.Username,
 			Password: conf.Password,
 		},
+		HttpClient: httputil.NewClient(httputil.NewTransport()),
 	}
 	client, err := consul.NewClient(clientConf)
 	if err != nil {
@@ -95,6 +98,7 @@ func NewConsulDiscovery(conf *config.ConsulSDConfig) *ConsulDiscovery {
 		clientConf:      clientConf,
 		tagSeparator:    conf.TagSeparator,
 		scrapedServices: map[string]struct{}{},
+		passingOnly:     conf.PassingOnly,
 		services:        map[string]*consulService{},
 	}
 	// If the datacenter isn't set in the clientConf, let's get it from the local Consul agent
@@ -117,7 +121,10 @@ func NewConsulDiscovery(conf *config.ConsulSDConfig) *ConsulDiscovery {
 // Sources implements the TargetProvider interface.
 func (cd *ConsulDiscovery) Sources() []string {
 	clientConf := *cd.clientConf
-	clientConf.HttpClient = &http.Client{Timeout: 5 * time.Second}
+	clientConf.HttpClient = &http.Client{
+		Transport: cd.clientConf.HttpClient.Transport,
+		Timeout:   5 * time.Second,
+	}
 
 	client, err := consul.NewClient(&clientConf)
 	if err != nil {
@@ -246,9 +253,8 @@ func (cd *ConsulDiscovery) watchServices(update chan<- *consulService, done <-ch
 // watchService retrieves updates about srv from Consul's service endpoint.
 // On a potential update the resulting target group is sent to ch.
 func (cd *ConsulDiscovery) watchService(srv *consulService, ch chan<- config.TargetGroup) {
-	catalog := cd.client.Catalog()
 	for {
-		nodes, meta, err := catalog.Service(srv.name, "", &consul.QueryOptions{
+		nodes, meta, err := cd.serviceNodes(srv.name, &consul.QueryOptions{
 			WaitIndex: srv.lastIndex,
 			WaitTime:  consulWatchTimeout,
 		})
@@ -293,3 +299,28 @@ func (cd *ConsulDiscovery) watchService(srv *consulService, ch chan<- config.Tar
 		cd.mu.Unlock()
 	}
 }
+
+// serviceNodes returns the instances of the named service. If passingOnly is
+// set, only the instances passing all their health checks are returned.
+func (cd *ConsulDiscovery) serviceNodes(name string, q *consul.QueryOptions) ([]*consul.CatalogService, *consul.QueryMeta, error) {
+	if !cd.passingOnly {
+		return cd.client.Catalog().Service(name, "", q)
+	}
+	entries, meta, err := cd.client.Health().Service(name, "", true, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	nodes := make([]*consul.CatalogService, 0, len(entries))
+	for _, e := range entries {
+		nodes = append(nodes, &consul.CatalogService{
+			Node:           e.Node.Node,
+			Address:        e.Node.Address,
+			ServiceID:      e.Service.ID,
+			ServiceName:    e.Service.Service,
+			ServiceAddress: e.Service.Address,
+			ServiceTags:    e.Service.Tags,
+			ServicePort:    e.Service.Port,
+		})
+	}
+	return nodes, meta, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+func TestConsulServiceNodesPassingOnly(t *testing.T) {
+	var requests []*url.URL
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL)
+		w.Header().Set("X-Consul-Index", "42")
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/catalog/service/web":
+			w.Write([]byte(`[
+				{"Node": "node1", "Address": "10.0.0.1", "ServiceID": "web1", "ServiceName": "web", "ServiceTags": ["a"], "ServicePort": 80},
+				{"Node": "node2", "Address": "10.0.0.2", "ServiceID": "web2", "ServiceName": "web", "ServiceTags": ["b"], "ServicePort": 80}
+			]`))
+		case "/v1/health/service/web":
+			w.Write([]byte(`[
+				{
+					"Node": {"Node": "node1", "Address": "10.0.0.1"},
+					"Service": {"ID": "web1", "Service": "web", "Tags": ["a"], "Port": 80},
+					"Checks": []
+				}
+			]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client, err := consul.NewClient(&consul.Config{Address: server.Listener.Addr().String(), Scheme: "http"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cd := &ConsulDiscovery{client: client}
+	nodes, meta, err := cd.serviceNodes("web", &consul.QueryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 {
+		t.Errorf("expected all 2 instances from the catalog, got %d", len(nodes))
+	}
+	if meta.LastIndex != 42 {
+		t.Errorf("expected last index 42, got %d", meta.LastIndex)
+	}
+
+	cd.passingOnly = true
+	nodes, meta, err = cd.serviceNodes("web", &consul.QueryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*consul.CatalogService{{
+		Node:        "node1",
+		Address:     "10.0.0.1",
+		ServiceID:   "web1",
+		ServiceName: "web",
+		ServiceTags: []string{"a"},
+		ServicePort: 80,
+	}}
+	if !reflect.DeepEqual(nodes, expected) {
+		t.Errorf("expected passing instances %v, got %v", expected, nodes)
+	}
+	if meta.LastIndex != 42 {
+		t.Errorf("expected last index 42, got %d", meta.LastIndex)
+	}
+	if last := requests[len(requests)-1]; last.Query().Get("passing") != "1" {
+		t.Errorf("expected health query for passing instances only, got %s", last)
+	}
+}
@@ -223,6 +223,11 @@ func lookup(name string, queryType uint16, client *dns.Client, servAddr string,
 	if msg.Id != response.Id {
 		return nil, fmt.Errorf("DNS ID mismatch, request: %d, response: %d", msg.Id, response.Id)
 	}
+	// A name that doesn't exist has no records, but any other error must not
+	// be mistaken for an empty answer, which would drop all targets.
+	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("DNS server returned %s for %s", dns.RcodeToString[response.Rcode], lname)
+	}
 
 	if response.MsgHdr.Truncated {
 		if client.Net == "tcp" {
@@ -0,0 +1,88 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startDNSServer starts a DNS server answering all queries with the given
+// response code and SRV records. It returns the server's address.
+func startDNSServer(t *testing.T, rcode int, srvs ...*dns.SRV) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			m := &dns.Msg{}
+			m.SetRcode(req, rcode)
+			for _, srv := range srvs {
+				m.Answer = append(m.Answer, srv)
+			}
+			w.WriteMsg(m)
+		}),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	<-started
+	return pc.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+func TestDNSLookupResponseCodes(t *testing.T) {
+	srv := &dns.SRV{
+		Hdr:    dns.RR_Header{Name: "_prometheus._tcp.example.org.", Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 60},
+		Target: "node1.example.org.",
+		Port:   9100,
+	}
+
+	scenarios := []struct {
+		rcode   int
+		srvs    []*dns.SRV
+		answers int
+		fail    bool
+	}{
+		{rcode: dns.RcodeSuccess, srvs: []*dns.SRV{srv}, answers: 1},
+		// A name without records legitimately has no targets.
+		{rcode: dns.RcodeNameError, answers: 0},
+		// Server failures must not be taken for an empty answer.
+		{rcode: dns.RcodeServerFailure, fail: true},
+		{rcode: dns.RcodeRefused, fail: true},
+	}
+
+	for _, s := range scenarios {
+		addr, shutdown := startDNSServer(t, s.rcode, s.srvs...)
+		resp, err := lookup("_prometheus._tcp.example.org", dns.TypeSRV, &dns.Client{}, addr, "", false)
+		shutdown()
+
+		if s.fail {
+			if err == nil {
+				t.Errorf("%s: expected lookup to fail", dns.RcodeToString[s.rcode])
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", dns.RcodeToString[s.rcode], err)
+			continue
+		}
+		if len(resp.Answer) != s.answers {
+			t.Errorf("%s: expected %d answers, got %d", dns.RcodeToString[s.rcode], s.answers, len(resp.Answer))
+		}
+	}
+}
@@ -26,6 +26,7 @@ import (
 
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/util/httputil"
 	"github.com/prometheus/prometheus/util/strutil"
 )
 
@@ -61,6 +62,7 @@ func NewEC2Discovery(conf *config.EC2SDConfig) *EC2Discovery {
 		aws: &aws.Config{
 			Region:      &conf.Region,
 			Credentials: creds,
+			HTTPClient:  httputil.NewClient(httputil.NewTransport()),
 		},
 		done:     make(chan struct{}),
 		interval: time.Duration(conf.RefreshInterval),
@@ -649,7 +649,11 @@ func newKubernetesHTTPClient(conf *config.KubernetesSDConfig) (*http.Client, err
 	}
 
 	if conf.BasicAuth != nil {
-		rt = httputil.NewBasicAuthRoundTripper(conf.BasicAuth.Username, conf.BasicAuth.Password, rt)
+		password, err := conf.BasicAuth.ReadPassword()
+		if err != nil {
+			return nil, err
+		}
+		rt = httputil.NewBasicAuthRoundTripper(conf.BasicAuth.Username, password, rt)
 	}
 
 	return &http.Client{
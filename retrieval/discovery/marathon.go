@@ -19,6 +19,7 @@ import (
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/prometheus/config"
 	"github.com/prometheus/prometheus/retrieval/discovery/marathon"
+	"github.com/prometheus/prometheus/util/httputil"
 )
 
 // MarathonDiscovery provides service discovery based on a Marathon instance.
@@ -36,7 +37,7 @@ func NewMarathonDiscovery(conf *config.MarathonSDConfig) *MarathonDiscovery {
 		servers:         conf.Servers,
 		refreshInterval: time.Duration(conf.RefreshInterval),
 		done:            make(chan struct{}),
-		client:          marathon.FetchMarathonApps,
+		client:          marathon.NewAppListClient(httputil.NewClient(httputil.NewTransport())),
 	}
 }
 
@@ -22,19 +22,23 @@ import (
 // AppListClient defines a function that can be used to get an application list from marathon.
 type AppListClient func(url string) (*AppList, error)
 
-// FetchMarathonApps requests a list of applications from a marathon server.
-func FetchMarathonApps(url string) (*AppList, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, err
-	}
+// NewAppListClient returns an AppListClient requesting the list of applications
+// from a marathon server with the given HTTP client.
+func NewAppListClient(client *http.Client) AppListClient {
+	return func(url string) (*AppList, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
 
-	return parseAppJSON(body)
+		return parseAppJSON(body)
+	}
 }
 
 func parseAppJSON(body []byte) (*AppList, error) {
@@ -14,6 +14,7 @@
 package retrieval
 
 import (
+	"errors"
 	"time"
 
 	"github.com/prometheus/common/model"
@@ -32,6 +33,17 @@ func (a slowAppender) Append(*model.Sample) {
 	time.Sleep(time.Millisecond)
 }
 
+// failingAppender is a storage.FallibleAppender failing every append.
+type failingAppender struct{}
+
+func (a failingAppender) Append(s *model.Sample) {
+	a.TryAppend(s)
+}
+
+func (a failingAppender) TryAppend(*model.Sample) error {
+	return errors.New("queue full")
+}
+
 type collectResultAppender struct {
 	result model.Samples
 }
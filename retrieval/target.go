@@ -14,11 +14,14 @@
 package retrieval
 
 import (
+	"bytes"
+	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -31,8 +34,11 @@ import (
 	"github.com/prometheus/common/model"
 
 	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/relabel"
 	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/storage/metric"
 	"github.com/prometheus/prometheus/util/httputil"
+	"github.com/prometheus/prometheus/version"
 )
 
 const (
@@ -42,13 +48,34 @@ const (
 	// Capacity of the channel to buffer samples during ingestion.
 	ingestedSamplesCap = 256
 
+	// tlsServerNameLabel is the name of the label overriding the TLS server
+	// name of the scrape configuration for a single target.
+	tlsServerNameLabel = model.ReservedLabelPrefix + "tls_server_name__"
+
 	// Constants for instrumentation.
 	namespace = "prometheus"
 	interval  = "interval"
+	reason    = "reason"
+
+	// Reasons for failed scrapes.
+	failureDNS         = "dns"
+	failureConnection  = "connection"
+	failureTimeout     = "timeout"
+	failureHTTPError   = "http_error"
+	failureParse       = "parse"
+	failureEmptyBody   = "empty_body"
+	failureSampleLimit = "sample_limit"
+	failureAppend      = "append"
 )
 
 var (
 	errIngestChannelFull = errors.New("ingestion channel full")
+	errEmptyBody         = errors.New("server returned an empty body")
+	errSampleLimit       = errors.New("sample limit exceeded")
+
+	// The User-Agent sent with scrape requests unless overridden by the
+	// scrape configuration.
+	defaultUserAgent = fmt.Sprintf("Prometheus/%s", version.Version)
 
 	targetIntervalLength = prometheus.NewSummaryVec(
 		prometheus.SummaryOpts{
@@ -59,10 +86,55 @@ var (
 		},
 		[]string{interval},
 	)
+	targetScrapesFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "target_scrapes_failed_total",
+			Help:      "Total number of failed scrapes by reason of the failure.",
+		},
+		[]string{reason},
+	)
+	targetScrapeTimeouts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "target_scrape_timeout_total",
+			Help:      "Total number of scrapes that failed as they exceeded the scrape timeout.",
+		},
+	)
+	targetScrapesExtended = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "target_scrapes_extended_total",
+			Help:      "Total number of failed scrapes for which the samples of the last successful scrape were re-emitted.",
+		},
+	)
+	targetScrapesExceededSampleLimit = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "target_scrapes_exceeded_sample_limit_total",
+			Help:      "Total number of scrapes that were discarded as they exceeded the sample limit.",
+		},
+	)
+	targetPrefixStripCollisions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "target_metric_name_prefix_strip_collisions_total",
+			Help:      "Total number of scraped samples dropped as their metric collided with another one of the same scrape after stripping the metric name prefix.",
+		},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(targetIntervalLength)
+	prometheus.MustRegister(targetScrapesFailed)
+	prometheus.MustRegister(targetScrapeTimeouts)
+	prometheus.MustRegister(targetScrapesExtended)
+	prometheus.MustRegister(targetScrapesExceededSampleLimit)
+	prometheus.MustRegister(targetPrefixStripCollisions)
+	// Initialize all reasons so failures can be alerted on from the start.
+	for _, r := range []string{failureDNS, failureConnection, failureTimeout, failureHTTPError, failureParse, failureEmptyBody, failureSampleLimit, failureAppend} {
+		targetScrapesFailed.WithLabelValues(r)
+	}
 }
 
 // TargetHealth describes the health state of a target.
@@ -88,7 +160,8 @@ func (t TargetHealth) value() model.SampleValue {
 }
 
 const (
-	// HealthUnknown is the state of a Target before it is first scraped.
+	// HealthUnknown is the state of a Target before it is first scraped
+	// or while it is failing within its initial scrape grace period.
 	HealthUnknown TargetHealth = iota
 	// HealthGood is the state of a Target that has been successfully scraped.
 	HealthGood
@@ -143,6 +216,14 @@ func (ts *TargetStatus) setLastError(err error) {
 	ts.lastError = err
 }
 
+// setLastErrorKeepHealth records the error of the last scrape without changing
+// the health state.
+func (ts *TargetStatus) setLastErrorKeepHealth(err error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.lastError = err
+}
+
 // Target refers to a singular HTTP or HTTPS endpoint.
 type Target struct {
 	// The status object for the target. It is only set once on initialization.
@@ -153,6 +234,16 @@ type Target struct {
 	scraperStopped chan struct{}
 	// Channel to buffer ingested samples.
 	ingestedSamples chan model.Vector
+	// The samples of the last successful scrape, kept if stale extension
+	// is enabled, and the number of consecutive failed scrapes since. Only
+	// accessed by the scraper.
+	lastScrapeSamples model.Samples
+	failedScrapes     int
+	// The series ingested by the last scrape and the scrape health series
+	// recorded for it. They are marked stale once they disappear. Only
+	// accessed by the scraper.
+	lastScrapeSeries map[model.Fingerprint]model.Metric
+	lastHealthSeries map[model.Fingerprint]model.Metric
 
 	// Mutex protects the members below.
 	sync.RWMutex
@@ -170,15 +261,33 @@ type Target struct {
 	deadline time.Duration
 	// The time between two scrapes.
 	scrapeInterval time.Duration
+	// When the target was created.
+	created time.Time
+	// The period after creation during which failed scrapes do not mark
+	// the target as unhealthy before its first successful scrape.
+	initialScrapeGrace time.Duration
 	// Whether the target's labels have precedence over the base labels
 	// assigned by the scraping instance.
 	honorLabels bool
 	// Metric relabel configuration.
 	metricRelabelConfigs []*config.RelabelConfig
+	// The prefix stripped from the names of scraped metrics.
+	metricNamePrefixStrip string
+	// Whether scrapes returning an empty body fail.
+	failOnEmptyBody bool
+	// The maximum number of samples a scrape may yield. Unlimited, if zero.
+	sampleLimit uint
+	// The number of consecutive failed scrapes for which the samples of the
+	// last successful scrape are re-emitted.
+	staleExtendScrapes int
+	// If not nil, the target's labels conflict with another target's and
+	// it is not scraped.
+	conflict error
 }
 
-// NewTarget creates a reasonably configured target for querying.
-func NewTarget(cfg *config.ScrapeConfig, baseLabels, metaLabels model.LabelSet) *Target {
+// NewTarget creates a reasonably configured target for querying. The target
+// is scraped with the given HTTP client.
+func NewTarget(cfg *config.ScrapeConfig, httpClient *http.Client, baseLabels, metaLabels model.LabelSet) *Target {
 	t := &Target{
 		url: &url.URL{
 			Scheme: string(baseLabels[model.SchemeLabel]),
@@ -187,8 +296,9 @@ func NewTarget(cfg *config.ScrapeConfig, baseLabels, metaLabels model.LabelSet)
 		status:          &TargetStatus{},
 		scraperStopping: make(chan struct{}),
 		scraperStopped:  make(chan struct{}),
+		created:         time.Now(),
 	}
-	t.Update(cfg, baseLabels, metaLabels)
+	t.Update(cfg, httpClient, baseLabels, metaLabels)
 	return t
 }
 
@@ -199,15 +309,10 @@ func (t *Target) Status() *TargetStatus {
 
 // Update overwrites settings in the target that are derived from the job config
 // it belongs to.
-func (t *Target) Update(cfg *config.ScrapeConfig, baseLabels, metaLabels model.LabelSet) {
+func (t *Target) Update(cfg *config.ScrapeConfig, httpClient *http.Client, baseLabels, metaLabels model.LabelSet) {
 	t.Lock()
 	defer t.Unlock()
 
-	httpClient, err := newHTTPClient(cfg)
-	if err != nil {
-		log.Errorf("cannot create HTTP client: %v", err)
-		return
-	}
 	t.httpClient = httpClient
 
 	t.url.Scheme = string(baseLabels[model.SchemeLabel])
@@ -217,6 +322,9 @@ func (t *Target) Update(cfg *config.ScrapeConfig, baseLabels, metaLabels model.L
 	t.internalLabels[model.SchemeLabel] = baseLabels[model.SchemeLabel]
 	t.internalLabels[model.MetricsPathLabel] = baseLabels[model.MetricsPathLabel]
 	t.internalLabels[model.AddressLabel] = model.LabelValue(t.url.Host)
+	if serverName, ok := baseLabels[tlsServerNameLabel]; ok {
+		t.internalLabels[tlsServerNameLabel] = serverName
+	}
 
 	params := url.Values{}
 
@@ -238,6 +346,8 @@ func (t *Target) Update(cfg *config.ScrapeConfig, baseLabels, metaLabels model.L
 
 	t.scrapeInterval = time.Duration(cfg.ScrapeInterval)
 	t.deadline = time.Duration(cfg.ScrapeTimeout)
+	t.initialScrapeGrace = time.Duration(cfg.InitialScrapeGrace)
+	t.staleExtendScrapes = cfg.StaleExtendScrapes
 
 	t.honorLabels = cfg.HonorLabels
 	t.metaLabels = metaLabels
@@ -252,14 +362,16 @@ func (t *Target) Update(cfg *config.ScrapeConfig, baseLabels, metaLabels model.L
 		t.baseLabels[model.InstanceLabel] = model.LabelValue(t.InstanceIdentifier())
 	}
 	t.metricRelabelConfigs = cfg.MetricRelabelConfigs
+	t.metricNamePrefixStrip = cfg.MetricNamePrefixStrip
+	t.failOnEmptyBody = cfg.FailOnEmptyBody
+	t.sampleLimit = cfg.SampleLimit
 }
 
 func newHTTPClient(cfg *config.ScrapeConfig) (*http.Client, error) {
-	rt := httputil.NewDeadlineRoundTripper(time.Duration(cfg.ScrapeTimeout), cfg.ProxyURL.URL)
-
 	tlsOpts := httputil.TLSOptions{
 		InsecureSkipVerify: cfg.TLSConfig.InsecureSkipVerify,
 		CAFile:             cfg.TLSConfig.CAFile,
+		ServerName:         cfg.TLSConfig.ServerName,
 	}
 	if len(cfg.TLSConfig.CertFile) > 0 && len(cfg.TLSConfig.KeyFile) > 0 {
 		tlsOpts.CertFile = cfg.TLSConfig.CertFile
@@ -269,11 +381,15 @@ func newHTTPClient(cfg *config.ScrapeConfig) (*http.Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	// Get a default roundtripper with the scrape timeout.
-	tr := rt.(*http.Transport)
-	// Set the TLS config from above
-	tr.TLSClientConfig = tlsConfig
-	rt = tr
+	// Get a round tripper with the scrape timeouts and the TLS config from
+	// above.
+	rt := httputil.NewTimeoutRoundTripper(
+		time.Duration(cfg.ScrapeTimeout),
+		time.Duration(cfg.DialTimeout),
+		time.Duration(cfg.ResponseTimeout),
+		cfg.ProxyURL.URL,
+		tlsConfig,
+	)
 
 	// If a bearer token is provided, create a round tripper that will set the
 	// Authorization header correctly on each request.
@@ -291,8 +407,18 @@ func newHTTPClient(cfg *config.ScrapeConfig) (*http.Client, error) {
 	}
 
 	if cfg.BasicAuth != nil {
-		rt = httputil.NewBasicAuthRoundTripper(cfg.BasicAuth.Username, cfg.BasicAuth.Password, rt)
+		password, err := cfg.BasicAuth.ReadPassword()
+		if err != nil {
+			return nil, err
+		}
+		rt = httputil.NewBasicAuthRoundTripper(cfg.BasicAuth.Username, password, rt)
+	}
+
+	userAgent := cfg.UserAgent
+	if len(userAgent) == 0 {
+		userAgent = defaultUserAgent
 	}
+	rt = httputil.NewUserAgentRoundTripper(userAgent, rt)
 
 	// Return a new client with the configured round tripper.
 	return httputil.NewClient(rt), nil
@@ -400,16 +526,83 @@ func (t *Target) ingest(s model.Vector) error {
 const acceptHeader = `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3,application/json;schema="prometheus/telemetry";version=0.0.2;q=0.2,*/*;q=0.1`
 
 func (t *Target) scrape(appender storage.SampleAppender) (err error) {
+	t.RLock()
+	conflict := t.conflict
+	t.RUnlock()
+	if conflict != nil {
+		// Do not record the scrape health either, as its series would
+		// conflict as well.
+		t.status.setLastError(conflict)
+		return conflict
+	}
+
 	start := time.Now()
 	baseLabels := t.BaseLabels()
 
 	defer func(appender storage.SampleAppender) {
+		// Within the initial grace period, a target that was never scraped
+		// successfully is not reported as down.
+		if err != nil && t.inInitialScrapeGrace(start) {
+			t.status.setLastErrorKeepHealth(err)
+			return
+		}
 		t.status.setLastError(err)
-		recordScrapeHealth(appender, start, baseLabels, t.status.Health(), time.Since(start))
+		health := &sampleRecorder{
+			app:    appender,
+			series: map[model.Fingerprint]model.Metric{},
+		}
+		recordScrapeHealth(health, start, baseLabels, t.status.Health(), time.Since(start))
+		t.lastHealthSeries = health.series
 	}(appender)
 
+	// The reason of a failure, if it is one we classify.
+	var failure string
+	defer func() {
+		if err != nil && failure != "" {
+			targetScrapesFailed.WithLabelValues(failure).Inc()
+			if failure == failureTimeout {
+				targetScrapeTimeouts.Inc()
+			}
+		}
+	}()
+
 	t.RLock()
 
+	staleExtendScrapes := t.staleExtendScrapes
+
+	// Record the samples as they are finally ingested, i.e. after all
+	// label modifications.
+	scraped := &sampleRecorder{
+		app:    appender,
+		series: map[model.Fingerprint]model.Metric{},
+	}
+	defer func(appender storage.SampleAppender) {
+		ts := model.TimeFromUnixNano(start.UnixNano())
+		if staleExtendScrapes > 0 {
+			// Re-emitted samples are recorded, too, so that their
+			// series are not marked stale.
+			t.extendScrape(scraped, scraped, staleExtendScrapes, ts, err)
+		}
+		t.markStale(appender, scraped, ts, err)
+	}(appender)
+	appender = scraped
+	if staleExtendScrapes == 0 {
+		t.lastScrapeSamples = nil
+		t.failedScrapes = 0
+	}
+
+	// The limitAppender counts the samples as they are finally ingested
+	// but has to be outside the sampleRecorder, which only records the
+	// samples it lets through.
+	var limited *limitAppender
+	if t.sampleLimit > 0 {
+		limited = &limitAppender{
+			app:   appender,
+			limit: int(t.sampleLimit),
+		}
+		appender = limited
+	}
+
 	// The relabelAppender has to be inside the label-modifying appenders
 	// so the relabeling rules are applied to the correct label set.
 	if len(t.metricRelabelConfigs) > 0 {
@@ -431,6 +624,16 @@ func (t *Target) scrape(appender storage.SampleAppender) (err error) {
 		}
 	}
 
+	// Stripping the prefix comes first so that all other label
+	// modifications see the stripped metric names.
+	if t.metricNamePrefixStrip != "" {
+		appender = prefixStripAppender{
+			app:          appender,
+			prefix:       t.metricNamePrefixStrip,
+			fingerprints: map[model.Fingerprint]struct{}{},
+		}
+	}
+
 	httpClient := t.httpClient
 
 	t.RUnlock()
@@ -440,18 +643,38 @@ func (t *Target) scrape(appender storage.SampleAppender) (err error) {
 		return err
 	}
 	req.Header.Add("Accept", acceptHeader)
+	// Requesting compression explicitly disables the transparent
+	// decompression of the transport, so the body is decompressed below.
+	req.Header.Add("Accept-Encoding", "gzip")
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
+		failure = requestFailure(err)
 		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		failure = failureHTTPError
 		return fmt.Errorf("server returned HTTP status %s", resp.Status)
 	}
 
-	dec := expfmt.NewDecoder(resp.Body, expfmt.ResponseFormat(resp.Header))
+	var r io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			if isTimeout(err) {
+				failure = failureTimeout
+			} else {
+				failure = failureParse
+			}
+			return fmt.Errorf("error decompressing response: %s", err)
+		}
+		defer gr.Close()
+		r = gr
+	}
+	body := &contentReader{r: r}
+	dec := expfmt.NewDecoder(body, expfmt.ResponseFormat(resp.Header))
 
 	sdec := expfmt.SampleDecoder{
 		Dec: dec,
@@ -486,12 +709,78 @@ func (t *Target) scrape(appender storage.SampleAppender) (err error) {
 		}
 	}
 
-	if err == io.EOF {
+	if limited != nil {
+		if limited.exceeded() {
+			failure = failureSampleLimit
+			targetScrapesExceededSampleLimit.Inc()
+			return errSampleLimit
+		}
+		limited.flush()
+	}
+
+	if scraped.err != nil {
+		failure = failureAppend
+		return fmt.Errorf("error appending scraped samples: %s", scraped.err)
+	}
+
+	switch err {
+	case io.EOF:
+		if t.failOnEmptyBody && !body.content {
+			failure = failureEmptyBody
+			return errEmptyBody
+		}
 		return nil
+	case errIngestChannelFull:
+		// Not a failure of the target.
+	default:
+		// Decoding fails on timeouts while reading the body, too.
+		if isTimeout(err) {
+			failure = failureTimeout
+		} else {
+			failure = failureParse
+		}
 	}
 	return err
 }
 
+// contentReader is an io.Reader recording whether anything but whitespace
+// was read from the underlying reader.
+type contentReader struct {
+	r       io.Reader
+	content bool
+}
+
+func (cr *contentReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if !cr.content && len(bytes.TrimSpace(p[:n])) > 0 {
+		cr.content = true
+	}
+	return n, err
+}
+
+// requestFailure classifies an error returned for a scrape request.
+func requestFailure(err error) string {
+	if isTimeout(err) {
+		return failureTimeout
+	}
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	if _, ok := err.(*net.DNSError); ok {
+		return failureDNS
+	}
+	return failureConnection
+}
+
+// isTimeout returns whether err is a network timeout.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
 // Merges the ingested sample's metric with the label set. On a collision the
 // value of the ingested label is stored in a label prefixed with 'exported_'.
 type ruleLabelsAppender struct {
@@ -536,7 +825,7 @@ type relabelAppender struct {
 }
 
 func (app relabelAppender) Append(s *model.Sample) {
-	labels, err := Relabel(model.LabelSet(s.Metric), app.relabelings...)
+	labels, err := relabel.Process(model.LabelSet(s.Metric), app.relabelings...)
 	if err != nil {
 		log.Errorf("Error while relabeling metric %s: %s", s.Metric, err)
 		return
@@ -550,6 +839,176 @@ func (app relabelAppender) Append(s *model.Sample) {
 	app.app.Append(s)
 }
 
+// Removes a prefix from the metric name of the sample before appending it.
+// Samples whose metric collides with the metric of a sample appended before
+// within the same scrape are dropped and counted. A new prefixStripAppender has
+// to be used for every scrape.
+type prefixStripAppender struct {
+	app          storage.SampleAppender
+	prefix       string
+	fingerprints map[model.Fingerprint]struct{}
+}
+
+func (app prefixStripAppender) Append(s *model.Sample) {
+	name := string(s.Metric[model.MetricNameLabel])
+	if strings.HasPrefix(name, app.prefix) && len(name) > len(app.prefix) {
+		s.Metric[model.MetricNameLabel] = model.LabelValue(name[len(app.prefix):])
+	}
+	fp := s.Metric.Fingerprint()
+	if _, ok := app.fingerprints[fp]; ok {
+		log.Debugf("Dropping sample of %s as it collides with another metric after stripping prefix %q", s.Metric, app.prefix)
+		targetPrefixStripCollisions.Inc()
+		return
+	}
+	app.fingerprints[fp] = struct{}{}
+
+	app.app.Append(s)
+}
+
+// limitAppender buffers the samples appended to it so that a scrape yielding
+// more than limit samples can be discarded as a whole. The buffered samples
+// are appended to app on flush. A new limitAppender has to be used for every
+// scrape.
+type limitAppender struct {
+	app     storage.SampleAppender
+	limit   int
+	n       int
+	samples model.Samples
+}
+
+func (app *limitAppender) Append(s *model.Sample) {
+	app.n++
+	if app.exceeded() {
+		// The samples are discarded anyway, so stop buffering them.
+		app.samples = nil
+		return
+	}
+	app.samples = append(app.samples, s)
+}
+
+// exceeded returns whether more than limit samples were appended.
+func (app *limitAppender) exceeded() bool {
+	return app.n > app.limit
+}
+
+// flush appends the buffered samples to app.
+func (app *limitAppender) flush() {
+	for _, s := range app.samples {
+		app.app.Append(s)
+	}
+	app.samples = nil
+}
+
+// sampleRecorder keeps the samples it appends and their metrics by
+// fingerprint. It also keeps the first error of the underlying appender, if it
+// reports errors.
+type sampleRecorder struct {
+	app     storage.SampleAppender
+	samples model.Samples
+	series  map[model.Fingerprint]model.Metric
+	err     error
+}
+
+func (app *sampleRecorder) Append(s *model.Sample) {
+	app.samples = append(app.samples, s)
+	app.series[s.Metric.Fingerprint()] = s.Metric
+	if err := storage.TryAppend(app.app, s); err != nil && app.err == nil {
+		app.err = err
+	}
+}
+
+// extendScrape keeps the samples of the last successful scrape. After a failed
+// scrape, it re-emits them to app with the timestamp of the failed scrape for
+// up to limit consecutive failures. Series that the failed scrape ingested
+// before failing are not re-emitted.
+func (t *Target) extendScrape(app storage.SampleAppender, scraped *sampleRecorder, limit int, ts model.Time, err error) {
+	switch {
+	case err == nil:
+		t.lastScrapeSamples = scraped.samples
+		t.failedScrapes = 0
+		return
+	case err == errIngestChannelFull:
+		// Not a failure of the target.
+		return
+	}
+
+	t.failedScrapes++
+	if t.failedScrapes > limit {
+		t.lastScrapeSamples = nil
+		return
+	}
+	if len(t.lastScrapeSamples) == 0 {
+		return
+	}
+	for _, s := range t.lastScrapeSamples {
+		if _, ok := scraped.series[s.Metric.Fingerprint()]; ok {
+			continue
+		}
+		app.Append(&model.Sample{
+			Metric:    s.Metric.Clone(),
+			Value:     s.Value,
+			Timestamp: ts,
+		})
+	}
+	targetScrapesExtended.Inc()
+}
+
+// markStale appends staleness markers with the given timestamp to app for the
+// series ingested by the last scrape but not by the scraped one, which then
+// becomes the last scrape. A failed scrape thus marks all series stale that
+// it did not ingest before failing or that were not re-emitted for it.
+func (t *Target) markStale(app storage.SampleAppender, scraped *sampleRecorder, ts model.Time, err error) {
+	if err == errIngestChannelFull {
+		// Not a failure of the target, so the series of the last scrape
+		// are kept in addition to those ingested.
+		if t.lastScrapeSeries == nil {
+			t.lastScrapeSeries = scraped.series
+			return
+		}
+		for fp, m := range scraped.series {
+			t.lastScrapeSeries[fp] = m
+		}
+		return
+	}
+	appendStaleMarkers(app, t.lastScrapeSeries, scraped.series, ts)
+	t.lastScrapeSeries = scraped.series
+}
+
+// markSeriesStale appends staleness markers for all series of the last scrape,
+// including the scrape health series, to app. It is called once the target
+// disappeared and must not be called while the scraper is running.
+func (t *Target) markSeriesStale(app storage.SampleAppender) {
+	ts := model.Now()
+	appendStaleMarkers(app, t.lastScrapeSeries, nil, ts)
+	appendStaleMarkers(app, t.lastHealthSeries, nil, ts)
+	t.lastScrapeSeries = nil
+	t.lastHealthSeries = nil
+}
+
+// appendStaleMarkers appends a staleness marker with the given timestamp to
+// app for each series in last that is not in current.
+func appendStaleMarkers(app storage.SampleAppender, last, current map[model.Fingerprint]model.Metric, ts model.Time) {
+	for fp, m := range last {
+		if _, ok := current[fp]; ok {
+			continue
+		}
+		app.Append(&model.Sample{
+			Metric:    m.Clone(),
+			Value:     metric.StaleNaN,
+			Timestamp: ts,
+		})
+	}
+}
+
+// inInitialScrapeGrace returns true if the target has not been scraped
+// successfully yet and is still within its initial scrape grace period at
+// the given time.
+func (t *Target) inInitialScrapeGrace(now time.Time) bool {
+	t.RLock()
+	defer t.RUnlock()
+	return t.status.Health() == HealthUnknown && now.Sub(t.created) < t.initialScrapeGrace
+}
+
 // URL returns a copy of the target's URL.
 func (t *Target) URL() *url.URL {
 	t.RLock()
@@ -560,6 +1019,29 @@ func (t *Target) URL() *url.URL {
 	return u
 }
 
+// setConflict sets the error describing a conflict of the target's labels
+// with those of other targets, or clears it if err is nil. A conflicting
+// target is reported as unhealthy right away. It returns whether the target
+// was not conflicting before.
+func (t *Target) setConflict(err error) bool {
+	t.Lock()
+	wasConflicting := t.conflict != nil
+	t.conflict = err
+	t.Unlock()
+	if err != nil {
+		t.status.setLastError(err)
+	}
+	return err != nil && !wasConflicting
+}
+
+// hasConflict returns whether the target's labels conflict with those of
+// another target.
+func (t *Target) hasConflict() bool {
+	t.RLock()
+	defer t.RUnlock()
+	return t.conflict != nil
+}
+
 // InstanceIdentifier returns the identifier for the target.
 func (t *Target) InstanceIdentifier() string {
 	return t.url.Host
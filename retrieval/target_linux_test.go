@@ -0,0 +1,87 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/config"
+)
+
+// newUnresponsiveAddress returns the address of a socket that never completes
+// the connection handshake for new connections. It listens with a zero
+// backlog, never accepts, and has its single queue slot occupied.
+func newUnresponsiveAddress(t *testing.T) (string, func()) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeFD := func() { syscall.Close(fd) }
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		closeFD()
+		t.Fatal(err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		closeFD()
+		t.Fatal(err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		closeFD()
+		t.Fatal(err)
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", sa.(*syscall.SockaddrInet4).Port)
+
+	filler, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		closeFD()
+		t.Fatal(err)
+	}
+	return addr, func() {
+		filler.Close()
+		closeFD()
+	}
+}
+
+func TestTargetScrapeDialTimeout(t *testing.T) {
+	addr, closer := newUnresponsiveAddress(t)
+	defer closer()
+
+	testTarget := newTestTarget(addr, 5*time.Second, model.LabelSet{})
+	c, err := newHTTPClient(&config.ScrapeConfig{
+		ScrapeTimeout:   config.Duration(5 * time.Second),
+		DialTimeout:     config.Duration(50 * time.Millisecond),
+		ResponseTimeout: config.Duration(time.Second),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTarget.httpClient = c
+
+	begin := time.Now()
+	err = testTarget.scrape(nopAppender{})
+	if err == nil || !strings.Contains(err.Error(), "dial timeout of 50ms exceeded") {
+		t.Fatalf("expected dial timeout, got %v", err)
+	}
+	if took := time.Since(begin); took > time.Second {
+		t.Errorf("expected scrape to fail after the dial timeout, took %v", took)
+	}
+}
@@ -14,22 +14,36 @@
 package retrieval
 
 import (
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
 
 	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/storage/metric"
 )
 
 func TestBaseLabels(t *testing.T) {
@@ -240,6 +254,161 @@ func TestTargetScrapeMetricRelabelConfigs(t *testing.T) {
 
 }
 
+func TestHonorLabelsMetricRelabelConfigs(t *testing.T) {
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+				w.Write([]byte("test_metric{instance=\"exposed\"} 1\n"))
+			},
+		),
+	)
+	defer server.Close()
+	addr := model.LabelValue(strings.Split(server.URL, "://")[1])
+
+	// Metric relabeling sees the labels as merged according to honor_labels.
+	for _, c := range []struct {
+		honorLabels bool
+		expected    model.Metric
+	}{
+		{
+			honorLabels: false,
+			expected: model.Metric{
+				model.MetricNameLabel:                           "test_metric",
+				model.InstanceLabel:                             addr,
+				model.ExportedLabelPrefix + model.InstanceLabel: "exposed",
+				"relabeled_instance":                            addr,
+			},
+		},
+		{
+			honorLabels: true,
+			expected: model.Metric{
+				model.MetricNameLabel: "test_metric",
+				model.InstanceLabel:   "exposed",
+				"relabeled_instance":  "exposed",
+			},
+		},
+	} {
+		testTarget := newTestTarget(server.URL, time.Second, model.LabelSet{})
+		testTarget.honorLabels = c.honorLabels
+		testTarget.metricRelabelConfigs = []*config.RelabelConfig{
+			{
+				SourceLabels: model.LabelNames{model.InstanceLabel},
+				Regex:        config.MustNewRegexp("(.*)"),
+				TargetLabel:  "relabeled_instance",
+				Replacement:  "$1",
+				Action:       config.RelabelReplace,
+			},
+		}
+
+		app := &collectResultAppender{}
+		if err := testTarget.scrape(app); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(app.result[0].Metric, c.expected) {
+			t.Errorf("honor_labels %t: expected %v, got %v", c.honorLabels, c.expected, app.result[0].Metric)
+		}
+	}
+}
+
+func TestTargetScrapeMetricNamePrefixStrip(t *testing.T) {
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+				w.Write([]byte("vendor_requests_total 1\n"))
+				w.Write([]byte("vendor_errors_total{code=\"500\"} 2\n"))
+				w.Write([]byte("errors_total{code=\"500\"} 3\n"))
+				w.Write([]byte("errors_total{code=\"404\"} 4\n"))
+				w.Write([]byte("vendor_ 5\n"))
+			},
+		),
+	)
+	defer server.Close()
+	testTarget := newTestTarget(server.URL, time.Second, model.LabelSet{})
+	testTarget.metricNamePrefixStrip = "vendor_"
+	// Metric relabeling sees the stripped names.
+	testTarget.metricRelabelConfigs = []*config.RelabelConfig{
+		{
+			SourceLabels: model.LabelNames{"__name__"},
+			Regex:        config.MustNewRegexp("requests_total"),
+			TargetLabel:  "foo",
+			Replacement:  "bar",
+			Action:       config.RelabelReplace,
+		},
+	}
+
+	collisions := func() float64 {
+		var m dto.Metric
+		if err := targetPrefixStripCollisions.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	before := collisions()
+
+	appender := &collectResultAppender{}
+	if err := testTarget.scrape(appender); err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove variables part of result.
+	for _, sample := range appender.result {
+		sample.Timestamp = 0
+	}
+	// The scrape health metrics are not of interest.
+	result := appender.result[:len(appender.result)-2]
+
+	// The scraped metric families are decoded in random order, so which
+	// of the colliding errors_total{code="500"} samples is kept varies.
+	instance := model.LabelValue(testTarget.url.Host)
+	expected := map[model.Fingerprint][]model.SampleValue{
+		model.Metric{
+			model.MetricNameLabel: "requests_total",
+			"foo":               "bar",
+			model.InstanceLabel: instance,
+		}.Fingerprint(): {1},
+		model.Metric{
+			model.MetricNameLabel: "errors_total",
+			"code":              "500",
+			model.InstanceLabel: instance,
+		}.Fingerprint(): {2, 3},
+		model.Metric{
+			model.MetricNameLabel: "errors_total",
+			"code":              "404",
+			model.InstanceLabel: instance,
+		}.Fingerprint(): {4},
+		// Metric names consisting only of the prefix are kept.
+		model.Metric{
+			model.MetricNameLabel: "vendor_",
+			model.InstanceLabel:   instance,
+		}.Fingerprint(): {5},
+	}
+
+	if len(result) != len(expected) {
+		t.Fatalf("Expected %d samples, got %d: %s", len(expected), len(result), result)
+	}
+	for _, s := range result {
+		values, ok := expected[s.Metric.Fingerprint()]
+		if !ok {
+			t.Fatalf("Unexpected sample %s", s)
+		}
+		found := false
+		for _, v := range values {
+			if s.Value == v {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Unexpected value for sample %s, expected one of %v", s, values)
+		}
+		delete(expected, s.Metric.Fingerprint())
+	}
+	if got := collisions() - before; got != 1 {
+		t.Fatalf("Expected 1 collision, got %v", got)
+	}
+}
+
 func TestTargetRecordScrapeHealth(t *testing.T) {
 	testTarget := newTestTarget("example.url:80", 0, model.LabelSet{model.JobLabel: "testjob"})
 
@@ -331,6 +500,94 @@ func TestTargetScrapeTimeout(t *testing.T) {
 	}
 }
 
+func TestTargetScrapeResponseTimeout(t *testing.T) {
+	var scenarios = []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "headers",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(200 * time.Millisecond)
+				w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+				w.Write([]byte("test_metric 1\n"))
+			},
+		},
+		{
+			name: "body",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+				// Stall in the middle of a line, as the text parser
+				// takes a read error at the start of a line for the
+				// end of the input.
+				w.Write([]byte("test_metric 1\ntest_metric_2"))
+				w.(http.Flusher).Flush()
+				time.Sleep(200 * time.Millisecond)
+				w.Write([]byte(" 1\n"))
+			},
+		},
+	}
+
+	for _, s := range scenarios {
+		server := httptest.NewServer(s.handler)
+
+		testTarget := newTestTarget(server.URL, 5*time.Second, model.LabelSet{})
+		c, err := newHTTPClient(&config.ScrapeConfig{
+			ScrapeTimeout:   config.Duration(5 * time.Second),
+			DialTimeout:     config.Duration(time.Second),
+			ResponseTimeout: config.Duration(50 * time.Millisecond),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testTarget.httpClient = c
+
+		err = testTarget.scrape(nopAppender{})
+		if err == nil || !strings.Contains(err.Error(), "response timeout of 50ms exceeded") {
+			t.Errorf("%s: expected response timeout, got %v", s.name, err)
+		}
+		server.Close()
+	}
+}
+
+func TestTargetScrapeReusesConnections(t *testing.T) {
+	var conns int32
+	server := httptest.NewUnstartedServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+				w.Write([]byte("test_metric 1\n"))
+			},
+		),
+	)
+	server.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	testTarget := newTestTarget(server.URL, 5*time.Second, model.LabelSet{})
+	c, err := newHTTPClient(&config.ScrapeConfig{
+		ScrapeTimeout:   config.Duration(5 * time.Second),
+		ResponseTimeout: config.Duration(time.Second),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTarget.httpClient = c
+
+	for i := 0; i < 3; i++ {
+		if err := testTarget.scrape(nopAppender{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("expected scrapes to share 1 connection, got %d connections", n)
+	}
+}
+
 func TestTargetScrape404(t *testing.T) {
 	server := httptest.NewServer(
 		http.HandlerFunc(
@@ -351,6 +608,328 @@ func TestTargetScrape404(t *testing.T) {
 	}
 }
 
+func TestTargetScrapeFailureReasons(t *testing.T) {
+	newServer := func(h http.HandlerFunc) (string, func()) {
+		server := httptest.NewServer(h)
+		return server.URL, server.Close
+	}
+
+	scenarios := []struct {
+		reason string
+		target func() (string, func())
+	}{
+		{
+			reason: failureDNS,
+			target: func() (string, func()) {
+				return "nonexistent.invalid:9090", func() {}
+			},
+		},
+		{
+			reason: failureConnection,
+			target: func() (string, func()) {
+				l, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				addr := l.Addr().String()
+				l.Close()
+				return addr, func() {}
+			},
+		},
+		{
+			reason: failureTimeout,
+			target: func() (string, func()) {
+				return newServer(func(w http.ResponseWriter, r *http.Request) {
+					time.Sleep(200 * time.Millisecond)
+				})
+			},
+		},
+		{
+			reason: failureHTTPError,
+			target: func() (string, func()) {
+				return newServer(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusInternalServerError)
+				})
+			},
+		},
+		{
+			reason: failureParse,
+			target: func() (string, func()) {
+				return newServer(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+					w.Write([]byte("metric{ 1\n"))
+				})
+			},
+		},
+	}
+
+	failures := func(reason string) float64 {
+		var m dto.Metric
+		if err := targetScrapesFailed.WithLabelValues(reason).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	timeouts := func() float64 {
+		var m dto.Metric
+		if err := targetScrapeTimeouts.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+
+	for _, s := range scenarios {
+		before := map[string]float64{}
+		for _, r := range scenarios {
+			before[r.reason] = failures(r.reason)
+		}
+		timeoutsBefore := timeouts()
+
+		addr, closer := s.target()
+		testTarget := newTestTarget(addr, 50*time.Millisecond, model.LabelSet{})
+		if err := testTarget.scrape(nopAppender{}); err == nil {
+			t.Errorf("%s: expected scrape to fail", s.reason)
+		}
+		closer()
+
+		for _, r := range scenarios {
+			want := before[r.reason]
+			if r.reason == s.reason {
+				want++
+			}
+			if got := failures(r.reason); got != want {
+				t.Errorf("%s: expected %v failures with reason %s, got %v", s.reason, want, r.reason, got)
+			}
+		}
+		want := timeoutsBefore
+		if s.reason == failureTimeout {
+			want++
+		}
+		if got := timeouts(); got != want {
+			t.Errorf("%s: expected %v scrape timeouts, got %v", s.reason, want, got)
+		}
+	}
+}
+
+func TestTargetScrapeAppendFailure(t *testing.T) {
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+				w.Write([]byte("test_metric 1\n"))
+			},
+		),
+	)
+	defer server.Close()
+
+	var m dto.Metric
+	if err := targetScrapesFailed.WithLabelValues(failureAppend).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	before := m.GetCounter().GetValue()
+
+	testTarget := newTestTarget(server.URL, time.Second, model.LabelSet{})
+	if err := testTarget.scrape(failingAppender{}); err == nil {
+		t.Fatal("expected scrape to fail on append errors")
+	}
+	if err := targetScrapesFailed.WithLabelValues(failureAppend).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetCounter().GetValue() - before; got != 1 {
+		t.Errorf("expected 1 scrape failed on appending, got %v", got)
+	}
+}
+
+func TestTargetScrapeEmptyBody(t *testing.T) {
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+				w.Write([]byte(" \n\t\n"))
+			},
+		),
+	)
+	defer server.Close()
+
+	failures := func() float64 {
+		var m dto.Metric
+		if err := targetScrapesFailed.WithLabelValues(failureEmptyBody).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+
+	scenarios := []struct {
+		failOnEmptyBody bool
+		up              model.SampleValue
+		failures        float64
+	}{
+		{failOnEmptyBody: false, up: 1, failures: 0},
+		{failOnEmptyBody: true, up: 0, failures: 1},
+	}
+
+	for _, s := range scenarios {
+		testTarget := newTestTarget(server.URL, time.Second, model.LabelSet{})
+		testTarget.failOnEmptyBody = s.failOnEmptyBody
+
+		before := failures()
+		appender := &collectResultAppender{}
+		err := testTarget.scrape(appender)
+		if s.failOnEmptyBody && err != errEmptyBody {
+			t.Errorf("failOnEmptyBody=%v: expected error %q, got %v", s.failOnEmptyBody, errEmptyBody, err)
+		}
+		if !s.failOnEmptyBody && err != nil {
+			t.Errorf("failOnEmptyBody=%v: unexpected error: %s", s.failOnEmptyBody, err)
+		}
+		if got := failures() - before; got != s.failures {
+			t.Errorf("failOnEmptyBody=%v: expected %v empty body failures, got %v", s.failOnEmptyBody, s.failures, got)
+		}
+
+		// Only the scrape health metrics are ingested.
+		if len(appender.result) != 2 {
+			t.Fatalf("failOnEmptyBody=%v: expected 2 samples, got %d", s.failOnEmptyBody, len(appender.result))
+		}
+		up := appender.result[0]
+		if up.Metric[model.MetricNameLabel] != scrapeHealthMetricName {
+			t.Fatalf("failOnEmptyBody=%v: expected %s sample, got %s", s.failOnEmptyBody, scrapeHealthMetricName, up.Metric)
+		}
+		if up.Value != s.up {
+			t.Errorf("failOnEmptyBody=%v: expected %s of %v, got %v", s.failOnEmptyBody, scrapeHealthMetricName, s.up, up.Value)
+		}
+	}
+}
+
+func TestTargetScrapeGzip(t *testing.T) {
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+				if r.Header.Get("Accept-Encoding") != "gzip" {
+					w.Write([]byte("test_metric{compressed=\"false\"} 1\n"))
+					return
+				}
+				w.Header().Set("Content-Encoding", "gzip")
+				gw := gzip.NewWriter(w)
+				gw.Write([]byte("test_metric{compressed=\"true\"} 1\n"))
+				gw.Close()
+			},
+		),
+	)
+	defer server.Close()
+
+	testTarget := newTestTarget(server.URL, time.Second, model.LabelSet{})
+	appender := &collectResultAppender{}
+	if err := testTarget.scrape(appender); err != nil {
+		t.Fatal(err)
+	}
+	if len(appender.result) != 3 {
+		t.Fatalf("expected 3 samples, got %d", len(appender.result))
+	}
+	if got := appender.result[0].Metric["compressed"]; got != "true" {
+		t.Errorf("expected compressed response to be scraped, got %s", appender.result[0].Metric)
+	}
+}
+
+func TestTargetScrapeBadGzip(t *testing.T) {
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Write([]byte("test_metric 1\n"))
+			},
+		),
+	)
+	defer server.Close()
+
+	testTarget := newTestTarget(server.URL, time.Second, model.LabelSet{})
+	if err := testTarget.scrape(&collectResultAppender{}); err == nil {
+		t.Fatal("expected error scraping response with invalid compression")
+	}
+	if testTarget.status.Health() != HealthBad {
+		t.Errorf("expected target to be unhealthy, got %s", testTarget.status.Health())
+	}
+}
+
+func TestTargetScrapeSampleLimit(t *testing.T) {
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+				w.Write([]byte("test_metric_a 1\ntest_metric_b 2\ntest_metric_c 3\n"))
+			},
+		),
+	)
+	defer server.Close()
+
+	exceeded := func() float64 {
+		var m dto.Metric
+		if err := targetScrapesExceededSampleLimit.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+
+	scenarios := []struct {
+		limit          uint
+		relabelConfigs []*config.RelabelConfig
+		samples        int
+		up             model.SampleValue
+	}{
+		{limit: 0, samples: 3, up: 1},
+		{limit: 3, samples: 3, up: 1},
+		{limit: 2, samples: 0, up: 0},
+		{
+			// Only samples remaining after metric relabeling count.
+			limit: 2,
+			relabelConfigs: []*config.RelabelConfig{
+				{
+					SourceLabels: model.LabelNames{model.MetricNameLabel},
+					Regex:        config.MustNewRegexp("test_metric_a"),
+					Action:       config.RelabelDrop,
+				},
+			},
+			samples: 2,
+			up:      1,
+		},
+	}
+
+	for i, s := range scenarios {
+		testTarget := newTestTarget(server.URL, time.Second, model.LabelSet{})
+		testTarget.sampleLimit = s.limit
+		testTarget.metricRelabelConfigs = s.relabelConfigs
+
+		before := exceeded()
+		appender := &collectResultAppender{}
+		err := testTarget.scrape(appender)
+		if s.up == 0 && err != errSampleLimit {
+			t.Errorf("%d. expected error %q, got %v", i, errSampleLimit, err)
+		}
+		if s.up == 1 && err != nil {
+			t.Errorf("%d. unexpected error: %s", i, err)
+		}
+		var want float64
+		if s.up == 0 {
+			want = 1
+		}
+		if got := exceeded() - before; got != want {
+			t.Errorf("%d. expected %v scrapes exceeding the sample limit, got %v", i, want, got)
+		}
+
+		// The scrape health metrics are ingested in any case.
+		if len(appender.result) != s.samples+2 {
+			t.Fatalf("%d. expected %d samples, got %d", i, s.samples+2, len(appender.result))
+		}
+		up := appender.result[s.samples]
+		if up.Metric[model.MetricNameLabel] != scrapeHealthMetricName {
+			t.Fatalf("%d. expected %s sample, got %s", i, scrapeHealthMetricName, up.Metric)
+		}
+		if up.Value != s.up {
+			t.Errorf("%d. expected %s of %v, got %v", i, scrapeHealthMetricName, s.up, up.Value)
+		}
+	}
+}
+
 func TestTargetRunScraperScrapes(t *testing.T) {
 	testTarget := newTestTarget("bad schema", 0, nil)
 
@@ -417,16 +996,22 @@ func TestURLParams(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	target := NewTarget(
-		&config.ScrapeConfig{
-			JobName:        "test_job1",
-			ScrapeInterval: config.Duration(1 * time.Minute),
-			ScrapeTimeout:  config.Duration(1 * time.Second),
-			Scheme:         serverURL.Scheme,
-			Params: url.Values{
-				"foo": []string{"bar", "baz"},
-			},
+	cfg := &config.ScrapeConfig{
+		JobName:        "test_job1",
+		ScrapeInterval: config.Duration(1 * time.Minute),
+		ScrapeTimeout:  config.Duration(1 * time.Second),
+		Scheme:         serverURL.Scheme,
+		Params: url.Values{
+			"foo": []string{"bar", "baz"},
 		},
+	}
+	c, err := newHTTPClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := NewTarget(
+		cfg,
+		c,
 		model.LabelSet{
 			model.SchemeLabel:  model.LabelValue(serverURL.Scheme),
 			model.AddressLabel: model.LabelValue(serverURL.Host),
@@ -552,6 +1137,82 @@ func TestNewHTTPBasicAuth(t *testing.T) {
 	}
 }
 
+func TestNewHTTPBasicAuthPasswordFile(t *testing.T) {
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				username, password, ok := r.BasicAuth()
+				if !(ok && username == "user" && password == "password123") {
+					t.Fatalf("Basic authorization header was not set correctly: expected '%v:%v', got '%v:%v'", "user", "password123", username, password)
+				}
+			},
+		),
+	)
+	defer server.Close()
+
+	cfg := &config.ScrapeConfig{
+		ScrapeTimeout: config.Duration(1 * time.Second),
+		BasicAuth: &config.BasicAuth{
+			Username:     "user",
+			PasswordFile: "testdata/password.txt",
+		},
+	}
+	c, err := newHTTPClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.BasicAuth.PasswordFile = "testdata/nonexistent.txt"
+	if _, err := newHTTPClient(cfg); err == nil {
+		t.Fatal("expected error for missing password file, got none")
+	}
+}
+
+func TestNewHTTPUserAgent(t *testing.T) {
+	var scenarios = []struct {
+		userAgent string
+		expected  string
+	}{
+		{
+			expected: defaultUserAgent,
+		},
+		{
+			userAgent: "custom-agent/1.0",
+			expected:  "custom-agent/1.0",
+		},
+	}
+
+	for _, s := range scenarios {
+		server := httptest.NewServer(
+			http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					if received := r.UserAgent(); received != s.expected {
+						t.Fatalf("User-Agent header was not set correctly: expected '%v', got '%v'", s.expected, received)
+					}
+				},
+			),
+		)
+
+		cfg := &config.ScrapeConfig{
+			ScrapeTimeout: config.Duration(1 * time.Second),
+			UserAgent:     s.userAgent,
+		}
+		c, err := newHTTPClient(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.Get(server.URL)
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func TestNewHTTPCACert(t *testing.T) {
 	server := httptest.NewUnstartedServer(
 		http.HandlerFunc(
@@ -616,6 +1277,334 @@ func TestNewHTTPClientCert(t *testing.T) {
 	}
 }
 
+func TestTargetInitialScrapeGrace(t *testing.T) {
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+		),
+	)
+	defer server.Close()
+
+	testTarget := newTestTarget(server.URL, 10*time.Millisecond, model.LabelSet{})
+	testTarget.created = time.Now()
+	testTarget.initialScrapeGrace = time.Hour
+
+	app := &collectResultAppender{}
+	if err := testTarget.scrape(app); err == nil {
+		t.Fatal("expected scrape to fail")
+	}
+	if h := testTarget.status.Health(); h != HealthUnknown {
+		t.Errorf("expected health %s within grace period, got %s", HealthUnknown, h)
+	}
+	if testTarget.status.LastError() == nil {
+		t.Error("expected last error to be recorded within grace period")
+	}
+	if len(app.result) != 0 {
+		t.Errorf("expected no samples within grace period, got %v", app.result)
+	}
+
+	// Once the grace period expired, the target is reported down.
+	testTarget.created = time.Now().Add(-2 * time.Hour)
+
+	if err := testTarget.scrape(app); err == nil {
+		t.Fatal("expected scrape to fail")
+	}
+	if h := testTarget.status.Health(); h != HealthBad {
+		t.Errorf("expected health %s after grace period, got %s", HealthBad, h)
+	}
+	if len(app.result) != 2 || app.result[0].Metric[model.MetricNameLabel] != scrapeHealthMetricName || app.result[0].Value != 0 {
+		t.Errorf("expected %s of 0 after grace period, got %v", scrapeHealthMetricName, app.result)
+	}
+
+	// A target that was down before is not covered by the grace period.
+	testTarget.created = time.Now()
+
+	if err := testTarget.scrape(app); err == nil {
+		t.Fatal("expected scrape to fail")
+	}
+	if h := testTarget.status.Health(); h != HealthBad {
+		t.Errorf("expected health %s for target that was down before, got %s", HealthBad, h)
+	}
+}
+
+func TestTargetStaleExtendScrapes(t *testing.T) {
+	var fail bool
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if fail {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+				w.Write([]byte("test_metric{foo=\"bar\"} 1\n"))
+			},
+		),
+	)
+	defer server.Close()
+
+	testTarget := newTestTarget(server.URL, time.Second, model.LabelSet{})
+	testTarget.staleExtendScrapes = 2
+
+	// scrape returns the samples of the scraped metric, i.e. without the
+	// scrape health samples.
+	scrape := func() model.Samples {
+		app := &collectResultAppender{}
+		testTarget.scrape(app)
+
+		var samples model.Samples
+		for _, s := range app.result {
+			switch s.Metric[model.MetricNameLabel] {
+			case scrapeHealthMetricName, scrapeDurationMetricName:
+			default:
+				samples = append(samples, s)
+			}
+		}
+		return samples
+	}
+
+	if samples := scrape(); len(samples) != 1 {
+		t.Fatalf("expected 1 scraped sample, got %v", samples)
+	}
+
+	fail = true
+	for i := 1; i <= testTarget.staleExtendScrapes; i++ {
+		before := model.Now()
+		samples := scrape()
+		if len(samples) != 1 {
+			t.Fatalf("failed scrape %d: expected 1 re-emitted sample, got %v", i, samples)
+		}
+		s := samples[0]
+		if s.Metric["foo"] != "bar" || s.Value != 1 {
+			t.Errorf("failed scrape %d: unexpected re-emitted sample %v", i, s)
+		}
+		if s.Timestamp.Before(before) {
+			t.Errorf("failed scrape %d: expected re-emitted sample at the time of the failed scrape, got %v", i, s.Timestamp)
+		}
+		if h := testTarget.status.Health(); h != HealthBad {
+			t.Errorf("failed scrape %d: expected health %s, got %s", i, HealthBad, h)
+		}
+	}
+
+	// The series go stale after one more failed scrape.
+	if samples := scrape(); len(samples) != 1 || !metric.IsStaleNaN(samples[0].Value) {
+		t.Fatalf("expected a staleness marker after %d failed scrapes, got %v", testTarget.staleExtendScrapes+1, samples)
+	}
+	// Further failed scrapes do not re-emit them either.
+	if samples := scrape(); len(samples) != 0 {
+		t.Fatalf("expected no samples after series went stale, got %v", samples)
+	}
+
+	// A successful scrape resets the number of consecutive failures.
+	fail = false
+	if samples := scrape(); len(samples) != 1 {
+		t.Fatalf("expected 1 scraped sample, got %v", samples)
+	}
+	fail = true
+	if samples := scrape(); len(samples) != 1 {
+		t.Fatalf("expected 1 re-emitted sample after recovery, got %v", samples)
+	}
+}
+
+func TestTargetScrapeStaleMarkers(t *testing.T) {
+	var body string
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if body == "" {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+				w.Write([]byte(body))
+			},
+		),
+	)
+	defer server.Close()
+
+	testTarget := newTestTarget(server.URL, time.Second, model.LabelSet{})
+
+	// staleSeries returns the names of the series marked stale.
+	staleSeries := func(samples model.Samples) []string {
+		var names []string
+		for _, s := range samples {
+			if metric.IsStaleNaN(s.Value) {
+				names = append(names, string(s.Metric[model.MetricNameLabel]))
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+	scrape := func() []string {
+		app := &collectResultAppender{}
+		testTarget.scrape(app)
+		return staleSeries(app.result)
+	}
+
+	scenarios := []struct {
+		body  string
+		stale []string
+	}{
+		{body: "metric_a 1\nmetric_b 1\n", stale: nil},
+		{body: "metric_a 2\nmetric_b 2\n", stale: nil},
+		{body: "metric_a 3\n", stale: []string{"metric_b"}},
+		// A failed scrape marks all series stale.
+		{body: "", stale: []string{"metric_a"}},
+		{body: "", stale: nil},
+		{body: "metric_a 4\n", stale: nil},
+	}
+	for i, s := range scenarios {
+		body = s.body
+		if got := scrape(); !reflect.DeepEqual(got, s.stale) {
+			t.Errorf("%d. expected stale series %v, got %v", i, s.stale, got)
+		}
+	}
+
+	// Once the target disappeared, its series and the scrape health series
+	// are marked stale.
+	app := &collectResultAppender{}
+	testTarget.markSeriesStale(app)
+	expected := []string{"metric_a", scrapeDurationMetricName, scrapeHealthMetricName}
+	if got := staleSeries(app.result); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected stale series %v, got %v", expected, got)
+	}
+	if len(app.result) != len(expected) {
+		t.Errorf("expected only staleness markers, got %v", app.result)
+	}
+}
+
+func TestTargetTLSServerName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls_server_name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Serve a different certificate for each server name and trust both.
+	var (
+		serverNames = []string{"a.example.org", "b.example.org"}
+		certs       []tls.Certificate
+		caPEM       []byte
+	)
+	for _, name := range serverNames {
+		cert, certPEM := newSelfSignedCert(t, name)
+		certs = append(certs, cert)
+		caPEM = append(caPEM, certPEM...)
+	}
+	caFile := filepath.Join(dir, "ca.cer")
+	if err := ioutil.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+				w.Write([]byte(fmt.Sprintf("server_name{name=%q} 1\n", r.TLS.ServerName)))
+			},
+		),
+	)
+	server.TLS = &tls.Config{Certificates: certs}
+	server.TLS.BuildNameToCertificate()
+	server.StartTLS()
+	defer server.Close()
+
+	cfg := &config.ScrapeConfig{
+		ScrapeTimeout: config.Duration(1 * time.Second),
+		TLSConfig: config.TLSConfig{
+			CAFile:     caFile,
+			ServerName: "a.example.org",
+		},
+	}
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm := NewTargetManager(nopAppender{}, ConflictIgnore)
+
+	tests := []struct {
+		labels     model.LabelSet
+		serverName string
+		fail       bool
+	}{
+		{
+			// The server name of the scrape configuration is used by default.
+			labels:     model.LabelSet{},
+			serverName: "a.example.org",
+		},
+		{
+			labels:     model.LabelSet{tlsServerNameLabel: "b.example.org"},
+			serverName: "b.example.org",
+		},
+		{
+			// The certificate served for an unknown server name must not
+			// validate.
+			labels: model.LabelSet{tlsServerNameLabel: "c.example.org"},
+			fail:   true,
+		},
+	}
+
+	for i, test := range tests {
+		labels := model.LabelSet{
+			model.SchemeLabel:      "https",
+			model.AddressLabel:     model.LabelValue(serverURL.Host),
+			model.MetricsPathLabel: "/metrics",
+		}
+		for ln, lv := range test.labels {
+			labels[ln] = lv
+		}
+		c, err := tm.httpClient(cfg, labels[tlsServerNameLabel])
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := NewTarget(cfg, c, labels, labels)
+
+		app := &collectResultAppender{}
+		err = target.scrape(app)
+		if test.fail {
+			if err == nil {
+				t.Errorf("%d. expected scrape to fail", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d. unexpected scrape error: %s", i, err)
+			continue
+		}
+		if got := app.result[0].Metric["name"]; got != model.LabelValue(test.serverName) {
+			t.Errorf("%d. expected server name %q in handshake, got %q", i, test.serverName, got)
+		}
+	}
+}
+
+// newSelfSignedCert returns a self-signed certificate valid for the given DNS
+// name and its PEM encoding.
+func newSelfSignedCert(t *testing.T, dnsName string) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: dnsName},
+		DNSNames:              []string{dnsName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
 func newTLSConfig(t *testing.T) *tls.Config {
 	tlsConfig := &tls.Config{}
 	caCertPool := x509.NewCertPool()
@@ -15,17 +15,90 @@ package retrieval
 
 import (
 	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
 
 	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/relabel"
 	"github.com/prometheus/prometheus/retrieval/discovery"
 	"github.com/prometheus/prometheus/storage"
 )
 
+const (
+	// portsLabel is the name of the meta label holding a comma-separated list
+	// of ports. A target carrying it is expanded into one target per port
+	// before relabeling.
+	portsLabel = model.MetaLabelPrefix + "ports"
+	// portLabel is the name of the meta label holding the port of a target
+	// expanded from a list of ports.
+	portLabel = model.MetaLabelPrefix + "port"
+)
+
+var targetLabelConflicts = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "target_label_conflicts_total",
+		Help:      "The total number of targets that were dropped or marked unhealthy because their labels are identical to those of another target.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(targetLabelConflicts)
+}
+
+// TargetConflictPolicy determines how distinct targets with identical label
+// sets are handled. Scraping both would interleave their samples in the same
+// series.
+type TargetConflictPolicy int
+
+// Possible values for TargetConflictPolicy.
+const (
+	// ConflictIgnore scrapes all conflicting targets.
+	ConflictIgnore TargetConflictPolicy = iota
+	// ConflictDrop keeps the target seen first and drops the others until
+	// the conflict is resolved.
+	ConflictDrop
+	// ConflictMarkUnhealthy keeps all conflicting targets but stops scraping
+	// them and reports them as unhealthy until the conflict is resolved.
+	ConflictMarkUnhealthy
+)
+
+// String implements flag.Value.
+func (p TargetConflictPolicy) String() string {
+	switch p {
+	case ConflictIgnore:
+		return "ignore"
+	case ConflictDrop:
+		return "drop"
+	case ConflictMarkUnhealthy:
+		return "mark-unhealthy"
+	}
+	return "<unknown>"
+}
+
+// Set implements flag.Value.
+func (p *TargetConflictPolicy) Set(s string) error {
+	switch s {
+	case "ignore":
+		*p = ConflictIgnore
+	case "drop":
+		*p = ConflictDrop
+	case "mark-unhealthy":
+		*p = ConflictMarkUnhealthy
+	default:
+		return fmt.Errorf("invalid target conflict policy: %s", s)
+	}
+	return nil
+}
+
 // A TargetProvider provides information about target groups. It maintains a set
 // of sources from which TargetGroups can originate. Whenever a target provider
 // detects a potential change, it sends the TargetGroup through its provided channel.
@@ -54,17 +127,35 @@ type TargetManager struct {
 	sampleAppender storage.SampleAppender
 	running        bool
 	done           chan struct{}
+	conflictPolicy TargetConflictPolicy
 
 	// Targets by their source ID.
 	targets map[string][]*Target
+	// The targets kept by the ConflictDrop policy by the fingerprint of
+	// their labels.
+	keptTargets map[model.Fingerprint]*Target
 	// Providers by the scrape configs they are derived from.
 	providers map[*config.ScrapeConfig][]TargetProvider
+
+	// HTTP clients shared by the targets of a scrape config, so that
+	// connections are pooled across targets and scrapes.
+	clientsMtx sync.Mutex
+	clients    map[scrapeClientKey]*http.Client
 }
 
-// NewTargetManager creates a new TargetManager.
-func NewTargetManager(sampleAppender storage.SampleAppender) *TargetManager {
+// scrapeClientKey identifies the HTTP client of a target by the scrape config
+// and the TLS server name the target sets for itself, if any.
+type scrapeClientKey struct {
+	cfg        *config.ScrapeConfig
+	serverName model.LabelValue
+}
+
+// NewTargetManager creates a new TargetManager handling targets with
+// conflicting labels according to the given policy.
+func NewTargetManager(sampleAppender storage.SampleAppender, conflictPolicy TargetConflictPolicy) *TargetManager {
 	tm := &TargetManager{
 		sampleAppender: sampleAppender,
+		conflictPolicy: conflictPolicy,
 		targets:        map[string][]*Target{},
 	}
 	return tm
@@ -157,7 +248,7 @@ func (tm *TargetManager) Run() {
 	defer tm.mtx.Unlock()
 
 	// Remove old target groups that are no longer in the set of sources.
-	tm.removeTargets(func(src string) bool {
+	tm.removeTargets(true, func(src string) bool {
 		if _, ok := sources[src]; ok {
 			return false
 		}
@@ -209,15 +300,18 @@ func (tm *TargetManager) stop(removeTargets bool) {
 	defer tm.mtx.Unlock()
 
 	if removeTargets {
-		tm.removeTargets(nil)
+		// The targets did not disappear, so their series are not marked
+		// stale. Scraping resumes with them after a restart.
+		tm.removeTargets(false, nil)
 	}
 
 	tm.running = false
 }
 
 // removeTargets stops and removes targets for sources where f(source) is true
-// or if f is nil. This method is not thread-safe.
-func (tm *TargetManager) removeTargets(f func(string) bool) {
+// or if f is nil. The series of the removed targets are marked stale if
+// markStale is true. This method is not thread-safe.
+func (tm *TargetManager) removeTargets(markStale bool, f func(string) bool) {
 	if f == nil {
 		f = func(string) bool { return true }
 	}
@@ -230,12 +324,88 @@ func (tm *TargetManager) removeTargets(f func(string) bool) {
 		for _, target := range targets {
 			go func(t *Target) {
 				t.StopScraper()
+				if markStale {
+					t.markSeriesStale(tm.sampleAppender)
+				}
 				wg.Done()
 			}(target)
 		}
 		delete(tm.targets, src)
 	}
 	wg.Wait()
+	tm.resolveConflicts()
+}
+
+// resolveConflicts applies the conflict policy to all current targets. Targets
+// whose labels are identical to those of another target are marked as
+// conflicting, except for the target kept by the ConflictDrop policy, and the
+// mark of all others is cleared. As it runs over all targets on each update,
+// a conflicting target is reinstated once its conflict is resolved. This
+// method is not thread-safe.
+func (tm *TargetManager) resolveConflicts() {
+	if tm.conflictPolicy == ConflictIgnore {
+		return
+	}
+	sources := make([]string, 0, len(tm.targets))
+	for src := range tm.targets {
+		sources = append(sources, src)
+	}
+	sort.Strings(sources)
+
+	byLabels := map[model.Fingerprint][]*Target{}
+	for _, src := range sources {
+		for _, t := range tm.targets[src] {
+			fp := t.BaseLabels().Fingerprint()
+			byLabels[fp] = append(byLabels[fp], t)
+		}
+	}
+
+	kept := make(map[model.Fingerprint]*Target, len(byLabels))
+	for fp, ts := range byLabels {
+		if len(ts) == 1 {
+			ts[0].setConflict(nil)
+			kept[fp] = ts[0]
+			continue
+		}
+		if tm.conflictPolicy == ConflictDrop {
+			// Keep the target kept so far, if it still exists, and
+			// the target seen first otherwise.
+			keep := ts[0]
+			for _, t := range ts {
+				if t == tm.keptTargets[fp] {
+					keep = t
+					break
+				}
+			}
+			keep.setConflict(nil)
+			kept[fp] = keep
+			for _, t := range ts {
+				if t == keep {
+					continue
+				}
+				err := fmt.Errorf("labels %s are identical to those of target %s", t.BaseLabels(), keep.URL())
+				if t.setConflict(err) {
+					log.Warnf("Dropping target %s: %s", t.URL(), err)
+					targetLabelConflicts.Inc()
+				}
+			}
+			continue
+		}
+		for _, t := range ts {
+			others := make([]string, 0, len(ts)-1)
+			for _, other := range ts {
+				if other != t {
+					others = append(others, other.URL().String())
+				}
+			}
+			err := fmt.Errorf("labels %s are identical to those of target(s) %s", t.BaseLabels(), strings.Join(others, ", "))
+			if t.setConflict(err) {
+				log.Warnf("Marking target %s as unhealthy: %s", t.URL(), err)
+				targetLabelConflicts.Inc()
+			}
+		}
+	}
+	tm.keptTargets = kept
 }
 
 // updateTargetGroup creates new targets for the group and replaces the old targets
@@ -253,6 +423,9 @@ func (tm *TargetManager) updateTargetGroup(tgroup *config.TargetGroup, cfg *conf
 		return nil
 	}
 
+	// New targets are only started once conflicts are resolved so that
+	// they are not scraped while conflicting.
+	var started []*Target
 	oldTargets, ok := tm.targets[tgroup.Source]
 	if ok {
 		var wg sync.WaitGroup
@@ -277,12 +450,12 @@ func (tm *TargetManager) updateTargetGroup(tgroup *config.TargetGroup, cfg *conf
 				// to build up.
 				wg.Add(1)
 				go func(t *Target) {
-					match.Update(cfg, t.fullLabels(), t.metaLabels)
+					match.Update(cfg, t.httpClient, t.fullLabels(), t.metaLabels)
 					wg.Done()
 				}(tnew)
 				newTargets[i] = match
 			} else {
-				go tnew.RunScraper(tm.sampleAppender)
+				started = append(started, tnew)
 			}
 		}
 		// Remove all old targets that disappeared.
@@ -291,6 +464,7 @@ func (tm *TargetManager) updateTargetGroup(tgroup *config.TargetGroup, cfg *conf
 				wg.Add(1)
 				go func(t *Target) {
 					t.StopScraper()
+					t.markSeriesStale(tm.sampleAppender)
 					wg.Done()
 				}(told)
 			}
@@ -298,9 +472,7 @@ func (tm *TargetManager) updateTargetGroup(tgroup *config.TargetGroup, cfg *conf
 		wg.Wait()
 	} else {
 		// The source ID is new, start all target scrapers.
-		for _, tnew := range newTargets {
-			go tnew.RunScraper(tm.sampleAppender)
-		}
+		started = newTargets
 	}
 
 	if len(newTargets) > 0 {
@@ -308,6 +480,10 @@ func (tm *TargetManager) updateTargetGroup(tgroup *config.TargetGroup, cfg *conf
 	} else {
 		delete(tm.targets, tgroup.Source)
 	}
+	tm.resolveConflicts()
+	for _, t := range started {
+		go t.RunScraper(tm.sampleAppender)
+	}
 	return nil
 }
 
@@ -320,6 +496,9 @@ func (tm *TargetManager) Pools() map[string][]*Target {
 
 	for _, ts := range tm.targets {
 		for _, t := range ts {
+			if tm.conflictPolicy == ConflictDrop && t.hasConflict() {
+				continue
+			}
 			job := string(t.BaseLabels()[model.JobLabel])
 			pools[job] = append(pools[job], t)
 		}
@@ -331,6 +510,18 @@ func (tm *TargetManager) Pools() map[string][]*Target {
 // by the new cfg. The state of targets that are valid in the new configuration remains unchanged.
 // Returns true on success.
 func (tm *TargetManager) ApplyConfig(cfg *config.Config) bool {
+	// Create the HTTP clients upfront so that an invalid TLS or
+	// authentication setup fails the config rather than the scrapes.
+	clients := map[scrapeClientKey]*http.Client{}
+	for _, scfg := range cfg.ScrapeConfigs {
+		c, err := newHTTPClient(scfg)
+		if err != nil {
+			log.Errorf("Cannot create HTTP client for job %q: %s", scfg.JobName, err)
+			return false
+		}
+		clients[scrapeClientKey{cfg: scfg}] = c
+	}
+
 	tm.mtx.RLock()
 	running := tm.running
 	tm.mtx.RUnlock()
@@ -350,9 +541,42 @@ func (tm *TargetManager) ApplyConfig(cfg *config.Config) bool {
 	defer tm.mtx.Unlock()
 
 	tm.providers = providers
+
+	tm.clientsMtx.Lock()
+	tm.clients = clients
+	tm.clientsMtx.Unlock()
+
 	return true
 }
 
+// httpClient returns the HTTP client for targets of the given scrape config.
+// A non-empty serverName overrides the TLS server name of the config. Clients
+// not created by ApplyConfig are created on first use.
+func (tm *TargetManager) httpClient(cfg *config.ScrapeConfig, serverName model.LabelValue) (*http.Client, error) {
+	tm.clientsMtx.Lock()
+	defer tm.clientsMtx.Unlock()
+
+	key := scrapeClientKey{cfg: cfg, serverName: serverName}
+	if c, ok := tm.clients[key]; ok {
+		return c, nil
+	}
+	clientCfg := cfg
+	if serverName != "" {
+		c := *cfg
+		c.TLSConfig.ServerName = string(serverName)
+		clientCfg = &c
+	}
+	c, err := newHTTPClient(clientCfg)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create HTTP client: %s", err)
+	}
+	if tm.clients == nil {
+		tm.clients = map[scrapeClientKey]*http.Client{}
+	}
+	tm.clients[key] = c
+	return c, nil
+}
+
 // prefixedTargetProvider wraps TargetProvider and prefixes source strings
 // to make the sources unique across a configuration.
 type prefixedTargetProvider struct {
@@ -473,47 +697,90 @@ func (tm *TargetManager) targetsFromGroup(tg *config.TargetGroup, cfg *config.Sc
 			return nil, fmt.Errorf("instance %d in target group %s has no address", i, tg)
 		}
 
-		preRelabelLabels := labels
-
-		labels, err := Relabel(labels, cfg.RelabelConfigs...)
+		expanded, err := expandPorts(labels)
 		if err != nil {
-			return nil, fmt.Errorf("error while relabeling instance %d in target group %s: %s", i, tg, err)
+			return nil, fmt.Errorf("error while expanding ports of instance %d in target group %s: %s", i, tg, err)
 		}
-		// Check if the target was dropped.
-		if labels == nil {
-			continue
-		}
-		// If no port was provided, infer it based on the used scheme.
-		addr := string(labels[model.AddressLabel])
-		if !strings.Contains(addr, ":") {
-			switch labels[model.SchemeLabel] {
-			case "http", "":
-				addr = fmt.Sprintf("%s:80", addr)
-			case "https":
-				addr = fmt.Sprintf("%s:443", addr)
-			default:
-				panic(fmt.Errorf("targetsFromGroup: invalid scheme %q", cfg.Scheme))
+
+		for _, labels := range expanded {
+			preRelabelLabels := labels
+
+			labels, err := relabel.Process(labels, cfg.RelabelConfigs...)
+			if err != nil {
+				return nil, fmt.Errorf("error while relabeling instance %d in target group %s: %s", i, tg, err)
+			}
+			// Check if the target was dropped.
+			if labels == nil {
+				continue
+			}
+			// Relabeling may have set any scheme.
+			scheme := labels[model.SchemeLabel]
+			if scheme != "http" && scheme != "https" && scheme != "" {
+				return nil, fmt.Errorf("invalid scheme %q of instance %d in target group %s after relabeling", scheme, i, tg)
+			}
+			// If no port was provided, infer it based on the used scheme.
+			addr := string(labels[model.AddressLabel])
+			if !strings.Contains(addr, ":") {
+				if scheme == "https" {
+					addr = fmt.Sprintf("%s:443", addr)
+				} else {
+					addr = fmt.Sprintf("%s:80", addr)
+				}
+				labels[model.AddressLabel] = model.LabelValue(addr)
+			}
+			if err = config.CheckTargetAddress(labels[model.AddressLabel]); err != nil {
+				return nil, err
 			}
-			labels[model.AddressLabel] = model.LabelValue(addr)
-		}
-		if err = config.CheckTargetAddress(labels[model.AddressLabel]); err != nil {
-			return nil, err
-		}
 
-		for ln := range labels {
-			// Meta labels are deleted after relabelling. Other internal labels propagate to
-			// the target which decides whether they will be part of their label set.
-			if strings.HasPrefix(string(ln), model.MetaLabelPrefix) {
-				delete(labels, ln)
+			for ln := range labels {
+				// Meta labels are deleted after relabelling. Other internal labels propagate to
+				// the target which decides whether they will be part of their label set.
+				if strings.HasPrefix(string(ln), model.MetaLabelPrefix) {
+					delete(labels, ln)
+				}
+			}
+			client, err := tm.httpClient(cfg, labels[tlsServerNameLabel])
+			if err != nil {
+				return nil, err
 			}
+			tr := NewTarget(cfg, client, labels, preRelabelLabels)
+			targets = append(targets, tr)
 		}
-		tr := NewTarget(cfg, labels, preRelabelLabels)
-		targets = append(targets, tr)
 	}
 
 	return targets, nil
 }
 
+// expandPorts returns one label set per port listed in the portsLabel of the
+// given label set. The address of each returned label set is set to the host
+// of the original address combined with the respective port, which is also
+// exposed in the portLabel. If no portsLabel is set, the label set is returned
+// unchanged.
+func expandPorts(labels model.LabelSet) ([]model.LabelSet, error) {
+	ports, ok := labels[portsLabel]
+	if !ok {
+		return []model.LabelSet{labels}, nil
+	}
+	host := string(labels[model.AddressLabel])
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	var expanded []model.LabelSet
+	for _, port := range strings.Split(string(ports), ",") {
+		port = strings.TrimSpace(port)
+		if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+			return nil, fmt.Errorf("invalid port %q in %s label", port, portsLabel)
+		}
+		lset := labels.Clone()
+		delete(lset, portsLabel)
+		lset[model.AddressLabel] = model.LabelValue(net.JoinHostPort(host, port))
+		lset[portLabel] = model.LabelValue(port)
+		expanded = append(expanded, lset)
+	}
+	return expanded, nil
+}
+
 // StaticProvider holds a list of target groups that never change.
 type StaticProvider struct {
 	TargetGroups []*config.TargetGroup
@@ -14,11 +14,16 @@
 package retrieval
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
 
 	"github.com/prometheus/prometheus/config"
@@ -382,7 +387,7 @@ func TestTargetManagerConfigUpdate(t *testing.T) {
 	conf := &config.Config{}
 	*conf = config.DefaultConfig
 
-	targetManager := NewTargetManager(nopAppender{})
+	targetManager := NewTargetManager(nopAppender{}, ConflictIgnore)
 	targetManager.ApplyConfig(conf)
 
 	targetManager.Run()
@@ -419,9 +424,349 @@ func TestTargetManagerConfigUpdate(t *testing.T) {
 	}
 }
 
+func TestTargetsFromGroupExpandsPorts(t *testing.T) {
+	cfg := &config.ScrapeConfig{
+		JobName:        "test_job",
+		ScrapeInterval: config.Duration(1 * time.Minute),
+		ScrapeTimeout:  config.Duration(10 * time.Second),
+		MetricsPath:    "/metrics",
+		Scheme:         "http",
+		RelabelConfigs: []*config.RelabelConfig{
+			{
+				SourceLabels: model.LabelNames{portLabel},
+				Regex:        config.MustNewRegexp("(.*)"),
+				TargetLabel:  "port",
+				Replacement:  "$1",
+				Action:       config.RelabelReplace,
+			},
+		},
+	}
+	tg := &config.TargetGroup{
+		Targets: []model.LabelSet{
+			{model.AddressLabel: "example.org", portsLabel: "9100, 9101,9102"},
+			{model.AddressLabel: "example.com:8080"},
+		},
+	}
+
+	tm := NewTargetManager(nopAppender{}, ConflictIgnore)
+	targets, err := tm.targetsFromGroup(tg, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []model.LabelSet{
+		{model.InstanceLabel: "example.org:9100", model.JobLabel: "test_job", "port": "9100"},
+		{model.InstanceLabel: "example.org:9101", model.JobLabel: "test_job", "port": "9101"},
+		{model.InstanceLabel: "example.org:9102", model.JobLabel: "test_job", "port": "9102"},
+		{model.InstanceLabel: "example.com:8080", model.JobLabel: "test_job"},
+	}
+	if len(targets) != len(expected) {
+		t.Fatalf("expected %d targets, got %d", len(expected), len(targets))
+	}
+	for i, tr := range targets {
+		if got := tr.BaseLabels(); !reflect.DeepEqual(got, expected[i]) {
+			t.Errorf("%d. expected base labels %v, got %v", i, expected[i], got)
+		}
+	}
+
+	tg = &config.TargetGroup{
+		Targets: []model.LabelSet{
+			{model.AddressLabel: "example.org", portsLabel: "9100,http"},
+		},
+	}
+	if _, err := tm.targetsFromGroup(tg, cfg); err == nil {
+		t.Fatal("expected error for invalid port")
+	}
+}
+
+func TestTargetsFromGroupRelabelScheme(t *testing.T) {
+	cfg := &config.ScrapeConfig{
+		JobName:        "test_job",
+		ScrapeInterval: config.Duration(1 * time.Minute),
+		ScrapeTimeout:  config.Duration(10 * time.Second),
+		MetricsPath:    "/metrics",
+		Scheme:         "http",
+		RelabelConfigs: []*config.RelabelConfig{
+			{
+				SourceLabels: model.LabelNames{"__meta_scheme"},
+				Regex:        config.MustNewRegexp("(.+)"),
+				TargetLabel:  model.SchemeLabel,
+				Replacement:  "$1",
+				Action:       config.RelabelReplace,
+			},
+		},
+	}
+	tm := NewTargetManager(nopAppender{}, ConflictIgnore)
+
+	tg := &config.TargetGroup{
+		Targets: []model.LabelSet{
+			{model.AddressLabel: "example.org", "__meta_scheme": "https"},
+			{model.AddressLabel: "example.com"},
+		},
+	}
+	targets, err := tm.targetsFromGroup(tg, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []string{"https://example.org:443/metrics", "http://example.com:80/metrics"} {
+		if got := targets[i].URL().String(); got != expected {
+			t.Errorf("%d. expected URL %s, got %s", i, expected, got)
+		}
+	}
+
+	tg = &config.TargetGroup{
+		Targets: []model.LabelSet{
+			{model.AddressLabel: "example.org", "__meta_scheme": "ftp"},
+		},
+	}
+	if _, err := tm.targetsFromGroup(tg, cfg); err == nil {
+		t.Fatal("expected error for invalid scheme")
+	}
+}
+
 func TestHandleUpdatesReturnsWhenUpdateChanIsClosed(t *testing.T) {
-	tm := NewTargetManager(nopAppender{})
+	tm := NewTargetManager(nopAppender{}, ConflictIgnore)
 	ch := make(chan targetGroupUpdate)
 	close(ch)
 	tm.handleUpdates(ch, make(chan struct{}))
 }
+
+func TestTargetManagerStopHaltsScraping(t *testing.T) {
+	var scrapes int32
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&scrapes, 1)
+				w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+				w.Write([]byte("test_metric 1\n"))
+			},
+		),
+	)
+	defer server.Close()
+
+	tm := NewTargetManager(nopAppender{}, ConflictIgnore)
+	tm.ApplyConfig(&config.Config{
+		ScrapeConfigs: []*config.ScrapeConfig{{
+			JobName:        "test_job",
+			ScrapeInterval: config.Duration(5 * time.Millisecond),
+			ScrapeTimeout:  config.Duration(time.Second),
+			MetricsPath:    "/metrics",
+			Scheme:         "http",
+			TargetGroups: []*config.TargetGroup{{
+				Targets: []model.LabelSet{
+					{model.AddressLabel: model.LabelValue(strings.TrimPrefix(server.URL, "http://"))},
+				},
+			}},
+		}},
+	})
+	go tm.Run()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&scrapes) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("target was not scraped")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	tm.Stop()
+	stopped := atomic.LoadInt32(&scrapes)
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt32(&scrapes); got != stopped {
+		t.Fatalf("expected no scrapes after stopping, got %d more", got-stopped)
+	}
+	if pools := tm.Pools(); len(pools) != 0 {
+		t.Fatalf("expected no targets after stopping, got %v", pools)
+	}
+
+	// Stopping again must be a no-op.
+	tm.Stop()
+}
+
+func TestTargetManagerLabelConflicts(t *testing.T) {
+	// Both jobs end up with the same job and instance labels for their
+	// distinct targets.
+	newConfig := func(target model.LabelValue) (*config.ScrapeConfig, *config.TargetGroup) {
+		cfg := &config.ScrapeConfig{
+			JobName:        "test_job",
+			ScrapeInterval: config.Duration(time.Hour),
+			ScrapeTimeout:  config.Duration(time.Second),
+			MetricsPath:    "/metrics",
+			Scheme:         "http",
+			RelabelConfigs: []*config.RelabelConfig{{
+				SourceLabels: model.LabelNames{model.AddressLabel},
+				Regex:        config.MustNewRegexp(".*"),
+				TargetLabel:  model.InstanceLabel,
+				Replacement:  "shared",
+				Action:       config.RelabelReplace,
+			}},
+		}
+		tg := &config.TargetGroup{
+			Source:  string(target),
+			Targets: []model.LabelSet{{model.AddressLabel: target}},
+		}
+		return cfg, tg
+	}
+	conflicts := func() float64 {
+		var m dto.Metric
+		if err := targetLabelConflicts.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	setup := func(policy TargetConflictPolicy) *TargetManager {
+		tm := NewTargetManager(nopAppender{}, policy)
+		tm.running = true
+		for _, target := range []model.LabelValue{"a.example.org:80", "b.example.org:80"} {
+			cfg, tg := newConfig(target)
+			if err := tm.updateTargetGroup(tg, cfg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return tm
+	}
+
+	before := conflicts()
+	tm := setup(ConflictIgnore)
+	pool := tm.Pools()["test_job"]
+	if len(pool) != 2 {
+		t.Fatalf("expected 2 targets when ignoring conflicts, got %d", len(pool))
+	}
+	for _, tr := range pool {
+		if tr.hasConflict() {
+			t.Errorf("expected target %s not to be conflicting", tr.URL())
+		}
+	}
+	if got := conflicts() - before; got != 0 {
+		t.Errorf("expected no conflicts, got %v", got)
+	}
+	tm.removeTargets(false, nil)
+
+	before = conflicts()
+	tm = setup(ConflictDrop)
+	pool = tm.Pools()["test_job"]
+	if len(pool) != 1 {
+		t.Fatalf("expected 1 target after dropping conflicts, got %d", len(pool))
+	}
+	if got, want := pool[0].URL().Host, "a.example.org:80"; got != want {
+		t.Errorf("expected target %s to be kept, got %s", want, got)
+	}
+	// Updating the dropped target again does not count the same conflict
+	// twice, and the kept target stays kept.
+	cfg, tg := newConfig("b.example.org:80")
+	if err := tm.updateTargetGroup(tg, cfg); err != nil {
+		t.Fatal(err)
+	}
+	pool = tm.Pools()["test_job"]
+	if len(pool) != 1 || pool[0].URL().Host != "a.example.org:80" {
+		t.Fatalf("expected only target a.example.org:80 to be kept, got %v", pool)
+	}
+	if got := conflicts() - before; got != 1 {
+		t.Errorf("expected 1 conflict, got %v", got)
+	}
+	// The dropped target is reinstated once the kept one disappears.
+	cfg, tg = newConfig("a.example.org:80")
+	tg.Targets = nil
+	if err := tm.updateTargetGroup(tg, cfg); err != nil {
+		t.Fatal(err)
+	}
+	pool = tm.Pools()["test_job"]
+	if len(pool) != 1 || pool[0].URL().Host != "b.example.org:80" {
+		t.Fatalf("expected target b.example.org:80 to be reinstated, got %v", pool)
+	}
+	if pool[0].hasConflict() {
+		t.Errorf("expected conflict of reinstated target to be cleared")
+	}
+	tm.removeTargets(false, nil)
+
+	before = conflicts()
+	tm = setup(ConflictMarkUnhealthy)
+	pool = tm.Pools()["test_job"]
+	if len(pool) != 2 {
+		t.Fatalf("expected 2 targets marked unhealthy, got %d", len(pool))
+	}
+	for _, tr := range pool {
+		if tr.Status().Health() != HealthBad {
+			t.Errorf("expected target %s to be unhealthy", tr.URL())
+		}
+		if err := tr.Status().LastError(); err == nil || !strings.Contains(err.Error(), "identical") {
+			t.Errorf("expected conflict error for target %s, got %v", tr.URL(), err)
+		}
+		// Scraping a conflicting target must not touch the network.
+		if err := tr.scrape(nopAppender{}); err == nil || !strings.Contains(err.Error(), "identical") {
+			t.Errorf("expected scrape of target %s to fail with conflict error, got %v", tr.URL(), err)
+		}
+	}
+	if got := conflicts() - before; got != 2 {
+		t.Errorf("expected 2 conflicts, got %v", got)
+	}
+
+	// Resolving the conflict clears the mark.
+	cfg, tg = newConfig("b.example.org:80")
+	tg.Targets = nil
+	if err := tm.updateTargetGroup(tg, cfg); err != nil {
+		t.Fatal(err)
+	}
+	pool = tm.Pools()["test_job"]
+	if len(pool) != 1 {
+		t.Fatalf("expected 1 target, got %d", len(pool))
+	}
+	if pool[0].hasConflict() {
+		t.Errorf("expected conflict to be cleared")
+	}
+	tm.removeTargets(false, nil)
+}
+
+func TestTargetManagerHTTPClients(t *testing.T) {
+	cfg := &config.ScrapeConfig{
+		JobName:        "test_job",
+		ScrapeInterval: config.Duration(1 * time.Minute),
+		ScrapeTimeout:  config.Duration(10 * time.Second),
+		MetricsPath:    "/metrics",
+		Scheme:         "https",
+	}
+	tm := NewTargetManager(nopAppender{}, ConflictIgnore)
+	if !tm.ApplyConfig(&config.Config{ScrapeConfigs: []*config.ScrapeConfig{cfg}}) {
+		t.Fatal("expected config to be applied")
+	}
+
+	tg := &config.TargetGroup{
+		Targets: []model.LabelSet{
+			{model.AddressLabel: "a.example.org:443"},
+			{model.AddressLabel: "b.example.org:443"},
+			{model.AddressLabel: "c.example.org:443", tlsServerNameLabel: "c.example.org"},
+			{model.AddressLabel: "d.example.org:443", tlsServerNameLabel: "c.example.org"},
+		},
+	}
+	targets, err := tm.targetsFromGroup(tg, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if targets[0].httpClient != targets[1].httpClient {
+		t.Error("expected targets of the same job to share their HTTP client")
+	}
+	if targets[2].httpClient == targets[0].httpClient {
+		t.Error("expected target with TLS server name to have its own HTTP client")
+	}
+	if targets[2].httpClient != targets[3].httpClient {
+		t.Error("expected targets with the same TLS server name to share their HTTP client")
+	}
+
+	// An unusable TLS configuration fails the config and keeps the
+	// previous one.
+	badCfg := *cfg
+	badCfg.TLSConfig.CAFile = "testdata/nonexistent.cer"
+	if tm.ApplyConfig(&config.Config{ScrapeConfigs: []*config.ScrapeConfig{&badCfg}}) {
+		t.Fatal("expected config with missing CA file to fail")
+	}
+	if _, ok := tm.providers[cfg]; !ok {
+		t.Error("expected previous scrape config to be kept")
+	}
+	c, err := tm.httpClient(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != targets[0].httpClient {
+		t.Error("expected HTTP clients of the previous config to be kept")
+	}
+}
@@ -15,13 +15,16 @@ package rules
 
 import (
 	"fmt"
-	"html/template"
+	html_template "html/template"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
 
 	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/template"
 	"github.com/prometheus/prometheus/util/strutil"
 )
 
@@ -103,7 +106,8 @@ type AlertingRule struct {
 	// The duration for which a labelset needs to persist in the expression
 	// output vector before an alert transitions from Pending to Firing state.
 	holdDuration time.Duration
-	// Extra labels to attach to the resulting alert sample vectors.
+	// Extra labels to attach to the resulting alert sample vectors. Their
+	// values may be templates, see expandLabels.
 	labels model.LabelSet
 	// Short alert summary, suitable for email subjects.
 	summary string
@@ -117,6 +121,10 @@ type AlertingRule struct {
 	// A map of alerts which are currently active (Pending or Firing), keyed by
 	// the fingerprint of the labelset they correspond to.
 	activeAlerts map[model.Fingerprint]*Alert
+	// If positive, alerts created by the next evaluation are considered
+	// active since that long before the evaluation. Used to not reset
+	// holding conditions completely on restart.
+	forGrace time.Duration
 }
 
 // NewAlertingRule constructs a new AlertingRule.
@@ -142,6 +150,42 @@ func NewAlertingRule(
 	}
 }
 
+// expandLabels returns the extra labels of the rule with their values expanded
+// as templates with the labels and value of the given sample. Labels are only
+// expanded once an alert is created, so that its label set stays the same
+// while it is active. If expanding a value fails, the unexpanded value is kept.
+func (rule *AlertingRule) expandLabels(sample *model.Sample, timestamp model.Time, engine *promql.Engine) model.LabelSet {
+	var tmplData struct {
+		Labels map[string]string
+		Value  float64
+	}
+	expanded := make(model.LabelSet, len(rule.labels))
+	for ln, lv := range rule.labels {
+		if !strings.Contains(string(lv), "{{") {
+			expanded[ln] = lv
+			continue
+		}
+		if tmplData.Labels == nil {
+			tmplData.Labels = make(map[string]string, len(sample.Metric))
+			for k, v := range sample.Metric {
+				tmplData.Labels[string(k)] = string(v)
+			}
+			tmplData.Value = float64(sample.Value)
+		}
+		// Inject the same convenience variables as for annotations.
+		defs := "{{$labels := .Labels}}{{$value := .Value}}"
+		tmpl := template.NewTemplateExpander(defs+string(lv), "__alert_label_"+string(ln), tmplData, timestamp, engine, "")
+		result, err := tmpl.Expand()
+		if err != nil {
+			log.Warnf("Error expanding label %s of alert %v with data '%v': %v", ln, rule.name, tmplData, err)
+			expanded[ln] = lv
+			continue
+		}
+		expanded[ln] = model.LabelValue(result)
+	}
+	return expanded
+}
+
 // Name returns the name of the alert.
 func (rule *AlertingRule) Name() string {
 	return rule.name
@@ -171,7 +215,7 @@ func (rule *AlertingRule) eval(timestamp model.Time, engine *promql.Engine) (mod
 
 		if alert, ok := rule.activeAlerts[fp]; !ok {
 			labels := model.LabelSet(sample.Metric.Clone())
-			labels = labels.Merge(rule.labels)
+			labels = labels.Merge(rule.expandLabels(sample, timestamp, engine))
 			if _, ok := labels[model.MetricNameLabel]; ok {
 				delete(labels, model.MetricNameLabel)
 			}
@@ -179,13 +223,14 @@ func (rule *AlertingRule) eval(timestamp model.Time, engine *promql.Engine) (mod
 				Name:        rule.name,
 				Labels:      labels,
 				State:       StatePending,
-				ActiveSince: timestamp,
+				ActiveSince: timestamp.Add(-rule.forGrace),
 				Value:       sample.Value,
 			}
 		} else {
 			alert.Value = sample.Value
 		}
 	}
+	rule.forGrace = 0
 
 	var vector model.Vector
 
@@ -226,7 +271,7 @@ func (rule *AlertingRule) String() string {
 // HTMLSnippet returns an HTML snippet representing this alerting rule. The
 // resulting snippet is expected to be presented in a <pre> element, so that
 // line breaks and other returned whitespace is respected.
-func (rule *AlertingRule) HTMLSnippet(pathPrefix string) template.HTML {
+func (rule *AlertingRule) HTMLSnippet(pathPrefix string) html_template.HTML {
 	alertMetric := model.Metric{
 		model.MetricNameLabel: alertMetricName,
 		alertNameLabel:        model.LabelValue(rule.name),
@@ -242,7 +287,7 @@ func (rule *AlertingRule) HTMLSnippet(pathPrefix string) template.HTML {
 	s += fmt.Sprintf("\n  SUMMARY %q", rule.summary)
 	s += fmt.Sprintf("\n  DESCRIPTION %q", rule.description)
 	s += fmt.Sprintf("\n  RUNBOOK %q", rule.runbook)
-	return template.HTML(s)
+	return html_template.HTML(s)
 }
 
 // State returns the "maximum" state: firing > pending > inactive.
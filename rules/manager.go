@@ -18,6 +18,7 @@ import (
 	"io/ioutil"
 	"net/url"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -42,6 +43,8 @@ const (
 	ruleTypeLabel     = "rule_type"
 	ruleTypeAlerting  = "alerting"
 	ruleTypeRecording = "recording"
+
+	ruleGroupLabel = "rule_group"
 )
 
 var (
@@ -63,13 +66,32 @@ var (
 	iterationDuration = prometheus.NewSummary(prometheus.SummaryOpts{
 		Namespace:  namespace,
 		Name:       "evaluator_duration_milliseconds",
-		Help:       "The duration for all evaluations to execute.",
+		Help:       "The duration for all evaluations of the default rule group to execute.",
 		Objectives: map[float64]float64{0.01: 0.001, 0.05: 0.005, 0.5: 0.05, 0.90: 0.01, 0.99: 0.001},
 	})
+	groupDuration = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace:  namespace,
+			Name:       "rule_group_duration_milliseconds",
+			Help:       "The duration for all evaluations of a rule group to execute.",
+			Objectives: map[float64]float64{0.01: 0.001, 0.05: 0.005, 0.5: 0.05, 0.90: 0.01, 0.99: 0.001},
+		},
+		[]string{ruleGroupLabel},
+	)
+	groupLastDuration = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "rule_group_last_duration_seconds",
+			Help:      "The duration of the last evaluation of a rule group.",
+		},
+		[]string{ruleGroupLabel},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(iterationDuration)
+	prometheus.MustRegister(groupDuration)
+	prometheus.MustRegister(groupLastDuration)
 	prometheus.MustRegister(evalFailures)
 	prometheus.MustRegister(evalDuration)
 }
@@ -88,100 +110,228 @@ type Rule interface {
 	HTMLSnippet(pathPrefix string) html_template.HTML
 }
 
+// A ruleGroup is a list of rules evaluated one after another at a common
+// interval, independently of other groups.
+type ruleGroup struct {
+	name     string
+	interval time.Duration
+	rules    []Rule
+
+	done       chan struct{}
+	terminated chan struct{}
+}
+
+func newRuleGroup(name string, interval time.Duration, rules []Rule) *ruleGroup {
+	return &ruleGroup{
+		name:       name,
+		interval:   interval,
+		rules:      rules,
+		done:       make(chan struct{}),
+		terminated: make(chan struct{}),
+	}
+}
+
+// run evaluates the rules of the group every interval until stop is called.
+func (g *ruleGroup) run(m *Manager) {
+	defer close(g.terminated)
+
+	if g.interval <= 0 {
+		<-g.done
+		return
+	}
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	for {
+		// The outer select clause makes sure that g.done is looked at
+		// first. Otherwise, if evaluating the group takes longer than
+		// its interval, there is only a 50% chance that g.done will be
+		// looked at before the next evaluation happens.
+		select {
+		case <-g.done:
+			return
+		default:
+			select {
+			case <-ticker.C:
+				// Wait for a free evaluation slot, if they are
+				// limited.
+				if m.evalSlots != nil {
+					select {
+					case m.evalSlots <- struct{}{}:
+					case <-g.done:
+						return
+					}
+				}
+				start := time.Now()
+				m.evalGroup(g)
+				duration := time.Since(start)
+				if m.evalSlots != nil {
+					<-m.evalSlots
+				}
+
+				groupDuration.WithLabelValues(g.name).Observe(float64(duration / time.Millisecond))
+				groupLastDuration.WithLabelValues(g.name).Set(duration.Seconds())
+				if g.name == config.DefaultRuleGroupName {
+					iterationDuration.Observe(float64(duration / time.Millisecond))
+				}
+			case <-g.done:
+				return
+			}
+		}
+	}
+}
+
+// stop stops the evaluation of the group and waits for an ongoing evaluation
+// to finish.
+func (g *ruleGroup) stop() {
+	close(g.done)
+	<-g.terminated
+}
+
 // The Manager manages recording and alerting rules.
 type Manager struct {
-	// Protects the rules list.
+	// Protects the rule lists and whether the manager is running.
 	sync.Mutex
-	rules []Rule
+	// All rules of all groups, in group order.
+	rules   []Rule
+	groups  []*ruleGroup
+	running bool
 
-	done chan bool
+	done       chan bool
+	terminated chan struct{}
+	// Limits the number of groups evaluated concurrently. Unlimited, if
+	// nil.
+	evalSlots chan struct{}
 
-	interval    time.Duration
 	queryEngine *promql.Engine
 
 	sampleAppender      storage.SampleAppender
 	notificationHandler *notification.NotificationHandler
 
 	externalURL *url.URL
+
+	forGracePeriod  time.Duration
+	evaluationDelay time.Duration
+	// The always firing watchdog alert added to the default group. None,
+	// if nil.
+	watchdog *AlertingRule
+	// Whether rules have been loaded successfully before.
+	rulesLoaded bool
 }
 
 // ManagerOptions bundles options for the Manager.
 type ManagerOptions struct {
-	EvaluationInterval time.Duration
-	QueryEngine        *promql.Engine
+	QueryEngine *promql.Engine
 
 	NotificationHandler *notification.NotificationHandler
 	SampleAppender      storage.SampleAppender
 
 	ExternalURL *url.URL
+
+	// ForGracePeriod is how long before their first evaluation alerts of
+	// the initially loaded rules are considered active.
+	ForGracePeriod time.Duration
+	// EvaluationDelay is how long before the actual evaluation time rules
+	// are evaluated and their samples are timestamped.
+	EvaluationDelay time.Duration
+	// MaxConcurrentEvaluations is the maximum number of rule groups
+	// evaluated at the same time. Unlimited, if not positive.
+	MaxConcurrentEvaluations int
+	// WatchdogAlert is the name of an alert that always fires, evaluated
+	// with the rules of the default group. A receiver expecting its
+	// notifications detects that Prometheus or its alerting is down once
+	// they stop. No such alert, if empty.
+	WatchdogAlert string
+	// WatchdogLabels are the labels attached to the watchdog alert.
+	WatchdogLabels model.LabelSet
 }
 
 // NewManager returns an implementation of Manager, ready to be started
 // by calling the Run method.
 func NewManager(o *ManagerOptions) *Manager {
 	manager := &Manager{
-		rules: []Rule{},
-		done:  make(chan bool),
+		rules:      []Rule{},
+		done:       make(chan bool),
+		terminated: make(chan struct{}),
 
-		interval:            o.EvaluationInterval,
 		sampleAppender:      o.SampleAppender,
 		queryEngine:         o.QueryEngine,
 		notificationHandler: o.NotificationHandler,
 		externalURL:         o.ExternalURL,
+		forGracePeriod:      o.ForGracePeriod,
+		evaluationDelay:     o.EvaluationDelay,
+	}
+	if o.MaxConcurrentEvaluations > 0 {
+		manager.evalSlots = make(chan struct{}, o.MaxConcurrentEvaluations)
+	}
+	if o.WatchdogAlert != "" {
+		manager.watchdog = newWatchdogRule(o.WatchdogAlert, o.WatchdogLabels)
 	}
 	return manager
 }
 
-// Run the rule manager's periodic rule evaluation.
+// newWatchdogRule returns an alerting rule of the given name and labels that
+// always fires.
+func newWatchdogRule(name string, labels model.LabelSet) *AlertingRule {
+	expr, err := promql.ParseExpr("vector(1)")
+	if err != nil {
+		panic(err)
+	}
+	return NewAlertingRule(
+		name, expr, 0, labels,
+		"Watchdog alert that is always firing",
+		"This alert fires as long as Prometheus evaluates rules and sends notifications. If it stops being received, Prometheus or its alerting pipeline is broken.",
+		"",
+	)
+}
+
+// Run the rule manager's periodic rule evaluation. Each rule group is
+// evaluated at its own interval.
 func (m *Manager) Run() {
 	defer log.Info("Rule manager stopped.")
+	defer close(m.terminated)
 
 	m.Lock()
-	lastInterval := m.interval
+	m.running = true
+	for _, g := range m.groups {
+		go g.run(m)
+	}
 	m.Unlock()
 
-	ticker := time.NewTicker(lastInterval)
-	defer ticker.Stop()
+	<-m.done
 
-	for {
-		// The outer select clause makes sure that m.done is looked at
-		// first. Otherwise, if m.runIteration takes longer than
-		// m.interval, there is only a 50% chance that m.done will be
-		// looked at before the next m.runIteration call happens.
-		select {
-		case <-m.done:
-			return
-		default:
-			select {
-			case <-ticker.C:
-				start := time.Now()
-				m.runIteration()
-				iterationDuration.Observe(float64(time.Since(start) / time.Millisecond))
-
-				m.Lock()
-				if lastInterval != m.interval {
-					ticker.Stop()
-					ticker = time.NewTicker(m.interval)
-					lastInterval = m.interval
-				}
-				m.Unlock()
-			case <-m.done:
-				return
-			}
-		}
+	m.Lock()
+	defer m.Unlock()
+	m.running = false
+	for _, g := range m.groups {
+		g.stop()
 	}
 }
 
-// Stop the rule manager's rule evaluation cycles.
+// Stop the rule manager's rule evaluation cycles. It returns once ongoing
+// evaluations have finished.
 func (m *Manager) Stop() {
 	log.Info("Stopping rule manager...")
 	m.done <- true
+	<-m.terminated
 }
 
 func (m *Manager) queueAlertNotifications(rule *AlertingRule, timestamp model.Time) {
+	notifications := m.alertNotifications(rule, timestamp)
+	if len(notifications) == 0 {
+		return
+	}
+	m.notificationHandler.SubmitReqs(notifications)
+}
+
+// alertNotifications returns the notifications for the firing alerts of the
+// rule. Summary, description and runbook are expanded as templates with the
+// labels and value of the alert. If expanding one of them fails, its
+// unexpanded text is sent instead.
+func (m *Manager) alertNotifications(rule *AlertingRule, timestamp model.Time) notification.NotificationReqs {
 	activeAlerts := rule.ActiveAlerts()
 	if len(activeAlerts) == 0 {
-		return
+		return nil
 	}
 
 	notifications := make(notification.NotificationReqs, 0, len(activeAlerts))
@@ -211,8 +361,8 @@ func (m *Manager) queueAlertNotifications(rule *AlertingRule, timestamp model.Ti
 			tmpl := template.NewTemplateExpander(defs+text, "__alert_"+rule.Name(), tmplData, timestamp, m.queryEngine, m.externalURL.Path)
 			result, err := tmpl.Expand()
 			if err != nil {
-				result = err.Error()
 				log.Warnf("Error expanding alert template %v with data '%v': %v", rule.Name(), tmplData, err)
+				return text
 			}
 			return result
 		}
@@ -220,7 +370,7 @@ func (m *Manager) queueAlertNotifications(rule *AlertingRule, timestamp model.Ti
 		notifications = append(notifications, &notification.NotificationReq{
 			Summary:     expand(rule.summary),
 			Description: expand(rule.description),
-			Runbook:     rule.runbook,
+			Runbook:     expand(rule.runbook),
 			Labels: aa.Labels.Merge(model.LabelSet{
 				alertNameLabel: model.LabelValue(rule.Name()),
 			}),
@@ -230,78 +380,87 @@ func (m *Manager) queueAlertNotifications(rule *AlertingRule, timestamp model.Ti
 			GeneratorURL: m.externalURL.String() + strutil.GraphLinkForExpression(rule.vector.String()),
 		})
 	}
-	m.notificationHandler.SubmitReqs(notifications)
+	return notifications
 }
 
-func (m *Manager) runIteration() {
-	now := model.Now()
-	wg := sync.WaitGroup{}
+// evalGroup evaluates the rules of the group one after another, so that the
+// samples recorded by a rule are available to the rules following it.
+func (m *Manager) evalGroup(g *ruleGroup) {
+	now := model.Now().Add(-m.evaluationDelay)
 
-	m.Lock()
-	rulesSnapshot := make([]Rule, len(m.rules))
-	copy(rulesSnapshot, m.rules)
-	m.Unlock()
+	for _, rule := range g.rules {
+		start := time.Now()
+		vector, err := rule.eval(now, m.queryEngine)
+		duration := time.Since(start)
 
-	for _, rule := range rulesSnapshot {
-		wg.Add(1)
-		// BUG(julius): Look at fixing thundering herd.
-		go func(rule Rule) {
-			defer wg.Done()
+		if err != nil {
+			evalFailures.Inc()
+			log.Warnf("Error while evaluating rule %q of group %q: %s", rule, g.name, err)
+			continue
+		}
 
-			start := time.Now()
-			vector, err := rule.eval(now, m.queryEngine)
-			duration := time.Since(start)
+		switch r := rule.(type) {
+		case *AlertingRule:
+			m.queueAlertNotifications(r, now)
+			evalDuration.WithLabelValues(ruleTypeAlerting).Observe(
+				float64(duration / time.Millisecond),
+			)
+		case *RecordingRule:
+			evalDuration.WithLabelValues(ruleTypeRecording).Observe(
+				float64(duration / time.Millisecond),
+			)
+		default:
+			panic(fmt.Errorf("unknown rule type: %T", rule))
+		}
 
-			if err != nil {
-				evalFailures.Inc()
-				log.Warnf("Error while evaluating rule %q: %s", rule, err)
-				return
+		var appendErr error
+		for _, s := range vector {
+			if err := storage.TryAppend(m.sampleAppender, s); err != nil && appendErr == nil {
+				appendErr = err
 			}
+		}
+		if appendErr != nil {
+			evalFailures.Inc()
+			log.Warnf("Error while appending samples of rule %q of group %q: %s", rule, g.name, appendErr)
+		}
+	}
+}
 
-			switch r := rule.(type) {
-			case *AlertingRule:
-				m.queueAlertNotifications(r, now)
-				evalDuration.WithLabelValues(ruleTypeAlerting).Observe(
-					float64(duration / time.Millisecond),
-				)
-			case *RecordingRule:
-				evalDuration.WithLabelValues(ruleTypeRecording).Observe(
-					float64(duration / time.Millisecond),
-				)
-			default:
-				panic(fmt.Errorf("unknown rule type: %T", rule))
-			}
+// alertingRuleKey identifies an alerting rule across reloads.
+type alertingRuleKey struct {
+	group  string
+	name   string
+	labels model.Fingerprint
+}
 
-			for _, s := range vector {
-				m.sampleAppender.Append(s)
+// forEachAlertingRule calls f for every alerting rule of the manager's groups
+// with its key.
+func (m *Manager) forEachAlertingRule(f func(alertingRuleKey, *AlertingRule)) {
+	for _, g := range m.groups {
+		for _, r := range g.rules {
+			if ar, ok := r.(*AlertingRule); ok {
+				f(alertingRuleKey{group: g.name, name: ar.name, labels: ar.labels.Fingerprint()}, ar)
 			}
-		}(rule)
+		}
 	}
-	wg.Wait()
 }
 
 // transferAlertState makes a copy of the state of alerting rules and returns a function
-// that restores them in the current state.
+// that restores them in the current state. The state of a rule is restored
+// for a rule of the same name and labels in a group of the same name.
 func (m *Manager) transferAlertState() func() {
-
-	alertingRules := map[string]*AlertingRule{}
-	for _, r := range m.rules {
-		if ar, ok := r.(*AlertingRule); ok {
-			alertingRules[ar.name] = ar
-		}
-	}
+	alertingRules := map[alertingRuleKey]*AlertingRule{}
+	m.forEachAlertingRule(func(k alertingRuleKey, ar *AlertingRule) {
+		alertingRules[k] = ar
+	})
 
 	return func() {
 		// Restore alerting rule state.
-		for _, r := range m.rules {
-			ar, ok := r.(*AlertingRule)
-			if !ok {
-				continue
-			}
-			if old, ok := alertingRules[ar.name]; ok {
+		m.forEachAlertingRule(func(k alertingRuleKey, ar *AlertingRule) {
+			if old, ok := alertingRules[k]; ok {
 				ar.activeAlerts = old.activeAlerts
 			}
-		}
+		})
 	}
 }
 
@@ -311,61 +470,179 @@ func (m *Manager) ApplyConfig(conf *config.Config) bool {
 	m.Lock()
 	defer m.Unlock()
 
-	defer m.transferAlertState()()
-
 	success := true
-	m.interval = time.Duration(conf.GlobalConfig.EvaluationInterval)
 
-	rulesSnapshot := make([]Rule, len(m.rules))
-	copy(rulesSnapshot, m.rules)
-	m.rules = m.rules[:0]
-
-	var files []string
-	for _, pat := range conf.RuleFiles {
-		fs, err := filepath.Glob(pat)
+	var groups []*ruleGroup
+	for _, gc := range ruleGroupConfigs(conf) {
+		var files []string
+		for _, pat := range gc.RuleFiles {
+			fs, err := filepath.Glob(pat)
+			if err != nil {
+				// The only error can be a bad pattern.
+				log.Errorf("Error retrieving rule files for %s: %s", pat, err)
+				success = false
+			}
+			files = append(files, fs...)
+		}
+		rules, err := loadRuleFiles(files...)
 		if err != nil {
-			// The only error can be a bad pattern.
-			log.Errorf("Error retrieving rule files for %s: %s", pat, err)
-			success = false
+			// If loading the new rules failed, keep the old rule set.
+			log.Errorf("Error loading rules of group %q, previous rule set restored: %s", gc.Name, err)
+			return false
 		}
-		files = append(files, fs...)
+		if gc.Name == config.DefaultRuleGroupName && m.watchdog != nil {
+			rules = append(rules, m.watchdog)
+		}
+		if len(rules) > 0 {
+			groups = append(groups, newRuleGroup(gc.Name, time.Duration(gc.EvaluationInterval), rules))
+		}
+	}
+
+	// Stop the old groups before handing their alert state over to the new
+	// ones.
+	if m.running {
+		for _, g := range m.groups {
+			g.stop()
+		}
+	}
+	restore := m.transferAlertState()
+	removed := map[string]struct{}{}
+	for _, g := range m.groups {
+		removed[g.name] = struct{}{}
+	}
+	for _, g := range groups {
+		delete(removed, g.name)
+	}
+	for name := range removed {
+		groupDuration.DeleteLabelValues(name)
+		groupLastDuration.DeleteLabelValues(name)
 	}
-	if err := m.loadRuleFiles(files...); err != nil {
-		// If loading the new rules failed, restore the old rule set.
-		m.rules = rulesSnapshot
-		log.Errorf("Error loading rules, previous rule set restored: %s", err)
-		success = false
+	m.groups = groups
+	m.rules = []Rule{}
+	for _, g := range groups {
+		m.rules = append(m.rules, g.rules...)
 	}
+	restore()
 
+	if !m.rulesLoaded {
+		// Conditions holding on startup may have been holding before a
+		// restart already.
+		for _, r := range m.rules {
+			if ar, ok := r.(*AlertingRule); ok {
+				ar.forGrace = m.forGracePeriod
+			}
+		}
+		m.rulesLoaded = true
+	}
+
+	if m.running {
+		for _, g := range m.groups {
+			go g.run(m)
+		}
+	}
 	return success
 }
 
-// loadRuleFiles loads alerting and recording rules from the given files.
-func (m *Manager) loadRuleFiles(filenames ...string) error {
+// ruleGroupConfigs returns the rule groups of the given configuration. The
+// rules of the top-level rule files form the default group.
+func ruleGroupConfigs(conf *config.Config) []*config.RuleGroupConfig {
+	return append([]*config.RuleGroupConfig{{
+		Name:               config.DefaultRuleGroupName,
+		EvaluationInterval: conf.GlobalConfig.EvaluationInterval,
+		RuleFiles:          conf.RuleFiles,
+	}}, conf.RuleGroups...)
+}
+
+// CheckRuleFiles loads the rule files referenced by the given configuration
+// without installing their rules and returns an error for each pattern or file
+// that fails to load. Unlike ApplyConfig, it also reports rule file names
+// without wildcards that do not match any file.
+func CheckRuleFiles(conf *config.Config) []error {
+	var errs []error
+	for _, gc := range ruleGroupConfigs(conf) {
+		for _, pat := range gc.RuleFiles {
+			files, err := filepath.Glob(pat)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid rule file pattern %q in group %q: %s", pat, gc.Name, err))
+				continue
+			}
+			if len(files) == 0 && !strings.ContainsAny(pat, "*?[") {
+				errs = append(errs, fmt.Errorf("rule file %q in group %q does not exist", pat, gc.Name))
+				continue
+			}
+			for _, fn := range files {
+				if _, err := loadRuleFiles(fn); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// loadRuleFiles loads alerting and recording rules from the given files, in
+// the order of the files.
+func loadRuleFiles(filenames ...string) ([]Rule, error) {
+	var rules []Rule
 	for _, fn := range filenames {
 		content, err := ioutil.ReadFile(fn)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		stmts, err := promql.ParseStmts(string(content))
+		rs, err := parseRules(string(content))
 		if err != nil {
-			return fmt.Errorf("error parsing %s: %s", fn, err)
+			return nil, fmt.Errorf("error parsing %s: %s", fn, err)
 		}
+		rules = append(rules, rs...)
+	}
+	return rules, nil
+}
 
-		for _, stmt := range stmts {
-			switch r := stmt.(type) {
-			case *promql.AlertStmt:
-				rule := NewAlertingRule(r.Name, r.Expr, r.Duration, r.Labels, r.Summary, r.Description, r.Runbook)
-				m.rules = append(m.rules, rule)
-			case *promql.RecordStmt:
-				rule := NewRecordingRule(r.Name, r.Expr, r.Labels)
-				m.rules = append(m.rules, rule)
-			default:
-				panic("retrieval.Manager.LoadRuleFiles: unknown statement type")
-			}
+// parseRules parses alerting and recording rules from the given rule file
+// content.
+func parseRules(content string) ([]Rule, error) {
+	stmts, err := promql.ParseStmts(content)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]Rule, 0, len(stmts))
+	for _, stmt := range stmts {
+		switch r := stmt.(type) {
+		case *promql.AlertStmt:
+			rules = append(rules, NewAlertingRule(r.Name, r.Expr, r.Duration, r.Labels, r.Summary, r.Description, r.Runbook))
+		case *promql.RecordStmt:
+			rules = append(rules, NewRecordingRule(r.Name, r.Expr, r.Labels))
+		default:
+			panic("retrieval.Manager.LoadRuleFiles: unknown statement type")
+		}
+	}
+	return rules, nil
+}
+
+// PreviewAlerts parses the given rule file content and evaluates its alerting
+// rules once at the given timestamp. The rules are neither installed nor do
+// they share state with installed rules. As they start without active alerts,
+// only alerts of rules without a FOR clause are reported as firing, all others
+// as pending. Recording rules are ignored.
+func PreviewAlerts(content string, timestamp model.Time, engine *promql.Engine) ([]Alert, error) {
+	rules, err := parseRules(content)
+	if err != nil {
+		return nil, err
+	}
+
+	alerts := []Alert{}
+	for _, rule := range rules {
+		alertingRule, ok := rule.(*AlertingRule)
+		if !ok {
+			continue
+		}
+		if _, err := alertingRule.eval(timestamp, engine); err != nil {
+			return nil, fmt.Errorf("error evaluating alert %s: %s", alertingRule.Name(), err)
 		}
+		alerts = append(alerts, alertingRule.ActiveAlerts()...)
 	}
-	return nil
+	return alerts, nil
 }
 
 // Rules returns the list of the manager's rules.
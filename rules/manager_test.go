@@ -14,15 +14,24 @@
 package rules
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
 
+	"github.com/prometheus/prometheus/config"
 	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/local"
 )
 
 func TestAlertingRule(t *testing.T) {
@@ -147,13 +156,15 @@ func TestTransferAlertState(t *testing.T) {
 		State: StateFiring,
 	}
 
-	arule := AlertingRule{
-		name:         "test",
-		activeAlerts: map[model.Fingerprint]*Alert{},
+	newRule := func(name string, labels model.LabelSet) *AlertingRule {
+		return &AlertingRule{
+			name:         name,
+			labels:       labels,
+			activeAlerts: map[model.Fingerprint]*Alert{},
+		}
 	}
-	aruleCopy := arule
-
-	m.rules = append(m.rules, &arule)
+	arule := newRule("test", model.LabelSet{"severity": "page"})
+	m.groups = []*ruleGroup{newRuleGroup("group", time.Minute, []Rule{arule})}
 
 	// Set an alert.
 	arule.activeAlerts[0] = alert
@@ -161,23 +172,659 @@ func TestTransferAlertState(t *testing.T) {
 	// Save state and get the restore function.
 	restore := m.transferAlertState()
 
-	// Remove arule from the rule list and add an unrelated rule and the
-	// stateless copy of arule.
-	m.rules = []Rule{
-		&AlertingRule{
-			name:         "test_other",
-			activeAlerts: map[model.Fingerprint]*Alert{},
-		},
-		&aruleCopy,
+	// Replace arule by an unrelated rule, rules differing from it in
+	// labels or group, and a stateless copy of it.
+	m.groups = []*ruleGroup{
+		newRuleGroup("group", time.Minute, []Rule{
+			newRule("test_other", model.LabelSet{"severity": "page"}),
+			newRule("test", model.LabelSet{"severity": "ticket"}),
+			newRule("test", model.LabelSet{"severity": "page"}),
+		}),
+		newRuleGroup("other_group", time.Minute, []Rule{
+			newRule("test", model.LabelSet{"severity": "page"}),
+		}),
 	}
 
 	// Apply the restore function.
 	restore()
 
-	if ar := m.rules[0].(*AlertingRule); len(ar.activeAlerts) != 0 {
-		t.Fatalf("unexpected alert for unrelated alerting rule")
+	for i, r := range m.groups[0].rules[:2] {
+		if ar := r.(*AlertingRule); len(ar.activeAlerts) != 0 {
+			t.Errorf("%d. unexpected alert for unrelated alerting rule", i)
+		}
+	}
+	if ar := m.groups[0].rules[2].(*AlertingRule); !reflect.DeepEqual(ar.activeAlerts[0], alert) {
+		t.Errorf("alert state was not restored")
+	}
+	if ar := m.groups[1].rules[0].(*AlertingRule); len(ar.activeAlerts) != 0 {
+		t.Errorf("unexpected alert for alerting rule of other group")
+	}
+}
+
+func TestApplyConfigReload(t *testing.T) {
+	suite, err := promql.NewTest(t, `
+		load 5m
+			http_requests{job="app-server", instance="0"}	0+10x10
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+
+	if err := suite.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "rule_reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ruleFile := filepath.Join(dir, "test.rules")
+	writeRules := func(rules string) {
+		if err := ioutil.WriteFile(ruleFile, []byte(rules), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf := &config.Config{RuleFiles: []string{ruleFile}}
+	alertRule := "ALERT HighRequests IF http_requests > 5 FOR 10m SUMMARY \"summary\" DESCRIPTION \"description\"\n"
+
+	writeRules(alertRule)
+	m := NewManager(&ManagerOptions{})
+	if !m.ApplyConfig(conf) {
+		t.Fatal("error applying config")
+	}
+	if _, err := m.AlertingRules()[0].eval(model.Time(0).Add(5*time.Minute), suite.QueryEngine()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Adding a rule keeps the pending alert of the unchanged rule.
+	writeRules(alertRule + "job:http_requests = sum(http_requests) by (job)\n")
+	if !m.ApplyConfig(conf) {
+		t.Fatal("error applying config")
+	}
+	if n := len(m.Rules()); n != 2 {
+		t.Fatalf("expected 2 rules after reload, got %d", n)
+	}
+	alerts := m.AlertingRules()[0].ActiveAlerts()
+	if len(alerts) != 1 || alerts[0].ActiveSince != model.Time(0).Add(5*time.Minute) {
+		t.Errorf("expected pending alert to be kept across reload, got %v", alerts)
+	}
+
+	// A broken rule file keeps the running rules.
+	writeRules(alertRule + "job:http_requests = sum(\n")
+	if m.ApplyConfig(conf) {
+		t.Fatal("expected error applying config with broken rule file")
+	}
+	if n := len(m.Rules()); n != 2 {
+		t.Errorf("expected the 2 running rules to be kept, got %d", n)
+	}
+	if alerts := m.AlertingRules()[0].ActiveAlerts(); len(alerts) != 1 {
+		t.Errorf("expected pending alert to be kept, got %v", alerts)
+	}
+}
+
+func TestWatchdogAlert(t *testing.T) {
+	suite, err := promql.NewTest(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+	if err := suite.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewManager(&ManagerOptions{
+		WatchdogAlert:  "Watchdog",
+		WatchdogLabels: model.LabelSet{"severity": "none"},
+	})
+	// The watchdog alert is evaluated without any rule files.
+	if !m.ApplyConfig(&config.Config{}) {
+		t.Fatal("error applying config")
+	}
+	rules := m.AlertingRules()
+	if len(rules) != 1 {
+		t.Fatalf("expected only the watchdog alerting rule, got %v", rules)
+	}
+	if _, err := rules[0].eval(model.Time(0), suite.QueryEngine()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The alert keeps firing across reloads.
+	if !m.ApplyConfig(&config.Config{}) {
+		t.Fatal("error applying config")
+	}
+	alerts := m.AlertingRules()[0].ActiveAlerts()
+	expected := model.LabelSet{"severity": "none"}
+	if len(alerts) != 1 || alerts[0].Name != "Watchdog" || alerts[0].State != StateFiring || !alerts[0].Labels.Equal(expected) {
+		t.Errorf("expected firing Watchdog alert with labels %v, got %v", expected, alerts)
+	}
+}
+
+func TestCheckRuleFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rule_check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	good := filepath.Join(dir, "good.rules")
+	bad := filepath.Join(dir, "bad.rules")
+	if err := ioutil.WriteFile(good, []byte("job:http_requests = sum(http_requests) by (job)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(bad, []byte("job:http_requests = sum(http_requests) by (job)\njob:broken = sum(foo bar)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &config.Config{
+		RuleFiles: []string{good, filepath.Join(dir, "missing.rules"), filepath.Join(dir, "*.none")},
+		RuleGroups: []*config.RuleGroupConfig{
+			{Name: "broken", RuleFiles: []string{bad}},
+		},
+	}
+	errs := CheckRuleFiles(conf)
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", errs)
+	}
+	if !strings.Contains(errs[0].Error(), "missing.rules") {
+		t.Errorf("expected error about missing rule file, got %q", errs[0])
+	}
+	if !strings.Contains(errs[1].Error(), bad) || !strings.Contains(errs[1].Error(), "line 2") {
+		t.Errorf("expected parse error with file and line of %s, got %q", bad, errs[1])
+	}
+
+	if errs := CheckRuleFiles(&config.Config{RuleFiles: []string{good}}); len(errs) != 0 {
+		t.Errorf("expected no errors for valid rule file, got %v", errs)
+	}
+}
+
+func TestForGracePeriod(t *testing.T) {
+	suite, err := promql.NewTest(t, `
+		load 5m
+			http_requests{job="app-server", instance="0"}	0+10x10
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+
+	if err := suite.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "for_grace_period")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ruleFile := filepath.Join(dir, "test.rules")
+	writeRules := func(names ...string) {
+		var rules string
+		for _, n := range names {
+			rules += fmt.Sprintf("ALERT %s IF http_requests < 100 FOR 10m SUMMARY \"summary\" DESCRIPTION \"description\"\n", n)
+		}
+		if err := ioutil.WriteFile(ruleFile, []byte(rules), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf := &config.Config{RuleFiles: []string{ruleFile}}
+
+	firstState := func(m *Manager, name string) AlertState {
+		for _, r := range m.AlertingRules() {
+			if r.Name() != name {
+				continue
+			}
+			if _, err := r.eval(model.Time(0).Add(5*time.Minute), suite.QueryEngine()); err != nil {
+				t.Fatal(err)
+			}
+			alerts := r.ActiveAlerts()
+			if len(alerts) != 1 {
+				t.Fatalf("expected 1 active alert for %s, got %d", name, len(alerts))
+			}
+			return alerts[0].State
+		}
+		t.Fatalf("alerting rule %s not found", name)
+		return 0
+	}
+
+	// Without a grace period, holding conditions start out pending.
+	writeRules("Restarted")
+	m := NewManager(&ManagerOptions{})
+	if !m.ApplyConfig(conf) {
+		t.Fatal("error applying config")
+	}
+	if s := firstState(m, "Restarted"); s != StatePending {
+		t.Errorf("expected alert to be pending without grace period, got %s", s)
+	}
+
+	// With a grace period covering the FOR duration, they fire right away.
+	m = NewManager(&ManagerOptions{ForGracePeriod: 10 * time.Minute})
+	if !m.ApplyConfig(conf) {
+		t.Fatal("error applying config")
+	}
+	if s := firstState(m, "Restarted"); s != StateFiring {
+		t.Errorf("expected alert to be firing with grace period, got %s", s)
+	}
+
+	// Rules added by a later reload are not affected by the grace period.
+	writeRules("Restarted", "Added")
+	if !m.ApplyConfig(conf) {
+		t.Fatal("error applying config")
+	}
+	if s := firstState(m, "Added"); s != StatePending {
+		t.Errorf("expected alert of reloaded rule to be pending, got %s", s)
+	}
+}
+
+func TestAlertingRuleTemplatedLabels(t *testing.T) {
+	suite, err := promql.NewTest(t, `
+		load 5m
+			http_requests{job="app-server", instance="0"}	50
+			http_requests{job="app-server", instance="1"}	80
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+
+	if err := suite.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	expr, err := promql.ParseExpr(`http_requests > 10`)
+	if err != nil {
+		t.Fatalf("Unable to parse alert expression: %s", err)
+	}
+
+	rule := NewAlertingRule(
+		"HTTPRequestsHigh",
+		expr,
+		0,
+		model.LabelSet{
+			"severity": `{{ if gt $value 75.0 }}critical{{ else }}warning{{ end }}`,
+			"team":     `{{ $labels.job }}-oncall`,
+			"broken":   `{{ $labels.job`,
+			"static":   "value",
+		},
+		"summary", "description", "runbook",
+	)
+
+	expected := map[model.LabelValue]model.LabelSet{
+		"0": {
+			"job":      "app-server",
+			"instance": "0",
+			"severity": "warning",
+			"team":     "app-server-oncall",
+			"broken":   `{{ $labels.job`,
+			"static":   "value",
+		},
+		"1": {
+			"job":      "app-server",
+			"instance": "1",
+			"severity": "critical",
+			"team":     "app-server-oncall",
+			"broken":   `{{ $labels.job`,
+			"static":   "value",
+		},
+	}
+
+	// Evaluating repeatedly must not change the alerts' identity.
+	for i := 0; i < 2; i++ {
+		if _, err := rule.eval(model.Time(0).Add(time.Duration(i)*time.Minute), suite.QueryEngine()); err != nil {
+			t.Fatalf("Error during alerting rule evaluation: %s", err)
+		}
+		alerts := rule.ActiveAlerts()
+		if len(alerts) != len(expected) {
+			t.Fatalf("%d. expected %d active alerts, got %d", i, len(expected), len(alerts))
+		}
+		for _, a := range alerts {
+			if want := expected[a.Labels["instance"]]; !reflect.DeepEqual(a.Labels, want) {
+				t.Errorf("%d. unexpected alert labels:\n got: %v\nwant: %v", i, a.Labels, want)
+			}
+		}
+	}
+}
+
+type collectingAppender struct {
+	sync.Mutex
+	samples model.Samples
+}
+
+func (a *collectingAppender) Append(s *model.Sample) {
+	a.Lock()
+	defer a.Unlock()
+	a.samples = append(a.samples, s)
+}
+
+func TestEvaluationDelay(t *testing.T) {
+	suite, err := promql.NewTest(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+
+	delay := time.Hour
+	app := &collectingAppender{}
+	m := NewManager(&ManagerOptions{
+		QueryEngine:     suite.QueryEngine(),
+		SampleAppender:  app,
+		EvaluationDelay: delay,
+	})
+	expr, err := promql.ParseExpr("vector(time())")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newRuleGroup("test", time.Minute, []Rule{NewRecordingRule("eval_time", expr, model.LabelSet{})})
+
+	before := model.Now()
+	m.evalGroup(g)
+	after := model.Now()
+
+	if len(app.samples) != 1 {
+		t.Fatalf("expected 1 recorded sample, got %d", len(app.samples))
+	}
+	s := app.samples[0]
+	if s.Timestamp.Before(before.Add(-delay)) || s.Timestamp.After(after.Add(-delay)) {
+		t.Errorf("expected sample timestamp between %v and %v, got %v", before.Add(-delay), after.Add(-delay), s.Timestamp)
+	}
+	// The expression is evaluated as of the delayed time, too.
+	if s.Value != model.SampleValue(s.Timestamp.Unix()) {
+		t.Errorf("expected sample value %v, got %v", s.Timestamp.Unix(), s.Value)
+	}
+}
+
+// failingAppender is a storage.FallibleAppender failing every append.
+type failingAppender struct{}
+
+func (a failingAppender) Append(s *model.Sample) {
+	a.TryAppend(s)
+}
+
+func (a failingAppender) TryAppend(*model.Sample) error {
+	return errors.New("queue full")
+}
+
+func TestAppendFailure(t *testing.T) {
+	suite, err := promql.NewTest(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+
+	m := NewManager(&ManagerOptions{
+		QueryEngine:    suite.QueryEngine(),
+		SampleAppender: failingAppender{},
+	})
+	expr, err := promql.ParseExpr("vector(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newRuleGroup("test", time.Minute, []Rule{NewRecordingRule("one", expr, model.LabelSet{})})
+
+	var metric dto.Metric
+	if err := evalFailures.Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	before := metric.GetCounter().GetValue()
+	m.evalGroup(g)
+	if err := evalFailures.Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	if got := metric.GetCounter().GetValue() - before; got != 1 {
+		t.Errorf("expected 1 evaluation failure, got %v", got)
+	}
+}
+
+func TestAlertNotificationTemplates(t *testing.T) {
+	suite, err := promql.NewTest(t, `
+		load 5m
+			http_requests{job="app-server", instance="0"}	80
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+
+	if err := suite.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	expr, err := promql.ParseExpr(`http_requests > 10`)
+	if err != nil {
+		t.Fatalf("Unable to parse alert expression: %s", err)
+	}
+	rule := NewAlertingRule(
+		"HTTPRequestsHigh",
+		expr,
+		0,
+		model.LabelSet{},
+		`{{ $labels.instance }} of {{ $labels.job }} has {{ $value }} requests`,
+		`{{ with query "count(http_requests)" }}{{ . | first | value }} instances{{ end }}`,
+		`{{ $labels.job`,
+	)
+
+	m := NewManager(&ManagerOptions{
+		QueryEngine: suite.QueryEngine(),
+		ExternalURL: &url.URL{Scheme: "http", Host: "localhost:9090"},
+	})
+	for i := 0; i < 2; i++ {
+		if _, err := rule.eval(model.Time(0).Add(time.Duration(i)*time.Minute), suite.QueryEngine()); err != nil {
+			t.Fatalf("Error during alerting rule evaluation: %s", err)
+		}
+	}
+	reqs := m.alertNotifications(rule, model.Time(0).Add(time.Minute))
+	if len(reqs) != 1 {
+		t.Fatalf("Expected 1 notification, got %d", len(reqs))
+	}
+
+	if exp := "0 of app-server has 80 requests"; reqs[0].Summary != exp {
+		t.Errorf("Expected summary %q, got %q", exp, reqs[0].Summary)
+	}
+	if exp := "1 instances"; reqs[0].Description != exp {
+		t.Errorf("Expected description %q, got %q", exp, reqs[0].Description)
+	}
+	// Templates failing to expand are sent unexpanded.
+	if exp := `{{ $labels.job`; reqs[0].Runbook != exp {
+		t.Errorf("Expected runbook %q, got %q", exp, reqs[0].Runbook)
+	}
+}
+
+// teeAppender appends samples to a storage and collects them.
+type teeAppender struct {
+	collectingAppender
+	storage local.Storage
+}
+
+func (a *teeAppender) Append(s *model.Sample) {
+	a.storage.Append(s)
+	a.collectingAppender.Append(s)
+}
+
+func TestRuleGroupEvaluationOrder(t *testing.T) {
+	suite, err := promql.NewTest(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+
+	app := &teeAppender{storage: suite.Storage()}
+	m := NewManager(&ManagerOptions{
+		QueryEngine:    suite.QueryEngine(),
+		SampleAppender: app,
+	})
+
+	parse := func(s string) promql.Expr {
+		expr, err := promql.ParseExpr(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return expr
+	}
+	g := newRuleGroup("test", time.Minute, []Rule{
+		NewRecordingRule("eval_time", parse("vector(time())"), model.LabelSet{}),
+		NewRecordingRule("eval_time_copy", parse("eval_time"), model.LabelSet{}),
+	})
+
+	// New series only become queryable once indexed, so the first
+	// evaluation just creates them.
+	m.evalGroup(g)
+	suite.Storage().WaitForIndexing()
+	time.Sleep(10 * time.Millisecond)
+
+	app.samples = nil
+	m.evalGroup(g)
+	if len(app.samples) != 2 {
+		t.Fatalf("expected 2 recorded samples, got %d", len(app.samples))
+	}
+	// The second rule sees the sample the first one recorded in the same
+	// evaluation.
+	if app.samples[0].Value != app.samples[1].Value {
+		t.Errorf("expected %v to equal the value recorded before it, got %v", app.samples[1], app.samples[0].Value)
+	}
+}
+
+func TestRuleGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rule_groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"default.rules":   "default = vector(1)\n",
+		"expensive.rules": "expensive_a = vector(1)\nexpensive_b = expensive_a\n",
+	}
+	for fn, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf := &config.Config{
+		GlobalConfig: config.GlobalConfig{EvaluationInterval: config.Duration(15 * time.Second)},
+		RuleFiles:    []string{filepath.Join(dir, "default.rules")},
+		RuleGroups: []*config.RuleGroupConfig{
+			{
+				Name:               "expensive",
+				EvaluationInterval: config.Duration(5 * time.Minute),
+				RuleFiles:          []string{filepath.Join(dir, "expensive.rules")},
+			},
+			{
+				Name:               "empty",
+				EvaluationInterval: config.Duration(time.Minute),
+				RuleFiles:          []string{filepath.Join(dir, "*.missing")},
+			},
+		},
+	}
+
+	m := NewManager(&ManagerOptions{})
+	go m.Run()
+	if !m.ApplyConfig(conf) {
+		t.Fatal("error applying config")
+	}
+
+	type group struct {
+		name     string
+		interval time.Duration
+		rules    []string
+	}
+	expected := []group{
+		{config.DefaultRuleGroupName, 15 * time.Second, []string{"default"}},
+		{"expensive", 5 * time.Minute, []string{"expensive_a", "expensive_b"}},
+	}
+	m.Lock()
+	var got []group
+	for _, g := range m.groups {
+		gg := group{name: g.name, interval: g.interval}
+		for _, r := range g.rules {
+			gg.rules = append(gg.rules, r.Name())
+		}
+		got = append(got, gg)
+	}
+	m.Unlock()
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected rule groups:\n got: %v\nwant: %v", got, expected)
+	}
+	if n := len(m.Rules()); n != 3 {
+		t.Errorf("expected 3 rules, got %d", n)
+	}
+
+	// Reloading while running replaces the running groups.
+	conf.RuleGroups = nil
+	if !m.ApplyConfig(conf) {
+		t.Fatal("error applying config")
+	}
+	if n := len(m.Rules()); n != 1 {
+		t.Errorf("expected 1 rule after reload, got %d", n)
+	}
+	m.Stop()
+}
+
+// concurrencyAppender tracks the maximum number of concurrent appends.
+type concurrencyAppender struct {
+	mtx           sync.Mutex
+	inFlight, max int
+}
+
+func (a *concurrencyAppender) Append(*model.Sample) {
+	a.mtx.Lock()
+	a.inFlight++
+	if a.inFlight > a.max {
+		a.max = a.inFlight
+	}
+	a.mtx.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	a.mtx.Lock()
+	a.inFlight--
+	a.mtx.Unlock()
+}
+
+func TestMaxConcurrentEvaluations(t *testing.T) {
+	suite, err := promql.NewTest(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+
+	expr, err := promql.ParseExpr("vector(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, limit := range []int{1, 0} {
+		app := &concurrencyAppender{}
+		m := NewManager(&ManagerOptions{
+			QueryEngine:              suite.QueryEngine(),
+			SampleAppender:           app,
+			MaxConcurrentEvaluations: limit,
+		})
+		for _, name := range []string{"a", "b", "c"} {
+			g := newRuleGroup(name, time.Millisecond, []Rule{NewRecordingRule(name, expr, model.LabelSet{})})
+			m.groups = append(m.groups, g)
+		}
+		go m.Run()
+		time.Sleep(100 * time.Millisecond)
+		m.Stop()
+
+		app.mtx.Lock()
+		max := app.max
+		app.mtx.Unlock()
+		if limit == 1 && max != 1 {
+			t.Errorf("expected at most 1 concurrent evaluation, got %d", max)
+		}
+		if limit == 0 && max < 2 {
+			t.Errorf("expected concurrent evaluations without limit, got at most %d", max)
+		}
+	}
+
+	var metric dto.Metric
+	if err := groupLastDuration.WithLabelValues("a").Write(&metric); err != nil {
+		t.Fatal(err)
 	}
-	if ar := m.rules[1].(*AlertingRule); !reflect.DeepEqual(ar.activeAlerts[0], alert) {
-		t.Fatalf("alert state was not restored")
+	if metric.GetGauge().GetValue() <= 0 {
+		t.Errorf("expected last duration of rule group to be set, got %v", metric.GetGauge().GetValue())
 	}
 }
@@ -25,29 +25,13 @@ import (
 	"github.com/prometheus/prometheus/storage/metric"
 )
 
-// The DefaultChunkEncoding can be changed via a flag.
-var DefaultChunkEncoding = doubleDelta
-
 type chunkEncoding byte
 
-// String implements flag.Value.
+// String implements fmt.Stringer.
 func (ce chunkEncoding) String() string {
 	return fmt.Sprintf("%d", ce)
 }
 
-// Set implements flag.Value.
-func (ce *chunkEncoding) Set(s string) error {
-	switch s {
-	case "0":
-		*ce = delta
-	case "1":
-		*ce = doubleDelta
-	default:
-		return fmt.Errorf("invalid chunk encoding: %s", s)
-	}
-	return nil
-}
-
 const (
 	delta chunkEncoding = iota
 	doubleDelta
@@ -221,7 +205,7 @@ type chunk interface {
 	newIterator() chunkIterator
 	marshal(io.Writer) error
 	unmarshal(io.Reader) error
-	unmarshalFromBuf([]byte)
+	unmarshalFromBuf([]byte) error
 	encoding() chunkEncoding
 }
 
@@ -271,12 +255,6 @@ func transcodeAndAdd(dst chunk, src chunk, s *model.SamplePair) []chunk {
 	return append(body, newChunks...)
 }
 
-// newChunk creates a new chunk according to the encoding set by the
-// defaultChunkEncoding flag.
-func newChunk() chunk {
-	return newChunkForEncoding(DefaultChunkEncoding)
-}
-
 func newChunkForEncoding(encoding chunkEncoding) chunk {
 	switch encoding {
 	case delta:
@@ -19,6 +19,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"sync/atomic"
 
 	"github.com/prometheus/common/log"
@@ -38,10 +39,6 @@ func (p *persistence) recoverFromCrash(fingerprintToSeries map[model.Fingerprint
 	log.Warn("Starting crash recovery. Prometheus is inoperational until complete.")
 	log.Warn("To avoid crash recovery in the future, shut down Prometheus with SIGTERM or a HTTP POST to /-/quit.")
 
-	fpsSeen := map[model.Fingerprint]struct{}{}
-	count := 0
-	seriesDirNameFmt := fmt.Sprintf("%%0%dx", seriesDirNameLen)
-
 	// Delete the fingerprint mapping file as it might be stale or
 	// corrupt. We'll rebuild the mappings as we go.
 	if err := os.RemoveAll(p.mappingsFileName()); err != nil {
@@ -51,31 +48,9 @@ func (p *persistence) recoverFromCrash(fingerprintToSeries map[model.Fingerprint
 	fpm := fpMappings{}
 
 	log.Info("Scanning files.")
-	for i := 0; i < 1<<(seriesDirNameLen*4); i++ {
-		dirname := path.Join(p.basePath, fmt.Sprintf(seriesDirNameFmt, i))
-		dir, err := os.Open(dirname)
-		if os.IsNotExist(err) {
-			continue
-		}
-		if err != nil {
-			return err
-		}
-		defer dir.Close()
-		for fis := []os.FileInfo{}; err != io.EOF; fis, err = dir.Readdir(1024) {
-			if err != nil {
-				return err
-			}
-			for _, fi := range fis {
-				fp, ok := p.sanitizeSeries(dirname, fi, fingerprintToSeries, fpm)
-				if ok {
-					fpsSeen[fp] = struct{}{}
-				}
-				count++
-				if count%10000 == 0 {
-					log.Infof("%d files scanned.", count)
-				}
-			}
-		}
+	fpsSeen, err := p.sanitizeSeriesFiles(fingerprintToSeries, fpm)
+	if err != nil {
+		return err
 	}
 	log.Infof("File scan complete. %d series found.", len(fpsSeen))
 
@@ -144,11 +119,102 @@ func (p *persistence) recoverFromCrash(fingerprintToSeries map[model.Fingerprint
 	return nil
 }
 
+// seriesFile is a file in a series directory.
+type seriesFile struct {
+	dirname string
+	fi      os.FileInfo
+}
+
+// sanitizeSeriesFiles sanitizes the series files in all series directories
+// with sanitizeSeries and returns the fingerprints of the series sanitized
+// successfully. Up to p.recoveryConcurrency files are sanitized concurrently,
+// which mostly pays off with pedantic checks, where every series file is
+// loaded. The series of different files are distinct, so the workers never
+// modify the same series.
+func (p *persistence) sanitizeSeriesFiles(
+	fingerprintToSeries map[model.Fingerprint]*memorySeries,
+	fpm fpMappings,
+) (map[model.Fingerprint]struct{}, error) {
+	concurrency := p.recoveryConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		mtx     sync.Mutex // Protects fpsSeen, fpm, and count.
+		fpsSeen = map[model.Fingerprint]struct{}{}
+		count   = 0
+		wg      sync.WaitGroup
+		files   = make(chan seriesFile, concurrency)
+	)
+	addMapping := func(fp model.Fingerprint, m model.Metric) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		maybeAddMapping(fp, m, fpm)
+	}
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for f := range files {
+				fp, ok := p.sanitizeSeries(f.dirname, f.fi, fingerprintToSeries, addMapping)
+
+				mtx.Lock()
+				if ok {
+					fpsSeen[fp] = struct{}{}
+				}
+				count++
+				if count%10000 == 0 {
+					log.Infof("%d files scanned.", count)
+				}
+				mtx.Unlock()
+			}
+		}()
+	}
+
+	err := p.listSeriesFiles(files)
+	close(files)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return fpsSeen, nil
+}
+
+// listSeriesFiles sends the files in all series directories to the given
+// channel.
+func (p *persistence) listSeriesFiles(files chan<- seriesFile) error {
+	seriesDirNameFmt := fmt.Sprintf("%%0%dx", seriesDirNameLen)
+	for i := 0; i < 1<<(seriesDirNameLen*4); i++ {
+		dirname := path.Join(p.basePath, fmt.Sprintf(seriesDirNameFmt, i))
+		dir, err := os.Open(dirname)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for fis := []os.FileInfo{}; err != io.EOF; fis, err = dir.Readdir(1024) {
+			if err != nil {
+				dir.Close()
+				return err
+			}
+			for _, fi := range fis {
+				files <- seriesFile{dirname: dirname, fi: fi}
+			}
+		}
+		dir.Close()
+	}
+	return nil
+}
+
 // sanitizeSeries sanitizes a series based on its series file as defined by the
 // provided directory and FileInfo.  The method returns the fingerprint as
 // derived from the directory and file name, and whether the provided file has
 // been sanitized. A file that failed to be sanitized is moved into the
-// "orphaned" sub-directory, if possible.
+// "orphaned" sub-directory, if possible. Fingerprint mappings found are added
+// with addMapping. The method is goroutine-safe as long as no other goroutine
+// touches the series of the same fingerprint.
 //
 // The following steps are performed:
 //
@@ -173,7 +239,7 @@ func (p *persistence) recoverFromCrash(fingerprintToSeries map[model.Fingerprint
 func (p *persistence) sanitizeSeries(
 	dirname string, fi os.FileInfo,
 	fingerprintToSeries map[model.Fingerprint]*memorySeries,
-	fpm fpMappings,
+	addMapping func(model.Fingerprint, model.Metric),
 ) (model.Fingerprint, bool) {
 	filename := path.Join(dirname, fi.Name())
 	purge := func() {
@@ -241,7 +307,7 @@ func (p *persistence) sanitizeSeries(
 		if s == nil {
 			panic("fingerprint mapped to nil pointer")
 		}
-		maybeAddMapping(fp, s.metric, fpm)
+		addMapping(fp, s.metric)
 		if !p.pedanticChecks &&
 			bytesToTrim == 0 &&
 			s.chunkDescsOffset != -1 &&
@@ -351,7 +417,7 @@ func (p *persistence) sanitizeSeries(
 		return fp, false
 	}
 	// This series looks like a properly archived one.
-	maybeAddMapping(fp, metric, fpm)
+	addMapping(fp, metric)
 	return fp, true
 }
 
@@ -89,7 +89,7 @@ func (c deltaEncodedChunk) add(s *model.SamplePair) []chunk {
 	// Do we generally have space for another sample in this chunk? If not,
 	// overflow into a new one.
 	if remainingBytes < sampleSize {
-		overflowChunks := newChunk().add(s)
+		overflowChunks := newDeltaEncodedChunk(d1, d0, true, chunkLen).add(s)
 		return []chunk{&c, overflowChunks[0]}
 	}
 
@@ -130,7 +130,7 @@ func (c deltaEncodedChunk) add(s *model.SamplePair) []chunk {
 			return transcodeAndAdd(newDeltaEncodedChunk(ntb, nvb, nInt, cap(c)), &c, s)
 		}
 		// Chunk is already half full. Better create a new one and save the transcoding efforts.
-		overflowChunks := newChunk().add(s)
+		overflowChunks := newDeltaEncodedChunk(d1, d0, true, chunkLen).add(s)
 		return []chunk{&c, overflowChunks[0]}
 	}
 
@@ -229,15 +229,29 @@ func (c *deltaEncodedChunk) unmarshal(r io.Reader) error {
 	if _, err := io.ReadFull(r, *c); err != nil {
 		return err
 	}
-	*c = (*c)[:binary.LittleEndian.Uint16((*c)[deltaHeaderBufLenOffset:])]
-	return nil
+	return c.setLenFromHeader()
 }
 
 // unmarshalFromBuf implements chunk.
-func (c *deltaEncodedChunk) unmarshalFromBuf(buf []byte) {
+func (c *deltaEncodedChunk) unmarshalFromBuf(buf []byte) error {
 	*c = (*c)[:cap(*c)]
 	copy(*c, buf)
-	*c = (*c)[:binary.LittleEndian.Uint16((*c)[deltaHeaderBufLenOffset:])]
+	return c.setLenFromHeader()
+}
+
+// setLenFromHeader sets the length of the chunk to the used buf bytes saved in
+// its header. An error is returned if the header is inconsistent, e.g. because
+// the chunk was corrupted on disk.
+func (c *deltaEncodedChunk) setLenFromHeader() error {
+	l := int(binary.LittleEndian.Uint16((*c)[deltaHeaderBufLenOffset:]))
+	if l < deltaHeaderBytes || l > cap(*c) {
+		return fmt.Errorf("invalid used buf bytes %d in delta chunk header", l)
+	}
+	*c = (*c)[:l]
+	if !validDeltaBytes(c.timeBytes(), c.valueBytes()) {
+		return fmt.Errorf("invalid delta bytes %d/%d in delta chunk header", c.timeBytes(), c.valueBytes())
+	}
+	return nil
 }
 
 // encoding implements chunk.
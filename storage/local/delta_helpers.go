@@ -70,6 +70,22 @@ func bytesNeededForIntegerSampleValueDelta(deltaV model.SampleValue) deltaBytes
 	}
 }
 
+// validDeltaBytes returns whether the given time and value delta bytes read
+// from a chunk header are valid. Time deltas need at least one byte.
+func validDeltaBytes(tb, vb deltaBytes) bool {
+	switch tb {
+	case d1, d2, d4, d8:
+	default:
+		return false
+	}
+	switch vb {
+	case d0, d1, d2, d4, d8:
+	default:
+		return false
+	}
+	return true
+}
+
 func max(a, b deltaBytes) deltaBytes {
 	if a > b {
 		return a
@@ -37,6 +37,12 @@ var (
 		},
 		[]string{opTypeLabel},
 	)
+	chunkDecodeErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "chunk_decode_errors_total",
+		Help:      "The total number of chunks loaded from disk that could not be decoded and were skipped.",
+	})
 	numMemChunkDescs = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Subsystem: subsystem,
@@ -83,6 +89,7 @@ const (
 func init() {
 	prometheus.MustRegister(chunkOps)
 	prometheus.MustRegister(chunkDescOps)
+	prometheus.MustRegister(chunkDecodeErrors)
 	prometheus.MustRegister(numMemChunkDescs)
 }
 
@@ -14,6 +14,7 @@
 package local
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -45,6 +46,11 @@ type Storage interface {
 	// provided fingerprint. If the respective time series does not exist or
 	// has an evicted head chunk, nil is returned.
 	LastSamplePairForFingerprint(model.Fingerprint) *model.SamplePair
+	// SampleIntervalForFingerprint returns the interval between the last
+	// two samples ingested for the provided fingerprint. If the respective
+	// time series is not in memory or has not been appended to twice since
+	// it was loaded, 0 is returned.
+	SampleIntervalForFingerprint(model.Fingerprint) time.Duration
 	// Get all of the label values that are associated with a given label name.
 	LabelValuesForLabelName(model.LabelName) model.LabelValues
 	// Get the metric associated with the provided fingerprint.
@@ -53,9 +59,31 @@ type Storage interface {
 	// The iterator will never return samples older than retention time,
 	// relative to the time NewIterator was called.
 	NewIterator(model.Fingerprint) SeriesIterator
+	// ChunkInfosForFingerprint returns meta-data about all chunks of the
+	// series with the given fingerprint, oldest first, without decoding
+	// their samples. If the series does not exist, nil is returned.
+	ChunkInfosForFingerprint(model.Fingerprint) ([]ChunkInfo, error)
+	// ChunkRangesForFingerprint returns the time ranges covered by the
+	// chunks of the series with the given fingerprint, oldest first, as far
+	// as they are known from the chunk meta-data in memory. Unlike
+	// ChunkInfosForFingerprint, it never reads the series file. If the
+	// series does not exist, nil is returned.
+	ChunkRangesForFingerprint(model.Fingerprint) ([]ChunkRange, error)
 	// Drop all time series associated with the given fingerprints. This operation
 	// will not show up in the series operations metrics.
 	DropMetricsForFingerprints(...model.Fingerprint)
+	// DeleteSamplesForFingerprints deletes the samples within the given
+	// interval from the series with the given fingerprints. The samples
+	// are hidden from queries right away and dropped from disk once the
+	// series maintenance gets to them. Series without samples left are
+	// dropped entirely.
+	DeleteSamplesForFingerprints(metric.Interval, ...model.Fingerprint) error
+	// Snapshot creates a snapshot of the storage in a new subdirectory of
+	// dir and returns the name of that subdirectory. The snapshot is a
+	// consistent storage directory Prometheus can be started on. Series
+	// files are hardlinked into it, so dir has to be on the same
+	// filesystem as the storage.
+	Snapshot(dir string) (string, error)
 	// Run the various maintenance loops in goroutines. Returns when the
 	// storage is ready to use. Keeps everything running in the background
 	// until Stop is called.
@@ -100,3 +128,19 @@ type Preloader interface {
 	// Close unpins any previously requested series data from memory.
 	Close()
 }
+
+// ChunkDecodeError is returned by Preloader.PreloadRange if chunks of a series
+// could not be decoded after loading them from disk, e.g. because they are
+// corrupted. All other chunks of the range are preloaded nevertheless, so that
+// a query can proceed with the remaining data.
+type ChunkDecodeError struct {
+	Fingerprint model.Fingerprint
+	// The number of chunks that could not be decoded.
+	NumChunks int
+	// The error of the first chunk that could not be decoded.
+	Err error
+}
+
+func (e *ChunkDecodeError) Error() string {
+	return fmt.Sprintf("could not decode %d chunk(s) of series %v, skipping them: %s", e.NumChunks, e.Fingerprint, e.Err)
+}
@@ -34,6 +34,7 @@ import (
 
 	"github.com/prometheus/prometheus/storage/local/codable"
 	"github.com/prometheus/prometheus/storage/local/index"
+	"github.com/prometheus/prometheus/storage/metric"
 	"github.com/prometheus/prometheus/util/flock"
 )
 
@@ -58,6 +59,11 @@ const (
 	mappingsFormatVersion = 1
 	mappingsMagicString   = "PrometheusMappings"
 
+	tombstonesFileName      = "tombstones.db"
+	tombstonesTempFileName  = "tombstones.db.tmp"
+	tombstonesFormatVersion = 1
+	tombstonesMagicString   = "PrometheusTombstones"
+
 	dirtyFileName = "DIRTY"
 
 	fileBufSize = 1 << 16 // 64kiB.
@@ -127,13 +133,27 @@ type persistence struct {
 	dirtyFileName  string         // The file used for locking and to mark dirty state.
 	fLock          flock.Releaser // The file lock to protect against concurrent usage.
 
-	shouldSync syncStrategy
+	// checkpointMtx serializes checkpoints and snapshots. snapshotMtx is
+	// held for reading while series files or the archive indexes are
+	// modified, and for writing while a snapshot links and copies them.
+	checkpointMtx sync.Mutex
+	snapshotMtx   sync.RWMutex
+
+	// The number of series files checked concurrently during crash
+	// recovery. Not concurrent if <= 1.
+	recoveryConcurrency int
+
+	shouldSync  syncStrategy
+	syncBatcher *syncBatcher
+	throttle    *writeThrottle
 
 	bufPool sync.Pool
 }
 
-// newPersistence returns a newly allocated persistence backed by local disk storage, ready to use.
-func newPersistence(basePath string, dirty, pedanticChecks bool, shouldSync syncStrategy) (*persistence, error) {
+// newPersistence returns a newly allocated persistence backed by local disk
+// storage, ready to use. Writes to series files are throttled by the provided
+// writeThrottle, and their syncs are batched by the provided syncBatcher.
+func newPersistence(basePath string, dirty, pedanticChecks bool, shouldSync syncStrategy, batcher *syncBatcher, throttle *writeThrottle) (*persistence, error) {
 	dirtyPath := filepath.Join(basePath, dirtyFileName)
 	versionPath := filepath.Join(basePath, versionFileName)
 
@@ -247,6 +267,8 @@ func newPersistence(basePath string, dirty, pedanticChecks bool, shouldSync sync
 		dirtyFileName:  dirtyPath,
 		fLock:          fLock,
 		shouldSync:     shouldSync,
+		syncBatcher:    batcher,
+		throttle:       throttle,
 		// Create buffers of length 3*chunkLenWithHeader by default because that is still reasonably small
 		// and at the same time enough for many uses. The contract is to never return buffer smaller than
 		// that to the pool so that callers can rely on a minimum buffer size.
@@ -273,6 +295,7 @@ func newPersistence(basePath string, dirty, pedanticChecks bool, shouldSync sync
 	p.labelPairToFingerprints = labelPairToFingerprints
 	p.labelNameToLabelValues = labelNameToLabelValues
 
+	go p.syncBatcher.run()
 	return p, nil
 }
 
@@ -288,6 +311,8 @@ func (p *persistence) Describe(ch chan<- *prometheus.Desc) {
 	p.indexingBatchDuration.Describe(ch)
 	ch <- p.checkpointDuration.Desc()
 	ch <- p.dirtyCounter.Desc()
+	p.throttle.Describe(ch)
+	p.syncBatcher.Describe(ch)
 }
 
 // Collect implements prometheus.Collector.
@@ -300,6 +325,8 @@ func (p *persistence) Collect(ch chan<- prometheus.Metric) {
 	p.indexingBatchDuration.Collect(ch)
 	ch <- p.checkpointDuration
 	ch <- p.dirtyCounter
+	p.throttle.Collect(ch)
+	p.syncBatcher.Collect(ch)
 }
 
 // isDirty returns the dirty flag in a goroutine-safe way.
@@ -367,13 +394,21 @@ func (p *persistence) persistChunks(fp model.Fingerprint, chunks []chunk) (index
 		}
 	}()
 
+	p.snapshotMtx.RLock()
+	defer p.snapshotMtx.RUnlock()
+
+	// Appending to a series file still linked into a snapshot would
+	// change the snapshot, too.
+	if err := p.unlinkSnapshottedSeriesFile(fp); err != nil {
+		return -1, err
+	}
 	f, err := p.openChunkFileForWriting(fp)
 	if err != nil {
 		return -1, err
 	}
 	defer p.closeChunkFile(f)
 
-	if err := writeChunks(f, chunks); err != nil {
+	if err := writeChunks(p.throttle.writer(f), chunks); err != nil {
 		return -1, err
 	}
 
@@ -395,6 +430,9 @@ func (p *persistence) persistChunks(fp model.Fingerprint, chunks []chunk) (index
 // incrementally larger indexes. The indexOffset denotes the offset to be added to
 // each index in indexes. It is the caller's responsibility to not persist or
 // drop anything for the same fingerprint concurrently.
+//
+// Chunks that cannot be decoded are returned as nil, together with a
+// *ChunkDecodeError, while the other chunks are returned as usual.
 func (p *persistence) loadChunks(fp model.Fingerprint, indexes []int, indexOffset int) ([]chunk, error) {
 	f, err := p.openChunkFileForReading(fp)
 	if err != nil {
@@ -402,7 +440,11 @@ func (p *persistence) loadChunks(fp model.Fingerprint, indexes []int, indexOffse
 	}
 	defer f.Close()
 
-	chunks := make([]chunk, 0, len(indexes))
+	var (
+		chunks    = make([]chunk, 0, len(indexes))
+		loaded    int
+		decodeErr *ChunkDecodeError
+	)
 	buf := p.bufPool.Get().([]byte)
 	defer func() {
 		// buf may change below, so wrap returning to the pool in a function.
@@ -432,16 +474,41 @@ func (p *persistence) loadChunks(fp model.Fingerprint, indexes []int, indexOffse
 			return nil, err
 		}
 		for c := 0; c < batchSize; c++ {
-			chunk := newChunkForEncoding(chunkEncoding(buf[c*chunkLenWithHeader+chunkHeaderTypeOffset]))
-			chunk.unmarshalFromBuf(buf[c*chunkLenWithHeader+chunkHeaderLen:])
+			chunk, err := decodeChunk(buf[c*chunkLenWithHeader : (c+1)*chunkLenWithHeader])
+			if err != nil {
+				chunkDecodeErrors.Inc()
+				log.Warnf("Could not decode chunk %d of series %v: %s", indexes[i-batchSize+1+c]+indexOffset, fp, err)
+				if decodeErr == nil {
+					decodeErr = &ChunkDecodeError{Fingerprint: fp, Err: err}
+				}
+				decodeErr.NumChunks++
+			} else {
+				loaded++
+			}
 			chunks = append(chunks, chunk)
 		}
 	}
-	chunkOps.WithLabelValues(load).Add(float64(len(chunks)))
-	atomic.AddInt64(&numMemChunks, int64(len(chunks)))
+	chunkOps.WithLabelValues(load).Add(float64(loaded))
+	atomic.AddInt64(&numMemChunks, int64(loaded))
+	if decodeErr != nil {
+		return chunks, decodeErr
+	}
 	return chunks, nil
 }
 
+// decodeChunk decodes a chunk including its header as saved in a series file.
+func decodeChunk(buf []byte) (chunk, error) {
+	encoding := chunkEncoding(buf[chunkHeaderTypeOffset])
+	if encoding != delta && encoding != doubleDelta {
+		return nil, fmt.Errorf("unknown chunk encoding %d", encoding)
+	}
+	c := newChunkForEncoding(encoding)
+	if err := c.unmarshalFromBuf(buf[chunkHeaderLen:]); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
 // loadChunkDescs loads the chunkDescs for a series from disk. offsetFromEnd is
 // the number of chunkDescs to skip from the end of the series file. It is the
 // caller's responsibility to not persist or drop anything for the same
@@ -491,6 +558,50 @@ func (p *persistence) loadChunkDescs(fp model.Fingerprint, offsetFromEnd int) ([
 	return cds, nil
 }
 
+// loadChunkInfos reads the meta-data of all chunks in the series file for the
+// given fingerprint. The chunks are unmarshaled to determine their number of
+// samples, but they are not decoded any further and not kept in memory. If the
+// series file does not exist, nil is returned. It is the caller's
+// responsibility to not persist or drop anything for the same fingerprint
+// concurrently.
+func (p *persistence) loadChunkInfos(fp model.Fingerprint) ([]ChunkInfo, error) {
+	f, err := p.openChunkFileForReading(fp)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := p.bufPool.Get().([]byte)
+	defer func() {
+		p.bufPool.Put(buf)
+	}()
+	buf = buf[:chunkLenWithHeader]
+
+	var infos []ChunkInfo
+	for {
+		if _, err := io.ReadFull(f, buf); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		c, err := decodeChunk(buf)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding chunk in series file for fingerprint %v: %s", fp, err)
+		}
+		infos = append(infos, ChunkInfo{
+			FirstTime:  model.Time(binary.LittleEndian.Uint64(buf[chunkHeaderFirstTimeOffset:])),
+			LastTime:   model.Time(binary.LittleEndian.Uint64(buf[chunkHeaderLastTimeOffset:])),
+			Encoding:   int(c.encoding()),
+			NumSamples: c.newIterator().length(),
+			Persisted:  true,
+		})
+	}
+	return infos, nil
+}
+
 // checkpointSeriesMapAndHeads persists the fingerprint to memory-series mapping
 // and all non persisted chunks. Do not call concurrently with
 // loadSeriesMapAndHeads. This method will only write heads format v2, but
@@ -535,9 +646,20 @@ func (p *persistence) loadChunkDescs(fp model.Fingerprint, offsetFromEnd int) ([
 // (4.8.2.1) A byte defining the chunk type.
 // (4.8.2.2) The chunk itself, marshaled with the marshal() method.
 //
-func (p *persistence) checkpointSeriesMapAndHeads(fingerprintToSeries *seriesMap, fpLocker *fingerprintLocker) (err error) {
+func (p *persistence) checkpointSeriesMapAndHeads(fingerprintToSeries *seriesMap, fpLocker *fingerprintLocker) error {
+	p.checkpointMtx.Lock()
+	defer p.checkpointMtx.Unlock()
+	return p.writeSeriesMapAndHeads(fingerprintToSeries, fpLocker)
+}
+
+// writeSeriesMapAndHeads does the work of checkpointSeriesMapAndHeads. The
+// caller must hold checkpointMtx.
+func (p *persistence) writeSeriesMapAndHeads(fingerprintToSeries *seriesMap, fpLocker *fingerprintLocker) (err error) {
 	log.Info("Checkpointing in-memory metrics and chunks...")
 	begin := time.Now()
+	// Make sure the checkpoint doesn't refer to chunks whose syncs are
+	// still pending.
+	p.syncBatcher.flush()
 	f, err := os.OpenFile(p.headsTempFileName(), os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0640)
 	if err != nil {
 		return err
@@ -990,25 +1112,29 @@ func (p *persistence) dropAndPersistChunks(
 		return
 	}
 
+	p.snapshotMtx.RLock()
+	defer p.snapshotMtx.RUnlock()
 	temp, err := os.OpenFile(p.tempFileNameForFingerprint(fp), os.O_WRONLY|os.O_CREATE, 0640)
 	if err != nil {
 		return
 	}
 	defer func() {
-		p.closeChunkFile(temp)
+		// The temporary file replaces the series file, so it has
+		// to be synced before the rename rather than batched.
+		p.syncAndCloseChunkFile(temp)
 		if err == nil {
 			err = os.Rename(p.tempFileNameForFingerprint(fp), p.fileNameForFingerprint(fp))
 		}
 	}()
 
-	written, err := io.Copy(temp, f)
+	written, err := io.Copy(p.throttle.writer(temp), f)
 	if err != nil {
 		return
 	}
 	offset = int(written / chunkLenWithHeader)
 
 	if len(chunks) > 0 {
-		if err = writeChunks(temp, chunks); err != nil {
+		if err = writeChunks(p.throttle.writer(temp), chunks); err != nil {
 			return
 		}
 	}
@@ -1019,6 +1145,9 @@ func (p *persistence) dropAndPersistChunks(
 // fingerprint. It returns the number of chunks that were contained in the
 // deleted file.
 func (p *persistence) deleteSeriesFile(fp model.Fingerprint) (int, error) {
+	p.snapshotMtx.RLock()
+	defer p.snapshotMtx.RUnlock()
+
 	fname := p.fileNameForFingerprint(fp)
 	fi, err := os.Stat(fname)
 	if os.IsNotExist(err) {
@@ -1086,6 +1215,9 @@ func (p *persistence) waitForIndexing() {
 func (p *persistence) archiveMetric(
 	fp model.Fingerprint, m model.Metric, first, last model.Time,
 ) error {
+	p.snapshotMtx.RLock()
+	defer p.snapshotMtx.RUnlock()
+
 	if err := p.archivedFingerprintToMetrics.Put(codable.Fingerprint(fp), codable.Metric(m)); err != nil {
 		p.setDirty(true)
 		return err
@@ -1113,6 +1245,9 @@ func (p *persistence) hasArchivedMetric(fp model.Fingerprint) (
 func (p *persistence) updateArchivedTimeRange(
 	fp model.Fingerprint, first, last model.Time,
 ) error {
+	p.snapshotMtx.RLock()
+	defer p.snapshotMtx.RUnlock()
+
 	return p.archivedFingerprintToTimeRange.Put(codable.Fingerprint(fp), codable.TimeRange{First: first, Last: last})
 }
 
@@ -1138,6 +1273,50 @@ func (p *persistence) fingerprintsModifiedBefore(beforeTime model.Time) ([]model
 	return fps, err
 }
 
+// oldestArchivedTime returns the time of the oldest sample of all archived
+// series, or model.Latest if there are no archived series. This method is
+// goroutine-safe.
+func (p *persistence) oldestArchivedTime() (model.Time, error) {
+	var tr codable.TimeRange
+	oldest := model.Latest
+	err := p.archivedFingerprintToTimeRange.ForEach(func(kv index.KeyValueAccessor) error {
+		if err := kv.Value(&tr); err != nil {
+			return err
+		}
+		if tr.First.Before(oldest) {
+			oldest = tr.First
+		}
+		return nil
+	})
+	return oldest, err
+}
+
+// diskUsage returns the number of bytes taken by the files in the storage
+// directory. Snapshots are not counted as dropping chunks cannot free their
+// space. This method is goroutine-safe.
+func (p *persistence) diskUsage() (int64, error) {
+	var size int64
+	snapDir := filepath.Join(p.basePath, SnapshotsDirName)
+	err := filepath.Walk(p.basePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Purged or rewritten in the meantime.
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if path == snapDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
 // archivedMetric retrieves the archived metric with the given fingerprint. This
 // method is goroutine-safe.
 func (p *persistence) archivedMetric(fp model.Fingerprint) (model.Metric, error) {
@@ -1156,6 +1335,9 @@ func (p *persistence) purgeArchivedMetric(fp model.Fingerprint) (err error) {
 		}
 	}()
 
+	p.snapshotMtx.RLock()
+	defer p.snapshotMtx.RUnlock()
+
 	metric, err := p.archivedMetric(fp)
 	if err != nil || metric == nil {
 		return err
@@ -1189,6 +1371,9 @@ func (p *persistence) unarchiveMetric(fp model.Fingerprint) (deletedAnything boo
 		}
 	}()
 
+	p.snapshotMtx.RLock()
+	defer p.snapshotMtx.RUnlock()
+
 	deleted, err := p.archivedFingerprintToMetrics.Delete(codable.Fingerprint(fp))
 	if err != nil || !deleted {
 		return false, err
@@ -1209,6 +1394,7 @@ func (p *persistence) unarchiveMetric(fp model.Fingerprint) (deletedAnything boo
 func (p *persistence) close() error {
 	close(p.indexingQueue)
 	<-p.indexingStopped
+	p.syncBatcher.stop()
 
 	var lastError, dirtyFileRemoveError error
 	if err := p.archivedFingerprintToMetrics.Close(); err != nil {
@@ -1270,12 +1456,23 @@ func (p *persistence) openChunkFileForWriting(fp model.Fingerprint) (*os.File, e
 }
 
 // closeChunkFile first syncs the provided file if mandated so by the sync
-// strategy. Then it closes the file. Errors are logged.
+// strategy. Then it closes the file. If syncs are batched, the file is only
+// synced and closed with its batch. Errors are logged.
 func (p *persistence) closeChunkFile(f *os.File) {
 	if p.shouldSync() {
-		if err := f.Sync(); err != nil {
-			log.Error("Error syncing file:", err)
-		}
+		p.syncBatcher.add(f)
+		return
+	}
+	if err := f.Close(); err != nil {
+		log.Error("Error closing chunk file:", err)
+	}
+}
+
+// syncAndCloseChunkFile is like closeChunkFile but never batches the sync.
+func (p *persistence) syncAndCloseChunkFile(f *os.File) {
+	if p.shouldSync() {
+		syncAndClose(f)
+		return
 	}
 	if err := f.Close(); err != nil {
 		log.Error("Error closing chunk file:", err)
@@ -1302,6 +1499,14 @@ func (p *persistence) mappingsTempFileName() string {
 	return path.Join(p.basePath, mappingsTempFileName)
 }
 
+func (p *persistence) tombstonesFileName() string {
+	return path.Join(p.basePath, tombstonesFileName)
+}
+
+func (p *persistence) tombstonesTempFileName() string {
+	return path.Join(p.basePath, tombstonesTempFileName)
+}
+
 func (p *persistence) processIndexingQueue() {
 	batchSize := 0
 	nameToValues := index.LabelNameLabelValuesMapping{}
@@ -1562,6 +1767,158 @@ func (p *persistence) loadFPMappings() (fpMappings, model.Fingerprint, error) {
 	return fpm, highestMappedFP, nil
 }
 
+// checkpointTombstones persists the tombstones if they have changed since the
+// last checkpoint. This method is goroutine-safe.
+//
+// Description of the file format, v1:
+//
+// (1) Magic string (const tombstonesMagicString).
+//
+// (2) Uvarint-encoded format version (const tombstonesFormatVersion).
+//
+// (3) Uvarint-encoded number of series with tombstones.
+//
+// (4) Repeated once per series:
+//
+// (4.1) The fingerprint as big-endian uint64.
+//
+// (4.2) The uvarint-encoded number of deleted intervals.
+//
+// (4.3) Repeated once per deleted interval, oldest first:
+//
+// (4.3.1) The varint-encoded oldest deleted timestamp.
+// (4.3.2) The varint-encoded newest deleted timestamp.
+func (p *persistence) checkpointTombstones(t *tombstones) (err error) {
+	p.checkpointMtx.Lock()
+	defer p.checkpointMtx.Unlock()
+
+	// Hold the lock while writing so that no change goes unnoticed.
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if !t.dirty {
+		return nil
+	}
+
+	f, err := os.OpenFile(p.tombstonesTempFileName(), os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0640)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		syncErr := f.Sync()
+		closeErr := f.Close()
+		if err != nil {
+			return
+		}
+		err = syncErr
+		if err != nil {
+			return
+		}
+		err = closeErr
+		if err != nil {
+			return
+		}
+		err = os.Rename(p.tombstonesTempFileName(), p.tombstonesFileName())
+		if err == nil {
+			t.dirty = false
+		}
+	}()
+
+	w := bufio.NewWriterSize(f, fileBufSize)
+
+	if _, err = w.WriteString(tombstonesMagicString); err != nil {
+		return
+	}
+	if _, err = codable.EncodeUvarint(w, tombstonesFormatVersion); err != nil {
+		return
+	}
+	if _, err = codable.EncodeUvarint(w, uint64(len(t.m))); err != nil {
+		return
+	}
+
+	for fp, ivs := range t.m {
+		if err = codable.EncodeUint64(w, uint64(fp)); err != nil {
+			return
+		}
+		if _, err = codable.EncodeUvarint(w, uint64(len(ivs))); err != nil {
+			return
+		}
+		for _, iv := range ivs {
+			if _, err = codable.EncodeVarint(w, int64(iv.OldestInclusive)); err != nil {
+				return
+			}
+			if _, err = codable.EncodeVarint(w, int64(iv.NewestInclusive)); err != nil {
+				return
+			}
+		}
+	}
+	err = w.Flush()
+	return
+}
+
+// loadTombstones loads the tombstones. If p.tombstonesFileName is not found,
+// the method returns empty tombstones.
+func (p *persistence) loadTombstones() (*tombstones, error) {
+	t := newTombstones()
+
+	f, err := os.Open(p.tombstonesFileName())
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, fileBufSize)
+
+	buf := make([]byte, len(tombstonesMagicString))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	magic := string(buf)
+	if magic != tombstonesMagicString {
+		return nil, fmt.Errorf(
+			"unexpected magic string, want %q, got %q",
+			tombstonesMagicString, magic,
+		)
+	}
+	version, err := binary.ReadUvarint(r)
+	if version != tombstonesFormatVersion || err != nil {
+		return nil, fmt.Errorf("unknown tombstones format version, want %d", tombstonesFormatVersion)
+	}
+	numSeries, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	for ; numSeries > 0; numSeries-- {
+		fp, err := codable.DecodeUint64(r)
+		if err != nil {
+			return nil, err
+		}
+		numIntervals, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		ivs := make([]metric.Interval, 0, numIntervals)
+		for ; numIntervals > 0; numIntervals-- {
+			oldest, err := binary.ReadVarint(r)
+			if err != nil {
+				return nil, err
+			}
+			newest, err := binary.ReadVarint(r)
+			if err != nil {
+				return nil, err
+			}
+			ivs = append(ivs, metric.Interval{
+				OldestInclusive: model.Time(oldest),
+				NewestInclusive: model.Time(newest),
+			})
+		}
+		t.m[model.Fingerprint(fp)] = ivs
+	}
+	return t, nil
+}
+
 func offsetForChunkIndex(i int) int64 {
 	return int64(i * chunkLenWithHeader)
 }
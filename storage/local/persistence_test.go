@@ -14,7 +14,11 @@
 package local
 
 import (
+	"os"
+	"path"
 	"reflect"
+	"sort"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -35,9 +39,8 @@ var (
 )
 
 func newTestPersistence(t *testing.T, encoding chunkEncoding) (*persistence, testutil.Closer) {
-	DefaultChunkEncoding = encoding
 	dir := testutil.NewTemporaryDirectory("test_persistence", t)
-	p, err := newPersistence(dir.Path(), false, false, func() bool { return false })
+	p, err := newPersistence(dir.Path(), false, false, func() bool { return false }, newSyncBatcher(1, 0), newWriteThrottle(0, nil))
 	if err != nil {
 		dir.Close()
 		t.Fatal(err)
@@ -359,19 +362,19 @@ func testCheckpointAndLoadSeriesMapAndHeads(t *testing.T, encoding chunkEncoding
 	s3 := newMemorySeries(m3, nil, time.Time{})
 	s4 := newMemorySeries(m4, nil, time.Time{})
 	s5 := newMemorySeries(m5, nil, time.Time{})
-	s1.add(&model.SamplePair{Timestamp: 1, Value: 3.14})
-	s3.add(&model.SamplePair{Timestamp: 2, Value: 2.7})
+	s1.add(&model.SamplePair{Timestamp: 1, Value: 3.14}, encoding)
+	s3.add(&model.SamplePair{Timestamp: 2, Value: 2.7}, encoding)
 	s3.headChunkClosed = true
 	s3.persistWatermark = 1
 	for i := 0; i < 10000; i++ {
 		s4.add(&model.SamplePair{
 			Timestamp: model.Time(i),
 			Value:     model.SampleValue(i) / 2,
-		})
+		}, encoding)
 		s5.add(&model.SamplePair{
 			Timestamp: model.Time(i),
 			Value:     model.SampleValue(i * i),
-		})
+		}, encoding)
 	}
 	s5.persistWatermark = 3
 	chunkCountS4 := len(s4.chunkDescs)
@@ -485,6 +488,209 @@ func TestCheckpointAndLoadSeriesMapAndHeadsChunkType1(t *testing.T) {
 	testCheckpointAndLoadSeriesMapAndHeads(t, 1)
 }
 
+func TestSeriesFileLayoutAndRecovery(t *testing.T) {
+	p, closer := newTestPersistence(t, 1)
+	defer closer.Close()
+
+	fpToMetric := map[model.Fingerprint]model.Metric{
+		m1.FastFingerprint(): m1,
+		m2.FastFingerprint(): m2,
+		m3.FastFingerprint(): m3,
+	}
+	fpToChunks := buildTestChunks(1)
+
+	for fp, chunks := range fpToChunks {
+		if _, err := p.persistChunks(fp, chunks); err != nil {
+			t.Fatal(err)
+		}
+
+		// Series files are sharded into directories named after the
+		// first seriesDirNameLen hex digits of their fingerprint.
+		fpStr := fp.String()
+		want := path.Join(p.basePath, fpStr[:seriesDirNameLen], fpStr[seriesDirNameLen:]+seriesFileSuffix)
+		if got := p.fileNameForFingerprint(fp); got != want {
+			t.Errorf("want file name %s for fingerprint %v, got %s", want, fp, got)
+		}
+		if _, err := os.Stat(want); err != nil {
+			t.Errorf("series file for fingerprint %v not found: %s", fp, err)
+		}
+	}
+
+	// Put a copy of a series file into a directory that doesn't match its
+	// name, which makes it a series file of an unknown fingerprint.
+	var misplacedFP model.Fingerprint
+	for fp := range fpToChunks {
+		misplacedFP = fp
+		break
+	}
+	misplacedDir := "00"
+	if misplacedFP.String()[:seriesDirNameLen] == misplacedDir {
+		misplacedDir = "ff"
+	}
+	misplacedName := path.Base(p.fileNameForFingerprint(misplacedFP))
+	if err := os.MkdirAll(path.Join(p.basePath, misplacedDir), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(
+		p.fileNameForFingerprint(misplacedFP),
+		path.Join(p.basePath, misplacedDir, misplacedName),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	fpToSeries := map[model.Fingerprint]*memorySeries{}
+	for fp, m := range fpToMetric {
+		s := newMemorySeries(m, nil, time.Time{})
+		s.headChunkClosed = true
+		fpToSeries[fp] = s
+	}
+	if err := p.recoverFromCrash(fpToSeries); err != nil {
+		t.Fatal(err)
+	}
+	p.waitForIndexing()
+
+	for fp, s := range fpToSeries {
+		if got, want := len(s.chunkDescs), len(fpToChunks[fp]); got != want {
+			t.Errorf("want %d recovered chunks for fingerprint %v, got %d", want, fp, got)
+		}
+		if got, want := s.persistWatermark, len(fpToChunks[fp]); got != want {
+			t.Errorf("want persistWatermark %d for fingerprint %v, got %d", want, fp, got)
+		}
+	}
+	if len(fpToSeries) != len(fpToMetric) {
+		t.Errorf("want %d series after recovery, got %d", len(fpToMetric), len(fpToSeries))
+	}
+	if _, err := os.Stat(path.Join(p.basePath, misplacedDir, misplacedName)); !os.IsNotExist(err) {
+		t.Errorf("misplaced series file was not removed from %s: %v", misplacedDir, err)
+	}
+	if _, err := os.Stat(path.Join(p.basePath, "orphaned", misplacedDir, misplacedName)); err != nil {
+		t.Errorf("misplaced series file was not moved to the orphaned directory: %s", err)
+	}
+}
+
+// persistSyntheticSeries persists numSeries series with numChunks chunks each
+// and returns their metrics by fingerprint.
+func persistSyntheticSeries(tb testing.TB, p *persistence, numSeries, numChunks int) map[model.Fingerprint]model.Metric {
+	fpToMetric := make(map[model.Fingerprint]model.Metric, numSeries)
+	for i := 0; i < numSeries; i++ {
+		m := model.Metric{
+			model.MetricNameLabel: "synthetic_metric",
+			"series":              model.LabelValue(strconv.Itoa(i)),
+		}
+		fp := m.FastFingerprint()
+		chunks := make([]chunk, 0, numChunks)
+		for j := 0; j < numChunks; j++ {
+			chunks = append(chunks, newChunkForEncoding(1).add(&model.SamplePair{
+				Timestamp: model.Time(j),
+				Value:     model.SampleValue(i),
+			})[0])
+		}
+		if _, err := p.persistChunks(fp, chunks); err != nil {
+			tb.Fatal(err)
+		}
+		fpToMetric[fp] = m
+	}
+	return fpToMetric
+}
+
+// newRecoveredSeries returns the series map crash recovery starts from if
+// all chunks of the given series were persisted.
+func newRecoveredSeries(fpToMetric map[model.Fingerprint]model.Metric) map[model.Fingerprint]*memorySeries {
+	fpToSeries := make(map[model.Fingerprint]*memorySeries, len(fpToMetric))
+	for fp, m := range fpToMetric {
+		s := newMemorySeries(m, nil, time.Time{})
+		s.headChunkClosed = true
+		fpToSeries[fp] = s
+	}
+	return fpToSeries
+}
+
+func TestRecoverFromCrashConcurrently(t *testing.T) {
+	p, closer := newTestPersistence(t, 1)
+	defer closer.Close()
+	p.pedanticChecks = true
+	p.recoveryConcurrency = 4
+
+	fpToMetric := persistSyntheticSeries(t, p, 100, 3)
+	// A file not named like a series file is moved to the orphaned
+	// directory by whichever worker gets it.
+	var someFP model.Fingerprint
+	for fp := range fpToMetric {
+		someFP = fp
+		break
+	}
+	strayName := path.Join(path.Dir(p.fileNameForFingerprint(someFP)), "stray")
+	if err := os.Link(p.fileNameForFingerprint(someFP), strayName); err != nil {
+		t.Fatal(err)
+	}
+
+	fpToSeries := newRecoveredSeries(fpToMetric)
+	if err := p.recoverFromCrash(fpToSeries); err != nil {
+		t.Fatal(err)
+	}
+	p.waitForIndexing()
+
+	if len(fpToSeries) != len(fpToMetric) {
+		t.Errorf("want %d series after recovery, got %d", len(fpToMetric), len(fpToSeries))
+	}
+	for fp, s := range fpToSeries {
+		if got := len(s.chunkDescs); got != 3 {
+			t.Errorf("want 3 recovered chunks for fingerprint %v, got %d", fp, got)
+		}
+		if got := s.persistWatermark; got != 3 {
+			t.Errorf("want persistWatermark 3 for fingerprint %v, got %d", fp, got)
+		}
+	}
+	// The label indexes are complete.
+	fps, err := p.fingerprintsForLabelPair(model.LabelPair{
+		Name:  model.MetricNameLabel,
+		Value: "synthetic_metric",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fps) != len(fpToMetric) {
+		t.Errorf("want %d indexed fingerprints, got %d", len(fpToMetric), len(fps))
+	}
+	if _, err := os.Stat(strayName); !os.IsNotExist(err) {
+		t.Errorf("stray file was not removed: %v", err)
+	}
+}
+
+func benchmarkRecoverFromCrash(b *testing.B, concurrency int) {
+	dir := testutil.NewTemporaryDirectory("bench_recovery", b)
+	defer dir.Close()
+
+	p, err := newPersistence(dir.Path(), false, true, func() bool { return false }, newSyncBatcher(1, 0), newWriteThrottle(0, nil))
+	if err != nil {
+		b.Fatal(err)
+	}
+	go p.run()
+	defer p.close()
+	p.recoveryConcurrency = concurrency
+
+	fpToMetric := persistSyntheticSeries(b, p, 2000, 10)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		fpToSeries := newRecoveredSeries(fpToMetric)
+		b.StartTimer()
+		if err := p.recoverFromCrash(fpToSeries); err != nil {
+			b.Fatal(err)
+		}
+		p.waitForIndexing()
+	}
+}
+
+func BenchmarkRecoverFromCrashPedanticConcurrency1(b *testing.B) {
+	benchmarkRecoverFromCrash(b, 1)
+}
+
+func BenchmarkRecoverFromCrashPedanticConcurrency8(b *testing.B) {
+	benchmarkRecoverFromCrash(b, 8)
+}
+
 func TestCheckpointAndLoadFPMappings(t *testing.T) {
 	p, closer := newTestPersistence(t, 1)
 	defer closer.Close()
@@ -848,6 +1054,79 @@ func TestIndexingChunkType1(t *testing.T) {
 	testIndexing(t, 1)
 }
 
+// TestLabelIndexesSurviveRestart checks that the label indexes written by one
+// persistence are loaded as-is by the next one on the same directory, and that
+// they are identical to indexes rebuilt from the series as crash recovery does.
+func TestLabelIndexesSurviveRestart(t *testing.T) {
+	fpToSeries := map[model.Fingerprint]*memorySeries{
+		m1.FastFingerprint(): newMemorySeries(m1, nil, time.Time{}),
+		m2.FastFingerprint(): newMemorySeries(m2, nil, time.Time{}),
+		m3.FastFingerprint(): newMemorySeries(m3, nil, time.Time{}),
+	}
+
+	dir := testutil.NewTemporaryDirectory("test_persistence", t)
+	defer dir.Close()
+	p, err := newPersistence(dir.Path(), false, false, func() bool { return false }, newSyncBatcher(1, 0), newWriteThrottle(0, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.run()
+	for fp, s := range fpToSeries {
+		p.indexMetric(fp, s.metric)
+	}
+	p.waitForIndexing()
+	if err := p.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := newPersistence(dir.Path(), false, false, func() bool { return false }, newSyncBatcher(1, 0), newWriteThrottle(0, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go restarted.run()
+	defer restarted.close()
+
+	rebuilt, closer := newTestPersistence(t, 1)
+	defer closer.Close()
+	if err := rebuilt.rebuildLabelIndexes(fpToSeries); err != nil {
+		t.Fatal(err)
+	}
+	rebuilt.waitForIndexing()
+
+	for _, s := range fpToSeries {
+		for ln, lv := range s.metric {
+			got, err := restarted.labelValuesForLabelName(ln)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := rebuilt.labelValuesForLabelName(ln)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Sort(got)
+			sort.Sort(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: label values don't match. Got: %v; want %v", ln, got, want)
+			}
+
+			lp := model.LabelPair{Name: ln, Value: lv}
+			gotFPs, err := restarted.fingerprintsForLabelPair(lp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantFPs, err := rebuilt.fingerprintsForLabelPair(lp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Sort(gotFPs)
+			sort.Sort(wantFPs)
+			if len(gotFPs) == 0 || !reflect.DeepEqual(gotFPs, wantFPs) {
+				t.Errorf("%v: fingerprints don't match. Got: %v; want %v", lp, gotFPs, wantFPs)
+			}
+		}
+	}
+}
+
 func verifyIndexedState(i int, t *testing.T, b incrementalBatch, indexedFpsToMetrics index.FingerprintMetricMapping, p *persistence) {
 	p.waitForIndexing()
 	for fp, m := range indexedFpsToMetrics {
@@ -32,11 +32,9 @@ func (p *memorySeriesPreloader) PreloadRange(
 	stalenessDelta time.Duration,
 ) error {
 	cds, err := p.storage.preloadChunksForRange(fp, from, through, stalenessDelta)
-	if err != nil {
-		return err
-	}
+	// Chunks are pinned even if some of them could not be decoded.
 	p.pinnedChunkDescs = append(p.pinnedChunkDescs, cds...)
-	return nil
+	return err
 }
 
 /*
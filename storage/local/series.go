@@ -14,6 +14,7 @@
 package local
 
 import (
+	"errors"
 	"sort"
 	"sync"
 	"time"
@@ -34,6 +35,11 @@ const (
 	headChunkTimeout = time.Hour // Close head chunk if not touched for that long.
 )
 
+var (
+	errSampleNotInHeadChunk = errors.New("sample is not within the open head chunk")
+	errDuplicateSample      = errors.New("sample with the same timestamp exists already")
+)
+
 // fingerprintSeriesPair pairs a fingerprint with a memorySeries pointer.
 type fingerprintSeriesPair struct {
 	fp     model.Fingerprint
@@ -165,6 +171,9 @@ type memorySeries struct {
 	// The timestamp of the last sample in this series. Needed for fast access to
 	// ensure timestamp monotonicity during ingestion.
 	lastTime model.Time
+	// The interval between the last two samples appended to this series
+	// since it was loaded into memory, or 0 if not known.
+	lastInterval time.Duration
 	// Whether the current head chunk has already been finished.  If true,
 	// the current head chunk must not be modified anymore.
 	headChunkClosed bool
@@ -204,12 +213,23 @@ func newMemorySeries(m model.Metric, chunkDescs []*chunkDesc, modTime time.Time)
 }
 
 // add adds a sample pair to the series. It returns the number of newly
-// completed chunks (which are now eligible for persistence).
+// completed chunks (which are now eligible for persistence). A new head chunk
+// is created with the provided encoding. Overflow chunks keep the encoding of
+// the chunk they overflow from.
 //
 // The caller must have locked the fingerprint of the series.
-func (s *memorySeries) add(v *model.SamplePair) int {
+func (s *memorySeries) add(v *model.SamplePair, encoding chunkEncoding) int {
+	completedChunksCount := 0
+	if len(s.chunkDescs) > 0 && !s.headChunkClosed && s.head().c.encoding() != encoding {
+		// The head chunk was loaded from a checkpoint written with
+		// another encoding. Close it so that the series switches to the
+		// requested encoding.
+		s.headChunkClosed = true
+		s.headChunkUsedByIterator = false
+		completedChunksCount++
+	}
 	if len(s.chunkDescs) == 0 || s.headChunkClosed {
-		newHead := newChunkDesc(newChunk())
+		newHead := newChunkDesc(newChunkForEncoding(encoding))
 		s.chunkDescs = append(s.chunkDescs, newHead)
 		s.headChunkClosed = false
 	} else if s.headChunkUsedByIterator && s.head().refCount() > 1 {
@@ -236,8 +256,70 @@ func (s *memorySeries) add(v *model.SamplePair) int {
 		s.chunkDescs = append(s.chunkDescs, newChunkDesc(c))
 	}
 
+	if s.lastTime != model.Earliest {
+		s.lastInterval = v.Timestamp.Sub(s.lastTime)
+	}
 	s.lastTime = v.Timestamp
-	return len(chunks) - 1
+	return completedChunksCount + len(chunks) - 1
+}
+
+// insert inserts a sample pair with a timestamp before the last time of the
+// series into the head chunk by re-encoding it. It returns the number of newly
+// completed chunks (which are now eligible for persistence). Samples before the
+// first time of the head chunk cannot be inserted anymore, as the chunks
+// preceding the head chunk are immutable. In that case,
+// errSampleNotInHeadChunk is returned. If a sample with the same timestamp
+// exists already, errDuplicateSample is returned and the series is unchanged.
+// The head chunk is re-encoded with the provided encoding.
+//
+// The caller must have locked the fingerprint of the series.
+func (s *memorySeries) insert(v *model.SamplePair, encoding chunkEncoding) (int, error) {
+	if len(s.chunkDescs) == 0 || s.headChunkClosed ||
+		len(s.chunkDescs)-1 < s.persistWatermark ||
+		v.Timestamp < s.head().firstTime() {
+		return 0, errSampleNotInHeadChunk
+	}
+
+	var (
+		samples  []*model.SamplePair
+		inserted bool
+		err      error
+	)
+	for sp := range s.head().c.newIterator().values() {
+		if err != nil {
+			// Drain the channel.
+			continue
+		}
+		if !inserted {
+			if sp.Timestamp == v.Timestamp {
+				err = errDuplicateSample
+				continue
+			}
+			if sp.Timestamp > v.Timestamp {
+				samples = append(samples, v)
+				inserted = true
+			}
+		}
+		samples = append(samples, sp)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Re-encode the head chunk into a new chunk, so that iterators using
+	// the current version of the head chunk are not affected.
+	chunks := []chunk{newChunkForEncoding(encoding)}
+	for _, sp := range samples {
+		last := len(chunks) - 1
+		chunks = append(chunks[:last], chunks[last].add(sp)...)
+	}
+	s.head().c = chunks[0]
+	s.headChunkUsedByIterator = false
+
+	for _, c := range chunks[1:] {
+		s.chunkDescs = append(s.chunkDescs, newChunkDesc(c))
+	}
+	return len(chunks) - 1, nil
 }
 
 // maybeCloseHeadChunk closes the head chunk if it has not been touched for the
@@ -327,7 +409,7 @@ func (s *memorySeries) preloadChunks(
 			panic("requested loading chunks from persistence in a situation where we must not have persisted data for chunk descriptors in memory")
 		}
 		chunks, err := mss.loadChunks(fp, loadIndexes, s.chunkDescsOffset)
-		if err != nil {
+		if _, ok := err.(*ChunkDecodeError); err != nil && !ok {
 			// Unpin the chunks since we won't return them as pinned chunks now.
 			for _, cd := range pinnedChunkDescs {
 				cd.unpin(mss.evictRequests)
@@ -336,8 +418,13 @@ func (s *memorySeries) preloadChunks(
 			return nil, err
 		}
 		for i, c := range chunks {
-			s.chunkDescs[loadIndexes[i]].setChunk(c)
+			// Chunks that could not be decoded stay evicted and are
+			// thereby skipped by iterators.
+			if c != nil {
+				s.chunkDescs[loadIndexes[i]].setChunk(c)
+			}
 		}
+		return pinnedChunkDescs, err
 	}
 	return pinnedChunkDescs, nil
 }
@@ -374,7 +461,8 @@ func (s *memorySeries) preloadChunksAtTime(t model.Time, p *persistence) (chunkD
 */
 
 // preloadChunksForRange loads chunks for the given range from the persistence.
-// The caller must have locked the fingerprint of the series.
+// If some chunks could not be decoded, the others are returned together with a
+// *ChunkDecodeError. The caller must have locked the fingerprint of the series.
 func (s *memorySeries) preloadChunksForRange(
 	from model.Time, through model.Time,
 	fp model.Fingerprint, mss *memorySeriesStorage,
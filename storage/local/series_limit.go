@@ -0,0 +1,158 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+const metricNameLabel = "metric_name"
+
+// SeriesLimits maps metric names to the maximum number of series in memory
+// for that name. A limit of zero or less means unlimited.
+type SeriesLimits map[model.LabelValue]int
+
+// String implements flag.Value.
+func (sl SeriesLimits) String() string {
+	limits := make([]string, 0, len(sl))
+	for name, limit := range sl {
+		limits = append(limits, fmt.Sprintf("%s=%d", name, limit))
+	}
+	sort.Strings(limits)
+	return strings.Join(limits, ",")
+}
+
+// Set implements flag.Value. It accepts a comma-separated list of
+// <metric name>=<limit> pairs and adds them to the existing limits.
+func (sl *SeriesLimits) Set(s string) error {
+	if *sl == nil {
+		*sl = SeriesLimits{}
+	}
+	for _, pair := range strings.Split(s, ",") {
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid series limit %q, expected <metric name>=<limit>", pair)
+		}
+		name := model.LabelValue(strings.TrimSpace(parts[0]))
+		if name == "" {
+			return fmt.Errorf("missing metric name in series limit %q", pair)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return fmt.Errorf("invalid series limit %q: %s", pair, err)
+		}
+		(*sl)[name] = limit
+	}
+	return nil
+}
+
+// seriesLimiter tracks the number of series in memory per metric name and
+// rejects the creation of new series for metric names that have reached their
+// limit, so that a single exploding metric cannot take down the storage.
+// Series that already exist are not affected.
+type seriesLimiter struct {
+	mtx          sync.Mutex
+	defaultLimit int
+	limits       SeriesLimits
+	numSeries    map[model.LabelValue]int
+
+	rejectedSamples *prometheus.CounterVec
+}
+
+// newSeriesLimiter returns a seriesLimiter applying defaultLimit to all metric
+// names without an entry in limits. A limit of zero or less means unlimited.
+func newSeriesLimiter(defaultLimit int, limits SeriesLimits) *seriesLimiter {
+	return &seriesLimiter{
+		defaultLimit: defaultLimit,
+		limits:       limits,
+		numSeries:    map[model.LabelValue]int{},
+
+		rejectedSamples: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "series_limit_rejected_samples_total",
+				Help:      "The total number of samples rejected because they would have created a new series for a metric name that has reached its limit of series in memory.",
+			},
+			[]string{metricNameLabel},
+		),
+	}
+}
+
+func (l *seriesLimiter) limit(name model.LabelValue) int {
+	if limit, ok := l.limits[name]; ok {
+		return limit
+	}
+	return l.defaultLimit
+}
+
+// tryAdd accounts for a new series of the given metric and returns true if
+// the metric name is below its limit. Otherwise, it counts a rejected sample
+// and returns false. It is goroutine-safe.
+func (l *seriesLimiter) tryAdd(m model.Metric) bool {
+	name := m[model.MetricNameLabel]
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if limit := l.limit(name); limit > 0 && l.numSeries[name] >= limit {
+		l.rejectedSamples.WithLabelValues(string(name)).Inc()
+		return false
+	}
+	l.numSeries[name]++
+	return true
+}
+
+// add accounts for a series of the given metric regardless of the limit, e.g.
+// for a series loaded on startup or unarchived. It is goroutine-safe.
+func (l *seriesLimiter) add(m model.Metric) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.numSeries[m[model.MetricNameLabel]]++
+}
+
+// remove accounts for a series of the given metric leaving memory. It is
+// goroutine-safe.
+func (l *seriesLimiter) remove(m model.Metric) {
+	name := m[model.MetricNameLabel]
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.numSeries[name] <= 1 {
+		delete(l.numSeries, name)
+		return
+	}
+	l.numSeries[name]--
+}
+
+// Describe implements prometheus.Collector.
+func (l *seriesLimiter) Describe(ch chan<- *prometheus.Desc) {
+	l.rejectedSamples.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (l *seriesLimiter) Collect(ch chan<- prometheus.Metric) {
+	l.rejectedSamples.Collect(ch)
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSeriesLimitsSet(t *testing.T) {
+	var scenarios = []struct {
+		in   []string
+		want SeriesLimits
+		fail bool
+	}{
+		{
+			in:   []string{"foo=10"},
+			want: SeriesLimits{"foo": 10},
+		},
+		{
+			in:   []string{"foo=10, bar = 0", "baz=5", "foo=20"},
+			want: SeriesLimits{"foo": 20, "bar": 0, "baz": 5},
+		},
+		{
+			in:   []string{"foo"},
+			fail: true,
+		},
+		{
+			in:   []string{"=10"},
+			fail: true,
+		},
+		{
+			in:   []string{"foo=ten"},
+			fail: true,
+		},
+	}
+
+	for i, s := range scenarios {
+		var got SeriesLimits
+		var err error
+		for _, in := range s.in {
+			if err = got.Set(in); err != nil {
+				break
+			}
+		}
+		if s.fail {
+			if err == nil {
+				t.Errorf("%d. expected error for %q", i, s.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d. unexpected error: %s", i, err)
+		}
+		if !reflect.DeepEqual(got, s.want) {
+			t.Errorf("%d. expected %v, got %v", i, s.want, got)
+		}
+	}
+
+	limits := SeriesLimits{"foo": 20, "bar": 0}
+	if got, want := limits.String(), "bar=0,foo=20"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
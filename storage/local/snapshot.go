@@ -0,0 +1,254 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"encoding"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/storage/local/codable"
+	"github.com/prometheus/prometheus/storage/local/index"
+)
+
+// A snapshot is a storage directory of its own that Prometheus can be started
+// on, e.g. after copying it elsewhere as a backup. Series files and the heads
+// and tombstones files are hardlinked into the snapshot where possible. As
+// series files are appended to in place, persistChunks replaces a series file
+// by a copy before appending to it if it is still linked into a snapshot.
+//
+// The snapshot contains a fresh checkpoint of the series map and head chunks,
+// so that chunks not yet persisted are part of it. Series files are linked
+// after the checkpoint has been written and might thus contain chunks the
+// checkpoint doesn't know of yet, just as after a crash. The snapshot is
+// therefore marked dirty, and crash recovery reconciles the series files with
+// the checkpoint and rebuilds the label indexes when Prometheus is started on
+// it.
+
+const (
+	// SnapshotsDirName is the name of the directory within the storage
+	// directory that snapshots are created in by default.
+	SnapshotsDirName = "snapshots"
+
+	// indexCopyBatchSize is the number of entries copied from an archive
+	// index into a snapshot per batch.
+	indexCopyBatchSize = 1024
+)
+
+// snapshot creates a new snapshot of the storage in a subdirectory of dir and
+// returns the name of the subdirectory. This method is goroutine-safe.
+func (p *persistence) snapshot(dir string, fingerprintToSeries *seriesMap, fpLocker *fingerprintLocker) (name string, err error) {
+	name = fmt.Sprintf("%s-%016x", time.Now().UTC().Format("20060102T150405Z"), rand.Int63())
+	snapDir := filepath.Join(dir, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	if err := os.Mkdir(snapDir, 0700); err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			if e := os.RemoveAll(snapDir); e != nil {
+				log.Errorf("Error removing incomplete snapshot %s: %s", snapDir, e)
+			}
+		}
+	}()
+
+	log.Infof("Creating storage snapshot %s...", snapDir)
+	begin := time.Now()
+
+	p.checkpointMtx.Lock()
+	defer p.checkpointMtx.Unlock()
+
+	if err := p.writeSeriesMapAndHeads(fingerprintToSeries, fpLocker); err != nil {
+		return "", err
+	}
+
+	p.snapshotMtx.Lock()
+	defer p.snapshotMtx.Unlock()
+
+	// Sync the series files once, as they are shared with the snapshot.
+	p.syncBatcher.flush()
+
+	if err := copyFile(filepath.Join(p.basePath, versionFileName), filepath.Join(snapDir, versionFileName)); err != nil {
+		return "", err
+	}
+	// The heads and tombstones files are only ever replaced, never
+	// modified in place.
+	if err := linkFile(p.headsFileName(), filepath.Join(snapDir, headsFileName)); err != nil {
+		return "", err
+	}
+	if err := linkFile(p.tombstonesFileName(), filepath.Join(snapDir, tombstonesFileName)); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := p.linkSeriesFiles(snapDir); err != nil {
+		return "", err
+	}
+	if err := p.copyArchiveIndexes(snapDir); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(snapDir, dirtyFileName), nil, 0640); err != nil {
+		return "", err
+	}
+
+	log.Infof("Done creating storage snapshot %s in %v.", snapDir, time.Since(begin))
+	return name, nil
+}
+
+// linkSeriesFiles links all series files into the snapshot directory snapDir.
+// The caller must hold snapshotMtx for writing.
+func (p *persistence) linkSeriesFiles(snapDir string) error {
+	seriesDirNameFmt := fmt.Sprintf("%%0%dx", seriesDirNameLen)
+	for i := 0; i < 1<<(seriesDirNameLen*4); i++ {
+		dirName := fmt.Sprintf(seriesDirNameFmt, i)
+		fis, err := ioutil.ReadDir(filepath.Join(p.basePath, dirName))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Mkdir(filepath.Join(snapDir, dirName), 0700); err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			if fi.IsDir() || !strings.HasSuffix(fi.Name(), seriesFileSuffix) || strings.HasSuffix(fi.Name(), seriesTempFileSuffix) {
+				continue
+			}
+			if err := linkFile(
+				filepath.Join(p.basePath, dirName, fi.Name()),
+				filepath.Join(snapDir, dirName, fi.Name()),
+			); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyArchiveIndexes copies the archive indexes into the snapshot directory
+// snapDir. The label indexes are not copied as they are rebuilt by crash
+// recovery anyway. The caller must hold snapshotMtx for writing.
+func (p *persistence) copyArchiveIndexes(snapDir string) error {
+	fpToMetric, err := index.NewFingerprintMetricIndex(snapDir)
+	if err != nil {
+		return err
+	}
+	defer fpToMetric.Close()
+	var (
+		fp codable.Fingerprint
+		m  codable.Metric
+	)
+	if err := copyIndex(fpToMetric, p.archivedFingerprintToMetrics, &fp, &m); err != nil {
+		return err
+	}
+
+	fpToTimeRange, err := index.NewFingerprintTimeRangeIndex(snapDir)
+	if err != nil {
+		return err
+	}
+	defer fpToTimeRange.Close()
+	var tr codable.TimeRange
+	return copyIndex(fpToTimeRange, p.archivedFingerprintToTimeRange, &fp, &tr)
+}
+
+type codableValue interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+// copyIndex copies all entries of src into dst, decoding them into key and
+// value on the way.
+func copyIndex(dst, src index.KeyValueStore, key, value codableValue) error {
+	b := dst.NewBatch()
+	n := 0
+	if err := src.ForEach(func(kv index.KeyValueAccessor) error {
+		if err := kv.Key(key); err != nil {
+			return err
+		}
+		if err := kv.Value(value); err != nil {
+			return err
+		}
+		if err := b.Put(key, value); err != nil {
+			return err
+		}
+		if n++; n%indexCopyBatchSize == 0 {
+			if err := dst.Commit(b); err != nil {
+				return err
+			}
+			b.Reset()
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return dst.Commit(b)
+}
+
+// unlinkSnapshottedSeriesFile replaces the series file of the given
+// fingerprint by a copy of it if it is still linked into a snapshot. The
+// caller must hold snapshotMtx for reading and must not persist or drop
+// anything for the same fingerprint concurrently.
+func (p *persistence) unlinkSnapshottedSeriesFile(fp model.Fingerprint) error {
+	fi, err := os.Stat(p.fileNameForFingerprint(fp))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !isLinked(fi) {
+		return nil
+	}
+	if err := copyFile(p.fileNameForFingerprint(fp), p.tempFileNameForFingerprint(fp)); err != nil {
+		return err
+	}
+	return os.Rename(p.tempFileNameForFingerprint(fp), p.fileNameForFingerprint(fp))
+}
+
+// copyFile copies the file src to the new file dst and syncs it.
+func copyFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		syncErr := out.Sync()
+		closeErr := out.Close()
+		if err == nil {
+			err = syncErr
+		}
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,31 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package local
+
+import "os"
+
+// linkFile makes the file src available as dst in a snapshot.
+// Without a way to tell whether a file is still linked into a snapshot, the
+// file is copied.
+func linkFile(src, dst string) error {
+	return copyFile(src, dst)
+}
+
+// isLinked always returns false as series files are never linked into
+// snapshots on this platform.
+func isLinked(fi os.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,114 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+func TestSnapshot(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+
+	m := model.Metric{model.MetricNameLabel: "test_snapshot"}
+	fp := m.FastFingerprint()
+	appendAndPersist := func(from, to int) {
+		for i := from; i < to; i++ {
+			s.Append(&model.Sample{
+				Metric:    m,
+				Timestamp: model.Time(i),
+				Value:     model.SampleValue(i),
+			})
+		}
+		s.WaitForIndexing()
+		s.maintainMemorySeries(fp, 0)
+	}
+
+	appendAndPersist(0, 10000)
+	if s.getNumChunksToPersist() != 0 {
+		t.Fatalf("expected all closed chunks to be persisted, %d left", s.getNumChunksToPersist())
+	}
+
+	dir := filepath.Join(s.persistence.basePath, SnapshotsDirName)
+	name, err := s.Snapshot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapDir := filepath.Join(dir, name)
+	seriesFile := filepath.Join(snapDir, fp.String()[:seriesDirNameLen], fp.String()[seriesDirNameLen:]+seriesFileSuffix)
+	before, err := os.Stat(seriesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Persisting more chunks must not change the snapshot.
+	appendAndPersist(10000, 20000)
+	after, err := os.Stat(seriesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Size() != after.Size() {
+		t.Fatalf("expected snapshotted series file to stay at %d bytes, got %d", before.Size(), after.Size())
+	}
+	live, err := os.Stat(s.persistence.fileNameForFingerprint(fp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live.Size() <= after.Size() {
+		t.Fatalf("expected live series file to grow beyond %d bytes, got %d", after.Size(), live.Size())
+	}
+
+	// A storage started on the snapshot has exactly the samples appended
+	// before the snapshot, including those in the head chunk.
+	snap := NewMemorySeriesStorage(&MemorySeriesStorageOptions{
+		MemoryChunks:               1000000,
+		MaxChunksToPersist:         1000000,
+		PersistenceRetentionPeriod: 24 * time.Hour * 365 * 100,
+		PersistenceStoragePath:     snapDir,
+		CheckpointInterval:         time.Hour,
+		SyncStrategy:               Adaptive,
+	}).(*memorySeriesStorage)
+	if err := snap.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Stop()
+
+	p := snap.NewPreloader()
+	defer p.Close()
+	p.PreloadRange(fp, 0, 20000, time.Hour)
+	values := snap.NewIterator(fp).RangeValues(metric.Interval{OldestInclusive: 0, NewestInclusive: 20000})
+	if len(values) != 10000 {
+		t.Fatalf("expected 10000 samples in snapshot, got %d", len(values))
+	}
+	for i, v := range values {
+		if v.Timestamp != model.Time(i) || v.Value != model.SampleValue(i) {
+			t.Fatalf("unexpected sample %d in snapshot: %v", i, v)
+		}
+	}
+	snap.WaitForIndexing()
+	if res := snap.MetricsForLabelMatchers(&metric.LabelMatcher{
+		Type:  metric.Equal,
+		Name:  model.MetricNameLabel,
+		Value: "test_snapshot",
+	}); len(res) != 1 {
+		t.Fatalf("expected the snapshotted series to be indexed, got %v", res)
+	}
+}
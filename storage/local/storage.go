@@ -17,10 +17,13 @@ package local
 import (
 	"container/list"
 	"fmt"
+	"math"
+	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
 
@@ -43,6 +46,9 @@ const (
 	// checkpoint anymore based on the dirty series count, and we do not
 	// sync series files anymore if using the adaptive sync strategy.
 	percentChunksToPersistForDegradation = 80
+
+	// How often the disk usage of the storage is checked.
+	diskUsageCheckInterval = time.Minute
 )
 
 var (
@@ -56,6 +62,16 @@ var (
 		"The maximum number of chunks that can be waiting for persistence before sample ingestion will stop.",
 		nil, nil,
 	)
+	retentionCutoffDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "retention_cutoff_timestamp_seconds"),
+		"The timestamp of the oldest sample that is still retained (and thus queryable) according to the retention settings.",
+		nil, nil,
+	)
+	chunkCacheHitRatioDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "chunk_cache_hit_ratio"),
+		"The ratio of chunks pinned for queries that did not have to be loaded from disk. NaN if no chunks have been pinned yet.",
+		nil, nil,
+	)
 )
 
 type evictRequest struct {
@@ -102,13 +118,58 @@ const (
 	Adaptive
 )
 
+// ChunkEncoding is an enum to select the encoding of newly created chunks.
+type ChunkEncoding int
+
+// String implements flag.Value.
+func (ce ChunkEncoding) String() string {
+	if e, err := ce.chunkEncoding(); err == nil {
+		return e.String()
+	}
+	return "<unknown>"
+}
+
+// Set implements flag.Value.
+func (ce *ChunkEncoding) Set(s string) error {
+	switch s {
+	case "0":
+		*ce = DeltaEncoding
+	case "1":
+		*ce = DoubleDeltaEncoding
+	default:
+		return fmt.Errorf("invalid chunk encoding: %s", s)
+	}
+	return nil
+}
+
+// chunkEncoding returns the encoding of chunks selected by ce.
+func (ce ChunkEncoding) chunkEncoding() (chunkEncoding, error) {
+	switch ce {
+	case DeltaEncoding:
+		return delta, nil
+	case DefaultEncoding, DoubleDeltaEncoding:
+		return doubleDelta, nil
+	}
+	return 0, fmt.Errorf("unknown chunk encoding: %d", ce)
+}
+
+// Possible values for ChunkEncoding. DefaultEncoding, the zero value, selects
+// double-delta encoding.
+const (
+	DefaultEncoding ChunkEncoding = iota
+	DeltaEncoding
+	DoubleDeltaEncoding
+)
+
 // A syncStrategy is a function that returns whether series files should be
 // synced or not. It does not need to be goroutine safe.
 type syncStrategy func() bool
 
 type memorySeriesStorage struct {
-	// numChunksToPersist has to be aligned for atomic operations.
+	// numChunksToPersist and sizeCutoff have to be aligned for atomic
+	// operations.
 	numChunksToPersist int64 // The number of chunks waiting for persistence.
+	sizeCutoff         int64 // The model.Time before which chunks are dropped to enforce maxDiskBytes.
 	maxChunksToPersist int   // If numChunksToPersist reaches this threshold, ingestion will stall.
 	degraded           bool
 
@@ -120,11 +181,19 @@ type memorySeriesStorage struct {
 	loopStopping, loopStopped  chan struct{}
 	maxMemoryChunks            int
 	dropAfter                  time.Duration
+	recordedDropAfter          time.Duration // Zero if the same as dropAfter.
+	minDropAfter               time.Duration
+	maxDiskBytes               int64 // Unlimited if <= 0.
+	lastDiskUsage              int64
+	outOfOrderWindow           time.Duration
 	checkpointInterval         time.Duration
 	checkpointDirtySeriesLimit int
+	chunkEncoding              chunkEncoding // Encoding of newly created chunks.
 
-	persistence *persistence
-	mapper      *fpMapper
+	persistence   *persistence
+	mapper        *fpMapper
+	seriesLimiter *seriesLimiter
+	tombstones    *tombstones
 
 	evictList                   *list.List
 	evictRequests               chan evictRequest
@@ -132,11 +201,13 @@ type memorySeriesStorage struct {
 
 	persistErrors               prometheus.Counter
 	numSeries                   prometheus.Gauge
+	diskUsage                   prometheus.Gauge
 	seriesOps                   *prometheus.CounterVec
 	ingestedSamplesCount        prometheus.Counter
 	outOfOrderSamplesCount      prometheus.Counter
 	invalidPreloadRequestsCount prometheus.Counter
 	maintainSeriesDuration      *prometheus.SummaryVec
+	sampleIngestionLag          prometheus.Histogram // Nil if disabled.
 }
 
 // MemorySeriesStorageOptions contains options needed by
@@ -147,11 +218,23 @@ type MemorySeriesStorageOptions struct {
 	MaxChunksToPersist         int           // Max number of chunks waiting to be persisted.
 	PersistenceStoragePath     string        // Location of persistence files.
 	PersistenceRetentionPeriod time.Duration // Chunks at least that old are dropped.
+	RecordedRetentionPeriod    time.Duration // Chunks of recorded series at least that old are dropped. PersistenceRetentionPeriod, if zero.
+	PersistenceRetentionSize   int64         // Max bytes taken by the storage directory before the oldest chunks are dropped. Unlimited if <= 0.
+	MinRetentionPeriod         time.Duration // Chunks younger than that are never dropped to enforce PersistenceRetentionSize.
 	CheckpointInterval         time.Duration // How often to checkpoint the series map and head chunks.
 	CheckpointDirtySeriesLimit int           // How many dirty series will trigger an early checkpoint.
 	Dirty                      bool          // Force the storage to consider itself dirty on startup.
 	PedanticChecks             bool          // If dirty, perform crash-recovery checks on each series file.
+	RecoveryConcurrency        int           // Max number of series files checked concurrently during crash recovery. Not concurrent if <= 1.
 	SyncStrategy               SyncStrategy  // Which sync strategy to apply to series files.
+	SyncBatchSize              int           // Max number of series files synced together. Not batched if <= 1.
+	SyncBatchInterval          time.Duration // Max time a series file sync is delayed for batching.
+	PersistThroughputLimit     int           // Max bytes per second written to series files. Unlimited if <= 0.
+	OutOfOrderWindow           time.Duration // How much older than the last sample of a series a sample may be to still be accepted.
+	IngestionLagHistogram      bool          // Whether to track the lag between sample timestamps and receive time.
+	MaxSeriesPerMetric         int           // Max number of series in memory per metric name. Unlimited if <= 0.
+	MaxSeriesPerMetricOverride SeriesLimits  // Per metric name overrides of MaxSeriesPerMetric.
+	ChunkEncoding              ChunkEncoding // Encoding of newly created chunks. Chunks in other encodings remain readable.
 }
 
 // NewMemorySeriesStorage returns a newly allocated Storage. Storage.Serve still
@@ -166,11 +249,18 @@ func NewMemorySeriesStorage(o *MemorySeriesStorageOptions) Storage {
 		loopStopped:                make(chan struct{}),
 		maxMemoryChunks:            o.MemoryChunks,
 		dropAfter:                  o.PersistenceRetentionPeriod,
+		recordedDropAfter:          o.RecordedRetentionPeriod,
+		minDropAfter:               o.MinRetentionPeriod,
+		maxDiskBytes:               o.PersistenceRetentionSize,
+		sizeCutoff:                 int64(model.Earliest),
+		outOfOrderWindow:           o.OutOfOrderWindow,
 		checkpointInterval:         o.CheckpointInterval,
 		checkpointDirtySeriesLimit: o.CheckpointDirtySeriesLimit,
 
 		maxChunksToPersist: o.MaxChunksToPersist,
 
+		seriesLimiter: newSeriesLimiter(o.MaxSeriesPerMetric, o.MaxSeriesPerMetricOverride),
+
 		evictList:     list.New(),
 		evictRequests: make(chan evictRequest, evictRequestsCap),
 		evictStopping: make(chan struct{}),
@@ -188,6 +278,12 @@ func NewMemorySeriesStorage(o *MemorySeriesStorageOptions) Storage {
 			Name:      "memory_series",
 			Help:      "The current number of series in memory.",
 		}),
+		diskUsage: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "disk_bytes",
+			Help:      "The number of bytes taken by the storage directory on disk, excluding snapshots. Updated periodically by the maintenance loop.",
+		}),
 		seriesOps: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Namespace: namespace,
@@ -207,7 +303,7 @@ func NewMemorySeriesStorage(o *MemorySeriesStorageOptions) Storage {
 			Namespace: namespace,
 			Subsystem: subsystem,
 			Name:      "out_of_order_samples_total",
-			Help:      "The total number of samples that were discarded because their timestamps were at or before the last received sample for a series.",
+			Help:      "The total number of samples that were discarded because their timestamps were before the last received sample for a series and could not be inserted within the out-of-order window.",
 		}),
 		invalidPreloadRequestsCount: prometheus.NewCounter(prometheus.CounterOpts{
 			Namespace: namespace,
@@ -225,11 +321,27 @@ func NewMemorySeriesStorage(o *MemorySeriesStorageOptions) Storage {
 			[]string{seriesLocationLabel},
 		),
 	}
+	if o.IngestionLagHistogram {
+		s.sampleIngestionLag = prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "sample_ingestion_lag_seconds",
+			Help:      "The difference between the wall-clock time a sample was received and its timestamp. Negative values indicate samples from the future.",
+			Buckets:   []float64{0, 1, 5, 15, 60, 300, 900, 3600},
+		})
+	}
 	return s
 }
 
 // Start implements Storage.
 func (s *memorySeriesStorage) Start() (err error) {
+	// Every chunk records its encoding, in series files as well as in
+	// checkpoints, so chunks created with another encoding before are
+	// still loaded correctly.
+	if s.chunkEncoding, err = s.options.ChunkEncoding.chunkEncoding(); err != nil {
+		return err
+	}
+
 	var syncStrategy syncStrategy
 	switch s.options.SyncStrategy {
 	case Never:
@@ -242,11 +354,20 @@ func (s *memorySeriesStorage) Start() (err error) {
 		panic("unknown sync strategy")
 	}
 
+	// Throttling is suspended once the storage is rushed, i.e. reaches the
+	// threshold of graceful degradation mode.
+	throttle := newWriteThrottle(s.options.PersistThroughputLimit, func() bool {
+		return s.persistenceBacklogScore() == 0
+	})
+
+	batcher := newSyncBatcher(s.options.SyncBatchSize, s.options.SyncBatchInterval)
+
 	var p *persistence
-	p, err = newPersistence(s.options.PersistenceStoragePath, s.options.Dirty, s.options.PedanticChecks, syncStrategy)
+	p, err = newPersistence(s.options.PersistenceStoragePath, s.options.Dirty, s.options.PedanticChecks, syncStrategy, batcher, throttle)
 	if err != nil {
 		return err
 	}
+	p.recoveryConcurrency = s.options.RecoveryConcurrency
 	s.persistence = p
 	// Persistence must start running before loadSeriesMapAndHeads() is called.
 	go s.persistence.run()
@@ -266,12 +387,24 @@ func (s *memorySeriesStorage) Start() (err error) {
 	}
 	log.Infof("%d series loaded.", s.fpToSeries.length())
 	s.numSeries.Set(float64(s.fpToSeries.length()))
+	for m := range s.fpToSeries.iter() {
+		s.seriesLimiter.add(m.series.metric)
+	}
 
 	s.mapper, err = newFPMapper(s.fpToSeries, p)
 	if err != nil {
 		return err
 	}
 
+	s.tombstones, err = p.loadTombstones()
+	if err != nil {
+		return err
+	}
+
+	// Report the disk usage right away rather than only after the first
+	// check interval.
+	s.checkDiskUsage()
+
 	go s.handleEvictList()
 	go s.loop()
 
@@ -294,6 +427,9 @@ func (s *memorySeriesStorage) Stop() error {
 	if err := s.persistence.checkpointSeriesMapAndHeads(s.fpToSeries, s.fpLocker); err != nil {
 		return err
 	}
+	if err := s.persistence.checkpointTombstones(s.tombstones); err != nil {
+		return err
+	}
 
 	if err := s.persistence.close(); err != nil {
 		return err
@@ -321,10 +457,14 @@ func (s *memorySeriesStorage) NewIterator(fp model.Fingerprint) SeriesIterator {
 		// return any values.
 		return nopSeriesIterator{}
 	}
-	return &boundedIterator{
+	var it SeriesIterator = &boundedIterator{
 		it:    series.newIterator(),
-		start: model.Now().Add(-s.dropAfter),
+		start: s.seriesRetentionCutoff(series.metric, s.retentionCutoff()),
+	}
+	if deleted := s.tombstones.get(fp); deleted != nil {
+		it = &tombstonedIterator{it: it, deleted: deleted}
 	}
+	return it
 }
 
 // LastSampleForFingerprint implements Storage.
@@ -336,7 +476,25 @@ func (s *memorySeriesStorage) LastSamplePairForFingerprint(fp model.Fingerprint)
 	if !ok {
 		return nil
 	}
-	return series.head().lastSamplePair()
+	sp := series.head().lastSamplePair()
+	if sp != nil {
+		if _, ok := deleted(s.tombstones.get(fp), sp.Timestamp); ok {
+			return nil
+		}
+	}
+	return sp
+}
+
+// SampleIntervalForFingerprint implements Storage.
+func (s *memorySeriesStorage) SampleIntervalForFingerprint(fp model.Fingerprint) time.Duration {
+	s.fpLocker.Lock(fp)
+	defer s.fpLocker.Unlock(fp)
+
+	series, ok := s.fpToSeries.get(fp)
+	if !ok {
+		return 0
+	}
+	return series.lastInterval
 }
 
 // boundedIterator wraps a SeriesIterator and does not allow fetching
@@ -509,25 +667,214 @@ func (s *memorySeriesStorage) MetricForFingerprint(fp model.Fingerprint) metric.
 	}
 }
 
+// ChunkInfo contains meta-data about a single chunk of a series.
+type ChunkInfo struct {
+	FirstTime  model.Time `json:"firstTime"`
+	LastTime   model.Time `json:"lastTime"`
+	Encoding   int        `json:"encoding"`
+	NumSamples int        `json:"numSamples"`
+	Persisted  bool       `json:"persisted"`
+	InMemory   bool       `json:"inMemory"`
+}
+
+// ChunkRange is the time range covered by a number of consecutive chunks of a
+// series.
+type ChunkRange struct {
+	FirstTime model.Time
+	LastTime  model.Time
+	// NumChunks is the number of chunks in the range. It is 0 if the
+	// chunks are only on disk and their number is not known in memory.
+	NumChunks int
+}
+
+// chunkCacheHitRatio returns the ratio of pinned chunks that were already in
+// memory, derived from the pin and load chunk operations. As chunks are only
+// loaded after being pinned, every load is a cache miss.
+func chunkCacheHitRatio() float64 {
+	pins := counterValue(chunkOps.WithLabelValues(pin))
+	if pins == 0 {
+		return math.NaN()
+	}
+	loads := counterValue(chunkOps.WithLabelValues(load))
+	return (pins - loads) / pins
+}
+
+// counterValue returns the current value of the given counter.
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		panic(err) // Cannot happen for counters.
+	}
+	return m.GetCounter().GetValue()
+}
+
+// ChunkInfosForFingerprint implements Storage.
+func (s *memorySeriesStorage) ChunkInfosForFingerprint(fp model.Fingerprint) ([]ChunkInfo, error) {
+	s.fpLocker.Lock(fp)
+	defer s.fpLocker.Unlock(fp)
+
+	series, inMemory := s.fpToSeries.get(fp)
+	if !inMemory {
+		has, _, _, err := s.persistence.hasArchivedMetric(fp)
+		if err != nil || !has {
+			return nil, err
+		}
+	}
+	persisted, err := s.persistence.loadChunkInfos(fp)
+	if err != nil {
+		return nil, err
+	}
+	if !inMemory {
+		return persisted, nil
+	}
+
+	// The chunks that are only on disk precede the chunkDescs in memory. A
+	// chunkDescsOffset of -1 means that there is no overlap between the
+	// series file and the chunkDescs in memory.
+	offset := series.chunkDescsOffset
+	if offset == -1 {
+		offset = len(persisted)
+	}
+	if offset > len(persisted) {
+		return nil, fmt.Errorf("series file for fingerprint %v has %d chunks, expected at least %d", fp, len(persisted), offset)
+	}
+	infos := append(make([]ChunkInfo, 0, offset+len(series.chunkDescs)), persisted[:offset]...)
+	for i, cd := range series.chunkDescs {
+		var info ChunkInfo
+		if c := cd.chunk(); c != nil {
+			it := c.newIterator()
+			info = ChunkInfo{
+				FirstTime:  c.firstTime(),
+				LastTime:   it.lastTimestamp(),
+				Encoding:   int(c.encoding()),
+				NumSamples: it.length(),
+				InMemory:   true,
+			}
+		} else if offset+i < len(persisted) {
+			info = persisted[offset+i]
+		} else {
+			return nil, fmt.Errorf("evicted chunk %d of fingerprint %v not found in series file", i, fp)
+		}
+		info.Persisted = i < series.persistWatermark
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// ChunkRangesForFingerprint implements Storage.
+func (s *memorySeriesStorage) ChunkRangesForFingerprint(fp model.Fingerprint) ([]ChunkRange, error) {
+	s.fpLocker.Lock(fp)
+	defer s.fpLocker.Unlock(fp)
+
+	series, inMemory := s.fpToSeries.get(fp)
+	if !inMemory {
+		has, first, last, err := s.persistence.hasArchivedMetric(fp)
+		if err != nil || !has {
+			return nil, err
+		}
+		return []ChunkRange{{FirstTime: first, LastTime: last}}, nil
+	}
+
+	ranges := make([]ChunkRange, 0, len(series.chunkDescs)+1)
+	if series.chunkDescsOffset != 0 {
+		// The chunks whose chunkDescs have been evicted precede the
+		// chunkDescs in memory. A chunkDescsOffset of -1 means that
+		// their number is unknown.
+		r := ChunkRange{FirstTime: series.savedFirstTime, LastTime: series.lastTime}
+		if len(series.chunkDescs) > 0 {
+			r.LastTime = series.chunkDescs[0].firstTime() - 1
+		}
+		if series.chunkDescsOffset > 0 {
+			r.NumChunks = series.chunkDescsOffset
+		}
+		ranges = append(ranges, r)
+	}
+	for _, cd := range series.chunkDescs {
+		ranges = append(ranges, ChunkRange{
+			FirstTime: cd.firstTime(),
+			LastTime:  cd.lastTime(),
+			NumChunks: 1,
+		})
+	}
+	return ranges, nil
+}
+
+// Snapshot implements Storage.
+func (s *memorySeriesStorage) Snapshot(dir string) (string, error) {
+	return s.persistence.snapshot(dir, s.fpToSeries, s.fpLocker)
+}
+
 // DropMetric implements Storage.
 func (s *memorySeriesStorage) DropMetricsForFingerprints(fps ...model.Fingerprint) {
 	for _, fp := range fps {
 		s.fpLocker.Lock(fp)
+		s.dropSeries(fp)
+		s.fpLocker.Unlock(fp)
+	}
+}
+
+// dropSeries drops the series with the given fingerprint from memory and
+// persistence. The caller must have locked the fp.
+func (s *memorySeriesStorage) dropSeries(fp model.Fingerprint) {
+	if series, ok := s.fpToSeries.get(fp); ok {
+		s.fpToSeries.del(fp)
+		s.numSeries.Dec()
+		s.seriesLimiter.remove(series.metric)
+		s.persistence.unindexMetric(fp, series.metric)
+	} else if err := s.persistence.purgeArchivedMetric(fp); err != nil {
+		log.Errorf("Error purging metric with fingerprint %v: %v", fp, err)
+	}
+	// Attempt to delete series file in any case.
+	if _, err := s.persistence.deleteSeriesFile(fp); err != nil {
+		log.Errorf("Error deleting series file for %v: %v", fp, err)
+	}
+	s.tombstones.del(fp)
+}
+
+// DeleteSamplesForFingerprints implements Storage.
+func (s *memorySeriesStorage) DeleteSamplesForFingerprints(in metric.Interval, fps ...model.Fingerprint) error {
+	for _, fp := range fps {
+		s.fpLocker.Lock(fp)
+		s.deleteSamples(fp, in)
+		s.fpLocker.Unlock(fp)
+	}
+	return s.persistence.checkpointTombstones(s.tombstones)
+}
 
-		if series, ok := s.fpToSeries.get(fp); ok {
-			s.fpToSeries.del(fp)
-			s.numSeries.Dec()
-			s.persistence.unindexMetric(fp, series.metric)
-		} else if err := s.persistence.purgeArchivedMetric(fp); err != nil {
-			log.Errorf("Error purging metric with fingerprint %v: %v", fp, err)
+// deleteSamples deletes the samples within the given interval from the series
+// with the given fingerprint. The caller must have locked the fp.
+func (s *memorySeriesStorage) deleteSamples(fp model.Fingerprint, in metric.Interval) {
+	var firstTime, lastTime model.Time
+	if series, ok := s.fpToSeries.get(fp); ok {
+		firstTime, lastTime = series.firstTime(), series.lastTime
+	} else {
+		has, first, last, err := s.persistence.hasArchivedMetric(fp)
+		if err != nil {
+			log.Errorf("Error looking up archived time range for fingerprint %v: %v", fp, err)
+			return
 		}
-		// Attempt to delete series file in any case.
-		if _, err := s.persistence.deleteSeriesFile(fp); err != nil {
-			log.Errorf("Error deleting series file for %v: %v", fp, err)
+		if !has {
+			return
 		}
+		firstTime, lastTime = first, last
+	}
 
-		s.fpLocker.Unlock(fp)
+	if in.NewestInclusive < firstTime || in.OldestInclusive > lastTime {
+		return
+	}
+	if in.OldestInclusive <= firstTime && in.NewestInclusive >= lastTime {
+		s.dropSeries(fp)
+		return
+	}
+	// Samples appended later must not be deleted, so the tombstone must
+	// not reach beyond the current last sample.
+	if in.NewestInclusive > lastTime {
+		in.NewestInclusive = lastTime
+	}
+	if in.OldestInclusive < firstTime {
+		in.OldestInclusive = firstTime
 	}
+	s.tombstones.add(fp, in)
 }
 
 // Append implements Storage.
@@ -559,30 +906,62 @@ func (s *memorySeriesStorage) Append(sample *model.Sample) {
 		s.fpLocker.Unlock(rawFP)
 		s.fpLocker.Lock(fp)
 	}
-	series := s.getOrCreateSeries(fp, sample.Metric)
+	series, ok := s.getOrCreateSeries(fp, sample.Metric, true)
+	if !ok {
+		s.fpLocker.Unlock(fp)
+		return
+	}
 
+	sp := &model.SamplePair{
+		Value:     sample.Value,
+		Timestamp: sample.Timestamp,
+	}
+	var completedChunksCount int
 	if sample.Timestamp <= series.lastTime {
 		// Don't log and track equal timestamps, as they are a common occurrence
 		// when using client-side timestamps (e.g. Pushgateway or federation).
 		// It would be even better to also compare the sample values here, but
 		// we don't have efficient access to a series's last value.
-		if sample.Timestamp != series.lastTime {
+		if sample.Timestamp == series.lastTime {
+			s.fpLocker.Unlock(fp)
+			return
+		}
+		if series.lastTime.Sub(sample.Timestamp) > s.outOfOrderWindow {
 			log.Warnf("Ignoring sample with out-of-order timestamp for fingerprint %v (%v): %v is not after %v", fp, series.metric, sample.Timestamp, series.lastTime)
 			s.outOfOrderSamplesCount.Inc()
+			s.fpLocker.Unlock(fp)
+			return
 		}
-		s.fpLocker.Unlock(fp)
-		return
+		var err error
+		completedChunksCount, err = series.insert(sp, s.chunkEncoding)
+		switch err {
+		case nil:
+		case errDuplicateSample:
+			// Duplicates are as common as equal timestamps, see above.
+			s.fpLocker.Unlock(fp)
+			return
+		default:
+			log.Warnf("Ignoring sample with out-of-order timestamp for fingerprint %v (%v) within the out-of-order window: %v", fp, series.metric, err)
+			s.outOfOrderSamplesCount.Inc()
+			s.fpLocker.Unlock(fp)
+			return
+		}
+	} else {
+		completedChunksCount = series.add(sp, s.chunkEncoding)
 	}
-	completedChunksCount := series.add(&model.SamplePair{
-		Value:     sample.Value,
-		Timestamp: sample.Timestamp,
-	})
 	s.fpLocker.Unlock(fp)
 	s.ingestedSamplesCount.Inc()
+	if s.sampleIngestionLag != nil {
+		s.sampleIngestionLag.Observe(model.Now().Sub(sample.Timestamp).Seconds())
+	}
 	s.incNumChunksToPersist(completedChunksCount)
 }
 
-func (s *memorySeriesStorage) getOrCreateSeries(fp model.Fingerprint, m model.Metric) *memorySeries {
+// getOrCreateSeries returns the series for fp, unarchiving or creating it if
+// it is not in memory. If limit is true, a genuinely new series is only
+// created if its metric name has not reached its series limit yet; otherwise,
+// nil and false are returned.
+func (s *memorySeriesStorage) getOrCreateSeries(fp model.Fingerprint, m model.Metric, limit bool) (*memorySeries, bool) {
 	series, ok := s.fpToSeries.get(fp)
 	if !ok {
 		var cds []*chunkDesc
@@ -603,7 +982,13 @@ func (s *memorySeriesStorage) getOrCreateSeries(fp model.Fingerprint, m model.Me
 				log.Errorf("Error loading chunk descs for fingerprint %v (metric %v): %v", fp, m, err)
 			}
 			modTime = s.persistence.seriesFileModTime(fp)
+			s.seriesLimiter.add(m)
 		} else {
+			if !limit {
+				s.seriesLimiter.add(m)
+			} else if !s.seriesLimiter.tryAdd(m) {
+				return nil, false
+			}
 			// This was a genuinely new series, so index the metric.
 			s.persistence.indexMetric(fp, m)
 			s.seriesOps.WithLabelValues(create).Inc()
@@ -612,7 +997,7 @@ func (s *memorySeriesStorage) getOrCreateSeries(fp model.Fingerprint, m model.Me
 		s.fpToSeries.put(fp, series)
 		s.numSeries.Inc()
 	}
-	return series
+	return series, true
 }
 
 func (s *memorySeriesStorage) preloadChunksForRange(
@@ -638,7 +1023,7 @@ func (s *memorySeriesStorage) preloadChunksForRange(
 			if err != nil {
 				return nil, err
 			}
-			series = s.getOrCreateSeries(fp, metric)
+			series, _ = s.getOrCreateSeries(fp, metric, false)
 		} else {
 			return nil, nil
 		}
@@ -824,7 +1209,7 @@ func (s *memorySeriesStorage) cycleThroughArchivedFingerprints() chan model.Fing
 
 		for {
 			archivedFPs, err := s.persistence.fingerprintsModifiedBefore(
-				model.Now().Add(-s.dropAfter),
+				s.latestRetentionCutoff(),
 			)
 			if err != nil {
 				log.Error("Failed to lookup archived fingerprint ranges: ", err)
@@ -858,11 +1243,13 @@ func (s *memorySeriesStorage) cycleThroughArchivedFingerprints() chan model.Fing
 
 func (s *memorySeriesStorage) loop() {
 	checkpointTimer := time.NewTimer(s.checkpointInterval)
+	diskUsageTicker := time.NewTicker(diskUsageCheckInterval)
 
 	dirtySeriesCount := 0
 
 	defer func() {
 		checkpointTimer.Stop()
+		diskUsageTicker.Stop()
 		log.Info("Maintenance loop stopped.")
 		close(s.loopStopped)
 	}()
@@ -882,9 +1269,14 @@ loop:
 			} else {
 				dirtySeriesCount = 0
 			}
+			if err := s.persistence.checkpointTombstones(s.tombstones); err != nil {
+				log.Errorln("Error while checkpointing tombstones:", err)
+			}
 			checkpointTimer.Reset(s.checkpointInterval)
+		case <-diskUsageTicker.C:
+			s.checkDiskUsage()
 		case fp := <-memoryFingerprints:
-			if s.maintainMemorySeries(fp, model.Now().Add(-s.dropAfter)) {
+			if s.maintainMemorySeries(fp, s.retentionCutoff()) {
 				dirtySeriesCount++
 				// Check if we have enough "dirty" series so that we need an early checkpoint.
 				// However, if we are already behind persisting chunks, creating a checkpoint
@@ -898,7 +1290,7 @@ loop:
 				}
 			}
 		case fp := <-archivedFingerprints:
-			s.maintainArchivedSeries(fp, model.Now().Add(-s.dropAfter))
+			s.maintainArchivedSeries(fp, s.retentionCutoff())
 		}
 	}
 	// Wait until both channels are closed.
@@ -965,10 +1357,13 @@ func (s *memorySeriesStorage) maintainMemorySeries(
 
 	seriesWasDirty := series.dirty
 
+	beforeTime = s.seriesRetentionCutoff(series.metric, beforeTime)
+	beforeTime = s.tombstones.cutoff(fp, series.firstTime(), beforeTime)
 	if s.writeMemorySeries(fp, series, beforeTime) {
 		// Series is gone now, we are done.
 		return false
 	}
+	s.tombstones.trim(fp, series.firstTime())
 
 	iOldestNotEvicted := -1
 	for i, cd := range series.chunkDescs {
@@ -982,6 +1377,7 @@ func (s *memorySeriesStorage) maintainMemorySeries(
 	if iOldestNotEvicted == -1 {
 		s.fpToSeries.del(fp)
 		s.numSeries.Dec()
+		s.seriesLimiter.remove(series.metric)
 		if err := s.persistence.archiveMetric(
 			fp, series.metric, series.firstTime(), series.lastTime,
 		); err != nil {
@@ -1057,8 +1453,10 @@ func (s *memorySeriesStorage) writeMemorySeries(
 		// All chunks dropped from both memory and persistence. Delete the series for good.
 		s.fpToSeries.del(fp)
 		s.numSeries.Dec()
+		s.seriesLimiter.remove(series.metric)
 		s.seriesOps.WithLabelValues(memoryPurge).Inc()
 		s.persistence.unindexMetric(fp, series.metric)
+		s.tombstones.del(fp)
 		return true
 	}
 	series.savedFirstTime = newFirstTime
@@ -1092,6 +1490,18 @@ func (s *memorySeriesStorage) maintainArchivedSeries(fp model.Fingerprint, befor
 		log.Error("Error looking up archived time range: ", err)
 		return
 	}
+	if has && s.recordedDropAfter != 0 {
+		// Only look up the metric if its retention might differ.
+		m, err := s.persistence.archivedMetric(fp)
+		if err != nil {
+			log.Error("Error looking up archived metric: ", err)
+			return
+		}
+		beforeTime = s.seriesRetentionCutoff(m, beforeTime)
+	}
+	if has {
+		beforeTime = s.tombstones.cutoff(fp, firstTime, beforeTime)
+	}
 	if !has || !firstTime.Before(beforeTime) {
 		// Oldest sample not old enough, or metric purged or unarchived in the meantime.
 		return
@@ -1109,11 +1519,13 @@ func (s *memorySeriesStorage) maintainArchivedSeries(fp model.Fingerprint, befor
 			return
 		}
 		s.seriesOps.WithLabelValues(archivePurge).Inc()
+		s.tombstones.del(fp)
 		return
 	}
 	if err := s.persistence.updateArchivedTimeRange(fp, newFirstTime, lastTime); err != nil {
 		log.Errorf("Error updating archived time range for fingerprint %v: %s", fp, err)
 	}
+	s.tombstones.trim(fp, newFirstTime)
 }
 
 // See persistence.loadChunks for detailed explanation.
@@ -1126,6 +1538,127 @@ func (s *memorySeriesStorage) loadChunkDescs(fp model.Fingerprint, offsetFromEnd
 	return s.persistence.loadChunkDescs(fp, offsetFromEnd)
 }
 
+// retentionCutoff returns the timestamp before which samples are not retained
+// anymore, i.e. the oldest timestamp that can still be queried.
+func (s *memorySeriesStorage) retentionCutoff() model.Time {
+	cutoff := model.Now().Add(-s.dropAfter)
+	if sizeCutoff := model.Time(atomic.LoadInt64(&s.sizeCutoff)); sizeCutoff.After(cutoff) {
+		return sizeCutoff
+	}
+	return cutoff
+}
+
+// recordedRetentionCutoff returns the retention cutoff of series produced by
+// recording rules if their retention period differs. Like retentionCutoff, it
+// takes the size-based cutoff into account, but it never lies within the
+// minimum retention period.
+func (s *memorySeriesStorage) recordedRetentionCutoff() model.Time {
+	now := model.Now()
+	cutoff := now.Add(-s.recordedDropAfter)
+	if sizeCutoff := model.Time(atomic.LoadInt64(&s.sizeCutoff)); sizeCutoff.After(cutoff) {
+		cutoff = sizeCutoff
+	}
+	if minCutoff := now.Add(-s.minDropAfter); cutoff.After(minCutoff) {
+		cutoff = minCutoff
+	}
+	return cutoff
+}
+
+// seriesRetentionCutoff returns the retention cutoff for the series with the
+// given metric, given the retention cutoff beforeTime of scraped series.
+// Series produced by recording rules are identified by the colon in their
+// metric name, following the naming convention for recording rules.
+func (s *memorySeriesStorage) seriesRetentionCutoff(m model.Metric, beforeTime model.Time) model.Time {
+	if s.recordedDropAfter == 0 || !isRecordedMetric(m) {
+		return beforeTime
+	}
+	return s.recordedRetentionCutoff()
+}
+
+// latestRetentionCutoff returns the later one of the retention cutoffs of
+// scraped and recorded series.
+func (s *memorySeriesStorage) latestRetentionCutoff() model.Time {
+	cutoff := s.retentionCutoff()
+	if s.recordedDropAfter != 0 {
+		if recordedCutoff := s.recordedRetentionCutoff(); recordedCutoff.After(cutoff) {
+			return recordedCutoff
+		}
+	}
+	return cutoff
+}
+
+// checkDiskUsage updates the disk usage of the storage. If it exceeds
+// maxDiskBytes and has not gone down since the last check, i.e. the series
+// maintenance has not caught up with a previous adjustment yet, the retention
+// cutoff is moved forward so that the retained time span shrinks in proportion
+// to the excess. The cutoff is never moved beyond minDropAfter. Once the disk
+// usage is within limits again, the cutoff stays in place and the retained time
+// span grows back as time passes. The method is not goroutine safe (but only
+// ever called from the goroutine dealing with series maintenance).
+func (s *memorySeriesStorage) checkDiskUsage() {
+	size, err := s.persistence.diskUsage()
+	if err != nil {
+		log.Error("Error determining disk usage of the storage: ", err)
+		return
+	}
+	s.diskUsage.Set(float64(size))
+	lastSize := s.lastDiskUsage
+	s.lastDiskUsage = size
+	if s.maxDiskBytes <= 0 || size <= s.maxDiskBytes || (lastSize > s.maxDiskBytes && size < lastSize) {
+		return
+	}
+
+	now := model.Now()
+	oldest, err := s.oldestSampleTime()
+	if err != nil {
+		log.Error("Error determining the oldest sample in the storage: ", err)
+		return
+	}
+	if cutoff := s.retentionCutoff(); cutoff.After(oldest) {
+		oldest = cutoff
+	}
+	span := now.Sub(oldest)
+	cutoff := now.Add(-time.Duration(float64(span) * float64(s.maxDiskBytes) / float64(size)))
+	if minCutoff := now.Add(-s.minDropAfter); cutoff.After(minCutoff) {
+		cutoff = minCutoff
+	}
+	if !cutoff.After(s.retentionCutoff()) {
+		log.Warnf(
+			"Storage takes %d bytes on disk, exceeding the limit of %d bytes, but no more chunks can be dropped without violating the minimum retention of %v.",
+			size, s.maxDiskBytes, s.minDropAfter,
+		)
+		return
+	}
+	log.Warnf(
+		"Storage takes %d bytes on disk, exceeding the limit of %d bytes. Dropping chunks older than %v.",
+		size, s.maxDiskBytes, cutoff,
+	)
+	atomic.StoreInt64(&s.sizeCutoff, int64(cutoff))
+}
+
+// oldestSampleTime returns the time of the oldest sample in the storage, or
+// model.Latest if the storage is empty.
+func (s *memorySeriesStorage) oldestSampleTime() (model.Time, error) {
+	oldest, err := s.persistence.oldestArchivedTime()
+	if err != nil {
+		return 0, err
+	}
+	for fp := range s.fpToSeries.fpIter() {
+		s.fpLocker.Lock(fp)
+		if series, ok := s.fpToSeries.get(fp); ok && series.firstTime().Before(oldest) {
+			oldest = series.firstTime()
+		}
+		s.fpLocker.Unlock(fp)
+	}
+	return oldest, nil
+}
+
+// isRecordedMetric returns whether the metric was produced by a recording
+// rule, i.e. whether its name contains a colon.
+func isRecordedMetric(m model.Metric) bool {
+	return strings.Contains(string(m[model.MetricNameLabel]), ":")
+}
+
 // getNumChunksToPersist returns numChunksToPersist in a goroutine-safe way.
 func (s *memorySeriesStorage) getNumChunksToPersist() int {
 	return int(atomic.LoadInt64(&s.numChunksToPersist))
@@ -1175,23 +1708,31 @@ func (s *memorySeriesStorage) persistenceBacklogScore() float64 {
 func (s *memorySeriesStorage) Describe(ch chan<- *prometheus.Desc) {
 	s.persistence.Describe(ch)
 	s.mapper.Describe(ch)
+	s.seriesLimiter.Describe(ch)
 
 	ch <- s.persistErrors.Desc()
 	ch <- maxChunksToPersistDesc
 	ch <- numChunksToPersistDesc
+	ch <- retentionCutoffDesc
+	ch <- chunkCacheHitRatioDesc
 	ch <- s.numSeries.Desc()
+	ch <- s.diskUsage.Desc()
 	s.seriesOps.Describe(ch)
 	ch <- s.ingestedSamplesCount.Desc()
 	ch <- s.outOfOrderSamplesCount.Desc()
 	ch <- s.invalidPreloadRequestsCount.Desc()
 	ch <- numMemChunksDesc
 	s.maintainSeriesDuration.Describe(ch)
+	if s.sampleIngestionLag != nil {
+		ch <- s.sampleIngestionLag.Desc()
+	}
 }
 
 // Collect implements prometheus.Collector.
 func (s *memorySeriesStorage) Collect(ch chan<- prometheus.Metric) {
 	s.persistence.Collect(ch)
 	s.mapper.Collect(ch)
+	s.seriesLimiter.Collect(ch)
 
 	ch <- s.persistErrors
 	ch <- prometheus.MustNewConstMetric(
@@ -1204,7 +1745,18 @@ func (s *memorySeriesStorage) Collect(ch chan<- prometheus.Metric) {
 		prometheus.GaugeValue,
 		float64(s.getNumChunksToPersist()),
 	)
+	ch <- prometheus.MustNewConstMetric(
+		retentionCutoffDesc,
+		prometheus.GaugeValue,
+		float64(s.retentionCutoff().UnixNano())/1e9,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		chunkCacheHitRatioDesc,
+		prometheus.GaugeValue,
+		chunkCacheHitRatio(),
+	)
 	ch <- s.numSeries
+	ch <- s.diskUsage
 	s.seriesOps.Collect(ch)
 	ch <- s.ingestedSamplesCount
 	ch <- s.outOfOrderSamplesCount
@@ -1215,4 +1767,7 @@ func (s *memorySeriesStorage) Collect(ch chan<- prometheus.Metric) {
 		float64(atomic.LoadInt64(&numMemChunks)),
 	)
 	s.maintainSeriesDuration.Collect(ch)
+	if s.sampleIngestionLag != nil {
+		ch <- s.sampleIngestionLag
+	}
 }
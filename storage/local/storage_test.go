@@ -23,6 +23,8 @@ import (
 	"testing/quick"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
 
@@ -432,6 +434,342 @@ func TestRetentionCutoff(t *testing.T) {
 	}
 }
 
+func TestRetentionCutoffMetric(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+
+	s.dropAfter = 1 * time.Hour
+
+	collectCutoff := func() float64 {
+		ch := make(chan prometheus.Metric)
+		go func() {
+			s.Collect(ch)
+			close(ch)
+		}()
+		var cutoff float64
+		found := false
+		for m := range ch {
+			if m.Desc() != retentionCutoffDesc {
+				continue
+			}
+			var pb dto.Metric
+			if err := m.Write(&pb); err != nil {
+				t.Fatalf("Error writing metric: %s", err)
+			}
+			cutoff = pb.GetGauge().GetValue()
+			found = true
+		}
+		if !found {
+			t.Fatal("retention cutoff metric not collected")
+		}
+		return cutoff
+	}
+
+	toSeconds := func(t model.Time) float64 {
+		return float64(t.UnixNano()) / 1e9
+	}
+
+	before := model.Now().Add(-s.dropAfter)
+	first := collectCutoff()
+	after := model.Now().Add(-s.dropAfter)
+	if first < toSeconds(before) || first > toSeconds(after) {
+		t.Errorf("expected retention cutoff between %v and %v, got %v", toSeconds(before), toSeconds(after), first)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	second := collectCutoff()
+	if second <= first {
+		t.Errorf("expected retention cutoff to advance from %v, got %v", first, second)
+	}
+	if now := toSeconds(model.Now().Add(-s.dropAfter)); second > now {
+		t.Errorf("retention cutoff %v is later than now minus retention %v", second, now)
+	}
+}
+
+func TestStorageHealthMetrics(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+
+	for i := 0; i < 10; i++ {
+		s.Append(&model.Sample{
+			Metric:    model.Metric{model.MetricNameLabel: "test_health", "i": model.LabelValue(fmt.Sprint(i))},
+			Timestamp: model.Time(i),
+			Value:     model.SampleValue(i),
+		})
+	}
+	s.WaitForIndexing()
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		s.Collect(ch)
+		close(ch)
+	}()
+	got := map[*prometheus.Desc]float64{}
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatalf("Error writing metric: %s", err)
+		}
+		if pb.Gauge != nil {
+			got[m.Desc()] = pb.GetGauge().GetValue()
+		}
+	}
+
+	if v, ok := got[s.numSeries.Desc()]; !ok || v != 10 {
+		t.Errorf("expected 10 memory series, got %v (collected: %t)", v, ok)
+	}
+	if v, ok := got[numChunksToPersistDesc]; !ok || v != 0 {
+		t.Errorf("expected no chunks to persist, got %v (collected: %t)", v, ok)
+	}
+	if v, ok := got[s.diskUsage.Desc()]; !ok || v <= 0 {
+		t.Errorf("expected disk usage to be reported on startup, got %v (collected: %t)", v, ok)
+	}
+}
+
+func TestChunkCacheHitRatio(t *testing.T) {
+	samples := make(model.Samples, 10000)
+	for i := range samples {
+		samples[i] = &model.Sample{
+			Timestamp: model.Time(2 * i),
+			Value:     model.SampleValue(float64(i * i)),
+		}
+	}
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+
+	for _, sample := range samples {
+		s.Append(sample)
+	}
+	s.WaitForIndexing()
+
+	fp := model.Metric{}.FastFingerprint()
+	series, ok := s.fpToSeries.get(fp)
+	if !ok {
+		t.Fatal("could not find series")
+	}
+	numChunks := len(series.chunkDescs)
+
+	preload := func() {
+		p := s.NewPreloader()
+		defer p.Close()
+		if err := p.PreloadRange(fp, model.Earliest, model.Latest, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ops := func() (pins, loads float64) {
+		return counterValue(chunkOps.WithLabelValues(pin)), counterValue(chunkOps.WithLabelValues(load))
+	}
+
+	// All chunks are in memory, so they are pinned without loads.
+	pins, loads := ops()
+	preload()
+	newPins, newLoads := ops()
+	if newPins-pins != float64(numChunks) {
+		t.Errorf("expected %d pins, got %v", numChunks, newPins-pins)
+	}
+	if newLoads != loads {
+		t.Errorf("expected no loads for chunks in memory, got %v", newLoads-loads)
+	}
+
+	// Persist and evict all chunks but the head chunk.
+	s.maintainMemorySeries(fp, 0)
+	s.fpLocker.Lock(fp)
+	for _, cd := range series.chunkDescs[:numChunks-1] {
+		if !cd.maybeEvict() {
+			t.Fatal("could not evict chunk")
+		}
+	}
+	s.fpLocker.Unlock(fp)
+
+	// Evicted chunks are loaded.
+	pins, loads = ops()
+	preload()
+	newPins, newLoads = ops()
+	if newPins-pins != float64(numChunks) {
+		t.Errorf("expected %d pins, got %v", numChunks, newPins-pins)
+	}
+	if newLoads-loads != float64(numChunks-1) {
+		t.Errorf("expected %d loads for evicted chunks, got %v", numChunks-1, newLoads-loads)
+	}
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		s.Collect(ch)
+		close(ch)
+	}()
+	found := false
+	for m := range ch {
+		if m.Desc() != chunkCacheHitRatioDesc {
+			continue
+		}
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatalf("Error writing metric: %s", err)
+		}
+		if got, want := pb.GetGauge().GetValue(), (newPins-newLoads)/newPins; got != want {
+			t.Errorf("expected chunk cache hit ratio %v, got %v", want, got)
+		}
+		found = true
+	}
+	if !found {
+		t.Fatal("chunk cache hit ratio metric not collected")
+	}
+}
+
+func TestMaxSeriesPerMetric(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+	s.seriesLimiter = newSeriesLimiter(2, SeriesLimits{"overridden": 3, "unlimited": 0})
+
+	appendSeries := func(name model.LabelValue, n int, ts model.Time) {
+		for i := 0; i < n; i++ {
+			s.Append(&model.Sample{
+				Metric: model.Metric{
+					model.MetricNameLabel: name,
+					"instance":            model.LabelValue(fmt.Sprint(i)),
+				},
+				Timestamp: ts,
+				Value:     1,
+			})
+		}
+	}
+	numSeries := func(name model.LabelValue) int {
+		return len(s.fingerprintsForLabelPairs(model.LabelPair{Name: model.MetricNameLabel, Value: name}))
+	}
+	rejected := func(name string) float64 {
+		var m dto.Metric
+		if err := s.seriesLimiter.rejectedSamples.WithLabelValues(name).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+
+	appendSeries("limited", 3, 1)
+	appendSeries("overridden", 4, 1)
+	appendSeries("unlimited", 5, 1)
+	appendSeries("other", 2, 1)
+	s.WaitForIndexing()
+
+	for name, want := range map[model.LabelValue]int{"limited": 2, "overridden": 3, "unlimited": 5, "other": 2} {
+		if got := numSeries(name); got != want {
+			t.Errorf("%s: expected %d series, got %d", name, want, got)
+		}
+	}
+	if got := rejected("limited"); got != 1 {
+		t.Errorf("expected 1 rejected sample for limited, got %v", got)
+	}
+	if got := rejected("overridden"); got != 1 {
+		t.Errorf("expected 1 rejected sample for overridden, got %v", got)
+	}
+	if got := rejected("other"); got != 0 {
+		t.Errorf("expected no rejected samples for other, got %v", got)
+	}
+
+	// Existing series keep ingesting at the limit.
+	appendSeries("limited", 2, 2)
+	for fp := range s.fingerprintsForLabelPairs(model.LabelPair{Name: model.MetricNameLabel, Value: "limited"}) {
+		series, ok := s.fpToSeries.get(fp)
+		if !ok {
+			t.Fatalf("series %v not in memory", fp)
+		}
+		if series.lastTime != 2 {
+			t.Errorf("expected last sample at 2 for series %v, got %v", series.metric, series.lastTime)
+		}
+	}
+	if got := rejected("limited"); got != 1 {
+		t.Errorf("expected 1 rejected sample for limited, got %v", got)
+	}
+
+	// Dropping a series makes room for a new one.
+	m := model.Metric{model.MetricNameLabel: "limited", "instance": "0"}
+	s.DropMetricsForFingerprints(m.FastFingerprint())
+	s.Append(&model.Sample{
+		Metric:    model.Metric{model.MetricNameLabel: "limited", "instance": "new"},
+		Timestamp: 3,
+		Value:     1,
+	})
+	s.WaitForIndexing()
+	if got := numSeries("limited"); got != 2 {
+		t.Errorf("expected 2 series for limited after dropping one, got %d", got)
+	}
+	if got := rejected("limited"); got != 1 {
+		t.Errorf("expected 1 rejected sample for limited, got %v", got)
+	}
+}
+
+func TestSampleIngestionLag(t *testing.T) {
+	directory := testutil.NewTemporaryDirectory("test_storage", t)
+	defer directory.Close()
+	o := &MemorySeriesStorageOptions{
+		MemoryChunks:               1000000,
+		MaxChunksToPersist:         1000000,
+		PersistenceRetentionPeriod: 24 * time.Hour * 365 * 100,
+		PersistenceStoragePath:     directory.Path(),
+		CheckpointInterval:         time.Hour,
+		SyncStrategy:               Adaptive,
+		IngestionLagHistogram:      true,
+	}
+	s := NewMemorySeriesStorage(o)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error creating storage: %s", err)
+	}
+	defer s.Stop()
+
+	now := model.Now()
+	lags := []time.Duration{30 * time.Second, 2 * time.Minute, -10 * time.Second}
+	for i, lag := range lags {
+		s.Append(&model.Sample{
+			Metric:    model.Metric{model.MetricNameLabel: model.LabelValue(fmt.Sprintf("test_metric_%d", i))},
+			Timestamp: now.Add(-lag),
+			Value:     1,
+		})
+	}
+
+	var pb dto.Metric
+	if err := s.(*memorySeriesStorage).sampleIngestionLag.Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	h := pb.GetHistogram()
+	if got, want := h.GetSampleCount(), uint64(len(lags)); got != want {
+		t.Errorf("expected %d observations, got %d", want, got)
+	}
+	// The receive time is slightly after now, so allow for some slack.
+	if got, want := h.GetSampleSum(), 140.0; got < want || got > want+5 {
+		t.Errorf("expected sum of observations slightly above %v, got %v", want, got)
+	}
+	wantBuckets := map[float64]uint64{0: 1, 1: 1, 15: 1, 60: 2, 300: 3, 3600: 3}
+	for _, b := range h.GetBucket() {
+		want, ok := wantBuckets[b.GetUpperBound()]
+		if !ok {
+			continue
+		}
+		if got := b.GetCumulativeCount(); got != want {
+			t.Errorf("expected %d observations <= %v, got %d", want, b.GetUpperBound(), got)
+		}
+	}
+}
+
+func TestSampleInterval(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+
+	m := model.Metric{model.MetricNameLabel: "test"}
+	fp := m.FastFingerprint()
+	if got := s.SampleIntervalForFingerprint(fp); got != 0 {
+		t.Errorf("expected no interval for non-existent series, got %v", got)
+	}
+
+	for i, ts := range []model.Time{1000, 16000, 46000} {
+		s.Append(&model.Sample{Metric: m, Timestamp: ts, Value: model.SampleValue(i)})
+		s.WaitForIndexing()
+		want := []time.Duration{0, 15 * time.Second, 30 * time.Second}[i]
+		if got := s.SampleIntervalForFingerprint(fp); got != want {
+			t.Errorf("%d. expected interval %v, got %v", i, want, got)
+		}
+	}
+}
+
 func TestDropMetrics(t *testing.T) {
 	now := model.Now()
 	insertStart := now.Add(-2 * time.Hour)
@@ -635,6 +973,88 @@ func TestChunkType1(t *testing.T) {
 	testChunk(t, 1)
 }
 
+func testOutOfOrderWindow(t *testing.T, encoding chunkEncoding) {
+	s, closer := NewTestStorage(t, encoding)
+	defer closer.Close()
+
+	s.outOfOrderWindow = 100 * time.Millisecond
+
+	m := model.Metric{model.MetricNameLabel: "test"}
+	appendAt := func(ts model.Time) {
+		s.Append(&model.Sample{
+			Metric:    m,
+			Timestamp: ts,
+			Value:     model.SampleValue(ts),
+		})
+	}
+	outOfOrder := func() float64 {
+		var pb dto.Metric
+		if err := s.outOfOrderSamplesCount.Write(&pb); err != nil {
+			t.Fatalf("Error writing metric: %s", err)
+		}
+		return pb.GetCounter().GetValue()
+	}
+
+	// Even timestamps first, then odd timestamps in reverse order, all of
+	// them within the window.
+	var want []model.Time
+	for ts := model.Time(0); ts < 200; ts += 2 {
+		appendAt(ts)
+	}
+	for ts := model.Time(199); ts > 100; ts -= 2 {
+		appendAt(ts)
+	}
+	// Duplicate, ignored silently.
+	appendAt(150)
+	// Outside of the window, discarded.
+	appendAt(97)
+	s.WaitForIndexing()
+
+	for ts := model.Time(0); ts <= 100; ts += 2 {
+		want = append(want, ts)
+	}
+	for ts := model.Time(101); ts < 200; ts++ {
+		want = append(want, ts)
+	}
+
+	if got := outOfOrder(); got != 1 {
+		t.Errorf("expected 1 discarded out-of-order sample, got %v", got)
+	}
+
+	fp := m.FastFingerprint()
+	s.fpLocker.Lock(fp)
+	defer s.fpLocker.Unlock(fp)
+	series, ok := s.fpToSeries.get(fp)
+	if !ok {
+		t.Fatal("series not found")
+	}
+	var got []model.SamplePair
+	for _, cd := range series.chunkDescs {
+		for sp := range cd.c.newIterator().values() {
+			got = append(got, *sp)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d samples, got %d", len(want), len(got))
+	}
+	for i, sp := range got {
+		if sp.Timestamp != want[i] {
+			t.Errorf("%d. Got timestamp %v; want %v", i, sp.Timestamp, want[i])
+		}
+		if sp.Value != model.SampleValue(want[i]) {
+			t.Errorf("%d. Got value %v; want %v", i, sp.Value, model.SampleValue(want[i]))
+		}
+	}
+}
+
+func TestOutOfOrderWindowChunkType0(t *testing.T) {
+	testOutOfOrderWindow(t, 0)
+}
+
+func TestOutOfOrderWindowChunkType1(t *testing.T) {
+	testOutOfOrderWindow(t, 1)
+}
+
 func testValueAtTime(t *testing.T, encoding chunkEncoding) {
 	samples := make(model.Samples, 10000)
 	for i := range samples {
@@ -728,6 +1148,55 @@ func TestValueAtTimeChunkType1(t *testing.T) {
 	testValueAtTime(t, 1)
 }
 
+// testStaleNaN checks that staleness markers keep their bit pattern through
+// the chunk encodings, whether they are the first sample of a chunk or follow
+// integer or float values.
+func testStaleNaN(t *testing.T, encoding chunkEncoding) {
+	samples := make(model.Samples, 10000)
+	for i := range samples {
+		v := model.SampleValue(i)
+		switch {
+		case i%7 == 0:
+			v = metric.StaleNaN
+		case i%3 == 0:
+			v = model.SampleValue(float64(i) * 0.2)
+		}
+		samples[i] = &model.Sample{
+			Timestamp: model.Time(2 * i),
+			Value:     v,
+		}
+	}
+	s, closer := NewTestStorage(t, encoding)
+	defer closer.Close()
+
+	for _, sample := range samples {
+		s.Append(sample)
+	}
+	s.WaitForIndexing()
+
+	it := s.NewIterator(model.Metric{}.FastFingerprint())
+	for i, expected := range samples {
+		actual := it.ValueAtTime(expected.Timestamp)
+		if len(actual) != 1 {
+			t.Fatalf("%d. Expected exactly one result, got %d.", i, len(actual))
+		}
+		if metric.IsStaleNaN(expected.Value) != metric.IsStaleNaN(actual[0].Value) {
+			t.Errorf("%d. Got %v; want %v", i, actual[0].Value, expected.Value)
+		}
+		if !metric.IsStaleNaN(expected.Value) && expected.Value != actual[0].Value {
+			t.Errorf("%d. Got %v; want %v", i, actual[0].Value, expected.Value)
+		}
+	}
+}
+
+func TestStaleNaNChunkType0(t *testing.T) {
+	testStaleNaN(t, 0)
+}
+
+func TestStaleNaNChunkType1(t *testing.T) {
+	testStaleNaN(t, 1)
+}
+
 func benchmarkValueAtTime(b *testing.B, encoding chunkEncoding) {
 	samples := make(model.Samples, 10000)
 	for i := range samples {
@@ -1128,7 +1597,7 @@ func testEvictAndPurgeSeries(t *testing.T, encoding chunkEncoding) {
 	}
 
 	// Unarchive metrics.
-	s.getOrCreateSeries(fp, model.Metric{})
+	s.getOrCreateSeries(fp, model.Metric{}, false)
 
 	series, ok = s.fpToSeries.get(fp)
 	if !ok {
@@ -1162,6 +1631,135 @@ func TestEvictAndPurgeSeriesChunkType1(t *testing.T) {
 	testEvictAndPurgeSeries(t, 1)
 }
 
+// appendRetentionTestSeries appends a sample per second of the last 3000s to a
+// scraped and a recorded series and returns their metrics.
+func appendRetentionTestSeries(s *memorySeriesStorage) (scraped, recorded model.Metric) {
+	scraped = model.Metric{model.MetricNameLabel: "http_requests_total"}
+	recorded = model.Metric{model.MetricNameLabel: "job:http_requests:rate5m"}
+	start := model.Now().Add(-3000 * time.Second)
+	for _, m := range []model.Metric{scraped, recorded} {
+		for i := 0; i < 3000; i++ {
+			s.Append(&model.Sample{
+				Metric:    m,
+				Timestamp: start.Add(time.Duration(i) * time.Second),
+				Value:     model.SampleValue(i),
+			})
+		}
+	}
+	s.WaitForIndexing()
+	return scraped, recorded
+}
+
+// oldestRetained maintains the series with the given metric and returns the
+// timestamp of its oldest sample that can still be queried.
+func oldestRetained(t *testing.T, s *memorySeriesStorage, m model.Metric) model.Time {
+	s.maintainMemorySeries(m.FastFingerprint(), s.retentionCutoff())
+	values := s.NewIterator(m.FastFingerprint()).BoundaryValues(metric.Interval{
+		OldestInclusive: model.Earliest,
+		NewestInclusive: model.Latest,
+	})
+	if len(values) == 0 {
+		t.Fatalf("expected samples of %v to be retained", m)
+	}
+	return values[0].Timestamp
+}
+
+// expectRetained checks that the oldest retained sample is about the given
+// duration old, allowing for the time passed while running the test.
+func expectRetained(t *testing.T, name string, oldest model.Time, d time.Duration) {
+	now := model.Now()
+	if oldest.Before(now.Add(-d-time.Second)) || oldest.After(now.Add(-d+10*time.Second)) {
+		t.Errorf("expected %s series to be retained for %v, oldest sample is %v old", name, d, now.Sub(oldest))
+	}
+}
+
+func TestRecordedSeriesRetention(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+
+	s.dropAfter = 1000 * time.Second
+	s.recordedDropAfter = 2000 * time.Second
+
+	scraped, recorded := appendRetentionTestSeries(s)
+	expectRetained(t, "scraped", oldestRetained(t, s, scraped), 1000*time.Second)
+	expectRetained(t, "recorded", oldestRetained(t, s, recorded), 2000*time.Second)
+}
+
+func TestShortRecordedSeriesRetention(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+
+	s.dropAfter = 2500 * time.Second
+	s.recordedDropAfter = 1000 * time.Second
+
+	scraped, recorded := appendRetentionTestSeries(s)
+	expectRetained(t, "scraped", oldestRetained(t, s, scraped), 2500*time.Second)
+	expectRetained(t, "recorded", oldestRetained(t, s, recorded), 1000*time.Second)
+
+	// The size-based cutoff is not shifted for recorded series.
+	s.sizeCutoff = int64(model.Now().Add(-2000 * time.Second))
+	expectRetained(t, "scraped", oldestRetained(t, s, scraped), 2000*time.Second)
+	expectRetained(t, "recorded", oldestRetained(t, s, recorded), 1000*time.Second)
+
+	// The minimum retention applies to recorded series, too.
+	s.minDropAfter = 1500 * time.Second
+	if cutoff, minCutoff := s.seriesRetentionCutoff(recorded, s.retentionCutoff()), model.Now().Add(-1500*time.Second); cutoff.After(minCutoff) {
+		t.Errorf("expected recorded cutoff %v not to violate the minimum retention cutoff %v", cutoff, minCutoff)
+	}
+}
+
+func TestRetentionSize(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+
+	m := model.Metric{model.MetricNameLabel: "test_retention_size"}
+	fp := m.FastFingerprint()
+	start := model.Now().Add(-10000 * time.Second)
+	for i := 0; i < 10000; i++ {
+		s.Append(&model.Sample{
+			Metric:    m,
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+			Value:     model.SampleValue(i),
+		})
+	}
+	s.WaitForIndexing()
+	s.maintainMemorySeries(fp, 0)
+
+	// Without a limit, only the disk usage is reported.
+	s.checkDiskUsage()
+	if s.lastDiskUsage == 0 {
+		t.Fatal("expected disk usage to be determined")
+	}
+	if s.sizeCutoff != int64(model.Earliest) {
+		t.Fatalf("expected no size-based cutoff without a limit, got %v", model.Time(s.sizeCutoff))
+	}
+
+	// Exceeding the limit moves the cutoff forward in proportion.
+	s.maxDiskBytes = s.lastDiskUsage / 2
+	s.minDropAfter = time.Hour
+	s.checkDiskUsage()
+	cutoff := s.retentionCutoff()
+	if !cutoff.After(start) || cutoff.After(model.Now().Add(-time.Hour)) {
+		t.Fatalf("expected cutoff between %v and the minimum retention, got %v", start, cutoff)
+	}
+	s.maintainMemorySeries(fp, cutoff)
+	series, ok := s.fpToSeries.get(fp)
+	if !ok {
+		t.Fatal("series unexpectedly purged")
+	}
+	if !series.firstTime().After(start) {
+		t.Errorf("expected oldest chunks to be dropped, series still starts at %v", series.firstTime())
+	}
+
+	// The minimum retention is never violated.
+	s.maxDiskBytes = 1
+	s.checkDiskUsage()
+	s.checkDiskUsage()
+	if cutoff := s.retentionCutoff(); cutoff.After(model.Now().Add(-time.Hour)) {
+		t.Errorf("expected cutoff to respect the minimum retention, got %v", cutoff)
+	}
+}
+
 func testEvictAndLoadChunkDescs(t *testing.T, encoding chunkEncoding) {
 	samples := make(model.Samples, 10000)
 	for i := range samples {
@@ -1234,6 +1832,368 @@ func TestEvictAndLoadChunkDescsType1(t *testing.T) {
 	testEvictAndLoadChunkDescs(t, 1)
 }
 
+func testChunkInfos(t *testing.T, encoding chunkEncoding) {
+	samples := make(model.Samples, 10000)
+	for i := range samples {
+		samples[i] = &model.Sample{
+			Timestamp: model.Time(2 * i),
+			Value:     model.SampleValue(float64(i * i)),
+		}
+	}
+	s, closer := NewTestStorage(t, encoding)
+	defer closer.Close()
+
+	for _, sample := range samples {
+		s.Append(sample)
+	}
+	s.WaitForIndexing()
+
+	fp := model.Metric{}.FastFingerprint()
+
+	series, ok := s.fpToSeries.get(fp)
+	if !ok {
+		t.Fatal("could not find series")
+	}
+	numChunks := len(series.chunkDescs)
+	if numChunks <= chunkDescEvictionFactor {
+		t.Fatalf("expected more than %d chunks, got %d", chunkDescEvictionFactor, numChunks)
+	}
+
+	expected := make([]ChunkInfo, numChunks)
+	numSamples := 0
+	for i, cd := range series.chunkDescs {
+		it := cd.c.newIterator()
+		expected[i] = ChunkInfo{
+			FirstTime:  cd.c.firstTime(),
+			LastTime:   it.lastTimestamp(),
+			Encoding:   int(encoding),
+			NumSamples: it.length(),
+			InMemory:   true,
+		}
+		numSamples += it.length()
+	}
+	if numSamples != len(samples) {
+		t.Fatalf("expected %d samples in chunks, got %d", len(samples), numSamples)
+	}
+	if expected[0].FirstTime != 0 || expected[numChunks-1].LastTime != samples[len(samples)-1].Timestamp {
+		t.Fatalf("unexpected chunk boundaries: %v", expected)
+	}
+
+	check := func(name string) {
+		infos, err := s.ChunkInfosForFingerprint(fp)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !reflect.DeepEqual(infos, expected) {
+			t.Errorf("%s: unexpected chunk infos:\n got: %v\nwant: %v", name, infos, expected)
+		}
+	}
+	checkRanges := func(name string, want []ChunkRange) {
+		ranges, err := s.ChunkRangesForFingerprint(fp)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !reflect.DeepEqual(ranges, want) {
+			t.Errorf("%s: unexpected chunk ranges:\n got: %v\nwant: %v", name, ranges, want)
+		}
+	}
+	rangesFrom := func(infos []ChunkInfo) []ChunkRange {
+		ranges := make([]ChunkRange, 0, len(infos))
+		for _, info := range infos {
+			ranges = append(ranges, ChunkRange{FirstTime: info.FirstTime, LastTime: info.LastTime, NumChunks: 1})
+		}
+		return ranges
+	}
+
+	// Nothing persisted yet.
+	check("in memory")
+	checkRanges("in memory", rangesFrom(expected))
+
+	// Closes the head chunk (as its last sample is old) and persists all chunks.
+	s.maintainMemorySeries(fp, 0)
+	for i := range expected {
+		expected[i].Persisted = true
+	}
+	check("persisted")
+	checkRanges("persisted", rangesFrom(expected))
+
+	// Evict all chunks but the head chunk and then the chunkDescs of the
+	// oldest evicted chunks.
+	for _, cd := range series.chunkDescs[:numChunks-1] {
+		if !cd.maybeEvict() {
+			t.Fatal("could not evict chunk")
+		}
+	}
+	series.evictChunkDescs(numChunks - 1)
+	if series.chunkDescsOffset == 0 {
+		t.Fatal("expected chunkDescs to be evicted")
+	}
+	for i := range expected[:numChunks-1] {
+		expected[i].InMemory = false
+	}
+	check("evicted")
+	offset := series.chunkDescsOffset
+	checkRanges("evicted", append([]ChunkRange{{
+		FirstTime: expected[0].FirstTime,
+		LastTime:  expected[offset].FirstTime - 1,
+		NumChunks: offset,
+	}}, rangesFrom(expected[offset:])...))
+
+	// Evicting the head chunk, too, leads to archiving upon maintenance.
+	if !series.head().maybeEvict() {
+		t.Fatal("could not evict head chunk")
+	}
+	s.maintainMemorySeries(fp, 0)
+	if _, ok := s.fpToSeries.get(fp); ok {
+		t.Fatal("expected series to be archived")
+	}
+	expected[numChunks-1].InMemory = false
+	check("archived")
+	checkRanges("archived", []ChunkRange{{
+		FirstTime: expected[0].FirstTime,
+		LastTime:  expected[numChunks-1].LastTime,
+	}})
+
+	infos, err := s.ChunkInfosForFingerprint(model.Metric{"foo": "bar"}.FastFingerprint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if infos != nil {
+		t.Errorf("expected no chunk infos for non-existent series, got %v", infos)
+	}
+	ranges, err := s.ChunkRangesForFingerprint(model.Metric{"foo": "bar"}.FastFingerprint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ranges != nil {
+		t.Errorf("expected no chunk ranges for non-existent series, got %v", ranges)
+	}
+}
+
+func testPreloadCorruptChunk(t *testing.T, encoding chunkEncoding) {
+	samples := make(model.Samples, 10000)
+	for i := range samples {
+		samples[i] = &model.Sample{
+			Timestamp: model.Time(2 * i),
+			Value:     model.SampleValue(float64(i * i)),
+		}
+	}
+	s, closer := NewTestStorage(t, encoding)
+	defer closer.Close()
+
+	for _, sample := range samples {
+		s.Append(sample)
+	}
+	s.WaitForIndexing()
+
+	fp := model.Metric{}.FastFingerprint()
+
+	series, ok := s.fpToSeries.get(fp)
+	if !ok {
+		t.Fatal("could not find series")
+	}
+	numChunks := len(series.chunkDescs)
+	if numChunks < 3 {
+		t.Fatalf("expected at least 3 chunks, got %d", numChunks)
+	}
+
+	// Persist all chunks and evict all but the head chunk.
+	s.maintainMemorySeries(fp, 0)
+	for _, cd := range series.chunkDescs[:numChunks-1] {
+		if !cd.maybeEvict() {
+			t.Fatal("could not evict chunk")
+		}
+	}
+
+	// Corrupt the second chunk on disk.
+	f, err := os.OpenFile(s.persistence.fileNameForFingerprint(fp), os.O_WRONLY, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, offsetForChunkIndex(1)+chunkHeaderTypeOffset); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	decodeErrors := counterValue(chunkDecodeErrors)
+
+	p := s.NewPreloader()
+	defer p.Close()
+	err = p.PreloadRange(fp, 0, samples[len(samples)-1].Timestamp, time.Hour)
+	de, ok := err.(*ChunkDecodeError)
+	if !ok {
+		t.Fatalf("expected chunk decode error, got %v", err)
+	}
+	if de.Fingerprint != fp || de.NumChunks != 1 {
+		t.Errorf("unexpected chunk decode error: %v", de)
+	}
+	if got := counterValue(chunkDecodeErrors) - decodeErrors; got != 1 {
+		t.Errorf("expected 1 chunk decode error to be counted, got %v", got)
+	}
+	if !series.chunkDescs[1].isEvicted() {
+		t.Error("expected corrupt chunk to stay evicted")
+	}
+
+	// All samples but the ones of the corrupt chunk are returned.
+	it := s.NewIterator(fp)
+	values := it.RangeValues(metric.Interval{
+		OldestInclusive: 0,
+		NewestInclusive: samples[len(samples)-1].Timestamp,
+	})
+	var expected []model.SamplePair
+	for i, cd := range series.chunkDescs {
+		if i == 1 {
+			continue
+		}
+		expected = append(expected, cd.chunk().newIterator().rangeValues(metric.Interval{
+			OldestInclusive: 0,
+			NewestInclusive: model.Latest,
+		})...)
+	}
+	if len(expected) == 0 || len(expected) >= len(samples) {
+		t.Fatalf("unexpected number of samples in good chunks: %d", len(expected))
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %d samples of good chunks, got %d", len(expected), len(values))
+	}
+}
+
+func TestPreloadCorruptChunkType0(t *testing.T) {
+	testPreloadCorruptChunk(t, 0)
+}
+
+func TestPreloadCorruptChunkType1(t *testing.T) {
+	testPreloadCorruptChunk(t, 1)
+}
+
+func TestChunkInfosChunkType0(t *testing.T) {
+	testChunkInfos(t, 0)
+}
+
+func TestChunkInfosChunkType1(t *testing.T) {
+	testChunkInfos(t, 1)
+}
+
+func TestUnknownChunkEncoding(t *testing.T) {
+	directory := testutil.NewTemporaryDirectory("test_storage", t)
+	defer directory.Close()
+
+	s := NewMemorySeriesStorage(&MemorySeriesStorageOptions{
+		MemoryChunks:               1000000,
+		MaxChunksToPersist:         1000000,
+		PersistenceRetentionPeriod: 24 * time.Hour * 365 * 100,
+		PersistenceStoragePath:     directory.Path(),
+		CheckpointInterval:         time.Hour,
+		SyncStrategy:               Adaptive,
+		ChunkEncoding:              DoubleDeltaEncoding + 1,
+	})
+	if err := s.Start(); err == nil {
+		s.Stop()
+		t.Fatal("expected error for unknown chunk encoding")
+	}
+}
+
+func TestSwitchHeadChunkEncoding(t *testing.T) {
+	s := newMemorySeries(model.Metric{model.MetricNameLabel: "test_switch_encoding"}, nil, time.Time{})
+	if n := s.add(&model.SamplePair{Timestamp: 1, Value: 1}, delta); n != 0 {
+		t.Fatalf("expected 0 completed chunks, got %d", n)
+	}
+	// An open head chunk in another encoding, as loaded from a checkpoint,
+	// is closed rather than appended to.
+	if n := s.add(&model.SamplePair{Timestamp: 2, Value: 2}, doubleDelta); n != 1 {
+		t.Fatalf("expected 1 completed chunk, got %d", n)
+	}
+	if len(s.chunkDescs) != 2 {
+		t.Fatalf("expected 2 chunks, got %d", len(s.chunkDescs))
+	}
+	if got := s.head().c.encoding(); got != doubleDelta {
+		t.Errorf("expected head chunk encoding %v, got %v", doubleDelta, got)
+	}
+	if got := s.chunkDescs[0].c.encoding(); got != delta {
+		t.Errorf("expected first chunk encoding %v, got %v", delta, got)
+	}
+}
+
+func TestMixedChunkEncodings(t *testing.T) {
+	directory := testutil.NewTemporaryDirectory("test_storage", t)
+	defer directory.Close()
+
+	m := model.Metric{model.MetricNameLabel: "test_mixed_encodings"}
+	fp := m.FastFingerprint()
+	var samples model.Samples
+
+	// Start the storage once per encoding and persist a few chunks each
+	// time, so that the series file ends up with chunks of both encodings.
+	for i, encoding := range []ChunkEncoding{DeltaEncoding, DoubleDeltaEncoding, DeltaEncoding} {
+		s := NewMemorySeriesStorage(&MemorySeriesStorageOptions{
+			MemoryChunks:               1000000,
+			MaxChunksToPersist:         1000000,
+			PersistenceRetentionPeriod: 24 * time.Hour * 365 * 100,
+			PersistenceStoragePath:     directory.Path(),
+			CheckpointInterval:         time.Hour,
+			SyncStrategy:               Adaptive,
+			ChunkEncoding:              encoding,
+		}).(*memorySeriesStorage)
+		if err := s.Start(); err != nil {
+			t.Fatalf("Error starting storage: %s", err)
+		}
+		for j := 0; j < 2000; j++ {
+			smpl := &model.Sample{
+				Metric:    m,
+				Timestamp: model.Time(i*2000 + j),
+				Value:     model.SampleValue(j),
+			}
+			s.Append(smpl)
+			samples = append(samples, smpl)
+		}
+		s.WaitForIndexing()
+		// A head chunk loaded from the checkpoint of the previous run
+		// must not keep its encoding.
+		series, _ := s.fpToSeries.get(fp)
+		if want, _ := encoding.chunkEncoding(); series.head().c.encoding() != want {
+			t.Errorf("%d. expected head chunk encoding %v, got %v", i, want, series.head().c.encoding())
+		}
+		s.maintainMemorySeries(fp, 0)
+		if !verifyStorage(t, s, samples, 24*time.Hour*365*100) {
+			t.Fatalf("%d. samples not retrieved correctly", i)
+		}
+		if err := s.Stop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := NewMemorySeriesStorage(&MemorySeriesStorageOptions{
+		MemoryChunks:               1000000,
+		MaxChunksToPersist:         1000000,
+		PersistenceRetentionPeriod: 24 * time.Hour * 365 * 100,
+		PersistenceStoragePath:     directory.Path(),
+		CheckpointInterval:         time.Hour,
+		SyncStrategy:               Adaptive,
+		ChunkEncoding:              DoubleDeltaEncoding,
+	}).(*memorySeriesStorage)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting storage: %s", err)
+	}
+	defer s.Stop()
+
+	infos, err := s.ChunkInfosForFingerprint(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodings := map[chunkEncoding]bool{}
+	for _, info := range infos {
+		encodings[chunkEncoding(info.Encoding)] = true
+	}
+	if !encodings[delta] || !encodings[doubleDelta] {
+		t.Fatalf("expected chunks of both encodings, got %v", infos)
+	}
+	if !verifyStorage(t, s, samples, 24*time.Hour*365*100) {
+		t.Fatal("samples not retrieved correctly after restart")
+	}
+}
+
 func benchmarkAppend(b *testing.B, encoding chunkEncoding) {
 	samples := make(model.Samples, b.N)
 	for i := range samples {
@@ -1308,7 +2268,6 @@ func TestFuzzChunkType1(t *testing.T) {
 //
 // go test -race -cpu 8 -short -bench BenchmarkFuzzChunkType
 func benchmarkFuzz(b *testing.B, encoding chunkEncoding) {
-	DefaultChunkEncoding = encoding
 	const samplesPerRun = 100000
 	rand.Seed(42)
 	directory := testutil.NewTemporaryDirectory("test_storage", b)
@@ -1320,6 +2279,7 @@ func benchmarkFuzz(b *testing.B, encoding chunkEncoding) {
 		PersistenceStoragePath:     directory.Path(),
 		CheckpointInterval:         time.Second,
 		SyncStrategy:               Adaptive,
+		ChunkEncoding:              encodingOption(encoding),
 	}
 	s := NewMemorySeriesStorage(o)
 	if err := s.Start(); err != nil {
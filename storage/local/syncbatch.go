@@ -0,0 +1,176 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// syncBatcher batches the syncs of series files mandated by the sync strategy.
+// Instead of syncing a series file after every write, the file is kept open
+// until up to maxFiles files are pending or interval has passed, and then all
+// pending files are synced and closed together. Files written to several times
+// within a batch are only synced once.
+//
+// Batching trades durability for throughput: chunks written to a series file
+// are only guaranteed to be on disk once their batch has been synced. A crash
+// loses up to one batch of writes, which crash recovery then detects as
+// truncated series files. A clean shutdown syncs all pending files.
+//
+// A syncBatcher with maxFiles of one or less syncs every file right away.
+type syncBatcher struct {
+	maxFiles int
+	interval time.Duration
+
+	mtx     sync.Mutex
+	pending []pendingSyncFile
+
+	stopping chan struct{}
+	stopped  chan struct{}
+
+	batchSizes prometheus.Summary
+}
+
+type pendingSyncFile struct {
+	f  *os.File
+	fi os.FileInfo
+}
+
+// newSyncBatcher returns a syncBatcher syncing up to maxFiles files together,
+// at the latest after the given interval.
+func newSyncBatcher(maxFiles int, interval time.Duration) *syncBatcher {
+	return &syncBatcher{
+		maxFiles: maxFiles,
+		interval: interval,
+		stopping: make(chan struct{}),
+		stopped:  make(chan struct{}),
+
+		batchSizes: prometheus.NewSummary(prometheus.SummaryOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "series_sync_batch_size",
+			Help:      "Quantiles for the number of series files synced together.",
+		}),
+	}
+}
+
+// enabled returns whether syncs are batched at all.
+func (b *syncBatcher) enabled() bool {
+	return b.maxFiles > 1
+}
+
+// add hands over the written file f to be synced and closed with the next
+// batch. It is goroutine-safe.
+func (b *syncBatcher) add(f *os.File) {
+	if !b.enabled() {
+		syncAndClose(f)
+		b.batchSizes.Observe(1)
+		return
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		// Without knowing the file, sync it right away to be safe.
+		log.Error("Error determining series file to sync: ", err)
+		syncAndClose(f)
+		return
+	}
+
+	b.mtx.Lock()
+	for _, p := range b.pending {
+		if os.SameFile(p.fi, fi) {
+			// The pending sync covers the writes via f, too.
+			b.mtx.Unlock()
+			if err := f.Close(); err != nil {
+				log.Error("Error closing chunk file:", err)
+			}
+			return
+		}
+	}
+	b.pending = append(b.pending, pendingSyncFile{f: f, fi: fi})
+	full := len(b.pending) >= b.maxFiles
+	b.mtx.Unlock()
+
+	if full {
+		b.flush()
+	}
+}
+
+// flush syncs and closes all pending files. It is goroutine-safe.
+func (b *syncBatcher) flush() {
+	b.mtx.Lock()
+	pending := b.pending
+	b.pending = nil
+	b.mtx.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+	for _, p := range pending {
+		syncAndClose(p.f)
+	}
+	b.batchSizes.Observe(float64(len(pending)))
+}
+
+// run flushes the pending files every interval until stop is called.
+func (b *syncBatcher) run() {
+	defer close(b.stopped)
+	if !b.enabled() || b.interval <= 0 {
+		<-b.stopping
+		return
+	}
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.flush()
+		case <-b.stopping:
+			return
+		}
+	}
+}
+
+// stop stops run and syncs all pending files.
+func (b *syncBatcher) stop() {
+	close(b.stopping)
+	<-b.stopped
+	b.flush()
+}
+
+// Describe implements prometheus.Collector.
+func (b *syncBatcher) Describe(ch chan<- *prometheus.Desc) {
+	b.batchSizes.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (b *syncBatcher) Collect(ch chan<- prometheus.Metric) {
+	b.batchSizes.Collect(ch)
+}
+
+// syncAndClose syncs and then closes f. Errors are logged.
+func syncAndClose(f *os.File) {
+	if err := f.Sync(); err != nil {
+		log.Error("Error syncing file:", err)
+	}
+	if err := f.Close(); err != nil {
+		log.Error("Error closing chunk file:", err)
+	}
+}
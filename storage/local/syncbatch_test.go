@@ -0,0 +1,159 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func (b *syncBatcher) numPending() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return len(b.pending)
+}
+
+func TestSyncBatchingSurvivesRestart(t *testing.T) {
+	dir := testutil.NewTemporaryDirectory("test_sync_batching", t)
+	defer dir.Close()
+
+	alwaysSync := func() bool { return true }
+	// The interval is long enough to never pass during the test, so that
+	// only full batches and the shutdown sync the files.
+	batcher := newSyncBatcher(4, time.Hour)
+	p, err := newPersistence(dir.Path(), false, false, alwaysSync, batcher, newWriteThrottle(0, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.run()
+
+	// Persist two chunks each for a number of series not divisible by the
+	// batch size, so that some syncs are still pending on shutdown.
+	fpToChunks := map[model.Fingerprint][]chunk{}
+	for i := 0; i < 10; i++ {
+		fp := model.Fingerprint(i)
+		for j := 0; j < 2; j++ {
+			c := newChunkForEncoding(1).add(&model.SamplePair{
+				Timestamp: model.Time(j),
+				Value:     model.SampleValue(i),
+			})[0]
+			if _, err := p.persistChunks(fp, []chunk{c}); err != nil {
+				t.Fatal(err)
+			}
+			fpToChunks[fp] = append(fpToChunks[fp], c)
+		}
+	}
+	if batcher.numPending() == 0 {
+		t.Fatal("expected pending syncs before shutdown, got none")
+	}
+	if err := p.close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := batcher.numPending(); n != 0 {
+		t.Fatalf("expected all syncs to be done on shutdown, %d pending", n)
+	}
+
+	restarted, err := newPersistence(dir.Path(), false, false, alwaysSync, newSyncBatcher(4, time.Hour), newWriteThrottle(0, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go restarted.run()
+	defer restarted.close()
+
+	for fp, expected := range fpToChunks {
+		actual, err := restarted.loadChunks(fp, []int{0, 1}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(actual) != len(expected) {
+			t.Fatalf("%v: expected %d chunks, got %d", fp, len(expected), len(actual))
+		}
+		for i := range expected {
+			if !chunksEqual(expected[i], actual[i]) {
+				t.Errorf("%v: chunk %d not persisted correctly", fp, i)
+			}
+		}
+	}
+}
+
+func TestSyncBatcherCoalescesFiles(t *testing.T) {
+	dir := testutil.NewTemporaryDirectory("test_sync_batching", t)
+	defer dir.Close()
+
+	p := &persistence{basePath: dir.Path()}
+	b := newSyncBatcher(3, 0)
+	go b.run()
+	defer b.stop()
+
+	// Writing to the same file repeatedly does not fill the batch.
+	for i := 0; i < 5; i++ {
+		f, err := p.openChunkFileForWriting(model.Fingerprint(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.add(f)
+	}
+	if n := b.numPending(); n != 1 {
+		t.Fatalf("expected 1 pending file, got %d", n)
+	}
+
+	for _, fp := range []model.Fingerprint{2, 3} {
+		f, err := p.openChunkFileForWriting(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.add(f)
+	}
+	if n := b.numPending(); n != 0 {
+		t.Fatalf("expected full batch to be synced, %d files pending", n)
+	}
+}
+
+func benchmarkPersistChunksSyncBatching(b *testing.B, batchSize int) {
+	dir := testutil.NewTemporaryDirectory("bench_sync_batching", b)
+	defer dir.Close()
+
+	p, err := newPersistence(dir.Path(), false, false, func() bool { return true }, newSyncBatcher(batchSize, time.Second), newWriteThrottle(0, nil))
+	if err != nil {
+		b.Fatal(err)
+	}
+	go p.run()
+	defer p.close()
+
+	c := newChunkForEncoding(1).add(&model.SamplePair{Timestamp: 1, Value: 1})[0]
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Write to a limited set of series repeatedly, as chunk
+		// persistence does.
+		if _, err := p.persistChunks(model.Fingerprint(i%256), []chunk{c}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPersistChunksSyncUnbatched(b *testing.B) {
+	benchmarkPersistChunksSyncBatching(b, 1)
+}
+
+func BenchmarkPersistChunksSyncBatch16(b *testing.B) {
+	benchmarkPersistChunksSyncBatching(b, 16)
+}
+
+func BenchmarkPersistChunksSyncBatch128(b *testing.B) {
+	benchmarkPersistChunksSyncBatching(b, 128)
+}
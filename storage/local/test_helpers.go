@@ -19,6 +19,7 @@
 package local
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/prometheus/prometheus/util/testutil"
@@ -40,7 +41,6 @@ func (t *testStorageCloser) Close() {
 // directory. The returned storage is already in serving state. Upon closing the
 // returned test.Closer, the temporary directory is cleaned up.
 func NewTestStorage(t testutil.T, encoding chunkEncoding) (*memorySeriesStorage, testutil.Closer) {
-	DefaultChunkEncoding = encoding
 	directory := testutil.NewTemporaryDirectory("test_storage", t)
 	o := &MemorySeriesStorageOptions{
 		MemoryChunks:               1000000,
@@ -49,6 +49,7 @@ func NewTestStorage(t testutil.T, encoding chunkEncoding) (*memorySeriesStorage,
 		PersistenceStoragePath:     directory.Path(),
 		CheckpointInterval:         time.Hour,
 		SyncStrategy:               Adaptive,
+		ChunkEncoding:              encodingOption(encoding),
 	}
 	storage := NewMemorySeriesStorage(o)
 	if err := storage.Start(); err != nil {
@@ -63,3 +64,14 @@ func NewTestStorage(t testutil.T, encoding chunkEncoding) (*memorySeriesStorage,
 
 	return storage.(*memorySeriesStorage), closer
 }
+
+// encodingOption returns the ChunkEncoding option that selects encoding.
+func encodingOption(encoding chunkEncoding) ChunkEncoding {
+	switch encoding {
+	case delta:
+		return DeltaEncoding
+	case doubleDelta:
+		return DoubleDeltaEncoding
+	}
+	panic(fmt.Errorf("unknown chunk encoding: %v", encoding))
+}
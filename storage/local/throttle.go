@@ -0,0 +1,131 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// writeThrottle limits the throughput of chunk persistence to a configured
+// number of bytes per second so that background persistence leaves some IO
+// capacity to foreground reads. Throttling is suspended while the storage is
+// rushed, i.e. while isRushed returns true, as falling behind on persistence is
+// worse than starving reads in that case.
+//
+// A writeThrottle with a limit of zero or less never delays writes, but it
+// still accounts for the written bytes.
+type writeThrottle struct {
+	mtx            sync.Mutex
+	bytesPerSecond int
+	next           time.Time // The earliest time the next write may start.
+	isRushed       func() bool
+
+	writtenBytes   prometheus.Counter
+	throttledTime  prometheus.Counter
+	limitBytesDesc *prometheus.Desc
+}
+
+// newWriteThrottle returns a writeThrottle with the given limit in bytes per
+// second. isRushed may be nil, in which case the throttle is never suspended.
+func newWriteThrottle(bytesPerSecond int, isRushed func() bool) *writeThrottle {
+	if isRushed == nil {
+		isRushed = func() bool { return false }
+	}
+	return &writeThrottle{
+		bytesPerSecond: bytesPerSecond,
+		isRushed:       isRushed,
+
+		writtenBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "persisted_bytes_total",
+			Help:      "The total number of bytes written to series files.",
+		}),
+		throttledTime: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "persist_throttled_milliseconds_total",
+			Help:      "The total time (in milliseconds) writes to series files were delayed to stay within the persistence throughput limit.",
+		}),
+		limitBytesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "persist_throughput_limit_bytes"),
+			"The configured limit for the persistence throughput in bytes per second. Zero if unlimited.",
+			nil, nil,
+		),
+	}
+}
+
+// wait blocks until n more bytes may be written without exceeding the
+// throughput limit. It is goroutine-safe.
+func (t *writeThrottle) wait(n int) {
+	t.writtenBytes.Add(float64(n))
+	if t.bytesPerSecond <= 0 {
+		return
+	}
+
+	t.mtx.Lock()
+	now := time.Now()
+	if t.next.Before(now) || t.isRushed() {
+		t.next = now
+	}
+	delay := t.next.Sub(now)
+	t.next = t.next.Add(time.Duration(n) * time.Second / time.Duration(t.bytesPerSecond))
+	t.mtx.Unlock()
+
+	if delay > 0 {
+		t.throttledTime.Add(float64(delay) / float64(time.Millisecond))
+		time.Sleep(delay)
+	}
+}
+
+// writer returns an io.Writer writing to w while observing the throughput
+// limit.
+func (t *writeThrottle) writer(w io.Writer) io.Writer {
+	return &throttledWriter{w: w, throttle: t}
+}
+
+// Describe implements prometheus.Collector.
+func (t *writeThrottle) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.writtenBytes.Desc()
+	ch <- t.throttledTime.Desc()
+	ch <- t.limitBytesDesc
+}
+
+// Collect implements prometheus.Collector.
+func (t *writeThrottle) Collect(ch chan<- prometheus.Metric) {
+	ch <- t.writtenBytes
+	ch <- t.throttledTime
+	ch <- prometheus.MustNewConstMetric(
+		t.limitBytesDesc,
+		prometheus.GaugeValue,
+		float64(t.bytesPerSecond),
+	)
+}
+
+// throttledWriter is an io.Writer that waits for its writeThrottle before each
+// write.
+type throttledWriter struct {
+	w        io.Writer
+	throttle *writeThrottle
+}
+
+// Write implements io.Writer.
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	tw.throttle.wait(len(p))
+	return tw.w.Write(p)
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestWriteThrottle(t *testing.T) {
+	const (
+		limit     = 1 << 20 // 1MiB/s.
+		writeSize = 16 << 10
+		writes    = 16 // 256kiB total, i.e. at least 240ms at the limit.
+	)
+
+	var scenarios = []struct {
+		limit   int
+		rushed  bool
+		minTime time.Duration
+		maxTime time.Duration
+	}{
+		{
+			limit:   limit,
+			minTime: (writes - 1) * writeSize * time.Second / limit,
+			maxTime: time.Minute,
+		},
+		{
+			limit:   0,
+			maxTime: 100 * time.Millisecond,
+		},
+		{
+			limit:   limit,
+			rushed:  true,
+			maxTime: 100 * time.Millisecond,
+		},
+	}
+
+	buf := make([]byte, writeSize)
+	for i, s := range scenarios {
+		rushed := s.rushed
+		throttle := newWriteThrottle(s.limit, func() bool { return rushed })
+		w := throttle.writer(ioutil.Discard)
+
+		begin := time.Now()
+		for j := 0; j < writes; j++ {
+			if _, err := w.Write(buf); err != nil {
+				t.Fatal(err)
+			}
+		}
+		took := time.Since(begin)
+
+		if took < s.minTime {
+			t.Errorf("%d. expected writes to take at least %v, took %v", i, s.minTime, took)
+		}
+		if took > s.maxTime {
+			t.Errorf("%d. expected writes to take at most %v, took %v", i, s.maxTime, took)
+		}
+	}
+}
+
+func TestThrottledWriterPassesThrough(t *testing.T) {
+	var out bytes.Buffer
+	w := newWriteThrottle(1<<30, nil).writer(&out)
+	for _, s := range []string{"foo", "bar"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := out.String(); got != "foobar" {
+		t.Errorf("expected %q to be written, got %q", "foobar", got)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// tombstones tracks the intervals of deleted samples per series. Deleted
+// samples stay in their chunks but are hidden from queries. Chunks only
+// containing deleted samples at the beginning of a series are dropped by the
+// series maintenance, in the same way as chunks beyond the retention period,
+// and tombstones are removed once the series doesn't reach back into them
+// anymore. The zero value is not ready to use, see newTombstones.
+type tombstones struct {
+	mtx   sync.RWMutex
+	m     map[model.Fingerprint][]metric.Interval // Sorted and disjoint.
+	dirty bool                                    // Whether changed since the last checkpoint.
+}
+
+func newTombstones() *tombstones {
+	return &tombstones{m: map[model.Fingerprint][]metric.Interval{}}
+}
+
+// add marks the samples in the given interval of the series as deleted.
+func (t *tombstones) add(fp model.Fingerprint, in metric.Interval) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	ivs := append(t.m[fp], in)
+	sort.Sort(byOldest(ivs))
+	merged := ivs[:1]
+	for _, iv := range ivs[1:] {
+		last := &merged[len(merged)-1]
+		if iv.OldestInclusive > last.NewestInclusive+1 {
+			merged = append(merged, iv)
+			continue
+		}
+		if iv.NewestInclusive > last.NewestInclusive {
+			last.NewestInclusive = iv.NewestInclusive
+		}
+	}
+	t.m[fp] = merged
+	t.dirty = true
+}
+
+// get returns the deleted intervals of the series, oldest first, or nil if
+// nothing of the series is deleted.
+func (t *tombstones) get(fp model.Fingerprint) []metric.Interval {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	ivs, ok := t.m[fp]
+	if !ok {
+		return nil
+	}
+	return append([]metric.Interval(nil), ivs...)
+}
+
+// del removes all tombstones of the series, e.g. once it has been purged.
+func (t *tombstones) del(fp model.Fingerprint) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if _, ok := t.m[fp]; ok {
+		delete(t.m, fp)
+		t.dirty = true
+	}
+}
+
+// trim removes the tombstones of the series that end before firstTime, the
+// time of its oldest sample left.
+func (t *tombstones) trim(fp model.Fingerprint, firstTime model.Time) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	ivs, ok := t.m[fp]
+	if !ok {
+		return
+	}
+	i := 0
+	for ; i < len(ivs) && ivs[i].NewestInclusive < firstTime; i++ {
+	}
+	switch {
+	case i == 0:
+		return
+	case i == len(ivs):
+		delete(t.m, fp)
+	default:
+		t.m[fp] = ivs[i:]
+	}
+	t.dirty = true
+}
+
+// cutoff returns the time before which all samples of the series are either
+// deleted or older than the retention cutoff beforeTime, given the time of
+// its oldest sample firstTime. Chunks ending before that time can be dropped.
+func (t *tombstones) cutoff(fp model.Fingerprint, firstTime, beforeTime model.Time) model.Time {
+	if firstTime > beforeTime {
+		beforeTime = firstTime
+	}
+	for _, iv := range t.get(fp) {
+		if iv.OldestInclusive > beforeTime {
+			break
+		}
+		if iv.NewestInclusive >= beforeTime {
+			beforeTime = iv.NewestInclusive + 1
+		}
+	}
+	return beforeTime
+}
+
+// deleted returns the interval of ivs containing ts and true, if the sample
+// at ts is deleted.
+func deleted(ivs []metric.Interval, ts model.Time) (metric.Interval, bool) {
+	i := sort.Search(len(ivs), func(i int) bool { return ivs[i].NewestInclusive >= ts })
+	if i < len(ivs) && ivs[i].OldestInclusive <= ts {
+		return ivs[i], true
+	}
+	return metric.Interval{}, false
+}
+
+type byOldest []metric.Interval
+
+func (ivs byOldest) Len() int           { return len(ivs) }
+func (ivs byOldest) Less(i, j int) bool { return ivs[i].OldestInclusive < ivs[j].OldestInclusive }
+func (ivs byOldest) Swap(i, j int)      { ivs[i], ivs[j] = ivs[j], ivs[i] }
+
+// tombstonedIterator wraps a SeriesIterator and hides the samples in the
+// deleted intervals.
+type tombstonedIterator struct {
+	it      SeriesIterator
+	deleted []metric.Interval
+}
+
+// before returns the latest sample not deleted at or before ts.
+func (tit *tombstonedIterator) before(ts model.Time) *model.SamplePair {
+	for {
+		var sp *model.SamplePair
+		for _, v := range tit.it.ValueAtTime(ts) {
+			if !v.Timestamp.After(ts) {
+				v := v
+				sp = &v
+				break
+			}
+		}
+		if sp == nil {
+			return nil
+		}
+		iv, ok := deleted(tit.deleted, sp.Timestamp)
+		if !ok {
+			return sp
+		}
+		ts = iv.OldestInclusive - 1
+	}
+}
+
+// after returns the earliest sample not deleted at or after ts.
+func (tit *tombstonedIterator) after(ts model.Time) *model.SamplePair {
+	for {
+		var sp *model.SamplePair
+		vs := tit.it.ValueAtTime(ts)
+		for i := len(vs) - 1; i >= 0; i-- {
+			if !vs[i].Timestamp.Before(ts) {
+				v := vs[i]
+				sp = &v
+				break
+			}
+		}
+		if sp == nil {
+			return nil
+		}
+		iv, ok := deleted(tit.deleted, sp.Timestamp)
+		if !ok {
+			return sp
+		}
+		ts = iv.NewestInclusive + 1
+	}
+}
+
+// ValueAtTime implements the SeriesIterator interface.
+func (tit *tombstonedIterator) ValueAtTime(ts model.Time) []model.SamplePair {
+	res := []model.SamplePair{}
+	before := tit.before(ts)
+	if before != nil && before.Timestamp == ts {
+		return append(res, *before)
+	}
+	if before != nil {
+		res = append(res, *before)
+	}
+	if after := tit.after(ts); after != nil {
+		res = append(res, *after)
+	}
+	return res
+}
+
+// BoundaryValues implements the SeriesIterator interface.
+func (tit *tombstonedIterator) BoundaryValues(in metric.Interval) []model.SamplePair {
+	values := tit.RangeValues(in)
+	if len(values) <= 1 {
+		return values
+	}
+	return []model.SamplePair{values[0], values[len(values)-1]}
+}
+
+// RangeValues implements the SeriesIterator interface.
+func (tit *tombstonedIterator) RangeValues(in metric.Interval) []model.SamplePair {
+	values := tit.it.RangeValues(in)
+	res := values[:0]
+	for _, v := range values {
+		if _, ok := deleted(tit.deleted, v.Timestamp); !ok {
+			res = append(res, v)
+		}
+	}
+	return res
+}
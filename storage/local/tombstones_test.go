@@ -0,0 +1,162 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+func TestTombstones(t *testing.T) {
+	ts := newTombstones()
+	ts.add(1, metric.Interval{OldestInclusive: 10, NewestInclusive: 20})
+	ts.add(1, metric.Interval{OldestInclusive: 30, NewestInclusive: 40})
+	ts.add(1, metric.Interval{OldestInclusive: 21, NewestInclusive: 25})
+
+	want := []metric.Interval{
+		{OldestInclusive: 10, NewestInclusive: 25},
+		{OldestInclusive: 30, NewestInclusive: 40},
+	}
+	if got := ts.get(1); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected tombstones %v, got %v", want, got)
+	}
+	if got := ts.get(2); got != nil {
+		t.Fatalf("expected no tombstones, got %v", got)
+	}
+
+	for _, s := range []struct {
+		firstTime, beforeTime, want model.Time
+	}{
+		{firstTime: 5, beforeTime: 0, want: 5},
+		{firstTime: 10, beforeTime: 0, want: 26},
+		{firstTime: 10, beforeTime: 28, want: 28},
+		{firstTime: 10, beforeTime: 30, want: 41},
+	} {
+		if got := ts.cutoff(1, s.firstTime, s.beforeTime); got != s.want {
+			t.Errorf("expected cutoff %v for first time %v and retention cutoff %v, got %v", s.want, s.firstTime, s.beforeTime, got)
+		}
+	}
+
+	ts.trim(1, 26)
+	want = want[1:]
+	if got := ts.get(1); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected tombstones %v after trimming, got %v", want, got)
+	}
+	ts.add(1, metric.Interval{OldestInclusive: 0, NewestInclusive: 100})
+	want = []metric.Interval{{OldestInclusive: 0, NewestInclusive: 100}}
+	if got := ts.get(1); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected tombstones %v, got %v", want, got)
+	}
+	ts.trim(1, 101)
+	if got := ts.get(1); got != nil {
+		t.Fatalf("expected no tombstones after trimming, got %v", got)
+	}
+}
+
+func TestDeleteSamples(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+
+	m1 := model.Metric{model.MetricNameLabel: "test_delete", "n": "1"}
+	m2 := model.Metric{model.MetricNameLabel: "test_delete", "n": "2"}
+	for _, m := range []model.Metric{m1, m2} {
+		for i := 0; i < 10000; i++ {
+			s.Append(&model.Sample{
+				Metric:    m,
+				Timestamp: model.Time(i),
+				Value:     model.SampleValue(i),
+			})
+		}
+	}
+	s.WaitForIndexing()
+	fp1, fp2 := m1.FastFingerprint(), m2.FastFingerprint()
+
+	if err := s.DeleteSamplesForFingerprints(metric.Interval{OldestInclusive: -1000, NewestInclusive: 4999}, fp1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteSamplesForFingerprints(metric.Interval{OldestInclusive: 6000, NewestInclusive: 6999}, fp1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteSamplesForFingerprints(metric.Interval{OldestInclusive: model.Earliest, NewestInclusive: model.Latest}, fp2); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.fpToSeries.get(fp2); ok {
+		t.Fatal("expected completely deleted series to be dropped")
+	}
+
+	check := func() {
+		p := s.NewPreloader()
+		defer p.Close()
+		p.PreloadRange(fp1, 0, 10000, time.Hour)
+		it := s.NewIterator(fp1)
+
+		values := it.RangeValues(metric.Interval{OldestInclusive: 0, NewestInclusive: 10000})
+		if len(values) != 4000 {
+			t.Fatalf("expected 4000 samples left, got %d", len(values))
+		}
+		for _, v := range values {
+			if v.Timestamp < 5000 || (v.Timestamp >= 6000 && v.Timestamp < 7000) {
+				t.Fatalf("unexpected deleted sample %v", v)
+			}
+		}
+
+		for _, s := range []struct {
+			ts   model.Time
+			want []model.SamplePair
+		}{
+			{ts: 100, want: []model.SamplePair{{Timestamp: 5000, Value: 5000}}},
+			{ts: 5500, want: []model.SamplePair{{Timestamp: 5500, Value: 5500}}},
+			{ts: 6500, want: []model.SamplePair{{Timestamp: 5999, Value: 5999}, {Timestamp: 7000, Value: 7000}}},
+			{ts: 20000, want: []model.SamplePair{{Timestamp: 9999, Value: 9999}}},
+		} {
+			if got := it.ValueAtTime(s.ts); !reflect.DeepEqual(got, s.want) {
+				t.Errorf("expected %v at %v, got %v", s.want, s.ts, got)
+			}
+		}
+		want := []model.SamplePair{{Timestamp: 5999, Value: 5999}, {Timestamp: 7500, Value: 7500}}
+		if got := it.BoundaryValues(metric.Interval{OldestInclusive: 5999, NewestInclusive: 7500}); !reflect.DeepEqual(got, want) {
+			t.Errorf("expected boundary values %v, got %v", want, got)
+		}
+	}
+	check()
+
+	// Maintenance drops the chunks only containing deleted samples.
+	s.maintainMemorySeries(fp1, 0)
+	series, ok := s.fpToSeries.get(fp1)
+	if !ok {
+		t.Fatal("series unexpectedly dropped")
+	}
+	if series.firstTime() == 0 || series.firstTime() > 5000 {
+		t.Fatalf("expected leading deleted chunks to be dropped, series starts at %v", series.firstTime())
+	}
+	check()
+
+	// The tombstones survive a restart.
+	if err := s.persistence.checkpointTombstones(s.tombstones); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := s.persistence.loadTombstones()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.m, s.tombstones.m) {
+		t.Fatalf("expected loaded tombstones %v, got %v", s.tombstones.m, loaded.m)
+	}
+}
@@ -13,7 +13,25 @@
 
 package metric
 
-import "github.com/prometheus/common/model"
+import (
+	"math"
+
+	"github.com/prometheus/common/model"
+)
+
+// staleNaNBits is the bit pattern of StaleNaN.
+const staleNaNBits uint64 = 0x7ff0000000000002
+
+// StaleNaN is the value of staleness markers, which are appended to a series
+// that disappeared from its target so that queries stop returning its last
+// value. It is a NaN distinct from the one returned by math.NaN, so it can be
+// told apart from NaN values exposed by targets.
+var StaleNaN = model.SampleValue(math.Float64frombits(staleNaNBits))
+
+// IsStaleNaN returns whether v is a staleness marker.
+func IsStaleNaN(v model.SampleValue) bool {
+	return math.Float64bits(float64(v)) == staleNaNBits
+}
 
 // Interval describes the inclusive interval between two Timestamps.
 type Interval struct {
@@ -72,13 +72,18 @@ func pathFromMetric(m model.Metric, prefix string) string {
 	return buffer.String()
 }
 
-// Store sends a batch of samples to Graphite.
+// Store sends a batch of samples to Graphite. Every batch is sent over a new
+// connection, so that a failed connection doesn't affect later batches.
 func (c *Client) Store(samples model.Samples) error {
 	conn, err := net.DialTimeout(c.transport, c.address, c.timeout)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
+	// Don't let a stalled Graphite block sending indefinitely.
+	if err := conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return err
+	}
 
 	var buf bytes.Buffer
 	for _, s := range samples {
@@ -101,6 +106,15 @@ func (c *Client) Store(samples model.Samples) error {
 	return nil
 }
 
+// Probe implements remote.ReadinessProber by connecting to Graphite.
+func (c *Client) Probe() error {
+	conn, err := net.DialTimeout(c.transport, c.address, c.timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
 // Name identifies the client as a Graphite client.
 func (c Client) Name() string {
 	return "graphite"
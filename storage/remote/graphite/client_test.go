@@ -14,7 +14,12 @@
 package graphite
 
 import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/prometheus/common/model"
 )
@@ -55,3 +60,49 @@ func TestPathFromMetric(t *testing.T) {
 		t.Errorf("Expected %s, got %s", expected, actual)
 	}
 }
+
+func TestStore(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan string)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b, _ := ioutil.ReadAll(conn)
+			conn.Close()
+			received <- string(b)
+		}
+	}()
+
+	c := NewClient(l.Addr().String(), "tcp", time.Second, "prefix.")
+	// Every batch is sent over its own connection.
+	for i := 0; i < 2; i++ {
+		err := c.Store(model.Samples{
+			{
+				Metric:    model.Metric{model.MetricNameLabel: "test_metric", "job": "a"},
+				Value:     model.SampleValue(i),
+				Timestamp: model.Time(1000 * i),
+			},
+			{
+				Metric:    model.Metric{model.MetricNameLabel: "test_metric", "job": "b"},
+				Value:     model.SampleValue(math.NaN()),
+				Timestamp: model.Time(1000 * i),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := fmt.Sprintf("prefix.test_metric.job=a %f %f\n", float64(i), float64(i))
+		if got := <-received; got != expected {
+			t.Errorf("%d. Expected %q, got %q", i, expected, got)
+		}
+	}
+}
@@ -14,41 +14,95 @@
 package influxdb
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
 
 	influx "github.com/influxdb/influxdb/client"
+
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/prometheus/util/httputil"
+)
+
+// ignoredSamples is shared by all clients, so that more than one client can
+// exist without registering the counter more than once.
+var ignoredSamples = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "prometheus_influxdb_ignored_samples_total",
+		Help: "The total number of samples not sent to InfluxDB due to unsupported float values (Inf, -Inf, NaN).",
+	},
 )
 
+func init() {
+	prometheus.MustRegister(ignoredSamples)
+}
+
+// Options are the settings of how samples are written to InfluxDB.
+type Options struct {
+	// Consistency is the write consistency level of clustered InfluxDB
+	// setups: any, one, quorum, or all. The server default, if empty.
+	Consistency string
+	// CreateDatabase makes the client create the database before it first
+	// writes to it, unless it exists already.
+	CreateDatabase bool
+}
+
+// ValidConsistency returns whether c is a valid write consistency level.
+func ValidConsistency(c string) bool {
+	switch c {
+	case "", "any", "one", "quorum", "all":
+		return true
+	}
+	return false
+}
+
 // Client allows sending batches of Prometheus samples to InfluxDB.
 type Client struct {
-	client          *influx.Client
+	url             url.URL
+	username        string
+	password        string
+	httpClient      *http.Client
 	database        string
 	retentionPolicy string
-	ignoredSamples  prometheus.Counter
-}
+	// Whether the InfluxDB credentials have to be sent as query parameters
+	// as the Authorization header is taken by other credentials.
+	credentialsInQuery bool
+	consistency        string
 
-// NewClient creates a new Client.
-func NewClient(conf influx.Config, db string, rp string) *Client {
-	c, err := influx.NewClient(conf)
-	// Currently influx.NewClient() *should* never return an error.
-	if err != nil {
-		log.Fatal(err)
-	}
+	// dbMtx serializes the creation of the database. dbCreated is true once
+	// the database was created or creating it is not configured.
+	dbMtx     sync.Mutex
+	dbCreated bool
+}
 
+// NewClient creates a new Client. The options set up TLS and authentication
+// for the connections to InfluxDB, e.g. with a proxy in front of it. The
+// InfluxDB credentials in conf are sent as query parameters if basic
+// authentication credentials are set in the HTTP client options.
+func NewClient(conf influx.Config, db string, rp string, opts Options, o httputil.ClientOptions) *Client {
 	return &Client{
-		client:          c,
-		database:        db,
-		retentionPolicy: rp,
-		ignoredSamples: prometheus.NewCounter(
-			prometheus.CounterOpts{
-				Name: "prometheus_influxdb_ignored_samples_total",
-				Help: "The total number of samples not sent to InfluxDB due to unsupported float values (Inf, -Inf, NaN).",
-			},
-		),
+		url:                conf.URL,
+		username:           conf.Username,
+		password:           conf.Password,
+		httpClient:         httputil.NewDeadlineClientWithOptions(conf.Timeout, nil, o),
+		database:           db,
+		retentionPolicy:    rp,
+		credentialsInQuery: o.BasicAuthUsername != "",
+		consistency:        opts.Consistency,
+		dbCreated:          !opts.CreateDatabase,
 	}
 }
 
@@ -70,7 +124,7 @@ func (c *Client) Store(samples model.Samples) error {
 		v := float64(s.Value)
 		if math.IsNaN(v) || math.IsInf(v, 0) {
 			log.Debugf("cannot send value %f to InfluxDB, skipping sample %#v", v, s)
-			c.ignoredSamples.Inc()
+			ignoredSamples.Inc()
 			continue
 		}
 		points = append(points, influx.Point{
@@ -84,26 +138,310 @@ func (c *Client) Store(samples model.Samples) error {
 		})
 	}
 
-	bps := influx.BatchPoints{
-		Points:          points,
-		Database:        c.database,
-		RetentionPolicy: c.retentionPolicy,
+	return c.write(points)
+}
+
+// write sends the points to the write endpoint of InfluxDB in the line
+// protocol.
+func (c *Client) write(points []influx.Point) error {
+	var buf bytes.Buffer
+	for _, p := range points {
+		buf.WriteString(p.MarshalString())
+		buf.WriteByte('\n')
+	}
+
+	if err := c.createDatabase(); err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Set("db", c.database)
+	params.Set("rp", c.retentionPolicy)
+	if c.consistency != "" {
+		params.Set("consistency", c.consistency)
 	}
-	_, err := c.client.Write(bps)
-	return err
+	req, err := c.newRequest("write", params, &buf)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
 }
 
-// Name identifies the client as an InfluxDB client.
-func (c Client) Name() string {
-	return "influxdb"
+// newRequest returns a POST request to the given endpoint of InfluxDB with the
+// given query parameters and the InfluxDB credentials.
+func (c *Client) newRequest(endpoint string, params url.Values, body io.Reader) (*http.Request, error) {
+	u := c.url
+	u.Path = endpoint
+	if c.username != "" && c.credentialsInQuery {
+		params.Set("u", c.username)
+		params.Set("p", c.password)
+	}
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequest("POST", u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if c.username != "" && !c.credentialsInQuery {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	return req, nil
+}
+
+// createDatabase creates the database if configured to do so and it has not
+// been created yet. Creating an existing database is not an error.
+func (c *Client) createDatabase() error {
+	c.dbMtx.Lock()
+	defer c.dbMtx.Unlock()
+	if c.dbCreated {
+		return nil
+	}
+
+	if _, err := c.query(fmt.Sprintf("CREATE DATABASE %s", quoteIdentifier(c.database)), url.Values{}); err != nil {
+		return fmt.Errorf("error creating database %q: %s", c.database, err)
+	}
+	c.dbCreated = true
+	return nil
+}
+
+// queryResult is the result of a single InfluxQL statement.
+type queryResult struct {
+	Err    string `json:"error"`
+	Series []struct {
+		Name    string            `json:"name"`
+		Tags    map[string]string `json:"tags"`
+		Columns []string          `json:"columns"`
+		Values  [][]interface{}   `json:"values"`
+	} `json:"series"`
+}
+
+// query runs the InfluxQL query q with the given query parameters and returns
+// its results. Errors of the query are reported in the response body and
+// returned as errors.
+func (c *Client) query(q string, params url.Values) ([]queryResult, error) {
+	params.Set("q", q)
+	req, err := c.newRequest("query", params, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	var r struct {
+		Err     string        `json:"error"`
+		Results []queryResult `json:"results"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&r); err != nil {
+		return nil, err
+	}
+	if r.Err != "" {
+		return nil, errors.New(r.Err)
+	}
+	for _, res := range r.Results {
+		if res.Err != "" {
+			return nil, errors.New(res.Err)
+		}
+	}
+	return r.Results, nil
 }
 
-// Describe implements prometheus.Collector.
-func (c *Client) Describe(ch chan<- *prometheus.Desc) {
-	ch <- c.ignoredSamples.Desc()
+// Read implements storage.Reader. It queries InfluxDB for the samples
+// written by Store. The label matchers are translated into InfluxQL as far as
+// possible, and all of them are applied to the returned series again.
+func (c *Client) Read(from, through model.Time, matchers metric.LabelMatchers) (model.Matrix, error) {
+	params := url.Values{}
+	params.Set("db", c.database)
+	params.Set("epoch", "ms")
+	results, err := c.query(buildQuery(c.retentionPolicy, from, through, matchers), params)
+	if err != nil {
+		return nil, fmt.Errorf("error reading from InfluxDB: %s", err)
+	}
+
+	var matrix model.Matrix
+	for _, res := range results {
+		for _, s := range res.Series {
+			m := make(model.Metric, len(s.Tags)+1)
+			m[model.MetricNameLabel] = model.LabelValue(s.Name)
+			for k, v := range s.Tags {
+				// Series lacking a tag grouped by have it empty.
+				if v != "" {
+					m[model.LabelName(k)] = model.LabelValue(v)
+				}
+			}
+			if !matchesAll(m, matchers) {
+				continue
+			}
+			values, err := samplePairs(s.Columns, s.Values)
+			if err != nil {
+				return nil, fmt.Errorf("error reading from InfluxDB: %s", err)
+			}
+			if len(values) == 0 {
+				continue
+			}
+			matrix = append(matrix, &model.SampleStream{Metric: m, Values: values})
+		}
+	}
+	return matrix, nil
 }
 
-// Collect implements prometheus.Collector.
-func (c *Client) Collect(ch chan<- prometheus.Metric) {
-	ch <- c.ignoredSamples
+// buildQuery returns the InfluxQL query selecting the values of the series
+// matching the label matchers between from and through, grouped by series.
+// Matchers which also match an empty label value are left out as InfluxDB
+// and Prometheus differ in how they treat missing tags.
+func buildQuery(rp string, from, through model.Time, matchers metric.LabelMatchers) string {
+	measurement := "/.+/"
+	conds := []string{
+		fmt.Sprintf("time >= %s", quoteString(from.Time().UTC().Format(time.RFC3339Nano))),
+		fmt.Sprintf("time <= %s", quoteString(through.Time().UTC().Format(time.RFC3339Nano))),
+	}
+	for _, m := range matchers {
+		if m.Match("") {
+			continue
+		}
+		if m.Name == model.MetricNameLabel {
+			switch m.Type {
+			case metric.Equal:
+				measurement = quoteIdentifier(string(m.Value))
+			case metric.RegexMatch:
+				measurement = quoteRegex(string(m.Value))
+			}
+			continue
+		}
+		tag := quoteIdentifier(string(m.Name))
+		switch m.Type {
+		case metric.Equal:
+			conds = append(conds, fmt.Sprintf("%s = %s", tag, quoteString(string(m.Value))))
+		case metric.NotEqual:
+			conds = append(conds, fmt.Sprintf("%s != %s", tag, quoteString(string(m.Value))))
+		case metric.RegexMatch:
+			conds = append(conds, fmt.Sprintf("%s =~ %s", tag, quoteRegex(string(m.Value))))
+		case metric.RegexNoMatch:
+			conds = append(conds, fmt.Sprintf("%s !~ %s", tag, quoteRegex(string(m.Value))))
+		}
+	}
+	if rp != "" {
+		measurement = quoteIdentifier(rp) + "." + measurement
+	}
+	return fmt.Sprintf("SELECT value FROM %s WHERE %s GROUP BY *", measurement, strings.Join(conds, " AND "))
+}
+
+// matchesAll returns whether m matches all the label matchers.
+func matchesAll(m model.Metric, matchers metric.LabelMatchers) bool {
+	for _, lm := range matchers {
+		if !lm.Match(m[lm.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// samplePairs converts the values of a series returned by InfluxDB with
+// millisecond timestamps into sample pairs. Rows without a value are skipped.
+func samplePairs(columns []string, rows [][]interface{}) ([]model.SamplePair, error) {
+	timeCol, valueCol := -1, -1
+	for i, c := range columns {
+		switch c {
+		case "time":
+			timeCol = i
+		case "value":
+			valueCol = i
+		}
+	}
+	if timeCol < 0 || valueCol < 0 {
+		return nil, fmt.Errorf("unexpected columns %v", columns)
+	}
+
+	values := make([]model.SamplePair, 0, len(rows))
+	for _, row := range rows {
+		if len(row) != len(columns) {
+			return nil, fmt.Errorf("unexpected row %v", row)
+		}
+		if row[valueCol] == nil {
+			continue
+		}
+		ts, ok := row[timeCol].(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("invalid timestamp %v", row[timeCol])
+		}
+		t, err := ts.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %v", row[timeCol])
+		}
+		v, ok := row[valueCol].(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("invalid value %v", row[valueCol])
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %v", row[valueCol])
+		}
+		values = append(values, model.SamplePair{
+			Timestamp: model.Time(t),
+			Value:     model.SampleValue(f),
+		})
+	}
+	return values, nil
+}
+
+// quoteString quotes an InfluxQL string literal.
+func quoteString(s string) string {
+	return `'` + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + `'`
+}
+
+// quoteRegex returns an InfluxQL regular expression literal matching the whole
+// of a string against the regular expression re, like Prometheus does.
+func quoteRegex(re string) string {
+	return "/^(?:" + strings.Replace(re, "/", `\/`, -1) + ")$/"
+}
+
+// quoteIdentifier quotes an InfluxQL identifier.
+func quoteIdentifier(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// Probe implements remote.ReadinessProber by pinging InfluxDB.
+func (c *Client) Probe() error {
+	u := c.url
+	u.Path = "/ping"
+
+	resp, err := c.httpClient.Get(u.String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+// Name identifies the client as an InfluxDB client.
+func (c *Client) Name() string {
+	return "influxdb"
 }
@@ -14,17 +14,24 @@
 package influxdb
 
 import (
+	"crypto/tls"
+	"fmt"
 	"io/ioutil"
 	"math"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	influx "github.com/influxdb/influxdb/client"
 
 	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/prometheus/util/httputil"
 )
 
 func TestClient(t *testing.T) {
@@ -80,6 +87,9 @@ testmetric,test_label=test_label_value2 value=5.1234 123456789123000000
 			if r.URL.Path != "/write" {
 				t.Fatalf("Unexpected path; expected %s, got %s", "/write", r.URL.Path)
 			}
+			if user, pass, ok := r.BasicAuth(); !ok || user != "testuser" || pass != "testpass" {
+				t.Fatalf("Unexpected basic auth credentials %q, %q", user, pass)
+			}
 			b, err := ioutil.ReadAll(r.Body)
 			if err != nil {
 				t.Fatalf("Error reading body: %s", err)
@@ -103,9 +113,234 @@ testmetric,test_label=test_label_value2 value=5.1234 123456789123000000
 		Password: "testpass",
 		Timeout:  time.Minute,
 	}
-	c := NewClient(conf, "test_db", "default")
+	c := NewClient(conf, "test_db", "default", Options{}, httputil.ClientOptions{})
+
+	if err := c.Store(samples); err != nil {
+		t.Fatalf("Error sending samples: %s", err)
+	}
+}
+
+func TestClientTLSBasicAuth(t *testing.T) {
+	var requests int
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			// The proxy credentials take the Authorization header, the
+			// InfluxDB credentials are moved to the query.
+			if user, pass, ok := r.BasicAuth(); !ok || user != "proxyuser" || pass != "proxypass" {
+				t.Errorf("Unexpected basic auth credentials %q, %q", user, pass)
+			}
+			q := r.URL.Query()
+			if q.Get("u") != "testuser" || q.Get("p") != "testpass" {
+				t.Errorf("Unexpected InfluxDB credentials %q, %q", q.Get("u"), q.Get("p"))
+			}
+			if q.Get("db") != "test_db" || q.Get("rp") != "default" {
+				t.Errorf("Unexpected database %q and retention policy %q", q.Get("db"), q.Get("rp"))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		},
+	))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("Unable to parse server URL %s: %s", server.URL, err)
+	}
+
+	conf := influx.Config{
+		URL:      *serverURL,
+		Username: "testuser",
+		Password: "testpass",
+		Timeout:  time.Minute,
+	}
+	c := NewClient(conf, "test_db", "default", Options{}, httputil.ClientOptions{
+		TLSConfig:         &tls.Config{InsecureSkipVerify: true},
+		BasicAuthUsername: "proxyuser",
+		BasicAuthPassword: "proxypass",
+	})
 
+	samples := model.Samples{{
+		Metric:    model.Metric{model.MetricNameLabel: "testmetric"},
+		Timestamp: model.Time(123456789123),
+		Value:     1,
+	}}
 	if err := c.Store(samples); err != nil {
 		t.Fatalf("Error sending samples: %s", err)
 	}
+	if requests != 1 {
+		t.Errorf("Expected 1 request, got %d", requests)
+	}
+}
+
+func TestClientCreateDatabase(t *testing.T) {
+	var (
+		createErr string
+		queries   []string
+		writes    int
+	)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/query":
+				queries = append(queries, r.URL.Query().Get("q"))
+				w.Header().Set("Content-Type", "application/json")
+				if createErr != "" {
+					fmt.Fprintf(w, `{"results":[{"error":%q}]}`, createErr)
+					return
+				}
+				w.Write([]byte(`{"results":[{}]}`))
+			case "/write":
+				writes++
+				if c := r.URL.Query().Get("consistency"); c != "quorum" {
+					t.Errorf("Unexpected consistency %q", c)
+				}
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				t.Errorf("Unexpected request to %s", r.URL.Path)
+			}
+		},
+	))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("Unable to parse server URL %s: %s", server.URL, err)
+	}
+
+	conf := influx.Config{
+		URL:     *serverURL,
+		Timeout: time.Minute,
+	}
+	c := NewClient(conf, `test"db`, "default", Options{
+		Consistency:    "quorum",
+		CreateDatabase: true,
+	}, httputil.ClientOptions{})
+
+	samples := model.Samples{{
+		Metric:    model.Metric{model.MetricNameLabel: "testmetric"},
+		Timestamp: model.Time(123456789123),
+		Value:     1,
+	}}
+
+	// Nothing is written as long as creating the database fails.
+	createErr = "database creation failed"
+	if err := c.Store(samples); err == nil || !strings.Contains(err.Error(), createErr) {
+		t.Fatalf("Expected error creating database, got %v", err)
+	}
+	if writes != 0 {
+		t.Fatalf("Expected no writes, got %d", writes)
+	}
+
+	// The database is created only once.
+	createErr = ""
+	for i := 0; i < 2; i++ {
+		if err := c.Store(samples); err != nil {
+			t.Fatalf("Error sending samples: %s", err)
+		}
+	}
+	if writes != 2 {
+		t.Errorf("Expected 2 writes, got %d", writes)
+	}
+	expected := `CREATE DATABASE "test\"db"`
+	if len(queries) != 2 || queries[0] != expected || queries[1] != expected {
+		t.Errorf("Expected 2 queries %q, got %q", expected, queries)
+	}
+}
+
+func TestBuildQuery(t *testing.T) {
+	mustMatcher := func(mt metric.MatchType, name model.LabelName, value model.LabelValue) *metric.LabelMatcher {
+		m, err := metric.NewLabelMatcher(mt, name, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	scenarios := []struct {
+		rp       string
+		matchers metric.LabelMatchers
+		expected string
+	}{
+		{
+			matchers: metric.LabelMatchers{
+				mustMatcher(metric.Equal, model.MetricNameLabel, "test_metric"),
+			},
+			expected: `SELECT value FROM "test_metric" WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:02.5Z' GROUP BY *`,
+		},
+		{
+			rp: "default",
+			matchers: metric.LabelMatchers{
+				mustMatcher(metric.RegexMatch, model.MetricNameLabel, "test_.*"),
+				mustMatcher(metric.Equal, "job", "it's"),
+				mustMatcher(metric.RegexMatch, "path", "/a|/b"),
+			},
+			expected: `SELECT value FROM "default"./^(?:test_.*)$/ WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:02.5Z' AND "job" = 'it\'s' AND "path" =~ /^(?:\/a|\/b)$/ GROUP BY *`,
+		},
+		{
+			// Matchers matching missing labels are only applied to
+			// the results.
+			matchers: metric.LabelMatchers{
+				mustMatcher(metric.NotEqual, model.MetricNameLabel, "test_metric"),
+				mustMatcher(metric.Equal, "job", ""),
+				mustMatcher(metric.RegexMatch, "instance", "a|"),
+				mustMatcher(metric.NotEqual, "path", "/a"),
+				mustMatcher(metric.RegexNoMatch, "code", "5.."),
+			},
+			expected: `SELECT value FROM /.+/ WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:02.5Z' GROUP BY *`,
+		},
+	}
+
+	for i, s := range scenarios {
+		if q := buildQuery(s.rp, 1000, 2500, s.matchers); q != s.expected {
+			t.Errorf("%d. expected query\n%s\ngot\n%s", i, s.expected, q)
+		}
+	}
+}
+
+func TestClientRead(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/query" {
+				t.Fatalf("Unexpected request to %s", r.URL.Path)
+			}
+			if db := r.URL.Query().Get("db"); db != "test_db" {
+				t.Errorf("Unexpected database %q", db)
+			}
+			if epoch := r.URL.Query().Get("epoch"); epoch != "ms" {
+				t.Errorf("Unexpected epoch %q", epoch)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"results":[{"series":[
+				{"name":"testmetric","tags":{"job":"a","instance":""},"columns":["time","value"],"values":[[1000,1],[2000,null],[3000,2.5]]},
+				{"name":"testmetric","tags":{"job":"b","instance":"x"},"columns":["time","value"],"values":[[1000,3]]}
+			]}]}`))
+		},
+	))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("Unable to parse server URL %s: %s", server.URL, err)
+	}
+	conf := influx.Config{
+		URL:     *serverURL,
+		Timeout: time.Minute,
+	}
+	c := NewClient(conf, "test_db", "", Options{}, httputil.ClientOptions{})
+
+	m, err := metric.NewLabelMatcher(metric.Equal, "instance", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	matrix, err := c.Read(0, 5000, metric.LabelMatchers{m})
+	if err != nil {
+		t.Fatalf("Error reading samples: %s", err)
+	}
+	expected := model.Matrix{{
+		Metric: model.Metric{model.MetricNameLabel: "testmetric", "job": "a"},
+		Values: []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 3000, Value: 2.5}},
+	}}
+	if !reflect.DeepEqual(matrix, expected) {
+		t.Errorf("Expected %v, got %v", expected, matrix)
+	}
 }
@@ -24,8 +24,8 @@ import (
 	"regexp"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
-
 	"github.com/prometheus/common/model"
 
 	"github.com/prometheus/prometheus/util/httputil"
@@ -33,29 +33,61 @@ import (
 
 const (
 	putEndpoint     = "/api/put"
+	versionEndpoint = "/api/version"
 	contentTypeJSON = "application/json"
 )
 
 var (
 	illegalCharsRE = regexp.MustCompile(`[^a-zA-Z0-9_\-./]`)
+
+	// ignoredSamples is shared by all clients, so that more than one
+	// client can exist without registering the counter more than once.
+	ignoredSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "prometheus_opentsdb_ignored_samples_total",
+			Help: "The total number of samples not sent to OpenTSDB as OpenTSDB does not accept them (non-finite values, no tags, or too many tags).",
+		},
+	)
 )
 
+func init() {
+	prometheus.MustRegister(ignoredSamples)
+}
+
+// Options are the settings of how samples are written to OpenTSDB.
+type Options struct {
+	// MetricPrefix is prepended to all metric names. It is escaped along
+	// with the metric name, so characters not allowed in OpenTSDB are
+	// escaped and '_' is doubled.
+	MetricPrefix string
+	// MaxTags is the maximum number of tags per series accepted by
+	// OpenTSDB, see its tsd.storage.max_tags setting. Samples with more
+	// tags are skipped. Unlimited, if zero.
+	MaxTags int
+}
+
 // Client allows sending batches of Prometheus samples to OpenTSDB.
 type Client struct {
-	url        string
-	httpClient *http.Client
+	url          string
+	httpClient   *http.Client
+	metricPrefix string
+	maxTags      int
 }
 
-// NewClient creates a new Client.
-func NewClient(url string, timeout time.Duration) *Client {
+// NewClient creates a new Client. The HTTP client options set up TLS and
+// authentication for the connections to OpenTSDB.
+func NewClient(url string, timeout time.Duration, opts Options, o httputil.ClientOptions) *Client {
 	return &Client{
-		url:        url,
-		httpClient: httputil.NewDeadlineClient(timeout, nil),
+		url:          url,
+		httpClient:   httputil.NewDeadlineClientWithOptions(timeout, nil, o),
+		metricPrefix: opts.MetricPrefix,
+		maxTags:      opts.MaxTags,
 	}
 }
 
 // StoreSamplesRequest is used for building a JSON request for storing samples
-// via the OpenTSDB.
+// via the OpenTSDB. Tags are always serialized sorted by tag name, so that
+// repeated writes of the same series result in identical tag sets.
 type StoreSamplesRequest struct {
 	Metric    TagValue            `json:"metric"`
 	Timestamp int64               `json:"timestamp"`
@@ -75,23 +107,44 @@ func tagsFromMetric(m model.Metric) map[string]TagValue {
 	return tags
 }
 
-// Store sends a batch of samples to OpenTSDB via its HTTP API.
+// invalidSample returns why OpenTSDB does not accept the given sample with
+// the given tags, or an empty string if it does.
+func (c *Client) invalidSample(s *model.Sample, tags map[string]TagValue) string {
+	v := float64(s.Value)
+	switch {
+	case math.IsNaN(v) || math.IsInf(v, 0):
+		return fmt.Sprintf("value %f", v)
+	case len(tags) == 0:
+		return "no tags"
+	case c.maxTags > 0 && len(tags) > c.maxTags:
+		return fmt.Sprintf("%d tags, more than the maximum of %d", len(tags), c.maxTags)
+	}
+	return ""
+}
+
+// Store sends a batch of samples to OpenTSDB via its HTTP API. Samples
+// OpenTSDB does not accept are skipped and counted, so that they do not fail
+// the whole batch.
 func (c *Client) Store(samples model.Samples) error {
 	reqs := make([]StoreSamplesRequest, 0, len(samples))
 	for _, s := range samples {
-		v := float64(s.Value)
-		if math.IsNaN(v) || math.IsInf(v, 0) {
-			log.Warnf("cannot send value %f to OpenTSDB, skipping sample %#v", v, s)
+		tags := tagsFromMetric(s.Metric)
+		if reason := c.invalidSample(s, tags); reason != "" {
+			log.Debugf("cannot send sample with %s to OpenTSDB, skipping sample %#v", reason, s)
+			ignoredSamples.Inc()
 			continue
 		}
-		metric := TagValue(s.Metric[model.MetricNameLabel])
+		metric := TagValue(c.metricPrefix + string(s.Metric[model.MetricNameLabel]))
 		reqs = append(reqs, StoreSamplesRequest{
 			Metric:    metric,
 			Timestamp: s.Timestamp.Unix(),
-			Value:     v,
-			Tags:      tagsFromMetric(s.Metric),
+			Value:     float64(s.Value),
+			Tags:      tags,
 		})
 	}
+	if len(reqs) == 0 {
+		return nil
+	}
 
 	u, err := url.Parse(c.url)
 	if err != nil {
@@ -135,6 +188,26 @@ func (c *Client) Store(samples model.Samples) error {
 	return fmt.Errorf("failed to write %d samples to OpenTSDB, %d succeeded", r["failed"], r["success"])
 }
 
+// Probe implements remote.ReadinessProber by requesting the version of
+// OpenTSDB.
+func (c *Client) Probe() error {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return err
+	}
+	u.Path = versionEndpoint
+
+	resp, err := c.httpClient.Get(u.String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
 // Name identifies the client as an OpenTSDB client.
 func (c Client) Name() string {
 	return "opentsdb"
@@ -15,11 +15,21 @@ package opentsdb
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"testing"
+	"time"
 
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/util/httputil"
 )
 
 var (
@@ -73,3 +83,160 @@ func TestMarshalStoreSamplesRequest(t *testing.T) {
 		)
 	}
 }
+
+func TestStoreSerializesTagsDeterministically(t *testing.T) {
+	var bodies [][]byte
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				body, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				bodies = append(bodies, body)
+				w.WriteHeader(http.StatusNoContent)
+			},
+		),
+	)
+	defer server.Close()
+
+	m := model.Metric{model.MetricNameLabel: "testmetric"}
+	for _, ln := range []model.LabelName{"zeta", "alpha", "mu", "beta", "omega", "kappa", "delta", "gamma"} {
+		m[ln] = "value"
+	}
+	samples := model.Samples{{Metric: m, Value: 1, Timestamp: 4711000}}
+
+	c := NewClient(server.URL, time.Second, Options{}, httputil.ClientOptions{})
+	for i := 0; i < 20; i++ {
+		if err := c.Store(samples); err != nil {
+			t.Fatalf("%d. Store(samples) resulted in err: %s", i, err)
+		}
+	}
+
+	expectedJSON := []byte(`[{"metric":"testmetric","timestamp":4711,"value":1,"tags":{"alpha":"value","beta":"value","delta":"value","gamma":"value","kappa":"value","mu":"value","omega":"value","zeta":"value"}}]`)
+	for i, body := range bodies {
+		if !bytes.Equal(body, expectedJSON) {
+			t.Errorf("%d. Store(samples) sent %q, want %q", i, body, expectedJSON)
+		}
+	}
+}
+
+func TestStoreTLSBasicAuth(t *testing.T) {
+	var requests int
+	server := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "secret" {
+					t.Errorf("unexpected basic auth credentials %q, %q", user, pass)
+				}
+				w.WriteHeader(http.StatusNoContent)
+			},
+		),
+	)
+	defer server.Close()
+
+	samples := model.Samples{{Metric: metric, Value: 1, Timestamp: 4711000}}
+
+	// Without trusting the server's certificate, the store fails.
+	c := NewClient(server.URL, time.Second, Options{}, httputil.ClientOptions{})
+	if err := c.Store(samples); err == nil {
+		t.Fatal("expected store to an untrusted server to fail")
+	}
+
+	c = NewClient(server.URL, time.Second, Options{}, httputil.ClientOptions{
+		TLSConfig:         &tls.Config{InsecureSkipVerify: true},
+		BasicAuthUsername: "user",
+		BasicAuthPassword: "secret",
+	})
+	if err := c.Store(samples); err != nil {
+		t.Fatalf("Store(samples) resulted in err: %s", err)
+	}
+	if requests != 1 {
+		t.Errorf("expected 1 request, got %d", requests)
+	}
+}
+
+func TestStoreProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				// Requests to a proxy carry the absolute URL of the target.
+				proxied = append(proxied, r.URL.String())
+				w.WriteHeader(http.StatusNoContent)
+			},
+		),
+	)
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient("http://opentsdb.example.com:4242", time.Second, Options{}, httputil.ClientOptions{
+		ProxyURL: proxyURL,
+	})
+	samples := model.Samples{{Metric: metric, Value: 1, Timestamp: 4711000}}
+	if err := c.Store(samples); err != nil {
+		t.Fatalf("Store(samples) resulted in err: %s", err)
+	}
+
+	expected := []string{"http://opentsdb.example.com:4242/api/put"}
+	if !reflect.DeepEqual(proxied, expected) {
+		t.Errorf("expected proxied requests %v, got %v", expected, proxied)
+	}
+}
+
+func TestStoreSkipsInvalidSamples(t *testing.T) {
+	var bodies [][]byte
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				body, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				bodies = append(bodies, body)
+				w.WriteHeader(http.StatusNoContent)
+			},
+		),
+	)
+	defer server.Close()
+
+	var m dto.Metric
+	if err := ignoredSamples.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	ignoredBefore := m.GetCounter().GetValue()
+
+	c := NewClient(server.URL, time.Second, Options{MetricPrefix: "prom:", MaxTags: 2}, httputil.ClientOptions{})
+	samples := model.Samples{
+		{Metric: metric, Value: 1, Timestamp: 4711000},
+		{Metric: metric, Value: model.SampleValue(math.NaN()), Timestamp: 4711000},
+		{Metric: model.Metric{model.MetricNameLabel: "no_tags"}, Value: 1, Timestamp: 4711000},
+		{Metric: model.Metric{model.MetricNameLabel: "many_tags", "a": "1", "b": "2", "c": "3"}, Value: 1, Timestamp: 4711000},
+	}
+	if err := c.Store(samples); err != nil {
+		t.Fatalf("Store(samples) resulted in err: %s", err)
+	}
+	// No request is sent without any valid samples.
+	if err := c.Store(samples[1:]); err != nil {
+		t.Fatalf("Store(samples) resulted in err: %s", err)
+	}
+
+	expectedJSON := []byte(`[{"metric":"prom_.test_.metric","timestamp":4711,"value":1,"tags":{"many_chars":"abc_21ABC_.012-3_2145_C3_B667_7E89./","testlabel":"test_.value"}}]`)
+	if len(bodies) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(bodies))
+	}
+	if !bytes.Equal(bodies[0], expectedJSON) {
+		t.Errorf("Store(samples) sent %q, want %q", bodies[0], expectedJSON)
+	}
+
+	if err := ignoredSamples.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetCounter().GetValue() - ignoredBefore; got != 6 {
+		t.Errorf("expected 6 ignored samples, got %v", got)
+	}
+}
@@ -14,23 +14,42 @@
 package remote
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/relabel"
+	"github.com/prometheus/prometheus/storage/metric"
 )
 
 const (
 	// The maximum number of concurrent send requests to the remote storage.
 	maxConcurrentSends = 10
-	// The maximum number of samples to fit into a single request to the remote storage.
+	// The default maximum number of samples to fit into a single request to
+	// the remote storage.
 	maxSamplesPerSend = 100
-	// The deadline after which to send queued samples even if the maximum batch
-	// size has not been reached.
+	// The default interval after which to send queued samples even if the
+	// maximum batch size has not been reached.
 	batchSendDeadline = 5 * time.Second
+	// The default time to wait on shutdown for queued samples to be sent.
+	defaultDrainTimeout = 10 * time.Second
 )
 
+var errQueueFull = errors.New("remote storage queue full")
+
+// The interval in which a remote storage is probed while waiting for it to
+// become ready.
+var readyProbeInterval = time.Second
+
 // String constants for instrumentation.
 const (
 	namespace = "prometheus"
@@ -40,8 +59,102 @@ const (
 	success = "success"
 	failure = "failure"
 	dropped = "dropped"
+
+	action  = "action"
+	drop    = "drop"
+	convert = "convert"
+)
+
+// NonFiniteValuePolicy selects how samples with NaN or infinite values are
+// sent to a remote storage.
+type NonFiniteValuePolicy int
+
+// Possible values for NonFiniteValuePolicy.
+const (
+	// SendNonFinite sends NaN and infinite values unchanged.
+	SendNonFinite NonFiniteValuePolicy = iota
+	// DropNonFinite does not send samples with NaN or infinite values.
+	DropNonFinite
+	// ConvertNonFinite sends NaN as zero and infinite values as the
+	// largest finite value of the same sign.
+	ConvertNonFinite
 )
 
+// String implements flag.Value.
+func (p NonFiniteValuePolicy) String() string {
+	switch p {
+	case SendNonFinite:
+		return "send"
+	case DropNonFinite:
+		return "drop"
+	case ConvertNonFinite:
+		return "convert"
+	}
+	return "<unknown>"
+}
+
+// Set implements flag.Value.
+func (p *NonFiniteValuePolicy) Set(s string) error {
+	switch s {
+	case "send":
+		*p = SendNonFinite
+	case "drop":
+		*p = DropNonFinite
+	case "convert":
+		*p = ConvertNonFinite
+	default:
+		return fmt.Errorf("invalid non-finite value policy: %s", s)
+	}
+	return nil
+}
+
+// RetryPolicy determines how often and how fast sending a batch of samples is
+// retried after the remote storage failed to store it.
+type RetryPolicy struct {
+	// The backoff before the first retry. It doubles with every further
+	// retry.
+	InitialBackoff time.Duration
+	// The upper bound of the backoff.
+	MaxBackoff time.Duration
+	// The maximum number of retries of a batch before its samples are
+	// dropped. Batches are not retried if zero.
+	MaxRetries int
+}
+
+// backoff returns the backoff before the given retry, counted from zero. It is
+// jittered randomly between half and the full exponential backoff so that
+// concurrent sends don't retry in lockstep.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	b := p.InitialBackoff
+	for i := 0; i < retry && b < p.MaxBackoff; i++ {
+		b *= 2
+	}
+	if p.MaxBackoff > 0 && b > p.MaxBackoff {
+		b = p.MaxBackoff
+	}
+	if b <= 0 {
+		return 0
+	}
+	return b/2 + time.Duration(rand.Int63n(int64(b/2)+1))
+}
+
+// QueueOptions are the configurable parameters of a StorageQueueManager.
+type QueueOptions struct {
+	// The maximum number of samples queued to be sent.
+	Capacity int
+	// The maximum number of samples sent in one request. Defaults to
+	// maxSamplesPerSend if zero.
+	BatchSize int
+	// The interval in which partial batches are sent. Defaults to
+	// batchSendDeadline if zero.
+	FlushInterval time.Duration
+	// How batches the remote storage failed to store are retried.
+	Retry RetryPolicy
+	// How long Stop waits for the queued samples to be sent before
+	// abandoning them. Defaults to defaultDrainTimeout if zero.
+	DrainTimeout time.Duration
+}
+
 // StorageClient defines an interface for sending a batch of samples to an
 // external timeseries database.
 type StorageClient interface {
@@ -51,34 +164,87 @@ type StorageClient interface {
 	Name() string
 }
 
+// ReadinessProber is implemented by StorageClients that can check whether
+// their remote storage is ready to receive samples.
+type ReadinessProber interface {
+	// Probe returns an error if the remote storage is not ready.
+	Probe() error
+}
+
 // StorageQueueManager manages a queue of samples to be sent to the Storage
 // indicated by the provided StorageClient.
 type StorageQueueManager struct {
+	// The number of samples queued or being sent. Accessed atomically,
+	// first in the struct for 64-bit alignment.
+	unsent int64
+
 	tsdb           StorageClient
 	queue          chan *model.Sample
 	pendingSamples model.Samples
 	sendSemaphore  chan bool
+	sends          sync.WaitGroup
 	drained        chan bool
+	stopping       chan struct{}
+	// Closed once the drain timeout has passed on shutdown, abandoning
+	// the samples not sent yet.
+	abandon        chan struct{}
+	drainTimeout   time.Duration
+	relabelConfigs []*config.RelabelConfig
+	// If positive, Run waits up to this long for the remote storage
+	// to become ready before sending samples.
+	waitForReady time.Duration
+	// How to handle samples with NaN or infinite values.
+	nonFiniteValues NonFiniteValuePolicy
+	// How to retry batches that failed to be sent.
+	retryPolicy RetryPolicy
+	// Batches are sent once they have batchSize samples or when the
+	// flushInterval has passed, whichever comes first.
+	batchSize     int
+	flushInterval time.Duration
 
 	samplesCount  *prometheus.CounterVec
 	sendLatency   prometheus.Summary
+	sentLatency   prometheus.Histogram
 	failedBatches prometheus.Counter
 	failedSamples prometheus.Counter
+	retries       prometheus.Counter
+	nonFinite     *prometheus.CounterVec
 	queueLength   prometheus.Gauge
 	queueCapacity prometheus.Metric
+	queueUsage    prometheus.Gauge
 }
 
 // NewStorageQueueManager builds a new StorageQueueManager.
-func NewStorageQueueManager(tsdb StorageClient, queueCapacity int) *StorageQueueManager {
+func NewStorageQueueManager(tsdb StorageClient, o QueueOptions) *StorageQueueManager {
 	constLabels := prometheus.Labels{
 		"type": tsdb.Name(),
 	}
 
+	batchSize := o.BatchSize
+	if batchSize <= 0 {
+		batchSize = maxSamplesPerSend
+	}
+	flushInterval := o.FlushInterval
+	if flushInterval <= 0 {
+		flushInterval = batchSendDeadline
+	}
+	drainTimeout := o.DrainTimeout
+	if drainTimeout <= 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+
 	return &StorageQueueManager{
-		tsdb:          tsdb,
-		queue:         make(chan *model.Sample, queueCapacity),
-		sendSemaphore: make(chan bool, maxConcurrentSends),
-		drained:       make(chan bool),
+		tsdb:           tsdb,
+		queue:          make(chan *model.Sample, o.Capacity),
+		pendingSamples: make(model.Samples, 0, batchSize),
+		sendSemaphore:  make(chan bool, maxConcurrentSends),
+		drained:        make(chan bool),
+		stopping:       make(chan struct{}),
+		abandon:        make(chan struct{}),
+		drainTimeout:   drainTimeout,
+		retryPolicy:    o.Retry,
+		batchSize:      batchSize,
+		flushInterval:  flushInterval,
 
 		samplesCount: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
@@ -97,6 +263,13 @@ func NewStorageQueueManager(tsdb StorageClient, queueCapacity int) *StorageQueue
 			Help:        "Latency quantiles for sending sample batches to the remote storage.",
 			ConstLabels: constLabels,
 		}),
+		sentLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        "sent_latency_seconds",
+			Help:        "Histogram of the durations of the requests storing sample batches in the remote storage, including failed ones.",
+			ConstLabels: constLabels,
+		}),
 		failedBatches: prometheus.NewCounter(prometheus.CounterOpts{
 			Namespace:   namespace,
 			Subsystem:   subsystem,
@@ -111,6 +284,23 @@ func NewStorageQueueManager(tsdb StorageClient, queueCapacity int) *StorageQueue
 			Help:        "Total number of samples that encountered an error while being sent to the remote storage.",
 			ConstLabels: constLabels,
 		}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        "retries_total",
+			Help:        "Total number of retries of sample batches that failed to be sent to the remote storage.",
+			ConstLabels: constLabels,
+		}),
+		nonFinite: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   namespace,
+				Subsystem:   subsystem,
+				Name:        "non_finite_samples_total",
+				Help:        "Total number of samples with NaN or infinite values that were dropped or converted before being sent to the remote storage.",
+				ConstLabels: constLabels,
+			},
+			[]string{action},
+		),
 		queueLength: prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace:   namespace,
 			Subsystem:   subsystem,
@@ -126,33 +316,118 @@ func NewStorageQueueManager(tsdb StorageClient, queueCapacity int) *StorageQueue
 				constLabels,
 			),
 			prometheus.GaugeValue,
-			float64(queueCapacity),
+			float64(o.Capacity),
 		),
+		queueUsage: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        "queue_capacity_utilization",
+			Help:        "The fraction of the capacity of the queue of samples to be sent to the remote storage that is in use.",
+			ConstLabels: constLabels,
+		}),
 	}
 }
 
 // Append queues a sample to be sent to the remote storage. It drops the
-// sample on the floor if the queue is full. It implements
-// storage.SampleAppender.
+// sample on the floor if the queue is full, if the write relabeling drops
+// its metric, or if its value is not finite and such samples are dropped. It
+// implements storage.SampleAppender.
 func (t *StorageQueueManager) Append(s *model.Sample) {
+	t.TryAppend(s)
+}
+
+// TryAppend is like Append but returns an error if the queue is full or the
+// write relabeling failed. It implements storage.FallibleAppender.
+func (t *StorageQueueManager) TryAppend(s *model.Sample) error {
+	// Remote storages have no notion of staleness markers.
+	if metric.IsStaleNaN(s.Value) {
+		return nil
+	}
+	if t.nonFiniteValues != SendNonFinite {
+		v := float64(s.Value)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			if t.nonFiniteValues == DropNonFinite {
+				t.nonFinite.WithLabelValues(drop).Inc()
+				return nil
+			}
+			t.nonFinite.WithLabelValues(convert).Inc()
+			s = &model.Sample{
+				Metric:    s.Metric,
+				Value:     model.SampleValue(finiteValue(v)),
+				Timestamp: s.Timestamp,
+			}
+		}
+	}
+
+	if len(t.relabelConfigs) > 0 {
+		labels, err := relabel.Process(model.LabelSet(s.Metric), t.relabelConfigs...)
+		if err != nil {
+			log.Errorf("Error relabeling sample for remote storage %s: %s", t.tsdb.Name(), err)
+			return err
+		}
+		if labels == nil {
+			return nil
+		}
+		s = &model.Sample{
+			Metric:    model.Metric(labels),
+			Value:     s.Value,
+			Timestamp: s.Timestamp,
+		}
+	}
+
+	atomic.AddInt64(&t.unsent, 1)
 	select {
 	case t.queue <- s:
+		return nil
 	default:
+		atomic.AddInt64(&t.unsent, -1)
 		t.samplesCount.WithLabelValues(dropped).Inc()
 		log.Warn("Remote storage queue full, discarding sample.")
+		return errQueueFull
 	}
 }
 
-// Stop stops sending samples to the remote storage and waits for pending
-// sends to complete.
+// finiteValue returns zero for NaN and the largest finite value of the same
+// sign for infinite values.
+func finiteValue(v float64) float64 {
+	switch {
+	case math.IsNaN(v):
+		return 0
+	case math.IsInf(v, 1):
+		return math.MaxFloat64
+	case math.IsInf(v, -1):
+		return -math.MaxFloat64
+	}
+	return v
+}
+
+// Stop stops accepting samples and waits up to the drain timeout for the
+// queued samples to be sent to the remote storage, including retries of
+// failed batches. The samples not sent by then are abandoned and counted as
+// dropped. Sends in progress are not waited for in that case. No samples must
+// be appended after calling Stop.
 func (t *StorageQueueManager) Stop() {
 	log.Infof("Stopping remote storage...")
+	close(t.stopping)
 	close(t.queue)
-	<-t.drained
-	for i := 0; i < maxConcurrentSends; i++ {
-		t.sendSemaphore <- true
+
+	done := make(chan struct{})
+	go func() {
+		<-t.drained
+		t.sends.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Info("Remote storage stopped.")
+	case <-time.After(t.drainTimeout):
+		close(t.abandon)
+		log.Warnf(
+			"Remote storage %s not drained within %s, abandoning %d unsent samples.",
+			t.tsdb.Name(), t.drainTimeout, atomic.LoadInt64(&t.unsent),
+		)
 	}
-	log.Info("Remote storage stopped.")
 }
 
 // Describe implements prometheus.Collector.
@@ -161,43 +436,82 @@ func (t *StorageQueueManager) Describe(ch chan<- *prometheus.Desc) {
 	t.sendLatency.Describe(ch)
 	ch <- t.failedBatches.Desc()
 	ch <- t.failedSamples.Desc()
+	ch <- t.retries.Desc()
+	t.nonFinite.Describe(ch)
 	ch <- t.queueLength.Desc()
 	ch <- t.queueCapacity.Desc()
+	ch <- t.queueUsage.Desc()
+	ch <- t.sentLatency.Desc()
 }
 
 // Collect implements prometheus.Collector.
 func (t *StorageQueueManager) Collect(ch chan<- prometheus.Metric) {
 	t.samplesCount.Collect(ch)
 	t.sendLatency.Collect(ch)
-	t.queueLength.Set(float64(len(t.queue)))
+	queued := len(t.queue)
+	t.queueLength.Set(float64(queued))
+	if capacity := cap(t.queue); capacity > 0 {
+		t.queueUsage.Set(float64(queued) / float64(capacity))
+	}
 	ch <- t.failedBatches
 	ch <- t.failedSamples
+	ch <- t.retries
+	t.nonFinite.Collect(ch)
 	ch <- t.queueLength
 	ch <- t.queueCapacity
+	ch <- t.queueUsage
+	ch <- t.sentLatency
 }
 
 func (t *StorageQueueManager) sendSamples(s model.Samples) {
-	t.sendSemaphore <- true
+	defer atomic.AddInt64(&t.unsent, -int64(len(s)))
+
+	select {
+	case t.sendSemaphore <- true:
+	case <-t.abandon:
+		t.samplesCount.WithLabelValues(dropped).Add(float64(len(s)))
+		return
+	}
 	defer func() {
 		<-t.sendSemaphore
 	}()
 
 	// Samples are sent to the remote storage on a best-effort basis. If a
-	// sample isn't sent correctly the first time, it's simply dropped on the
-	// floor.
-	begin := time.Now()
-	err := t.tsdb.Store(s)
-	duration := time.Since(begin) / time.Second
+	// batch isn't sent correctly, it is retried according to the retry
+	// policy, and its samples are dropped on the floor once the retries are
+	// exhausted. As the remote storages don't tell transient from permanent
+	// errors, every error is retried. Retrying is abandoned once the drain
+	// timeout has passed on shutdown.
+retries:
+	for retry := 0; ; retry++ {
+		begin := time.Now()
+		err := t.tsdb.Store(s)
+		duration := time.Since(begin).Seconds()
+		t.sendLatency.Observe(duration)
+		t.sentLatency.Observe(duration)
+
+		if err == nil {
+			t.samplesCount.WithLabelValues(success).Add(float64(len(s)))
+			return
+		}
+		if retry >= t.retryPolicy.MaxRetries {
+			log.Warnf("error sending %d samples to remote storage: %s", len(s), err)
+			break
+		}
 
-	labelValue := success
-	if err != nil {
-		log.Warnf("error sending %d samples to remote storage: %s", len(s), err)
-		labelValue = failure
-		t.failedBatches.Inc()
-		t.failedSamples.Add(float64(len(s)))
+		backoff := t.retryPolicy.backoff(retry)
+		log.Warnf("error sending %d samples to remote storage, retrying in %v: %s", len(s), backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-t.abandon:
+			log.Warnf("not retrying to send %d samples to remote storage on shutdown", len(s))
+			break retries
+		}
+		t.retries.Inc()
 	}
-	t.samplesCount.WithLabelValues(labelValue).Add(float64(len(s)))
-	t.sendLatency.Observe(float64(duration))
+	t.failedBatches.Inc()
+	t.failedSamples.Add(float64(len(s)))
+	t.samplesCount.WithLabelValues(failure).Add(float64(len(s)))
 }
 
 // Run continuously sends samples to the remote storage.
@@ -206,9 +520,17 @@ func (t *StorageQueueManager) Run() {
 		close(t.drained)
 	}()
 
-	// Send batches of at most maxSamplesPerSend samples to the remote storage.
-	// If we have fewer samples than that, flush them out after a deadline
-	// anyways.
+	if t.waitForReady > 0 {
+		t.awaitReady()
+	}
+
+	// Send batches of at most batchSize samples to the remote storage. If
+	// we have fewer samples than that, flush them out every flushInterval
+	// anyways, so that partial batches are not held indefinitely at low
+	// sample rates.
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case s, ok := <-t.queue:
@@ -221,20 +543,55 @@ func (t *StorageQueueManager) Run() {
 
 			t.pendingSamples = append(t.pendingSamples, s)
 
-			for len(t.pendingSamples) >= maxSamplesPerSend {
-				go t.sendSamples(t.pendingSamples[:maxSamplesPerSend])
-				t.pendingSamples = t.pendingSamples[maxSamplesPerSend:]
+			if len(t.pendingSamples) >= t.batchSize {
+				t.flush()
 			}
-		case <-time.After(batchSendDeadline):
+		case <-ticker.C:
 			t.flush()
 		}
 	}
 }
 
+// awaitReady probes the remote storage until it is ready, waitForReady has
+// passed, or the queue manager is stopped. Appended samples are queued up to
+// the queue capacity in the meantime.
+func (t *StorageQueueManager) awaitReady() {
+	p, ok := t.tsdb.(ReadinessProber)
+	if !ok {
+		log.Warnf("Remote storage %s does not support readiness probes, not waiting for it", t.tsdb.Name())
+		return
+	}
+
+	deadline := time.After(t.waitForReady)
+	for {
+		err := p.Probe()
+		if err == nil {
+			return
+		}
+		log.Infof("Remote storage %s not ready yet: %s", t.tsdb.Name(), err)
+
+		select {
+		case <-time.After(readyProbeInterval):
+		case <-deadline:
+			log.Errorf("Remote storage %s did not become ready within %s, sending samples anyway: %s", t.tsdb.Name(), t.waitForReady, err)
+			return
+		case <-t.stopping:
+			return
+		}
+	}
+}
+
 // Flush flushes remaining queued samples.
 func (t *StorageQueueManager) flush() {
-	if len(t.pendingSamples) > 0 {
-		go t.sendSamples(t.pendingSamples)
+	if len(t.pendingSamples) == 0 {
+		return
 	}
-	t.pendingSamples = t.pendingSamples[:0]
+	t.sends.Add(1)
+	go func(s model.Samples) {
+		t.sendSamples(s)
+		t.sends.Done()
+	}(t.pendingSamples)
+	// The sent samples are still in use, so the next batch needs a new
+	// backing array.
+	t.pendingSamples = make(model.Samples, 0, t.batchSize)
 }
@@ -14,9 +14,15 @@
 package remote
 
 import (
+	"errors"
+	"math"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
 )
 
@@ -67,7 +73,7 @@ func TestSampleDelivery(t *testing.T) {
 
 	c := &TestStorageClient{}
 	c.expectSamples(samples[:len(samples)/2])
-	m := NewStorageQueueManager(c, len(samples)/2)
+	m := NewStorageQueueManager(c, QueueOptions{Capacity: len(samples) / 2})
 
 	// These should be received by the client.
 	for _, s := range samples[:len(samples)/2] {
@@ -82,3 +88,501 @@ func TestSampleDelivery(t *testing.T) {
 
 	c.waitForExpectedSamples(t)
 }
+
+type TestReadinessStorageClient struct {
+	TestStorageClient
+	mtx      sync.Mutex
+	ready    bool
+	received int
+}
+
+func (c *TestReadinessStorageClient) Probe() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if !c.ready {
+		return errors.New("not ready")
+	}
+	return nil
+}
+
+func (c *TestReadinessStorageClient) setReady() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.ready = true
+}
+
+func (c *TestReadinessStorageClient) Store(s model.Samples) error {
+	c.mtx.Lock()
+	c.received += len(s)
+	c.mtx.Unlock()
+	return c.TestStorageClient.Store(s)
+}
+
+func (c *TestReadinessStorageClient) numReceived() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.received
+}
+
+func TestSampleDeliveryWaitsForReady(t *testing.T) {
+	defer func(d time.Duration) { readyProbeInterval = d }(readyProbeInterval)
+	readyProbeInterval = 10 * time.Millisecond
+
+	samples := make(model.Samples, 0, maxSamplesPerSend)
+	for i := 0; i < maxSamplesPerSend; i++ {
+		samples = append(samples, &model.Sample{
+			Metric: model.Metric{
+				model.MetricNameLabel: "test_metric",
+			},
+			Value: model.SampleValue(i),
+		})
+	}
+
+	c := &TestReadinessStorageClient{}
+	c.expectSamples(samples)
+	m := NewStorageQueueManager(c, QueueOptions{Capacity: len(samples)})
+	m.waitForReady = time.Minute
+
+	go m.Run()
+	defer m.Stop()
+
+	// Appending must not block while the remote storage is not ready.
+	for _, s := range samples {
+		m.Append(s)
+	}
+
+	time.Sleep(5 * readyProbeInterval)
+	if n := c.numReceived(); n != 0 {
+		t.Fatalf("expected no samples to be sent before the remote storage is ready, got %d", n)
+	}
+
+	c.setReady()
+	c.waitForExpectedSamples(t)
+}
+
+func TestSampleDeliveryWaitForReadyTimeout(t *testing.T) {
+	defer func(d time.Duration) { readyProbeInterval = d }(readyProbeInterval)
+	readyProbeInterval = 10 * time.Millisecond
+
+	samples := make(model.Samples, 0, maxSamplesPerSend)
+	for i := 0; i < maxSamplesPerSend; i++ {
+		samples = append(samples, &model.Sample{
+			Metric: model.Metric{
+				model.MetricNameLabel: "test_metric",
+			},
+			Value: model.SampleValue(i),
+		})
+	}
+
+	c := &TestReadinessStorageClient{}
+	c.expectSamples(samples)
+	m := NewStorageQueueManager(c, QueueOptions{Capacity: len(samples)})
+	m.waitForReady = 50 * time.Millisecond
+
+	for _, s := range samples {
+		m.Append(s)
+	}
+	go m.Run()
+	defer m.Stop()
+
+	// The remote storage never becomes ready, but samples are sent once
+	// waiting has timed out.
+	c.waitForExpectedSamples(t)
+}
+
+func TestSampleDeliveryNonFiniteValues(t *testing.T) {
+	nonFinite := []float64{math.NaN(), math.Inf(1), math.Inf(-1)}
+
+	// The samples sent make up exactly one full batch so that they are
+	// sent right away.
+	var scenarios = []struct {
+		policy    NonFiniteValuePolicy
+		action    string
+		converted []float64
+	}{
+		{
+			policy: DropNonFinite,
+			action: drop,
+		},
+		{
+			policy:    ConvertNonFinite,
+			action:    convert,
+			converted: []float64{0, math.MaxFloat64, -math.MaxFloat64},
+		},
+	}
+
+	for i, s := range scenarios {
+		var input, expected model.Samples
+		for _, v := range nonFinite {
+			input = append(input, &model.Sample{
+				Metric: model.Metric{model.MetricNameLabel: "test_metric"},
+				Value:  model.SampleValue(v),
+			})
+		}
+		for _, v := range s.converted {
+			expected = append(expected, &model.Sample{
+				Metric: model.Metric{model.MetricNameLabel: "test_metric"},
+				Value:  model.SampleValue(v),
+			})
+		}
+		for j := len(expected); j < maxSamplesPerSend; j++ {
+			sample := &model.Sample{
+				Metric: model.Metric{model.MetricNameLabel: "test_metric"},
+				Value:  model.SampleValue(j),
+			}
+			input = append(input, sample)
+			expected = append(expected, sample)
+		}
+
+		c := &TestStorageClient{}
+		c.expectSamples(expected)
+		m := NewStorageQueueManager(c, QueueOptions{Capacity: len(input)})
+		m.nonFiniteValues = s.policy
+
+		for _, sample := range input {
+			m.Append(sample)
+		}
+		go m.Run()
+
+		c.waitForExpectedSamples(t)
+		m.Stop()
+
+		var metric dto.Metric
+		if err := m.nonFinite.WithLabelValues(s.action).Write(&metric); err != nil {
+			t.Fatal(err)
+		}
+		if got := metric.GetCounter().GetValue(); got != float64(len(nonFinite)) {
+			t.Errorf("%d. expected %d non-finite samples counted, got %v", i, len(nonFinite), got)
+		}
+	}
+
+	var p NonFiniteValuePolicy
+	if err := p.Set("convert"); err != nil || p != ConvertNonFinite {
+		t.Errorf("expected policy %v, got %v (error %v)", ConvertNonFinite, p, err)
+	}
+	if err := p.Set("ignore"); err == nil {
+		t.Error("expected error for invalid policy")
+	}
+}
+
+type TestFailingStorageClient struct {
+	TestStorageClient
+	mtx      sync.Mutex
+	failures int
+	attempts int
+}
+
+func (c *TestFailingStorageClient) Store(s model.Samples) error {
+	c.mtx.Lock()
+	c.attempts++
+	if c.failures > 0 {
+		c.failures--
+		c.mtx.Unlock()
+		return errors.New("temporarily unavailable")
+	}
+	c.mtx.Unlock()
+	return c.TestStorageClient.Store(s)
+}
+
+func TestSampleDeliveryRetry(t *testing.T) {
+	samples := make(model.Samples, 0, maxSamplesPerSend)
+	for i := 0; i < maxSamplesPerSend; i++ {
+		samples = append(samples, &model.Sample{
+			Metric: model.Metric{
+				model.MetricNameLabel: "test_metric",
+			},
+			Value: model.SampleValue(i),
+		})
+	}
+
+	c := &TestFailingStorageClient{failures: 2}
+	c.expectSamples(samples)
+	m := NewStorageQueueManager(c, QueueOptions{
+		Capacity: len(samples),
+		Retry: RetryPolicy{
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     5 * time.Millisecond,
+			MaxRetries:     3,
+		},
+	})
+
+	for _, s := range samples {
+		m.Append(s)
+	}
+	go m.Run()
+	defer m.Stop()
+
+	c.waitForExpectedSamples(t)
+
+	var metric dto.Metric
+	m.retries.Write(&metric)
+	if got := metric.GetCounter().GetValue(); got != 2 {
+		t.Errorf("expected 2 retries, got %v", got)
+	}
+	m.failedSamples.Write(&metric)
+	if got := metric.GetCounter().GetValue(); got != 0 {
+		t.Errorf("expected no failed samples, got %v", got)
+	}
+}
+
+func TestSampleDeliveryRetriesExhausted(t *testing.T) {
+	samples := make(model.Samples, 0, maxSamplesPerSend)
+	for i := 0; i < maxSamplesPerSend; i++ {
+		samples = append(samples, &model.Sample{
+			Metric: model.Metric{
+				model.MetricNameLabel: "test_metric",
+			},
+			Value: model.SampleValue(i),
+		})
+	}
+
+	c := &TestFailingStorageClient{failures: 10}
+	m := NewStorageQueueManager(c, QueueOptions{
+		Capacity: len(samples),
+		Retry: RetryPolicy{
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     5 * time.Millisecond,
+			MaxRetries:     2,
+		},
+	})
+
+	m.sendSamples(samples)
+
+	if c.attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", c.attempts)
+	}
+	var metric dto.Metric
+	m.retries.Write(&metric)
+	if got := metric.GetCounter().GetValue(); got != 2 {
+		t.Errorf("expected 2 retries, got %v", got)
+	}
+	m.failedSamples.Write(&metric)
+	if got := metric.GetCounter().GetValue(); got != float64(len(samples)) {
+		t.Errorf("expected %d failed samples, got %v", len(samples), got)
+	}
+}
+
+func TestStopDrainsQueue(t *testing.T) {
+	samples := make(model.Samples, 0, 25)
+	for i := 0; i < 25; i++ {
+		samples = append(samples, &model.Sample{
+			Metric: model.Metric{
+				model.MetricNameLabel: "test_metric",
+			},
+			Value: model.SampleValue(i),
+		})
+	}
+
+	// The partial batch is only sent on shutdown, and it is retried then.
+	c := &TestFailingStorageClient{failures: 1}
+	c.expectSamples(samples)
+	m := NewStorageQueueManager(c, QueueOptions{
+		Capacity:      len(samples),
+		BatchSize:     len(samples) + 1,
+		FlushInterval: time.Hour,
+		Retry: RetryPolicy{
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     5 * time.Millisecond,
+			MaxRetries:     3,
+		},
+	})
+
+	for _, s := range samples {
+		m.Append(s)
+	}
+	go m.Run()
+	m.Stop()
+
+	c.waitForExpectedSamples(t)
+}
+
+type TestBlockingStorageClient struct {
+	block chan struct{}
+}
+
+func (c *TestBlockingStorageClient) Store(s model.Samples) error {
+	<-c.block
+	return nil
+}
+
+func (c *TestBlockingStorageClient) Name() string {
+	return "testblockingstorageclient"
+}
+
+func TestStopDrainTimeout(t *testing.T) {
+	c := &TestBlockingStorageClient{block: make(chan struct{})}
+	defer close(c.block)
+	m := NewStorageQueueManager(c, QueueOptions{
+		Capacity:     maxConcurrentSends + 5,
+		BatchSize:    1,
+		DrainTimeout: 50 * time.Millisecond,
+	})
+
+	for i := 0; i < maxConcurrentSends+5; i++ {
+		m.Append(&model.Sample{
+			Metric: model.Metric{model.MetricNameLabel: "test_metric"},
+			Value:  model.SampleValue(i),
+		})
+	}
+	go m.Run()
+
+	stopped := make(chan struct{})
+	go func() {
+		m.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return after the drain timeout")
+	}
+
+	// The samples of the batches waiting for a send slot are dropped,
+	// the ones being sent are not waited for.
+	var metric dto.Metric
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m.samplesCount.WithLabelValues(dropped).Write(&metric)
+		if metric.GetCounter().GetValue() == 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 5 dropped samples, got %v", metric.GetCounter().GetValue())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+	}
+	for retry, max := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	} {
+		for i := 0; i < 10; i++ {
+			if b := p.backoff(retry); b < max/2 || b > max {
+				t.Fatalf("retry %d: expected backoff between %v and %v, got %v", retry, max/2, max, b)
+			}
+		}
+	}
+}
+
+type TestBatchStorageClient struct {
+	TestStorageClient
+	mtx     sync.Mutex
+	batches []int
+}
+
+func (c *TestBatchStorageClient) Store(s model.Samples) error {
+	c.mtx.Lock()
+	c.batches = append(c.batches, len(s))
+	err := c.TestStorageClient.Store(s)
+	c.mtx.Unlock()
+	return err
+}
+
+func TestSampleDeliveryBatching(t *testing.T) {
+	samples := make(model.Samples, 0, 25)
+	for i := 0; i < 25; i++ {
+		samples = append(samples, &model.Sample{
+			Metric: model.Metric{
+				model.MetricNameLabel: "test_metric",
+			},
+			Value: model.SampleValue(i),
+		})
+	}
+
+	c := &TestBatchStorageClient{}
+	c.expectSamples(samples)
+	m := NewStorageQueueManager(c, QueueOptions{
+		Capacity:      len(samples),
+		BatchSize:     10,
+		FlushInterval: 50 * time.Millisecond,
+	})
+
+	for _, s := range samples {
+		m.Append(s)
+	}
+	go m.Run()
+	defer m.Stop()
+
+	// Full batches are sent right away, the partial one after the flush
+	// interval although no further samples are appended.
+	c.wg.Wait()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	sizes := map[int]int{}
+	for _, b := range c.batches {
+		sizes[b]++
+	}
+	if len(c.batches) != 3 || sizes[10] != 2 || sizes[5] != 1 {
+		t.Fatalf("expected batches of 10, 10, and 5 samples, got %v", c.batches)
+	}
+}
+
+func TestQueueMetrics(t *testing.T) {
+	c := &TestBatchStorageClient{}
+	m := NewStorageQueueManager(c, QueueOptions{Capacity: 10, BatchSize: 2})
+
+	for i := 0; i < 4; i++ {
+		m.Append(&model.Sample{
+			Metric: model.Metric{model.MetricNameLabel: "test_metric"},
+			Value:  model.SampleValue(i),
+		})
+	}
+
+	collect := func() map[string]*dto.Metric {
+		ch := make(chan prometheus.Metric)
+		go func() {
+			m.Collect(ch)
+			close(ch)
+		}()
+		metrics := map[string]*dto.Metric{}
+		for met := range ch {
+			var pb dto.Metric
+			if err := met.Write(&pb); err != nil {
+				t.Fatal(err)
+			}
+			metrics[met.Desc().String()] = &pb
+		}
+		return metrics
+	}
+	find := func(metrics map[string]*dto.Metric, name string) *dto.Metric {
+		for desc, met := range metrics {
+			if strings.Contains(desc, `"`+name+`"`) {
+				return met
+			}
+		}
+		t.Fatalf("metric %s not collected", name)
+		return nil
+	}
+
+	before := collect()
+	if got := find(before, "prometheus_remote_storage_queue_length").GetGauge().GetValue(); got != 4 {
+		t.Errorf("expected queue length 4, got %v", got)
+	}
+	if got := find(before, "prometheus_remote_storage_queue_capacity_utilization").GetGauge().GetValue(); got != 0.4 {
+		t.Errorf("expected queue capacity utilization 0.4, got %v", got)
+	}
+
+	c.expectSamples(make(model.Samples, 4))
+	go m.Run()
+	c.wg.Wait()
+	m.Stop()
+
+	after := collect()
+	if got := find(after, "prometheus_remote_storage_queue_capacity_utilization").GetGauge().GetValue(); got != 0 {
+		t.Errorf("expected queue capacity utilization 0, got %v", got)
+	}
+	if got := find(after, "prometheus_remote_storage_sent_latency_seconds").GetHistogram().GetSampleCount(); got != 2 {
+		t.Errorf("expected 2 observed store latencies, got %v", got)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// A Factory creates a client for the remote storage at the given URL. The
+// options hold the settings of the remote storages, e.g. the timeout of
+// requests and the TLS and authentication settings of HTTP clients.
+type Factory func(url string, o *Options) (StorageClient, error)
+
+var (
+	factoriesMtx sync.RWMutex
+	factories    = map[string]Factory{}
+)
+
+func init() {
+	Register("graphite", func(address string, o *Options) (StorageClient, error) {
+		return newGraphiteClient(address, o), nil
+	})
+	Register("influxdb", func(u string, o *Options) (StorageClient, error) {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, err
+		}
+		return newInfluxdbClient(parsed, o), nil
+	})
+	Register("opentsdb", func(u string, o *Options) (StorageClient, error) {
+		return newOpentsdbClient(u, o), nil
+	})
+}
+
+// Register makes a remote storage available under the given name, which
+// must be the name returned by its clients' Name methods. It is meant to be
+// called from init functions and panics if a remote storage of the same name
+// is registered already or if the factory is nil.
+func Register(name string, factory Factory) {
+	factoriesMtx.Lock()
+	defer factoriesMtx.Unlock()
+
+	if factory == nil {
+		panic(fmt.Sprintf("remote: nil factory for remote storage %q", name))
+	}
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("remote: remote storage %q registered twice", name))
+	}
+	factories[name] = factory
+}
+
+// NewClient creates a client for the remote storage registered under the
+// given name, configured with the given options.
+func NewClient(name, url string, o *Options) (StorageClient, error) {
+	factoriesMtx.RLock()
+	factory, ok := factories[name]
+	factoriesMtx.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown remote storage %q", name)
+	}
+	return factory(url, o)
+}
+
+// Names returns the sorted names of the registered remote storages.
+func Names() []string {
+	factoriesMtx.RLock()
+	defer factoriesMtx.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// registered returns whether a remote storage is registered under the given
+// name.
+func registered(name string) bool {
+	factoriesMtx.RLock()
+	defer factoriesMtx.RUnlock()
+
+	_, ok := factories[name]
+	return ok
+}
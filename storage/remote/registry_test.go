@@ -0,0 +1,130 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/util/httputil"
+)
+
+func TestRegistry(t *testing.T) {
+	var gotURL string
+	var gotOptions *Options
+	Register("teststorageclient", func(url string, o *Options) (StorageClient, error) {
+		gotURL, gotOptions = url, o
+		return &TestStorageClient{}, nil
+	})
+	defer func() {
+		factoriesMtx.Lock()
+		delete(factories, "teststorageclient")
+		factoriesMtx.Unlock()
+	}()
+
+	expected := []string{"graphite", "influxdb", "opentsdb", "teststorageclient"}
+	if names := Names(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected registered remote storages %v, got %v", expected, names)
+	}
+
+	o := &Options{StorageTimeout: time.Second}
+	c, err := NewClient("teststorageclient", "http://example.com", o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.(*TestStorageClient); !ok {
+		t.Errorf("expected client of type %T, got %T", &TestStorageClient{}, c)
+	}
+	if gotURL != "http://example.com" || gotOptions != o {
+		t.Errorf("unexpected factory arguments %q, %v", gotURL, gotOptions)
+	}
+
+	if _, err := NewClient("unknown", "http://example.com", o); err == nil {
+		t.Error("expected error creating client of unknown remote storage")
+	}
+
+	// The built-in remote storages are registered under their clients' names.
+	for _, name := range []string{"graphite", "influxdb", "opentsdb"} {
+		c, err := NewClient(name, "http://example.com", o)
+		if err != nil {
+			t.Fatalf("error creating %s client: %s", name, err)
+		}
+		if c.Name() != name {
+			t.Errorf("expected %s client, got %s", name, c.Name())
+		}
+	}
+
+	// Registering the same name twice panics.
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a remote storage twice to panic")
+		}
+	}()
+	Register("teststorageclient", func(string, *Options) (StorageClient, error) {
+		return nil, nil
+	})
+}
+
+func TestRegistryOptions(t *testing.T) {
+	var gotQuery, gotUser string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.RawQuery
+		gotUser, _, _ = r.BasicAuth()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	o := &Options{
+		StorageTimeout:          time.Second,
+		InfluxdbDatabase:        "testdb",
+		InfluxdbRetentionPolicy: "testrp",
+		HTTPClient:              httputil.ClientOptions{BasicAuthUsername: "user"},
+	}
+	c, err := NewClient("influxdb", server.URL, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Store(model.Samples{{Metric: model.Metric{model.MetricNameLabel: "test"}, Value: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "db=testdb&rp=testrp"; gotQuery != expected {
+		t.Errorf("expected query %q, got %q", expected, gotQuery)
+	}
+	if gotUser != "user" {
+		t.Errorf("expected basic auth user %q, got %q", "user", gotUser)
+	}
+}
+
+func TestNewWithLegacyAndRegisteredClients(t *testing.T) {
+	o := &Options{
+		StorageTimeout: time.Second,
+		OpentsdbURL:    "http://localhost:4242",
+	}
+	c, err := NewClient("opentsdb", "http://localhost:4243", o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Clients = []StorageClient{c}
+
+	// Creating a legacy and a registered client of the same remote storage
+	// must not register their metrics twice.
+	if s := New(o); len(s.queues) != 2 {
+		t.Errorf("expected 2 queues, got %d", len(s.queues))
+	}
+}
@@ -14,6 +14,8 @@
 package remote
 
 import (
+	"fmt"
+	"io/ioutil"
 	"net/url"
 	"sync"
 	"time"
@@ -22,11 +24,14 @@ import (
 	"github.com/prometheus/common/model"
 
 	influx "github.com/influxdb/influxdb/client"
+	"gopkg.in/yaml.v2"
 
 	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/storage/remote/graphite"
 	"github.com/prometheus/prometheus/storage/remote/influxdb"
 	"github.com/prometheus/prometheus/storage/remote/opentsdb"
+	"github.com/prometheus/prometheus/util/httputil"
 )
 
 // Storage collects multiple remote storage queues.
@@ -50,25 +55,19 @@ func (s *Storage) ApplyConfig(conf *config.Config) bool {
 func New(o *Options) *Storage {
 	s := &Storage{}
 	if o.GraphiteAddress != "" {
-		c := graphite.NewClient(
-			o.GraphiteAddress, o.GraphiteTransport,
-			o.StorageTimeout, o.GraphitePrefix)
-		s.queues = append(s.queues, NewStorageQueueManager(c, 100*1024))
+		s.addQueue(newGraphiteClient(o.GraphiteAddress, o), o)
 	}
 	if o.OpentsdbURL != "" {
-		c := opentsdb.NewClient(o.OpentsdbURL, o.StorageTimeout)
-		s.queues = append(s.queues, NewStorageQueueManager(c, 100*1024))
+		s.addQueue(newOpentsdbClient(o.OpentsdbURL, o), o)
 	}
 	if o.InfluxdbURL != nil {
-		conf := influx.Config{
-			URL:      *o.InfluxdbURL,
-			Username: o.InfluxdbUsername,
-			Password: o.InfluxdbPassword,
-			Timeout:  o.StorageTimeout,
+		s.addQueue(newInfluxdbClient(o.InfluxdbURL, o), o)
+	}
+	for _, c := range o.Clients {
+		if col, ok := c.(prometheus.Collector); ok {
+			prometheus.MustRegister(col)
 		}
-		c := influxdb.NewClient(conf, o.InfluxdbDatabase, o.InfluxdbRetentionPolicy)
-		prometheus.MustRegister(c)
-		s.queues = append(s.queues, NewStorageQueueManager(c, 100*1024))
+		s.addQueue(c, o)
 	}
 	if len(s.queues) == 0 {
 		return nil
@@ -76,6 +75,74 @@ func New(o *Options) *Storage {
 	return s
 }
 
+// NewReader returns a reader of the remote storage to query in addition to the
+// local storage, or nil if none is configured. Currently, only reading from
+// InfluxDB is supported.
+func NewReader(o *Options) storage.Reader {
+	if o.ReadURL == nil {
+		return nil
+	}
+	return newInfluxdbClient(o.ReadURL, o)
+}
+
+// newGraphiteClient creates a client for the Graphite server at the given
+// address with the Graphite settings of the options.
+func newGraphiteClient(address string, o *Options) *graphite.Client {
+	return graphite.NewClient(address, o.GraphiteTransport, o.StorageTimeout, o.GraphitePrefix)
+}
+
+// newOpentsdbClient creates a client for the OpenTSDB server at the given URL
+// with the OpenTSDB and HTTP client settings of the options.
+func newOpentsdbClient(u string, o *Options) *opentsdb.Client {
+	httpOpts := o.HTTPClient
+	httpOpts.ProxyURL = o.OpentsdbProxyURL
+	return opentsdb.NewClient(u, o.StorageTimeout, o.Opentsdb, httpOpts)
+}
+
+// newInfluxdbClient creates a client for the InfluxDB server at the given URL
+// with the InfluxDB and HTTP client settings of the options.
+func newInfluxdbClient(u *url.URL, o *Options) *influxdb.Client {
+	conf := influx.Config{
+		URL:      *u,
+		Username: o.InfluxdbUsername,
+		Password: o.InfluxdbPassword,
+		Timeout:  o.StorageTimeout,
+	}
+	httpOpts := o.HTTPClient
+	httpOpts.ProxyURL = o.InfluxdbProxyURL
+	return influxdb.NewClient(conf, o.InfluxdbDatabase, o.InfluxdbRetentionPolicy, o.Influxdb, httpOpts)
+}
+
+// addQueue adds a queue sending to the given client, relabeled with the write
+// relabel configurations configured for the client's remote storage.
+func (s *Storage) addQueue(c StorageClient, o *Options) {
+	q := NewStorageQueueManager(c, o.Queue)
+	q.relabelConfigs = o.WriteRelabelConfigs[c.Name()]
+	q.waitForReady = o.WaitForReady
+	q.nonFiniteValues = o.NonFiniteValues
+	s.queues = append(s.queues, q)
+}
+
+// LoadWriteRelabelConfigs parses the given YAML file into relabel
+// configurations by remote storage name. Samples are relabeled with them
+// before they are sent to the respective remote storage.
+func LoadWriteRelabelConfigs(filename string) (map[string][]*config.RelabelConfig, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	cfgs := map[string][]*config.RelabelConfig{}
+	if err := yaml.Unmarshal(content, &cfgs); err != nil {
+		return nil, err
+	}
+	for name := range cfgs {
+		if !registered(name) {
+			return nil, fmt.Errorf("unknown remote storage %q", name)
+		}
+	}
+	return cfgs, nil
+}
+
 // Options contains configuration parameters for a remote storage.
 type Options struct {
 	StorageTimeout          time.Duration
@@ -84,10 +151,38 @@ type Options struct {
 	InfluxdbUsername        string
 	InfluxdbPassword        string
 	InfluxdbDatabase        string
+	Influxdb                influxdb.Options
 	OpentsdbURL             string
 	GraphiteAddress         string
 	GraphiteTransport       string
 	GraphitePrefix          string
+	Opentsdb                opentsdb.Options
+	// The HTTP proxies to connect to OpenTSDB and InfluxDB through. Taken
+	// from the environment, if nil.
+	OpentsdbProxyURL *url.URL
+	InfluxdbProxyURL *url.URL
+	// ReadURL is the URL of the InfluxDB server queried in addition to
+	// the local storage, with the InfluxDB settings above. Not reading
+	// from remote storage, if nil.
+	ReadURL *url.URL
+	// Clients are the clients of further remote storages, e.g. created
+	// by name with NewClient.
+	Clients []StorageClient
+	// HTTPClient holds the TLS and authentication settings for the
+	// remote storages accessed via HTTP, i.e. OpenTSDB and InfluxDB.
+	HTTPClient httputil.ClientOptions
+	// WaitForReady is how long to wait for the remote storages to
+	// become ready before sending samples to them. Not waiting if zero.
+	WaitForReady time.Duration
+	// WriteRelabelConfigs are applied to samples before sending them to
+	// the remote storage of the respective name.
+	WriteRelabelConfigs map[string][]*config.RelabelConfig
+	// NonFiniteValues determines how samples with NaN or infinite values
+	// are sent.
+	NonFiniteValues NonFiniteValuePolicy
+	// Queue configures the queues of samples to be sent to each remote
+	// storage.
+	Queue QueueOptions
 }
 
 // Run starts the background processing of the storage queues.
@@ -97,15 +192,28 @@ func (s *Storage) Run() {
 	}
 }
 
-// Stop the background processing of the storage queues.
+// Stop the background processing of the storage queues. The queues are
+// drained concurrently, so Stop takes at most as long as the drain timeout.
 func (s *Storage) Stop() {
+	var wg sync.WaitGroup
+	wg.Add(len(s.queues))
 	for _, q := range s.queues {
-		q.Stop()
+		go func(q *StorageQueueManager) {
+			q.Stop()
+			wg.Done()
+		}(q)
 	}
+	wg.Wait()
 }
 
 // Append implements storage.SampleAppender.
 func (s *Storage) Append(smpl *model.Sample) {
+	s.TryAppend(smpl)
+}
+
+// TryAppend implements storage.FallibleAppender. The sample is queued for all
+// remote storages, and the first error of any of them is returned.
+func (s *Storage) TryAppend(smpl *model.Sample) error {
 	s.mtx.RLock()
 
 	var snew model.Sample
@@ -119,9 +227,22 @@ func (s *Storage) Append(smpl *model.Sample) {
 	}
 	s.mtx.RUnlock()
 
+	var err error
+	for _, q := range s.queues {
+		if qErr := q.TryAppend(&snew); qErr != nil && err == nil {
+			err = qErr
+		}
+	}
+	return err
+}
+
+// Clients returns the clients of the configured remote storages.
+func (s *Storage) Clients() []StorageClient {
+	clients := make([]StorageClient, 0, len(s.queues))
 	for _, q := range s.queues {
-		q.Append(&snew)
+		clients = append(clients, q.tsdb)
 	}
+	return clients
 }
 
 // Describe implements prometheus.Collector.
@@ -0,0 +1,181 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+func TestWriteRelabeling(t *testing.T) {
+	c := &TestStorageClient{}
+	q := NewStorageQueueManager(c, QueueOptions{Capacity: 10})
+	q.relabelConfigs = []*config.RelabelConfig{
+		{
+			SourceLabels: model.LabelNames{model.MetricNameLabel},
+			Regex:        config.MustNewRegexp("local_only"),
+			Action:       config.RelabelDrop,
+		},
+		{
+			SourceLabels: model.LabelNames{"job"},
+			Regex:        config.MustNewRegexp("(.*)"),
+			TargetLabel:  "remote_job",
+			Replacement:  "$1",
+			Action:       config.RelabelReplace,
+		},
+		{
+			Regex:  config.MustNewRegexp("job"),
+			Action: config.RelabelLabelDrop,
+		},
+	}
+	remoteStorage := &Storage{queues: []*StorageQueueManager{q}}
+
+	localStorage, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+
+	appender := storage.Fanout{
+		{Name: "local", Appender: localStorage},
+		{Name: "remote", Appender: remoteStorage},
+	}
+	appender.Append(&model.Sample{
+		Metric:    model.Metric{model.MetricNameLabel: "local_only", "job": "a"},
+		Value:     1,
+		Timestamp: 1,
+	})
+	appender.Append(&model.Sample{
+		Metric:    model.Metric{model.MetricNameLabel: "everywhere", "job": "a"},
+		Value:     2,
+		Timestamp: 2,
+	})
+	c.expectSamples(model.Samples{
+		{
+			Metric:    model.Metric{model.MetricNameLabel: "everywhere", "remote_job": "a"},
+			Value:     2,
+			Timestamp: 2,
+		},
+	})
+
+	go remoteStorage.Run()
+	c.waitForExpectedSamples(t)
+	remoteStorage.Stop()
+
+	if len(c.receivedSamples) != 1 {
+		t.Fatalf("expected 1 sample sent to remote storage, got %d", len(c.receivedSamples))
+	}
+
+	localStorage.WaitForIndexing()
+	for _, name := range []model.LabelValue{"local_only", "everywhere"} {
+		m, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := localStorage.MetricsForLabelMatchers(m); len(got) != 1 {
+			t.Errorf("expected series %s to be stored locally, got %v", name, got)
+		}
+	}
+}
+
+func TestExternalLabels(t *testing.T) {
+	c := &TestStorageClient{}
+	q := NewStorageQueueManager(c, QueueOptions{Capacity: 10, BatchSize: 2})
+	remoteStorage := &Storage{queues: []*StorageQueueManager{q}}
+	remoteStorage.ApplyConfig(&config.Config{
+		GlobalConfig: config.GlobalConfig{
+			ExternalLabels: model.LabelSet{"monitor": "a", "replica": "1"},
+		},
+	})
+
+	samples := model.Samples{
+		{
+			Metric:    model.Metric{model.MetricNameLabel: "test_metric"},
+			Value:     1,
+			Timestamp: 1,
+		},
+		{
+			// Labels of the series take precedence over external labels.
+			Metric:    model.Metric{model.MetricNameLabel: "test_metric", "replica": "2"},
+			Value:     2,
+			Timestamp: 2,
+		},
+	}
+	c.expectSamples(make(model.Samples, len(samples)))
+	for _, s := range samples {
+		remoteStorage.Append(s)
+	}
+
+	go remoteStorage.Run()
+	c.wg.Wait()
+	remoteStorage.Stop()
+
+	expected := map[model.Time]model.Metric{
+		1: {model.MetricNameLabel: "test_metric", "monitor": "a", "replica": "1"},
+		2: {model.MetricNameLabel: "test_metric", "monitor": "a", "replica": "2"},
+	}
+	for _, s := range c.receivedSamples {
+		if !s.Metric.Equal(expected[s.Timestamp]) {
+			t.Errorf("expected sample at %v to have metric %v, got %v", s.Timestamp, expected[s.Timestamp], s.Metric)
+		}
+	}
+	// The appended samples are left untouched for other appenders.
+	if _, ok := samples[0].Metric["monitor"]; ok {
+		t.Errorf("expected appended sample not to be modified, got %v", samples[0].Metric)
+	}
+}
+
+func TestLoadWriteRelabelConfigs(t *testing.T) {
+	f, err := ioutil.TempFile("", "write_relabel_configs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(`
+graphite:
+- source_labels: [__name__]
+  regex: expensive_.*
+  action: drop
+opentsdb:
+- regex: instance
+  action: labeldrop
+`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	cfgs, err := LoadWriteRelabelConfigs(f.Name())
+	if err != nil {
+		t.Fatalf("error loading write relabel configs: %s", err)
+	}
+	if len(cfgs["graphite"]) != 1 || cfgs["graphite"][0].Action != config.RelabelDrop {
+		t.Errorf("unexpected graphite relabel configs: %v", cfgs["graphite"])
+	}
+	if len(cfgs["opentsdb"]) != 1 || cfgs["opentsdb"][0].Action != config.RelabelLabelDrop {
+		t.Errorf("unexpected opentsdb relabel configs: %v", cfgs["opentsdb"])
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte("unknown: []\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadWriteRelabelConfigs(f.Name()); err == nil {
+		t.Error("expected error for unknown remote storage")
+	}
+}
@@ -14,24 +14,130 @@
 package storage
 
 import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+var fanoutAppendErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "prometheus",
+		Subsystem: "storage",
+		Name:      "fanout_append_errors_total",
+		Help:      "Total number of samples that could not be appended to a branch of a fan-out, by branch.",
+	},
+	[]string{"branch"},
 )
 
+func init() {
+	prometheus.MustRegister(fanoutAppendErrors)
+}
+
 // SampleAppender is the interface to append samples to both, local and remote
 // storage.
 type SampleAppender interface {
 	Append(*model.Sample)
 }
 
-// Fanout is a SampleAppender that appends every sample to each SampleAppender
-// in its list.
-type Fanout []SampleAppender
+// A FallibleAppender is a SampleAppender that can report samples it could not
+// append, e.g. because a queue was full.
+type FallibleAppender interface {
+	SampleAppender
+	// TryAppend appends the sample like Append but returns an error if it
+	// could not be appended.
+	TryAppend(*model.Sample) error
+}
+
+// TryAppend appends the sample to app and returns the error of appending it if
+// app is a FallibleAppender. Otherwise, it always returns nil.
+func TryAppend(app SampleAppender, s *model.Sample) error {
+	if fa, ok := app.(FallibleAppender); ok {
+		return fa.TryAppend(s)
+	}
+	app.Append(s)
+	return nil
+}
+
+// A Reader reads the series matching a set of label matchers within a time
+// range, e.g. from a remote storage holding data beyond the local retention.
+type Reader interface {
+	// Read returns the samples between from and through, inclusive, of
+	// all series matching all of the given label matchers.
+	Read(from, through model.Time, matchers metric.LabelMatchers) (model.Matrix, error)
+}
+
+// FanoutPolicy determines how a branch of a Fanout failing to append a sample
+// affects the append to the Fanout as a whole.
+type FanoutPolicy int
+
+// Possible values for FanoutPolicy.
+const (
+	// Required branches fail the append to the Fanout if they fail.
+	Required FanoutPolicy = iota
+	// BestEffort branches only have their failures counted.
+	BestEffort
+)
+
+// String implements flag.Value.
+func (p FanoutPolicy) String() string {
+	switch p {
+	case Required:
+		return "required"
+	case BestEffort:
+		return "best-effort"
+	}
+	return "<unknown>"
+}
+
+// Set implements flag.Value.
+func (p *FanoutPolicy) Set(s string) error {
+	switch s {
+	case "required":
+		*p = Required
+	case "best-effort":
+		*p = BestEffort
+	default:
+		return fmt.Errorf("invalid fan-out policy: %s", s)
+	}
+	return nil
+}
+
+// FanoutBranch is a SampleAppender in a Fanout.
+type FanoutBranch struct {
+	// Name identifies the branch in logs and metrics.
+	Name     string
+	Appender SampleAppender
+	Policy   FanoutPolicy
+}
+
+// Fanout is a SampleAppender that appends every sample to each of its
+// branches.
+type Fanout []FanoutBranch
 
 // Append implements SampleAppender. It appends the provided sample to all
-// SampleAppenders in the Fanout slice and waits for each append to complete
-// before proceeding with the next.
+// branches of the Fanout like TryAppend, but failures of required branches
+// are only counted. Use TryAppend to have them reported.
 func (f Fanout) Append(s *model.Sample) {
-	for _, a := range f {
-		a.Append(s)
+	f.TryAppend(s)
+}
+
+// TryAppend implements FallibleAppender. It appends the provided sample to all
+// branches of the Fanout in their order and waits for each append to complete
+// before proceeding with the next. Every branch is appended to independently
+// of the others failing. Failures are counted per branch, and the first
+// failure of a required branch is returned.
+func (f Fanout) TryAppend(s *model.Sample) error {
+	var reqErr error
+	for _, b := range f {
+		if err := TryAppend(b.Appender, s); err != nil {
+			fanoutAppendErrors.WithLabelValues(b.Name).Inc()
+			if b.Policy == Required && reqErr == nil {
+				reqErr = fmt.Errorf("error appending sample to %s: %s", b.Name, err)
+			}
+		}
 	}
+	return reqErr
 }
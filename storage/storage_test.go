@@ -0,0 +1,120 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"errors"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+type collectingAppender struct {
+	samples model.Samples
+}
+
+func (a *collectingAppender) Append(s *model.Sample) {
+	a.samples = append(a.samples, s)
+}
+
+type failingAppender struct {
+	appended int
+}
+
+func (a *failingAppender) Append(s *model.Sample) {
+	a.TryAppend(s)
+}
+
+func (a *failingAppender) TryAppend(*model.Sample) error {
+	a.appended++
+	return errors.New("failed")
+}
+
+func fanoutErrors(t *testing.T, branch string) float64 {
+	var m dto.Metric
+	if err := fanoutAppendErrors.WithLabelValues(branch).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestFanoutFailureIsolation(t *testing.T) {
+	sample := &model.Sample{Metric: model.Metric{model.MetricNameLabel: "test"}, Value: 1}
+
+	for _, policy := range []FanoutPolicy{BestEffort, Required} {
+		var (
+			before  = &collectingAppender{}
+			failing = &failingAppender{}
+			after   = &collectingAppender{}
+			name    = "failing_" + policy.String()
+		)
+		f := Fanout{
+			{Name: "before", Appender: before, Policy: Required},
+			{Name: name, Appender: failing, Policy: policy},
+			{Name: "after", Appender: after, Policy: Required},
+		}
+
+		errsBefore := fanoutErrors(t, name)
+		err := f.TryAppend(sample)
+		if policy == BestEffort && err != nil {
+			t.Errorf("%s: unexpected error: %s", policy, err)
+		}
+		if policy == Required && err == nil {
+			t.Errorf("%s: expected error, got none", policy)
+		}
+
+		if len(before.samples) != 1 || failing.appended != 1 || len(after.samples) != 1 {
+			t.Errorf(
+				"%s: expected every branch to be appended to once, got %d, %d, %d",
+				policy, len(before.samples), failing.appended, len(after.samples),
+			)
+		}
+		if got := fanoutErrors(t, name) - errsBefore; got != 1 {
+			t.Errorf("%s: expected 1 counted error, got %v", policy, got)
+		}
+	}
+}
+
+func TestTryAppend(t *testing.T) {
+	sample := &model.Sample{Metric: model.Metric{model.MetricNameLabel: "test"}, Value: 1}
+
+	collecting := &collectingAppender{}
+	if err := TryAppend(collecting, sample); err != nil {
+		t.Errorf("unexpected error appending to infallible appender: %s", err)
+	}
+	if len(collecting.samples) != 1 {
+		t.Errorf("expected 1 appended sample, got %d", len(collecting.samples))
+	}
+
+	f := Fanout{{Name: "failing_required", Appender: &failingAppender{}, Policy: Required}}
+	if err := TryAppend(f, sample); err == nil {
+		t.Error("expected error of required branch, got none")
+	}
+}
+
+func TestFanoutPolicySet(t *testing.T) {
+	var p FanoutPolicy
+	for _, s := range []string{"required", "best-effort"} {
+		if err := p.Set(s); err != nil {
+			t.Fatalf("unexpected error setting %q: %s", s, err)
+		}
+		if p.String() != s {
+			t.Errorf("expected %q, got %q", s, p)
+		}
+	}
+	if err := p.Set("always"); err == nil {
+		t.Error("expected error for invalid policy, got none")
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 
 	html_template "html/template"
 	text_template "text/template"
@@ -38,6 +39,41 @@ type sample struct {
 }
 type queryResult []*sample
 
+// A version of matrix that's easier to use from templates.
+type series struct {
+	Labels map[string]string
+	Values []samplePair
+}
+type samplePair struct {
+	Timestamp float64
+	Value     float64
+}
+type queryRangeResult []*series
+
+// graphPoints is the number of points a graph should have approximately.
+const graphPoints = 1000
+
+// graphSteps are the steps in seconds graphStep chooses from.
+var graphSteps = []float64{
+	1, 2, 5, 10, 15, 30,
+	60, 2 * 60, 5 * 60, 10 * 60, 15 * 60, 30 * 60,
+	3600, 2 * 3600, 3 * 3600, 6 * 3600, 12 * 3600, 86400,
+}
+
+// graphStep returns a step in seconds for graphing the given range in
+// seconds. The step is the smallest of graphSteps (or a multiple of a day for
+// very long ranges) that yields no more than graphPoints points.
+func graphStep(rangeSeconds float64) float64 {
+	min := rangeSeconds / graphPoints
+	for _, s := range graphSteps {
+		if s >= min {
+			return s
+		}
+	}
+	day := graphSteps[len(graphSteps)-1]
+	return math.Ceil(min/day) * day
+}
+
 type queryResultByLabelSorter struct {
 	results queryResult
 	by      string
@@ -101,6 +137,40 @@ func query(q string, timestamp model.Time, queryEngine *promql.Engine) (queryRes
 	return result, nil
 }
 
+func queryRange(q string, start, end model.Time, step time.Duration, queryEngine *promql.Engine) (queryRangeResult, error) {
+	query, err := queryEngine.NewRangeQuery(q, start, end, step)
+	if err != nil {
+		return nil, err
+	}
+	res := query.Exec()
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	matrix, err := res.Matrix()
+	if err != nil {
+		return nil, err
+	}
+
+	var result = make(queryRangeResult, len(matrix))
+	for n, ss := range matrix {
+		s := series{
+			Labels: make(map[string]string),
+			Values: make([]samplePair, len(ss.Values)),
+		}
+		for label, value := range ss.Metric {
+			s.Labels[string(label)] = string(value)
+		}
+		for i, v := range ss.Values {
+			s.Values[i] = samplePair{
+				Timestamp: float64(v.Timestamp.UnixNano()) / 1e9,
+				Value:     float64(v.Value),
+			}
+		}
+		result[n] = &s
+	}
+	return result, nil
+}
+
 // Expander executes templates in text or HTML mode with a common set of Prometheus template functions.
 type Expander struct {
 	text    string
@@ -119,6 +189,17 @@ func NewTemplateExpander(text string, name string, data interface{}, timestamp m
 			"query": func(q string) (queryResult, error) {
 				return query(q, timestamp, queryEngine)
 			},
+			// queryRange evaluates q over the given range in seconds
+			// up to the expansion time. If step is not positive, the
+			// step is chosen by graphStep.
+			"queryRange": func(q string, rangeSeconds, stepSeconds float64) (queryRangeResult, error) {
+				if stepSeconds <= 0 {
+					stepSeconds = graphStep(rangeSeconds)
+				}
+				start := timestamp.Add(-time.Duration(rangeSeconds * float64(time.Second)))
+				return queryRange(q, start, timestamp, time.Duration(stepSeconds*float64(time.Second)), queryEngine)
+			},
+			"graphStep": graphStep,
 			"first": func(v queryResult) (*sample, error) {
 				if len(v) > 0 {
 					return v[0], nil
@@ -84,6 +84,21 @@ func TestTemplateExpansion(t *testing.T) {
 			text:   "{{ query \"metric{instance='a'}\" | first | label \"instance\" }}",
 			output: "a",
 		},
+		{
+			// Range query with explicit step.
+			text:   "{{ range queryRange \"vector(time())\" 60 30 }}{{ range .Values }}{{ .Timestamp }}:{{ .Value }} {{ end }}{{ end }}",
+			output: "-60:-60 -30:-30 0:0 ",
+		},
+		{
+			// Range query with step chosen by graphStep.
+			text:   "{{ range queryRange \"vector(time())\" 3000 0 }}{{ len .Values }}{{ end }}",
+			output: "601",
+		},
+		{
+			// Graph step.
+			text:   "{{ graphStep 3600 }}",
+			output: "5",
+		},
 		{
 			// Range over query and sort by label.
 			text:   "{{ range query \"metric\" | sortByLabel \"instance\" }}{{.Labels.instance}}:{{.Value}}: {{end}}",
@@ -217,3 +232,21 @@ func TestTemplateExpansion(t *testing.T) {
 		}
 	}
 }
+
+func TestGraphStep(t *testing.T) {
+	for _, r := range []float64{0, 1, 59, 999, 1000, 1001, 3600, 86400, 7 * 86400, 365 * 86400, 10 * 365 * 86400} {
+		step := graphStep(r)
+		if step <= 0 {
+			t.Errorf("non-positive step %v for range %v", step, r)
+			continue
+		}
+		if points := math.Floor(r/step) + 1; points > graphPoints+1 {
+			t.Errorf("step %v for range %v yields %v points, more than %v", step, r, points, graphPoints)
+		}
+		if r >= 10*graphPoints {
+			if points := r / step; points < graphPoints/10 {
+				t.Errorf("step %v for range %v yields only %v points", step, r, points)
+			}
+		}
+	}
+}
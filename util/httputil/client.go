@@ -14,13 +14,17 @@
 package httputil
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"sync"
 	"time"
 )
 
@@ -35,31 +39,224 @@ func NewDeadlineClient(timeout time.Duration, proxyURL *url.URL) *http.Client {
 	return NewClient(NewDeadlineRoundTripper(timeout, proxyURL))
 }
 
+// ClientOptions are the TLS, authentication, and proxy settings of an HTTP
+// client.
+type ClientOptions struct {
+	// The TLS configuration to use. The shared TLS settings only, if nil.
+	TLSConfig *tls.Config
+	// The basic authentication credentials sent with requests that do not
+	// carry an Authorization header already. None, if the username is empty.
+	BasicAuthUsername string
+	BasicAuthPassword string
+	// The HTTP proxy to connect through. Takes precedence over the proxy
+	// passed to NewDeadlineClientWithOptions if set.
+	ProxyURL *url.URL
+}
+
+// NewDeadlineClientWithOptions returns a new http.Client like NewDeadlineClient
+// with the given options applied.
+func NewDeadlineClientWithOptions(timeout time.Duration, proxyURL *url.URL, o ClientOptions) *http.Client {
+	if o.ProxyURL != nil {
+		proxyURL = o.ProxyURL
+	}
+	rt := NewTimeoutRoundTripper(timeout, 0, 0, proxyURL, o.TLSConfig)
+	if o.BasicAuthUsername != "" {
+		rt = NewBasicAuthRoundTripper(o.BasicAuthUsername, o.BasicAuthPassword, rt)
+	}
+	return NewClient(rt)
+}
+
+// proxyFunc returns the proxy function of a transport connecting through the
+// given proxy. Without a proxy, the proxy is taken from the HTTP_PROXY,
+// HTTPS_PROXY, and NO_PROXY environment variables, and connections are direct
+// if they are not set.
+func proxyFunc(proxyURL *url.URL) func(*http.Request) (*url.URL, error) {
+	if proxyURL == nil {
+		return http.ProxyFromEnvironment
+	}
+	return http.ProxyURL(proxyURL)
+}
+
+// NewTransport returns a new http.Transport without timeouts that connects
+// through the proxy taken from the environment and applies the shared TLS
+// settings.
+func NewTransport() *http.Transport {
+	return &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: newBaseTLSConfig(),
+	}
+}
+
+// idleConnTimeout is how long connections are kept open for reuse between
+// requests.
+const idleConnTimeout = 5 * time.Minute
+
 // NewDeadlineRoundTripper returns a new http.RoundTripper which will time out
 // long running requests.
 func NewDeadlineRoundTripper(timeout time.Duration, proxyURL *url.URL) http.RoundTripper {
-	return &http.Transport{
-		// Set proxy (if null, then becomes a direct connection)
-		Proxy: http.ProxyURL(proxyURL),
-		// We need to disable keepalive, because we set a deadline on the
-		// underlying connection.
-		DisableKeepAlives: true,
-		Dial: func(netw, addr string) (c net.Conn, err error) {
-			start := time.Now()
-
-			c, err = net.DialTimeout(netw, addr, timeout)
-			if err != nil {
-				return nil, err
-			}
-
-			if err = c.SetDeadline(start.Add(timeout)); err != nil {
-				c.Close()
-				return nil, err
-			}
-
-			return c, nil
+	return NewTimeoutRoundTripper(timeout, 0, 0, proxyURL, nil)
+}
+
+// NewTimeoutRoundTripper returns a new http.RoundTripper which will time out
+// requests that take longer than dialTimeout to establish a connection, or
+// longer than responseTimeout to be sent and have their response read once
+// connected. In any case, requests time out after timeout. A dial or response
+// timeout of zero or less is ignored. The shared TLS settings are used if
+// tlsConfig is nil.
+//
+// The timeouts apply to each request rather than to the connections, so that
+// connections are kept alive and reused by subsequent requests.
+func NewTimeoutRoundTripper(timeout, dialTimeout, responseTimeout time.Duration, proxyURL *url.URL, tlsConfig *tls.Config) http.RoundTripper {
+	if tlsConfig == nil {
+		tlsConfig = newBaseTLSConfig()
+	}
+	dialStage, dialLimit := "request", timeout
+	if dialTimeout > 0 && dialTimeout < timeout {
+		dialStage, dialLimit = "dial", dialTimeout
+	}
+	dialer := &net.Dialer{Timeout: dialLimit}
+	return &timeoutRoundTripper{
+		rt: &http.Transport{
+			// Set proxy (if nil, then taken from the environment)
+			Proxy:           proxyFunc(proxyURL),
+			TLSClientConfig: tlsConfig,
+			IdleConnTimeout: idleConnTimeout,
+			DialContext: func(ctx context.Context, netw, addr string) (net.Conn, error) {
+				c, err := dialer.DialContext(ctx, netw, addr)
+				if err != nil {
+					return nil, wrapTimeout(err, dialStage, dialLimit)
+				}
+				return c, nil
+			},
 		},
+		timeout:         timeout,
+		responseTimeout: responseTimeout,
+	}
+}
+
+// timeoutRoundTripper cancels requests that exceed its timeouts.
+type timeoutRoundTripper struct {
+	rt              *http.Transport
+	timeout         time.Duration
+	responseTimeout time.Duration
+}
+
+func (rt *timeoutRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	d := &requestDeadlines{cancel: cancel}
+	d.add("request", rt.timeout)
+	if rt.responseTimeout > 0 && rt.responseTimeout < rt.timeout {
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GotConn: func(httptrace.GotConnInfo) {
+				d.add("response", rt.responseTimeout)
+			},
+		})
+	}
+
+	resp, err := rt.rt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		d.stop()
+		return nil, d.wrap(err)
+	}
+	resp.Body = &deadlineBody{ReadCloser: resp.Body, deadlines: d}
+	return resp, nil
+}
+
+// requestDeadlines cancels a request once the first of its deadlines is
+// exceeded and remembers which one it was.
+type requestDeadlines struct {
+	cancel func()
+
+	mtx      sync.Mutex
+	timers   []*time.Timer
+	exceeded *timeoutError
+	stopped  bool
+}
+
+// add cancels the request after the given timeout, reported as a timeout of
+// the given stage of the request.
+func (d *requestDeadlines) add(stage string, timeout time.Duration) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.stopped {
+		return
+	}
+	d.timers = append(d.timers, time.AfterFunc(timeout, func() {
+		d.mtx.Lock()
+		if d.exceeded == nil {
+			d.exceeded = &timeoutError{stage: stage, timeout: timeout}
+		}
+		d.mtx.Unlock()
+		d.cancel()
+	}))
+}
+
+// stop stops the timers and releases the resources of the request.
+func (d *requestDeadlines) stop() {
+	d.mtx.Lock()
+	d.stopped = true
+	for _, t := range d.timers {
+		t.Stop()
+	}
+	d.mtx.Unlock()
+	d.cancel()
+}
+
+// wrap wraps an error of the request in a timeoutError if the request was
+// canceled as it exceeded a deadline.
+func (d *requestDeadlines) wrap(err error) error {
+	if _, ok := err.(*timeoutError); ok || err == nil || err == io.EOF {
+		return err
 	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.exceeded == nil {
+		return err
+	}
+	return &timeoutError{stage: d.exceeded.stage, timeout: d.exceeded.timeout, err: err}
+}
+
+// deadlineBody is the body of a response to a request with deadlines, which
+// still apply while the body is read.
+type deadlineBody struct {
+	io.ReadCloser
+	deadlines *requestDeadlines
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	return n, b.deadlines.wrap(err)
+}
+
+func (b *deadlineBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.deadlines.stop()
+	return err
+}
+
+// timeoutError is a net.Error reporting which of the timeouts of a round
+// tripper created by NewTimeoutRoundTripper was exceeded.
+type timeoutError struct {
+	stage   string
+	timeout time.Duration
+	err     error
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s timeout of %v exceeded: %s", e.stage, e.timeout, e.err)
+}
+
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// wrapTimeout wraps err in a timeoutError if it is a timeout.
+func wrapTimeout(err error, stage string, timeout time.Duration) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return &timeoutError{stage: stage, timeout: timeout, err: err}
+	}
+	return err
 }
 
 type bearerAuthRoundTripper struct {
@@ -103,6 +300,23 @@ func (rt *basicAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, e
 	return rt.rt.RoundTrip(req)
 }
 
+type userAgentRoundTripper struct {
+	userAgent string
+	rt        http.RoundTripper
+}
+
+// NewUserAgentRoundTripper sets the User-Agent header of a request to the
+// provided value.
+func NewUserAgentRoundTripper(userAgent string, rt http.RoundTripper) http.RoundTripper {
+	return &userAgentRoundTripper{userAgent, rt}
+}
+
+func (rt *userAgentRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = cloneRequest(req)
+	req.Header.Set("User-Agent", rt.userAgent)
+	return rt.rt.RoundTrip(req)
+}
+
 // cloneRequest returns a clone of the provided *http.Request.
 // The clone is a shallow copy of the struct and its Header map.
 func cloneRequest(r *http.Request) *http.Request {
@@ -122,10 +336,15 @@ type TLSOptions struct {
 	CAFile             string
 	CertFile           string
 	KeyFile            string
+	ServerName         string
 }
 
+// NewTLSConfig returns a TLS configuration for clients with the shared TLS
+// settings and the provided options applied.
 func NewTLSConfig(opts TLSOptions) (*tls.Config, error) {
-	tlsConfig := &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify}
+	tlsConfig := newBaseTLSConfig()
+	tlsConfig.InsecureSkipVerify = opts.InsecureSkipVerify
+	tlsConfig.ServerName = opts.ServerName
 
 	// If a CA cert is provided then let's read it in so we can validate the
 	// scrape target's certificate properly.
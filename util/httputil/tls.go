@@ -0,0 +1,148 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TLSVersion is a TLS protocol version. It implements flag.Value.
+type TLSVersion uint16
+
+var tlsVersions = map[string]TLSVersion{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+}
+
+// String implements flag.Value.
+func (v TLSVersion) String() string {
+	for name, version := range tlsVersions {
+		if version == v {
+			return name
+		}
+	}
+	return ""
+}
+
+// Set implements flag.Value.
+func (v *TLSVersion) Set(s string) error {
+	version, ok := tlsVersions[s]
+	if !ok {
+		return fmt.Errorf("unknown TLS version: %s", s)
+	}
+	*v = version
+	return nil
+}
+
+var cipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_RC4_128_SHA":                tls.TLS_RSA_WITH_RC4_128_SHA,
+	"TLS_RSA_WITH_3DES_EDE_CBC_SHA":           tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_RC4_128_SHA":        tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_RC4_128_SHA":          tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
+	"TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA":     tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+}
+
+// CipherSuites is a list of TLS cipher suites. It implements flag.Value and
+// is set from a comma-separated list of cipher suite names as defined in the
+// crypto/tls package, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+type CipherSuites []uint16
+
+// String implements flag.Value.
+func (cs CipherSuites) String() string {
+	names := make([]string, 0, len(cs))
+	for _, c := range cs {
+		for name, id := range cipherSuites {
+			if id == c {
+				names = append(names, name)
+			}
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Set implements flag.Value.
+func (cs *CipherSuites) Set(s string) error {
+	var ids CipherSuites
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := cipherSuites[name]
+		if !ok {
+			known := make([]string, 0, len(cipherSuites))
+			for n := range cipherSuites {
+				known = append(known, n)
+			}
+			sort.Strings(known)
+			return fmt.Errorf("unknown TLS cipher suite %q, must be one of %s", name, strings.Join(known, ", "))
+		}
+		ids = append(ids, id)
+	}
+	*cs = ids
+	return nil
+}
+
+// TLSSettings are the protocol settings shared by all TLS connections made and
+// accepted by Prometheus.
+type TLSSettings struct {
+	// The minimum TLS version to accept. The crypto/tls default, if 0.
+	MinVersion TLSVersion
+	// The allowed cipher suites. The crypto/tls defaults, if empty.
+	CipherSuites CipherSuites
+}
+
+var tlsSettings TLSSettings
+
+// SetTLSSettings sets the settings applied to all TLS configurations created
+// by this package afterwards. It has to be called on startup before any
+// clients or servers are created.
+func SetTLSSettings(s TLSSettings) {
+	tlsSettings = s
+}
+
+// newBaseTLSConfig returns a TLS configuration with the shared settings
+// applied.
+func newBaseTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:   uint16(tlsSettings.MinVersion),
+		CipherSuites: tlsSettings.CipherSuites,
+	}
+}
+
+// NewServerTLSConfig returns a TLS configuration for servers with the shared
+// settings applied.
+func NewServerTLSConfig() *tls.Config {
+	tlsConfig := newBaseTLSConfig()
+	// With the cipher suites restricted, the server's preference has to win
+	// for the restriction to be meaningful to clients offering more.
+	tlsConfig.PreferServerCipherSuites = len(tlsConfig.CipherSuites) > 0
+	return tlsConfig
+}
@@ -0,0 +1,72 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTLSSettings(t *testing.T) {
+	var s TLSSettings
+	if err := s.MinVersion.Set("TLS12"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CipherSuites.Set("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"); err != nil {
+		t.Fatal(err)
+	}
+	SetTLSSettings(s)
+	defer SetTLSSettings(TLSSettings{})
+
+	expectedCiphers := []uint16{
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	}
+
+	clientConfig, err := NewTLSConfig(TLSOptions{ServerName: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadlineConfig := NewDeadlineRoundTripper(time.Second, nil).(*timeoutRoundTripper).rt.TLSClientConfig
+
+	for name, c := range map[string]*tls.Config{
+		"client":    clientConfig,
+		"deadline":  deadlineConfig,
+		"transport": NewTransport().TLSClientConfig,
+		"server":    NewServerTLSConfig(),
+	} {
+		if c.MinVersion != tls.VersionTLS12 {
+			t.Errorf("%s: expected minimum version %x, got %x", name, tls.VersionTLS12, c.MinVersion)
+		}
+		if !reflect.DeepEqual(c.CipherSuites, expectedCiphers) {
+			t.Errorf("%s: expected cipher suites %v, got %v", name, expectedCiphers, c.CipherSuites)
+		}
+	}
+	if clientConfig.ServerName != "example.com" {
+		t.Errorf("expected server name example.com, got %q", clientConfig.ServerName)
+	}
+}
+
+func TestTLSSettingsInvalid(t *testing.T) {
+	var v TLSVersion
+	if err := v.Set("SSL3"); err == nil {
+		t.Error("expected error for unknown TLS version, got none")
+	}
+	var cs CipherSuites
+	if err := cs.Set("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_NO_SUCH_CIPHER"); err == nil {
+		t.Error("expected error for unknown cipher suite, got none")
+	}
+}
@@ -141,3 +141,61 @@ func TestQuery(t *testing.T) {
 		}
 	}
 }
+
+func TestQueryRangeMaxPoints(t *testing.T) {
+	storage, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+	end := testTimestamp.Add(-time.Duration(testTimestamp.UnixNano() % int64(time.Second)))
+	for i := 0; i < 60; i++ {
+		storage.Append(&model.Sample{
+			Metric: model.Metric{
+				model.MetricNameLabel: "testmetric",
+			},
+			Timestamp: end.Add(time.Duration(i-59) * time.Second),
+			Value:     model.SampleValue(i),
+		})
+	}
+	storage.WaitForIndexing()
+
+	api := &API{
+		Now:         testNow,
+		Storage:     storage,
+		QueryEngine: promql.NewEngine(storage, nil),
+	}
+	rtr := route.New()
+	api.Register(rtr.WithPrefix("/api"))
+
+	server := httptest.NewServer(rtr)
+	defer server.Close()
+
+	query := func(params string) (int, []byte) {
+		resp, err := http.Get(server.URL + "/api/query_range?expr=testmetric&range=59&step=1&" + params)
+		if err != nil {
+			t.Fatalf("Error querying API: %s", err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Error reading response body: %s", err)
+		}
+		return resp.StatusCode, b
+	}
+
+	_, b := query("")
+	if n := len(regexp.MustCompile(`\[\d+(\.\d+)?,"\d+"\]`).FindAll(b, -1)); n != 60 {
+		t.Fatalf("Got %d points without max_points; want 60. Body: %s", n, b)
+	}
+
+	_, b = query("max_points=6")
+	points := regexp.MustCompile(`\[\d+(\.\d+)?,"(\d+)"\]`).FindAllSubmatch(b, -1)
+	if len(points) != 6 {
+		t.Fatalf("Got %d points with max_points=6; want 6. Body: %s", len(points), b)
+	}
+	if string(points[0][2]) != "0" || string(points[5][2]) != "59" {
+		t.Fatalf("Extrema not preserved with max_points=6. Body: %s", b)
+	}
+
+	if status, _ := query("max_points=1"); status != http.StatusBadRequest {
+		t.Fatalf("Unexpected status code for invalid max_points; got %d, want %d", status, http.StatusBadRequest)
+	}
+}
@@ -180,6 +180,15 @@ func (api *API) QueryRange(w http.ResponseWriter, r *http.Request) {
 		httpJSONError(w, fmt.Errorf("invalid query timestamp: %s", err), http.StatusBadRequest)
 		return
 	}
+
+	var maxPoints int
+	if mp := params.Get("max_points"); mp != "" {
+		maxPoints, err = strconv.Atoi(mp)
+		if err != nil || maxPoints < 2 {
+			httpJSONError(w, fmt.Errorf("invalid maximum number of points %q: must be an integer of at least 2", mp), http.StatusBadRequest)
+			return
+		}
+	}
 	// TODO(julius): Remove this special-case handling a while after PromDash and
 	// other API consumers have been changed to no longer set "end=0" for setting
 	// the current time as the end time. Instead, the "end" parameter should
@@ -211,10 +220,50 @@ func (api *API) QueryRange(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if maxPoints > 0 {
+		for _, ss := range matrix {
+			ss.Values = decimate(ss.Values, maxPoints)
+		}
+	}
+
 	log.Debugf("Range query: %s\nQuery stats:\n%s\n", expr, query.Stats())
 	respondJSON(w, matrix)
 }
 
+// decimate reduces the given sample pairs to at most maxPoints, which must be
+// at least 2. The pairs are split into maxPoints/2 consecutive buckets of
+// (almost) equal size, of which the minimum and maximum are kept in their
+// original order, so that spikes are not lost. Pairs not exceeding maxPoints
+// are returned unchanged.
+func decimate(pairs []model.SamplePair, maxPoints int) []model.SamplePair {
+	if len(pairs) <= maxPoints {
+		return pairs
+	}
+	buckets := maxPoints / 2
+	res := make([]model.SamplePair, 0, 2*buckets)
+	for b := 0; b < buckets; b++ {
+		bucket := pairs[b*len(pairs)/buckets : (b+1)*len(pairs)/buckets]
+		minIdx, maxIdx := 0, 0
+		for i, sp := range bucket {
+			if sp.Value < bucket[minIdx].Value {
+				minIdx = i
+			}
+			if sp.Value > bucket[maxIdx].Value {
+				maxIdx = i
+			}
+		}
+		switch {
+		case minIdx < maxIdx:
+			res = append(res, bucket[minIdx], bucket[maxIdx])
+		case minIdx > maxIdx:
+			res = append(res, bucket[maxIdx], bucket[minIdx])
+		default:
+			res = append(res, bucket[minIdx])
+		}
+	}
+	return res
+}
+
 // Metrics handles the /api/metrics endpoint.
 func (api *API) Metrics(w http.ResponseWriter, r *http.Request) {
 	setAccessControlHeaders(w)
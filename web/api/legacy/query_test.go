@@ -64,3 +64,48 @@ func TestParseDuration(t *testing.T) {
 		t.Fatalf("d = %v; want %v", d, expD)
 	}
 }
+
+func TestDecimate(t *testing.T) {
+	pairs := make([]model.SamplePair, 100)
+	for i := range pairs {
+		pairs[i] = model.SamplePair{
+			Timestamp: model.Time(i * 1000),
+			Value:     model.SampleValue(i % 10),
+		}
+	}
+	// Spikes that must survive decimation.
+	pairs[37].Value = 1000
+	pairs[71].Value = -1000
+
+	for _, maxPoints := range []int{2, 3, 10, 11, 50, 99} {
+		res := decimate(pairs, maxPoints)
+		if len(res) > maxPoints {
+			t.Fatalf("%d points returned for maximum of %d", len(res), maxPoints)
+		}
+		var hasMax, hasMin bool
+		for i, sp := range res {
+			if i > 0 && !res[i-1].Timestamp.Before(sp.Timestamp) {
+				t.Fatalf("points not in order for maximum of %d: %v", maxPoints, res)
+			}
+			hasMax = hasMax || sp == pairs[37]
+			hasMin = hasMin || sp == pairs[71]
+		}
+		if !hasMax || !hasMin {
+			t.Fatalf("extrema lost for maximum of %d: %v", maxPoints, res)
+		}
+	}
+
+	if res := decimate(pairs, 100); len(res) != 100 {
+		t.Fatalf("%d points returned; want all 100 points unchanged", len(res))
+	}
+
+	flat := []model.SamplePair{
+		{Timestamp: 0, Value: 1},
+		{Timestamp: 1000, Value: 1},
+		{Timestamp: 2000, Value: 1},
+		{Timestamp: 3000, Value: 1},
+	}
+	if res := decimate(flat, 2); len(res) != 1 || res[0] != flat[0] {
+		t.Fatalf("decimating constant series = %v; want single first point", res)
+	}
+}
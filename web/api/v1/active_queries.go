@@ -0,0 +1,109 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/promql"
+)
+
+// activeQuery describes a query that is currently being executed.
+type activeQuery struct {
+	ID       string    `json:"id"`
+	Expr     string    `json:"expr"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"durationSeconds"`
+	Client   string    `json:"client"`
+
+	cancel func()
+}
+
+// activeQueries keeps track of the queries that are currently being executed
+// via the API. The zero value is ready to use.
+type activeQueries struct {
+	mtx     sync.Mutex
+	nextID  uint64
+	queries map[uint64]activeQuery
+}
+
+// insert registers the query with the given expression issued by the given
+// request. The returned function removes the query again and has to be called
+// once the query has finished.
+func (aq *activeQueries) insert(qry promql.Query, expr string, r *http.Request) func() {
+	aq.mtx.Lock()
+	defer aq.mtx.Unlock()
+
+	if aq.queries == nil {
+		aq.queries = map[uint64]activeQuery{}
+	}
+	id := aq.nextID
+	aq.nextID++
+	aq.queries[id] = activeQuery{
+		ID:     strconv.FormatUint(id, 10),
+		Expr:   expr,
+		Start:  time.Now(),
+		Client: r.RemoteAddr,
+		cancel: qry.Cancel,
+	}
+
+	return func() {
+		aq.mtx.Lock()
+		defer aq.mtx.Unlock()
+		delete(aq.queries, id)
+	}
+}
+
+// cancel cancels the active query with the given ID. It returns false if no
+// such query is active.
+func (aq *activeQueries) cancel(id string) bool {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	aq.mtx.Lock()
+	q, ok := aq.queries[n]
+	aq.mtx.Unlock()
+
+	if ok {
+		q.cancel()
+	}
+	return ok
+}
+
+// list returns the active queries ordered by their start time.
+func (aq *activeQueries) list() []activeQuery {
+	aq.mtx.Lock()
+	defer aq.mtx.Unlock()
+
+	now := time.Now()
+	res := make([]activeQuery, 0, len(aq.queries))
+	for _, q := range aq.queries {
+		q.Duration = now.Sub(q.Start).Seconds()
+		res = append(res, q)
+	}
+	sort.Sort(byStart(res))
+	return res
+}
+
+type byStart []activeQuery
+
+func (s byStart) Len() int           { return len(s) }
+func (s byStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byStart) Less(i, j int) bool { return s[i].Start.Before(s[j].Start) }
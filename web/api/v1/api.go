@@ -4,19 +4,24 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/route"
 	"golang.org/x/net/context"
 
 	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/rules"
 	"github.com/prometheus/prometheus/storage/local"
 	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/prometheus/storage/remote"
 	"github.com/prometheus/prometheus/util/httputil"
 	"github.com/prometheus/prometheus/util/strutil"
 )
@@ -38,6 +43,20 @@ const (
 	errorBadData            = "bad_data"
 )
 
+const (
+	// The maximum number of queries of a batch evaluated concurrently.
+	maxBatchConcurrency = 10
+	// The time after which queries of a batch are canceled if no timeout
+	// is requested.
+	defaultBatchTimeout = 2 * time.Minute
+	// The maximum number of samples sent to a remote storage at once when
+	// exporting query results.
+	exportBatchSize = 100
+	// The maximum number of series whose samples are deleted at once via
+	// the admin endpoints.
+	deletionBatchSize = 1000
+)
+
 type apiError struct {
 	typ errorType
 	err error
@@ -69,9 +88,23 @@ type apiFunc func(r *http.Request) (interface{}, *apiError)
 type API struct {
 	Storage     local.Storage
 	QueryEngine *promql.Engine
-
-	context func(r *http.Request) context.Context
-	now     func() model.Time
+	// EnableAdmin registers administrative and debugging endpoints under
+	// /admin if set.
+	EnableAdmin bool
+	// RemoteClients are the remote storages query results can be exported
+	// to via the admin endpoints.
+	RemoteClients []remote.StorageClient
+	// SnapshotDir is the directory snapshots of the local storage are
+	// created in via the admin endpoints.
+	SnapshotDir string
+	// QueryLog logs the executed queries. Optional.
+	QueryLog *QueryLog
+
+	context          func(r *http.Request) context.Context
+	now              func() model.Time
+	counters         func() (model.Vector, error)
+	activeQueries    activeQueries
+	counterBaselines counterBaselines
 }
 
 // NewAPI returns an initialized API type.
@@ -81,6 +114,7 @@ func NewAPI(qe *promql.Engine, st local.Storage) *API {
 		Storage:     st,
 		context:     route.Context,
 		now:         model.Now,
+		counters:    gatherCounters,
 	}
 }
 
@@ -102,16 +136,60 @@ func (api *API) Register(r *route.Router) {
 
 	r.Get("/query", instr("query", api.query))
 	r.Get("/query_range", instr("query_range", api.queryRange))
+	r.Post("/query_batch", instr("query_batch", api.queryBatch))
+	r.Get("/query_explain", instr("query_explain", api.queryExplain))
 
 	r.Get("/label/:name/values", instr("label_values", api.labelValues))
 
+	r.Get("/functions", instr("functions", api.functions))
+
 	r.Get("/series", instr("series", api.series))
 	r.Del("/series", instr("drop_series", api.dropSeries))
+
+	if api.EnableAdmin {
+		r.Get("/admin/chunks", instr("admin_chunks", api.chunks))
+		r.Get("/admin/queries", instr("admin_active_queries", api.listActiveQueries))
+		r.Del("/admin/queries/:id", instr("admin_cancel_query", api.cancelQuery))
+		r.Post("/admin/export", instr("admin_export", api.exportQuery))
+		r.Post("/admin/rules/preview", instr("admin_preview_alerts", api.previewAlerts))
+		r.Post("/admin/tsdb/snapshot", instr("admin_snapshot", api.snapshot))
+		r.Post("/admin/tsdb/delete_series", instr("admin_delete_series", api.deleteSeries))
+		if counterAPIEnabled {
+			r.Get("/admin/counters", instr("admin_counters", api.listCounters))
+			r.Post("/admin/counters/reset", instr("admin_reset_counters", api.resetCounters))
+		}
+	}
+}
+
+// exec executes the query with the given expression, issued by the given
+// request, and logs it to the query log, if any.
+func (api *API) exec(qry promql.Query, expr string, r *http.Request) *promql.Result {
+	begin := time.Now()
+	res := qry.Exec()
+	if api.QueryLog != nil {
+		api.QueryLog.log(qry, expr, time.Since(begin), res, r)
+	}
+	return res
 }
 
 type queryData struct {
 	ResultType model.ValueType `json:"resultType"`
 	Result     model.Value     `json:"result"`
+	// Warnings about data missing from the result, e.g. because chunks
+	// could not be decoded.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// newQueryData returns the queryData of a successfully executed query.
+func newQueryData(res *promql.Result) *queryData {
+	qd := &queryData{
+		ResultType: res.Value.Type(),
+		Result:     res.Value,
+	}
+	for _, w := range res.Warnings {
+		qd.Warnings = append(qd.Warnings, w.Error())
+	}
+	return qd
 }
 
 func (api *API) query(r *http.Request) (interface{}, *apiError) {
@@ -130,24 +208,196 @@ func (api *API) query(r *http.Request) (interface{}, *apiError) {
 	if err != nil {
 		return nil, &apiError{errorBadData, err}
 	}
+	defer api.activeQueries.insert(qry, r.FormValue("query"), r)()
 
-	res := qry.Exec()
+	res := api.exec(qry, r.FormValue("query"), r)
 	if res.Err != nil {
-		switch res.Err.(type) {
-		case promql.ErrQueryCanceled:
-			return nil, &apiError{errorCanceled, res.Err}
-		case promql.ErrQueryTimeout:
-			return nil, &apiError{errorTimeout, res.Err}
+		return nil, queryError(res.Err)
+	}
+	return newQueryData(res), nil
+}
+
+// explainData is the analysis of an expression without evaluating it.
+type explainData struct {
+	Expr   string `json:"expr"`
+	Tree   string `json:"tree"`
+	Series int    `json:"series"`
+	Chunks int    `json:"chunks"`
+}
+
+func (api *API) queryExplain(r *http.Request) (interface{}, *apiError) {
+	var start, end model.Time
+	if r.FormValue("start") != "" || r.FormValue("end") != "" {
+		var err error
+		start, err = parseTime(r.FormValue("start"))
+		if err != nil {
+			return nil, &apiError{errorBadData, err}
+		}
+		end, err = parseTime(r.FormValue("end"))
+		if err != nil {
+			return nil, &apiError{errorBadData, err}
+		}
+		if end.Before(start) {
+			err := errors.New("end timestamp must not be before start time")
+			return nil, &apiError{errorBadData, err}
+		}
+	} else if t := r.FormValue("time"); t != "" {
+		var err error
+		start, err = parseTime(t)
+		if err != nil {
+			return nil, &apiError{errorBadData, err}
 		}
-		return nil, &apiError{errorExec, res.Err}
+		end = start
+	} else {
+		start = api.now()
+		end = start
 	}
-	return &queryData{
-		ResultType: res.Value.Type(),
-		Result:     res.Value,
+
+	expr, err := promql.ParseExpr(r.FormValue("query"))
+	if err != nil {
+		return nil, &apiError{errorBadData, err}
+	}
+	a := &promql.Analyzer{
+		Storage: api.Storage,
+		Expr:    expr,
+		Start:   start,
+		End:     end,
+	}
+	if err := a.Analyze(api.context(r)); err != nil {
+		return nil, &apiError{errorExec, err}
+	}
+	series, chunks, err := a.Estimate()
+	if err != nil {
+		return nil, &apiError{errorExec, err}
+	}
+	return &explainData{
+		Expr:   expr.String(),
+		Tree:   promql.Tree(expr),
+		Series: series,
+		Chunks: chunks,
 	}, nil
 }
 
+// queryError converts an error returned by query execution into an API error.
+func queryError(err error) *apiError {
+	switch err.(type) {
+	case promql.ErrQueryCanceled:
+		return &apiError{errorCanceled, err}
+	case promql.ErrQueryTimeout:
+		return &apiError{errorTimeout, err}
+	}
+	return &apiError{errorExec, err}
+}
+
+// batchQuery is a single instant query of a query batch.
+type batchQuery struct {
+	Expr string `json:"expr"`
+	Time string `json:"time,omitempty"`
+}
+
+// queryBatch evaluates a JSON array of instant queries and returns one response
+// per query in the same order. At most maxBatchConcurrency queries of a batch
+// are evaluated concurrently and all of them share a single timeout.
+func (api *API) queryBatch(r *http.Request) (interface{}, *apiError) {
+	var queries []batchQuery
+	if err := json.NewDecoder(r.Body).Decode(&queries); err != nil {
+		return nil, &apiError{errorBadData, fmt.Errorf("error decoding query batch: %s", err)}
+	}
+	timeout := defaultBatchTimeout
+	if t := r.FormValue("timeout"); t != "" {
+		var err error
+		timeout, err = parseDuration(t)
+		if err != nil {
+			return nil, &apiError{errorBadData, err}
+		}
+	}
+	deadline := time.Now().Add(timeout)
+
+	var (
+		results = make([]*response, len(queries))
+		gate    = make(chan struct{}, maxBatchConcurrency)
+		wg      sync.WaitGroup
+	)
+	for i, q := range queries {
+		wg.Add(1)
+		go func(i int, q batchQuery) {
+			defer wg.Done()
+
+			gate <- struct{}{}
+			defer func() { <-gate }()
+
+			data, apiErr := api.evalBatchQuery(q, deadline, r)
+			if apiErr != nil {
+				results[i] = &response{
+					Status:    statusError,
+					ErrorType: apiErr.typ,
+					Error:     apiErr.err.Error(),
+				}
+				return
+			}
+			results[i] = &response{
+				Status: statusSuccess,
+				Data:   data,
+			}
+		}(i, q)
+	}
+	wg.Wait()
+
+	return results, nil
+}
+
+// evalBatchQuery evaluates a single query of a batch. The query is canceled if it
+// is still running at the deadline.
+func (api *API) evalBatchQuery(q batchQuery, deadline time.Time, r *http.Request) (interface{}, *apiError) {
+	ts := api.now()
+	if q.Time != "" {
+		var err error
+		ts, err = parseTime(q.Time)
+		if err != nil {
+			return nil, &apiError{errorBadData, err}
+		}
+	}
+
+	qry, err := api.QueryEngine.NewInstantQuery(q.Expr, ts)
+	if err != nil {
+		return nil, &apiError{errorBadData, err}
+	}
+	defer api.activeQueries.insert(qry, q.Expr, r)()
+
+	timeout := deadline.Sub(time.Now())
+	if timeout <= 0 {
+		return nil, &apiError{errorTimeout, errors.New("query batch timed out")}
+	}
+	timer := time.AfterFunc(timeout, qry.Cancel)
+	defer timer.Stop()
+
+	res := api.exec(qry, q.Expr, r)
+	if res.Err != nil {
+		if !time.Now().Before(deadline) {
+			return nil, &apiError{errorTimeout, fmt.Errorf("query batch timed out: %s", res.Err)}
+		}
+		return nil, queryError(res.Err)
+	}
+	return newQueryData(res), nil
+}
+
 func (api *API) queryRange(r *http.Request) (interface{}, *apiError) {
+	qry, apiErr := api.newRangeQuery(r)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	defer api.activeQueries.insert(qry, r.FormValue("query"), r)()
+
+	res := api.exec(qry, r.FormValue("query"), r)
+	if res.Err != nil {
+		return nil, queryError(res.Err)
+	}
+	return newQueryData(res), nil
+}
+
+// newRangeQuery creates the range query described by the query, start, end,
+// and step parameters of the request.
+func (api *API) newRangeQuery(r *http.Request) (promql.Query, *apiError) {
 	start, err := parseTime(r.FormValue("start"))
 	if err != nil {
 		return nil, &apiError{errorBadData, err}
@@ -156,10 +406,18 @@ func (api *API) queryRange(r *http.Request) (interface{}, *apiError) {
 	if err != nil {
 		return nil, &apiError{errorBadData, err}
 	}
+	if end.Before(start) {
+		err := errors.New("end timestamp must not be before start time")
+		return nil, &apiError{errorBadData, err}
+	}
 	step, err := parseDuration(r.FormValue("step"))
 	if err != nil {
 		return nil, &apiError{errorBadData, err}
 	}
+	if step <= 0 {
+		err := errors.New("zero or negative query resolution step widths are not accepted. Try a positive integer")
+		return nil, &apiError{errorBadData, err}
+	}
 
 	// For safety, limit the number of returned points per timeseries.
 	// This is sufficient for 60s resolution for a week or 1h resolution for a year.
@@ -172,21 +430,157 @@ func (api *API) queryRange(r *http.Request) (interface{}, *apiError) {
 	if err != nil {
 		return nil, &apiError{errorBadData, err}
 	}
+	return qry, nil
+}
 
-	res := qry.Exec()
+// exportData summarizes the query results written to a remote storage.
+type exportData struct {
+	Remote  string `json:"remote"`
+	Series  int    `json:"series"`
+	Samples int    `json:"samples"`
+}
+
+// exportQuery evaluates a range query like queryRange but writes the
+// resulting samples to a remote storage instead of returning them. The remote
+// storage is selected by name via the remote parameter, which may be omitted
+// if only one is configured. The samples are sent as they are, i.e. without
+// external labels or write relabeling applied.
+func (api *API) exportQuery(r *http.Request) (interface{}, *apiError) {
+	client, apiErr := api.remoteClient(r.FormValue("remote"))
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	qry, apiErr := api.newRangeQuery(r)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	defer api.activeQueries.insert(qry, r.FormValue("query"), r)()
+
+	res := api.exec(qry, r.FormValue("query"), r)
 	if res.Err != nil {
-		switch res.Err.(type) {
-		case promql.ErrQueryCanceled:
-			return nil, &apiError{errorCanceled, res.Err}
-		case promql.ErrQueryTimeout:
-			return nil, &apiError{errorTimeout, res.Err}
+		return nil, queryError(res.Err)
+	}
+	mat, err := res.Matrix()
+	if err != nil {
+		return nil, &apiError{errorExec, err}
+	}
+
+	total := 0
+	for _, ss := range mat {
+		total += len(ss.Values)
+	}
+	data := &exportData{Remote: client.Name()}
+	batch := make(model.Samples, 0, exportBatchSize)
+	flush := func() *apiError {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := client.Store(batch); err != nil {
+			return &apiError{errorExec, fmt.Errorf("error exporting samples to %s after %d of %d samples: %s", client.Name(), data.Samples, total, err)}
 		}
-		return nil, &apiError{errorExec, res.Err}
+		data.Samples += len(batch)
+		log.Debugf("Exported %d of %d samples of query %q to %s", data.Samples, total, r.FormValue("query"), client.Name())
+		batch = batch[:0]
+		return nil
 	}
-	return &queryData{
-		ResultType: res.Value.Type(),
-		Result:     res.Value,
-	}, nil
+	for _, ss := range mat {
+		for _, sp := range ss.Values {
+			batch = append(batch, &model.Sample{
+				Metric:    ss.Metric,
+				Value:     sp.Value,
+				Timestamp: sp.Timestamp,
+			})
+			if len(batch) == exportBatchSize {
+				if apiErr := flush(); apiErr != nil {
+					return data, apiErr
+				}
+			}
+		}
+		data.Series++
+	}
+	if apiErr := flush(); apiErr != nil {
+		return data, apiErr
+	}
+	log.Infof("Exported %d samples of %d series of query %q to %s", data.Samples, data.Series, r.FormValue("query"), client.Name())
+	return data, nil
+}
+
+// remoteClient returns the remote storage client with the given name, or the
+// only configured one if the name is empty.
+func (api *API) remoteClient(name string) (remote.StorageClient, *apiError) {
+	if name == "" {
+		if len(api.RemoteClients) != 1 {
+			err := fmt.Errorf("%d remote storages configured, select one via the remote parameter", len(api.RemoteClients))
+			return nil, &apiError{errorBadData, err}
+		}
+		return api.RemoteClients[0], nil
+	}
+	for _, c := range api.RemoteClients {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, &apiError{errorBadData, fmt.Errorf("unknown remote storage %q", name)}
+}
+
+// alertPreview is an alert that a previewed alerting rule would create.
+type alertPreview struct {
+	Name        string            `json:"name"`
+	Labels      model.LabelSet    `json:"labels"`
+	State       string            `json:"state"`
+	ActiveSince model.Time        `json:"activeSince"`
+	Value       model.SampleValue `json:"value"`
+}
+
+type alertPreviews []alertPreview
+
+func (p alertPreviews) Len() int      { return len(p) }
+func (p alertPreviews) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p alertPreviews) Less(i, j int) bool {
+	if p[i].Name != p[j].Name {
+		return p[i].Name < p[j].Name
+	}
+	return p[i].Labels.Before(p[j].Labels)
+}
+
+// previewAlerts evaluates the alerting rules of the rule file posted as the
+// request body once against the current storage content and returns the
+// alerts they would create. The rules are not installed and the state of the
+// installed rules is not touched.
+func (api *API) previewAlerts(r *http.Request) (interface{}, *apiError) {
+	var ts model.Time
+	if t := r.URL.Query().Get("time"); t != "" {
+		var err error
+		ts, err = parseTime(t)
+		if err != nil {
+			return nil, &apiError{errorBadData, err}
+		}
+	} else {
+		ts = api.now()
+	}
+
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, &apiError{errorBadData, err}
+	}
+	alerts, err := rules.PreviewAlerts(string(content), ts, api.QueryEngine)
+	if err != nil {
+		return nil, &apiError{errorBadData, err}
+	}
+
+	res := make(alertPreviews, 0, len(alerts))
+	for _, a := range alerts {
+		res = append(res, alertPreview{
+			Name:        a.Name,
+			Labels:      a.Labels,
+			State:       a.State.String(),
+			ActiveSince: a.ActiveSince,
+			Value:       a.Value,
+		})
+	}
+	sort.Sort(res)
+	return res, nil
 }
 
 func (api *API) labelValues(r *http.Request) (interface{}, *apiError) {
@@ -201,6 +595,27 @@ func (api *API) labelValues(r *http.Request) (interface{}, *apiError) {
 	return vals, nil
 }
 
+// functionData describes a function supported by the query language.
+type functionData struct {
+	Name         string            `json:"name"`
+	ArgTypes     []model.ValueType `json:"argTypes"`
+	OptionalArgs int               `json:"optionalArgs"`
+	ReturnType   model.ValueType   `json:"returnType"`
+}
+
+func (api *API) functions(r *http.Request) (interface{}, *apiError) {
+	res := []functionData{}
+	for _, f := range promql.Functions() {
+		res = append(res, functionData{
+			Name:         f.Name,
+			ArgTypes:     f.ArgTypes,
+			OptionalArgs: f.OptionalArgs,
+			ReturnType:   f.ReturnType,
+		})
+	}
+	return res, nil
+}
+
 func (api *API) series(r *http.Request) (interface{}, *apiError) {
 	r.ParseForm()
 	if len(r.Form["match[]"]) == 0 {
@@ -218,6 +633,10 @@ func (api *API) series(r *http.Request) (interface{}, *apiError) {
 		}
 	}
 
+	if r.FormValue("timestamps") == "true" {
+		return api.seriesTimestamps(res)
+	}
+
 	metrics := make([]model.Metric, 0, len(res))
 	for _, met := range res {
 		metrics = append(metrics, met.Metric)
@@ -225,6 +644,35 @@ func (api *API) series(r *http.Request) (interface{}, *apiError) {
 	return metrics, nil
 }
 
+// seriesWithTimestamps is a series together with the timestamps of its oldest
+// and newest sample still in the storage.
+type seriesWithTimestamps struct {
+	Metric      model.Metric `json:"metric"`
+	FirstSample model.Time   `json:"firstSample"`
+	LastSample  model.Time   `json:"lastSample"`
+}
+
+// seriesTimestamps reads the first and last sample timestamps of the given
+// series from the chunk meta-data in memory.
+func (api *API) seriesTimestamps(series map[model.Fingerprint]metric.Metric) (interface{}, *apiError) {
+	res := make([]seriesWithTimestamps, 0, len(series))
+	for fp, met := range series {
+		ranges, err := api.Storage.ChunkRangesForFingerprint(fp)
+		if err != nil {
+			return nil, &apiError{errorExec, err}
+		}
+		if len(ranges) == 0 {
+			continue
+		}
+		res = append(res, seriesWithTimestamps{
+			Metric:      met.Metric,
+			FirstSample: ranges[0].FirstTime,
+			LastSample:  ranges[len(ranges)-1].LastTime,
+		})
+	}
+	return res, nil
+}
+
 func (api *API) dropSeries(r *http.Request) (interface{}, *apiError) {
 	r.ParseForm()
 	if len(r.Form["match[]"]) == 0 {
@@ -253,6 +701,150 @@ func (api *API) dropSeries(r *http.Request) (interface{}, *apiError) {
 	return res, nil
 }
 
+func (api *API) deleteSeries(r *http.Request) (interface{}, *apiError) {
+	r.ParseForm()
+	if len(r.Form["match[]"]) == 0 {
+		return nil, &apiError{errorBadData, fmt.Errorf("no match[] parameter provided")}
+	}
+	in := metric.Interval{OldestInclusive: model.Earliest, NewestInclusive: model.Latest}
+	if t := r.FormValue("start"); t != "" {
+		start, err := parseTime(t)
+		if err != nil {
+			return nil, &apiError{errorBadData, err}
+		}
+		in.OldestInclusive = start
+	}
+	if t := r.FormValue("end"); t != "" {
+		end, err := parseTime(t)
+		if err != nil {
+			return nil, &apiError{errorBadData, err}
+		}
+		in.NewestInclusive = end
+	}
+	if in.NewestInclusive.Before(in.OldestInclusive) {
+		return nil, &apiError{errorBadData, fmt.Errorf("end timestamp must not be before start time")}
+	}
+
+	fps := map[model.Fingerprint]struct{}{}
+	for _, lm := range r.Form["match[]"] {
+		matchers, err := promql.ParseMetricSelector(lm)
+		if err != nil {
+			return nil, &apiError{errorBadData, err}
+		}
+		for fp := range api.Storage.MetricsForLabelMatchers(matchers...) {
+			fps[fp] = struct{}{}
+		}
+	}
+
+	batch := make([]model.Fingerprint, 0, deletionBatchSize)
+	deleteBatch := func() *apiError {
+		if err := api.Storage.DeleteSamplesForFingerprints(in, batch...); err != nil {
+			return &apiError{errorExec, fmt.Errorf("error deleting samples: %s", err)}
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for fp := range fps {
+		batch = append(batch, fp)
+		if len(batch) == deletionBatchSize {
+			if apiErr := deleteBatch(); apiErr != nil {
+				return nil, apiErr
+			}
+		}
+	}
+	if len(batch) > 0 {
+		if apiErr := deleteBatch(); apiErr != nil {
+			return nil, apiErr
+		}
+	}
+
+	res := struct {
+		NumSeries int `json:"numSeries"`
+	}{
+		NumSeries: len(fps),
+	}
+	return res, nil
+}
+
+type seriesChunks struct {
+	Fingerprint string            `json:"fingerprint"`
+	Metric      model.Metric      `json:"metric"`
+	Chunks      []local.ChunkInfo `json:"chunks"`
+}
+
+func (api *API) chunks(r *http.Request) (interface{}, *apiError) {
+	r.ParseForm()
+	if len(r.Form["match[]"]) == 0 && len(r.Form["fingerprint"]) == 0 {
+		return nil, &apiError{errorBadData, fmt.Errorf("no match[] or fingerprint parameter provided")}
+	}
+	fps := map[model.Fingerprint]struct{}{}
+
+	for _, lm := range r.Form["match[]"] {
+		matchers, err := promql.ParseMetricSelector(lm)
+		if err != nil {
+			return nil, &apiError{errorBadData, err}
+		}
+		for fp := range api.Storage.MetricsForLabelMatchers(matchers...) {
+			fps[fp] = struct{}{}
+		}
+	}
+	for _, s := range r.Form["fingerprint"] {
+		fp, err := model.FingerprintFromString(s)
+		if err != nil {
+			return nil, &apiError{errorBadData, fmt.Errorf("invalid fingerprint %q: %s", s, err)}
+		}
+		fps[fp] = struct{}{}
+	}
+
+	sorted := make(model.Fingerprints, 0, len(fps))
+	for fp := range fps {
+		sorted = append(sorted, fp)
+	}
+	sort.Sort(sorted)
+
+	res := []seriesChunks{}
+	for _, fp := range sorted {
+		chunks, err := api.Storage.ChunkInfosForFingerprint(fp)
+		if err != nil {
+			return nil, &apiError{errorExec, err}
+		}
+		if chunks == nil {
+			continue
+		}
+		res = append(res, seriesChunks{
+			Fingerprint: fp.String(),
+			Metric:      api.Storage.MetricForFingerprint(fp).Metric,
+			Chunks:      chunks,
+		})
+	}
+	return res, nil
+}
+
+type snapshotData struct {
+	Name string `json:"name"`
+}
+
+func (api *API) snapshot(r *http.Request) (interface{}, *apiError) {
+	name, err := api.Storage.Snapshot(api.SnapshotDir)
+	if err != nil {
+		return nil, &apiError{errorExec, fmt.Errorf("error creating snapshot: %s", err)}
+	}
+	return snapshotData{Name: name}, nil
+}
+
+func (api *API) listActiveQueries(r *http.Request) (interface{}, *apiError) {
+	return api.activeQueries.list(), nil
+}
+
+func (api *API) cancelQuery(r *http.Request) (interface{}, *apiError) {
+	id := route.Param(api.context(r), "id")
+
+	if !api.activeQueries.cancel(id) {
+		return nil, &apiError{errorBadData, fmt.Errorf("no active query with id %q", id)}
+	}
+	return nil, nil
+}
+
 func respond(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
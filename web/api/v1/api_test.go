@@ -8,15 +8,24 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/route"
 	"golang.org/x/net/context"
 
 	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/prometheus/prometheus/util/testutil"
 )
 
 func TestEndpoints(t *testing.T) {
@@ -155,6 +164,37 @@ func TestEndpoints(t *testing.T) {
 			},
 			errType: errorBadData,
 		},
+		// Invalid range query params.
+		{
+			endpoint: api.queryRange,
+			query: url.Values{
+				"query": []string{"time()"},
+				"start": []string{"2"},
+				"end":   []string{"1"},
+				"step":  []string{"1"},
+			},
+			errType: errorBadData,
+		},
+		{
+			endpoint: api.queryRange,
+			query: url.Values{
+				"query": []string{"time()"},
+				"start": []string{"0"},
+				"end":   []string{"2"},
+				"step":  []string{"0"},
+			},
+			errType: errorBadData,
+		},
+		{
+			endpoint: api.queryRange,
+			query: url.Values{
+				"query": []string{"time()"},
+				"start": []string{"0"},
+				"end":   []string{"2"},
+				"step":  []string{"-1"},
+			},
+			errType: errorBadData,
+		},
 		// Bad query expression.
 		{
 			endpoint: api.query,
@@ -250,6 +290,23 @@ func TestEndpoints(t *testing.T) {
 				},
 			},
 		},
+		{
+			endpoint: api.series,
+			query: url.Values{
+				"match[]":    []string{`test_metric2`},
+				"timestamps": []string{"true"},
+			},
+			response: []seriesWithTimestamps{
+				{
+					Metric: model.Metric{
+						"__name__": "test_metric2",
+						"foo":      "boo",
+					},
+					FirstSample: 0,
+					LastSample:  model.Time(0).Add(100 * time.Minute),
+				},
+			},
+		},
 		// Missing match[] query params in series requests.
 		{
 			endpoint: api.series,
@@ -259,6 +316,73 @@ func TestEndpoints(t *testing.T) {
 			endpoint: api.dropSeries,
 			errType:  errorBadData,
 		},
+		{
+			endpoint: api.chunks,
+			query: url.Values{
+				"match[]": []string{`test_metric2`},
+			},
+			response: []seriesChunks{
+				{
+					Fingerprint: model.Metric{"__name__": "test_metric2", "foo": "boo"}.FastFingerprint().String(),
+					Metric: model.Metric{
+						"__name__": "test_metric2",
+						"foo":      "boo",
+					},
+					Chunks: []local.ChunkInfo{
+						{
+							FirstTime:  0,
+							LastTime:   start.Add(100 * time.Minute),
+							Encoding:   1,
+							NumSamples: 101,
+							InMemory:   true,
+						},
+					},
+				},
+			},
+		},
+		{
+			endpoint: api.chunks,
+			query: url.Values{
+				"fingerprint": []string{model.Metric{"__name__": "test_metric1", "foo": "boo"}.FastFingerprint().String()},
+			},
+			response: []seriesChunks{
+				{
+					Fingerprint: model.Metric{"__name__": "test_metric1", "foo": "boo"}.FastFingerprint().String(),
+					Metric: model.Metric{
+						"__name__": "test_metric1",
+						"foo":      "boo",
+					},
+					Chunks: []local.ChunkInfo{
+						{
+							FirstTime:  0,
+							LastTime:   start.Add(100 * time.Minute),
+							Encoding:   1,
+							NumSamples: 101,
+							InMemory:   true,
+						},
+					},
+				},
+			},
+		},
+		{
+			endpoint: api.chunks,
+			query: url.Values{
+				"fingerprint": []string{"0000000000000001"},
+			},
+			response: []seriesChunks{},
+		},
+		// Missing or invalid parameters in chunks requests.
+		{
+			endpoint: api.chunks,
+			errType:  errorBadData,
+		},
+		{
+			endpoint: api.chunks,
+			query: url.Values{
+				"fingerprint": []string{"not-a-fingerprint"},
+			},
+			errType: errorBadData,
+		},
 		// The following tests delete time series from the test storage. They
 		// must remain at the end and are fixed in their order.
 		{
@@ -327,6 +451,704 @@ func TestEndpoints(t *testing.T) {
 	}
 }
 
+// blockingStorage blocks label matcher lookups until unblock is closed.
+type blockingStorage struct {
+	local.Storage
+	entered chan struct{}
+	unblock chan struct{}
+}
+
+func (s *blockingStorage) MetricsForLabelMatchers(matchers ...*metric.LabelMatcher) map[model.Fingerprint]metric.Metric {
+	close(s.entered)
+	<-s.unblock
+	return s.Storage.MetricsForLabelMatchers(matchers...)
+}
+
+func TestActiveQueries(t *testing.T) {
+	suite, err := promql.NewTest(t, `
+		load 1m
+			test_metric1{foo="bar"} 0+100x100
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+
+	if err := suite.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	st := &blockingStorage{
+		Storage: suite.Storage(),
+		entered: make(chan struct{}),
+		unblock: make(chan struct{}),
+	}
+	api := &API{
+		Storage:     st,
+		QueryEngine: promql.NewEngine(st, nil),
+		now:         model.Now,
+	}
+
+	if active, _ := api.listActiveQueries(nil); len(active.([]activeQuery)) != 0 {
+		t.Fatalf("Expected no active queries, got %v", active)
+	}
+
+	req, err := http.NewRequest("GET", "http://example.org/?query=test_metric1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "127.0.0.1:4711"
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, apiErr := api.query(req); apiErr != nil {
+			t.Errorf("Unexpected error: %s", apiErr)
+		}
+	}()
+	<-st.entered
+
+	resp, apiErr := api.listActiveQueries(nil)
+	if apiErr != nil {
+		t.Fatalf("Unexpected error: %s", apiErr)
+	}
+	active := resp.([]activeQuery)
+	if len(active) != 1 {
+		t.Fatalf("Expected one active query, got %v", active)
+	}
+	if active[0].Expr != "test_metric1" || active[0].Client != "127.0.0.1:4711" || active[0].Duration < 0 {
+		t.Fatalf("Unexpected active query %+v", active[0])
+	}
+
+	close(st.unblock)
+	<-done
+
+	if active, _ := api.listActiveQueries(nil); len(active.([]activeQuery)) != 0 {
+		t.Fatalf("Expected no active queries after completion, got %v", active)
+	}
+}
+
+func TestCancelQuery(t *testing.T) {
+	suite, err := promql.NewTest(t, `
+		load 1m
+			test_metric1{foo="bar"} 0+100x100
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+
+	if err := suite.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	st := &blockingStorage{
+		Storage: suite.Storage(),
+		entered: make(chan struct{}),
+		unblock: make(chan struct{}),
+	}
+	api := &API{
+		Storage:     st,
+		QueryEngine: promql.NewEngine(st, nil),
+		now:         model.Now,
+	}
+	cancelReq := func(id string) *apiError {
+		api.context = func(r *http.Request) context.Context {
+			return route.WithParam(context.Background(), "id", id)
+		}
+		_, apiErr := api.cancelQuery(nil)
+		return apiErr
+	}
+
+	req, err := http.NewRequest("GET", "http://example.org/?query=test_metric1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan *apiError)
+	go func() {
+		_, apiErr := api.query(req)
+		errc <- apiErr
+	}()
+	<-st.entered
+
+	if apiErr := cancelReq("4711"); apiErr == nil || apiErr.typ != errorBadData {
+		t.Fatalf("Expected error of type %q for unknown query id, got %v", errorBadData, apiErr)
+	}
+
+	resp, _ := api.listActiveQueries(nil)
+	active := resp.([]activeQuery)
+	if len(active) != 1 {
+		t.Fatalf("Expected one active query, got %v", active)
+	}
+	if apiErr := cancelReq(active[0].ID); apiErr != nil {
+		t.Fatalf("Unexpected error: %s", apiErr)
+	}
+	close(st.unblock)
+
+	apiErr := <-errc
+	if apiErr == nil || apiErr.typ != errorCanceled {
+		t.Fatalf("Expected error of type %q, got %v", errorCanceled, apiErr)
+	}
+	if active, _ := api.listActiveQueries(nil); len(active.([]activeQuery)) != 0 {
+		t.Fatalf("Expected no active queries after cancelation, got %v", active)
+	}
+}
+
+func TestQueryBatch(t *testing.T) {
+	suite, err := promql.NewTest(t, `
+		load 1m
+			test_metric1{foo="bar"} 0+100x100
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+
+	if err := suite.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	api := &API{
+		Storage:     suite.Storage(),
+		QueryEngine: suite.QueryEngine(),
+		now:         func() model.Time { return model.Time(0) },
+	}
+
+	body := `[
+		{"expr": "test_metric1", "time": "120"},
+		{"expr": "test_metric1{"},
+		{"expr": "2", "time": "invalid"},
+		{"expr": "time()"}
+	]`
+	req, err := http.NewRequest("POST", "http://example.org/", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, apiErr := api.queryBatch(req)
+	if apiErr != nil {
+		t.Fatalf("Unexpected error: %s", apiErr)
+	}
+
+	results := resp.([]*response)
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 results, got %d", len(results))
+	}
+	expected := &response{
+		Status: statusSuccess,
+		Data: &queryData{
+			ResultType: model.ValVector,
+			Result: model.Vector{
+				{
+					Metric:    model.Metric{"__name__": "test_metric1", "foo": "bar"},
+					Value:     200,
+					Timestamp: model.Time(120000),
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(results[0], expected) {
+		t.Errorf("Unexpected first result, expected:\n%+v\ngot:\n%+v", expected, results[0])
+	}
+	for _, i := range []int{1, 2} {
+		if results[i].Status != statusError || results[i].ErrorType != errorBadData || results[i].Error == "" {
+			t.Errorf("Expected bad data error for result %d, got %+v", i, results[i])
+		}
+	}
+	expected = &response{
+		Status: statusSuccess,
+		Data: &queryData{
+			ResultType: model.ValScalar,
+			Result:     &model.Scalar{Value: 0, Timestamp: 0},
+		},
+	}
+	if !reflect.DeepEqual(results[3], expected) {
+		t.Errorf("Unexpected last result, expected:\n%+v\ngot:\n%+v", expected, results[3])
+	}
+
+	req, err = http.NewRequest("POST", "http://example.org/", strings.NewReader(`{"expr": "1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, apiErr := api.queryBatch(req); apiErr == nil || apiErr.typ != errorBadData {
+		t.Errorf("Expected bad data error for invalid batch, got %v", apiErr)
+	}
+}
+
+func TestQueryExplain(t *testing.T) {
+	var load string
+	for i := 0; i < 50; i++ {
+		load += fmt.Sprintf("test_metric{instance=\"%d\"} 0+1x100\n", i)
+	}
+	suite, err := promql.NewTest(t, "load 1m\n"+load)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+
+	if err := suite.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	api := &API{
+		Storage:     suite.Storage(),
+		QueryEngine: suite.QueryEngine(),
+		now:         func() model.Time { return model.Time(0).Add(50 * time.Minute) },
+		context: func(r *http.Request) context.Context {
+			return context.Background()
+		},
+	}
+
+	explain := func(q url.Values) *explainData {
+		req, err := http.NewRequest("GET", "http://example.org/?"+q.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, apiErr := api.queryExplain(req)
+		if apiErr != nil {
+			t.Fatalf("Unexpected error for %v: %s", q, apiErr.err)
+		}
+		return resp.(*explainData)
+	}
+
+	broad := explain(url.Values{"query": []string{`sum(rate(test_metric[5m]))`}})
+	if broad.Series != 50 {
+		t.Errorf("Expected 50 series for broad selector, got %d", broad.Series)
+	}
+	if broad.Chunks < broad.Series {
+		t.Errorf("Expected at least one chunk per series, got %d chunks", broad.Chunks)
+	}
+	if broad.Expr != `sum(rate(test_metric[5m]))` || !strings.Contains(broad.Tree, "MatrixSelector") {
+		t.Errorf("Unexpected expression %q or tree:\n%s", broad.Expr, broad.Tree)
+	}
+
+	narrow := explain(url.Values{
+		"query": []string{`test_metric{instance="1"}`},
+		"start": []string{"0"},
+		"end":   []string{"3000"},
+	})
+	if narrow.Series != 1 || narrow.Chunks != 1 {
+		t.Errorf("Expected 1 series and chunk for narrow selector, got %d series and %d chunks", narrow.Series, narrow.Chunks)
+	}
+
+	// Nothing is preloaded or evaluated.
+	none := explain(url.Values{"query": []string{`test_metric{instance="none"}`}})
+	if none.Series != 0 || none.Chunks != 0 {
+		t.Errorf("Expected no series and chunks for non-matching selector, got %d series and %d chunks", none.Series, none.Chunks)
+	}
+
+	req, err := http.NewRequest("GET", "http://example.org/?query=sum(", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, apiErr := api.queryExplain(req); apiErr == nil || apiErr.typ != errorBadData {
+		t.Errorf("Expected bad data error for invalid expression, got %v", apiErr)
+	}
+}
+
+// fakeStorageClient records the batches of samples stored in it.
+type fakeStorageClient struct {
+	name    string
+	err     error
+	batches []model.Samples
+}
+
+func (c *fakeStorageClient) Store(s model.Samples) error {
+	if c.err != nil {
+		return c.err
+	}
+	batch := make(model.Samples, len(s))
+	copy(batch, s)
+	c.batches = append(c.batches, batch)
+	return nil
+}
+
+func (c *fakeStorageClient) Name() string {
+	return c.name
+}
+
+func TestExportQuery(t *testing.T) {
+	var load string
+	for i := 0; i < 30; i++ {
+		load += fmt.Sprintf("test_metric{instance=\"%d\"} 0+1x10\n", i)
+	}
+	suite, err := promql.NewTest(t, "load 1m\n"+load)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+
+	if err := suite.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &fakeStorageClient{name: "fake"}
+	failing := &fakeStorageClient{name: "failing", err: errors.New("remote down")}
+	api := &API{
+		Storage:       suite.Storage(),
+		QueryEngine:   suite.QueryEngine(),
+		RemoteClients: []remote.StorageClient{client, failing},
+		now:           model.Now,
+		context: func(r *http.Request) context.Context {
+			return context.Background()
+		},
+	}
+
+	export := func(name string) (*exportData, *apiError) {
+		q := url.Values{
+			"query":  []string{"test_metric"},
+			"start":  []string{"0"},
+			"end":    []string{"600"},
+			"step":   []string{"60"},
+			"remote": []string{name},
+		}
+		req, err := http.NewRequest("POST", "http://example.org/?"+q.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, apiErr := api.exportQuery(req)
+		if resp == nil {
+			return nil, apiErr
+		}
+		return resp.(*exportData), apiErr
+	}
+
+	data, apiErr := export("fake")
+	if apiErr != nil {
+		t.Fatalf("Unexpected error: %s", apiErr.err)
+	}
+	expected := &exportData{Remote: "fake", Series: 30, Samples: 330}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("Unexpected export summary, expected %+v, got %+v", expected, data)
+	}
+	received := map[model.Fingerprint]model.Samples{}
+	total := 0
+	for _, b := range client.batches {
+		if len(b) > exportBatchSize {
+			t.Errorf("Expected batches of at most %d samples, got %d", exportBatchSize, len(b))
+		}
+		for _, s := range b {
+			fp := s.Metric.Fingerprint()
+			received[fp] = append(received[fp], s)
+			total++
+		}
+	}
+	if total != 330 || len(received) != 30 {
+		t.Fatalf("Expected 330 samples of 30 series to reach the remote storage, got %d samples of %d series", total, len(received))
+	}
+	for _, ss := range received {
+		for i, s := range ss {
+			if s.Timestamp != model.Time(i*60*1000) || s.Value != model.SampleValue(i) {
+				t.Errorf("Unexpected sample %d of %s: %v", i, s.Metric, s)
+			}
+		}
+	}
+
+	if _, apiErr := export("unknown"); apiErr == nil || apiErr.typ != errorBadData {
+		t.Errorf("Expected bad data error for unknown remote storage, got %v", apiErr)
+	}
+	if _, apiErr := export(""); apiErr == nil || apiErr.typ != errorBadData {
+		t.Errorf("Expected bad data error for ambiguous remote storage, got %v", apiErr)
+	}
+	data, apiErr = export("failing")
+	if apiErr == nil || apiErr.typ != errorExec || !strings.Contains(apiErr.err.Error(), "remote down") {
+		t.Errorf("Expected execution error for failing remote storage, got %v", apiErr)
+	}
+	if data == nil || data.Samples != 0 {
+		t.Errorf("Expected no exported samples for failing remote storage, got %+v", data)
+	}
+}
+
+func TestPreviewAlerts(t *testing.T) {
+	suite, err := promql.NewTest(t, `
+		load 1m
+			http_errors{instance="a"} 0+10x10
+			http_errors{instance="b"} 0+1x10
+			http_errors{instance="c"} 0+20x10
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+
+	if err := suite.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	api := &API{
+		Storage:     suite.Storage(),
+		QueryEngine: suite.QueryEngine(),
+		now:         func() model.Time { return model.Time(10 * 60 * 1000) },
+	}
+
+	preview := func(ruleFile string) (alertPreviews, *apiError) {
+		req, err := http.NewRequest("POST", "http://example.org/", strings.NewReader(ruleFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, apiErr := api.previewAlerts(req)
+		if resp == nil {
+			return nil, apiErr
+		}
+		return resp.(alertPreviews), apiErr
+	}
+
+	res, apiErr := preview(`
+		ALERT HighErrors
+			IF http_errors > 50
+			WITH {severity="page"}
+			SUMMARY "High error count"
+			DESCRIPTION "{{$labels.instance}} has many errors"
+		ALERT HighErrorsHolding
+			IF http_errors > 150
+			FOR 5m
+			SUMMARY "High error count"
+			DESCRIPTION "{{$labels.instance}} has many errors"
+		errors:sum = sum(http_errors)
+	`)
+	if apiErr != nil {
+		t.Fatalf("Unexpected error: %s", apiErr.err)
+	}
+	expected := alertPreviews{
+		{
+			Name:        "HighErrors",
+			Labels:      model.LabelSet{"instance": "a", "severity": "page"},
+			State:       "firing",
+			ActiveSince: model.Time(10 * 60 * 1000),
+			Value:       100,
+		},
+		{
+			Name:        "HighErrors",
+			Labels:      model.LabelSet{"instance": "c", "severity": "page"},
+			State:       "firing",
+			ActiveSince: model.Time(10 * 60 * 1000),
+			Value:       200,
+		},
+		{
+			Name:        "HighErrorsHolding",
+			Labels:      model.LabelSet{"instance": "c"},
+			State:       "pending",
+			ActiveSince: model.Time(10 * 60 * 1000),
+			Value:       200,
+		},
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Unexpected alerts, expected %+v, got %+v", expected, res)
+	}
+
+	if _, apiErr := preview("ALERT Broken IF"); apiErr == nil || apiErr.typ != errorBadData {
+		t.Errorf("Expected bad data error for invalid rule file, got %v", apiErr)
+	}
+}
+
+func TestQueryDataWarnings(t *testing.T) {
+	res := &promql.Result{
+		Value: model.Vector{},
+		Warnings: []error{
+			&local.ChunkDecodeError{Fingerprint: 1, NumChunks: 2, Err: errors.New("unknown chunk encoding 255")},
+		},
+	}
+	expected := &queryData{
+		ResultType: model.ValVector,
+		Result:     model.Vector{},
+		Warnings:   []string{"could not decode 2 chunk(s) of series 0000000000000001, skipping them: unknown chunk encoding 255"},
+	}
+	if qd := newQueryData(res); !reflect.DeepEqual(qd, expected) {
+		t.Errorf("Unexpected query data, expected %+v, got %+v", expected, qd)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	suite, err := promql.NewTest(t, `
+		load 1m
+			test_metric{foo="bar"} 0+100x100
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+
+	if err := suite.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := testutil.NewTemporaryDirectory("test_snapshot", t)
+	defer dir.Close()
+
+	api := &API{
+		Storage:     suite.Storage(),
+		QueryEngine: suite.QueryEngine(),
+		SnapshotDir: dir.Path(),
+	}
+	resp, apiErr := api.snapshot(&http.Request{})
+	if apiErr != nil {
+		t.Fatalf("Unexpected error: %s", apiErr)
+	}
+	name := resp.(snapshotData).Name
+	if _, err := ioutil.ReadFile(filepath.Join(dir.Path(), name, "heads.db")); err != nil {
+		t.Fatalf("Expected snapshot %q to contain a checkpoint: %s", name, err)
+	}
+}
+
+func TestDeleteSeries(t *testing.T) {
+	suite, err := promql.NewTest(t, `
+		load 1m
+			test_metric{foo="bar"} 0+100x100
+			test_metric{foo="baz"} 0+100x100
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+
+	if err := suite.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	api := &API{
+		Storage:     suite.Storage(),
+		QueryEngine: suite.QueryEngine(),
+	}
+	deleteSeries := func(query url.Values) (interface{}, *apiError) {
+		req, err := http.NewRequest("POST", "http://example.org/?"+query.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return api.deleteSeries(req)
+	}
+
+	for _, query := range []url.Values{
+		{},
+		{"match[]": []string{`test_metric`}, "start": []string{"invalid"}},
+		{"match[]": []string{`test_metric`}, "start": []string{"1200"}, "end": []string{"600"}},
+	} {
+		if _, apiErr := deleteSeries(query); apiErr == nil || apiErr.typ != errorBadData {
+			t.Errorf("Expected bad data error for %v, got %v", query, apiErr)
+		}
+	}
+
+	resp, apiErr := deleteSeries(url.Values{
+		"match[]": []string{`test_metric{foo="bar"}`},
+		"start":   []string{"600"},
+		"end":     []string{"1200"},
+	})
+	if apiErr != nil {
+		t.Fatalf("Unexpected error: %s", apiErr)
+	}
+	expected := struct {
+		NumSeries int `json:"numSeries"`
+	}{1}
+	if !reflect.DeepEqual(resp, expected) {
+		t.Fatalf("Unexpected response, expected %+v, got %+v", expected, resp)
+	}
+	if _, apiErr := deleteSeries(url.Values{"match[]": []string{`test_metric{foo="baz"}`}}); apiErr != nil {
+		t.Fatalf("Unexpected error: %s", apiErr)
+	}
+
+	q, err := suite.QueryEngine().NewInstantQuery(`count_over_time(test_metric[101m])`, model.Time(0).Add(100*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := q.Exec()
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	vec := res.Value.(model.Vector)
+	// 11 of the 101 samples of the first series are deleted, and the
+	// second series is gone entirely.
+	if len(vec) != 1 || vec[0].Value != 90 {
+		t.Fatalf("Unexpected query result after deletion: %v", vec)
+	}
+}
+
+func TestCounters(t *testing.T) {
+	dropped := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "test_api_samples_dropped_total",
+		Help: "Samples dropped in the counter API test.",
+	}, []string{"reason"})
+	prometheus.MustRegister(dropped)
+	defer prometheus.Unregister(dropped)
+
+	api := &API{counters: gatherCounters}
+
+	call := func(f apiFunc, selector string) model.Vector {
+		req, err := http.NewRequest("GET", "http://example.org/?match[]="+url.QueryEscape(selector), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, apiErr := f(req)
+		if apiErr != nil {
+			t.Fatalf("Unexpected error: %s", apiErr)
+		}
+		if resp == nil {
+			return nil
+		}
+		return resp.(model.Vector)
+	}
+	values := func(selector string) map[model.LabelValue]model.SampleValue {
+		res := map[model.LabelValue]model.SampleValue{}
+		for _, s := range call(api.listCounters, selector) {
+			res[s.Metric["reason"]] = s.Value
+		}
+		return res
+	}
+
+	dropped.WithLabelValues("full").Add(3)
+	dropped.WithLabelValues("relabel").Add(2)
+
+	expected := map[model.LabelValue]model.SampleValue{"full": 3, "relabel": 2}
+	if got := values("test_api_samples_dropped_total"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+
+	// Resetting only affects the selected counters.
+	call(api.resetCounters, `test_api_samples_dropped_total{reason="full"}`)
+	dropped.WithLabelValues("full").Inc()
+
+	expected = map[model.LabelValue]model.SampleValue{"full": 1, "relabel": 2}
+	if got := values("test_api_samples_dropped_total"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v after reset, got %v", expected, got)
+	}
+	expected = map[model.LabelValue]model.SampleValue{"relabel": 2}
+	if got := values(`test_api_samples_dropped_total{reason="relabel"}`); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v for selected counter, got %v", expected, got)
+	}
+
+	// The counters themselves are left untouched.
+	var m dto.Metric
+	dropped.WithLabelValues("full").Write(&m)
+	if v := m.GetCounter().GetValue(); v != 4 {
+		t.Errorf("Expected counter to remain at 4, got %v", v)
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	api := &API{}
+	req, err := http.NewRequest("GET", "http://example.org/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, apiErr := api.functions(req)
+	if apiErr != nil {
+		t.Fatalf("Unexpected error: %s", apiErr.err)
+	}
+	var rate *functionData
+	for _, f := range resp.([]functionData) {
+		if f.Name == "rate" {
+			f := f
+			rate = &f
+		}
+	}
+	expected := &functionData{
+		Name:       "rate",
+		ArgTypes:   []model.ValueType{model.ValMatrix},
+		ReturnType: model.ValVector,
+	}
+	if !reflect.DeepEqual(rate, expected) {
+		t.Errorf("Unexpected rate function, expected:\n%+v\ngot:\n%+v", expected, rate)
+	}
+}
+
 func TestRespondSuccess(t *testing.T) {
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		respond(w, "test")
@@ -503,3 +1325,109 @@ func TestParseDuration(t *testing.T) {
 		}
 	}
 }
+
+func TestQueryLog(t *testing.T) {
+	suite, err := promql.NewTest(t, `
+		load 1m
+			test_metric{foo="bar"} 0+100x100
+			test_metric{foo="boo"} 1+0x100
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer suite.Close()
+
+	if err := suite.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := testutil.NewTemporaryDirectory("test_query_log", t)
+	defer dir.Close()
+	filename := filepath.Join(dir.Path(), "queries.log")
+
+	queryLog, err := NewQueryLog(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queryLog.Close()
+
+	api := &API{
+		Storage:     suite.Storage(),
+		QueryEngine: suite.QueryEngine(),
+		QueryLog:    queryLog,
+		now:         func() model.Time { return model.Time(0) },
+	}
+
+	request := func(f apiFunc, query url.Values) {
+		req, err := http.NewRequest("GET", "http://example.org/?"+query.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "127.0.0.1:1234"
+		f(req)
+	}
+	readLog := func(filename string) []queryLogEntry {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []queryLogEntry
+		for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+			var e queryLogEntry
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatalf("Error decoding query log line %q: %s", line, err)
+			}
+			entries = append(entries, e)
+		}
+		return entries
+	}
+
+	request(api.queryRange, url.Values{
+		"query": []string{"test_metric"},
+		"start": []string{"0"},
+		"end":   []string{"120"},
+		"step":  []string{"60"},
+	})
+	request(api.query, url.Values{
+		"query": []string{"sum(test_metric)"},
+		"time":  []string{"60"},
+	})
+
+	entries := readLog(filename)
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 logged queries, got %v", entries)
+	}
+	e := entries[0]
+	if e.Expr != "test_metric" || e.Start != 0 || e.End != model.TimeFromUnix(120) || e.Step != 60 || e.Series != 2 || e.Client != "127.0.0.1:1234" || e.Error != "" {
+		t.Errorf("Unexpected range query log entry %+v", e)
+	}
+	e = entries[1]
+	if e.Expr != "sum(test_metric)" || e.Start != model.TimeFromUnix(60) || e.End != model.TimeFromUnix(60) || e.Step != 0 || e.Series != 1 {
+		t.Errorf("Unexpected instant query log entry %+v", e)
+	}
+
+	// After rotating the log, queries are logged to a new file.
+	rotated := filename + ".1"
+	if err := os.Rename(filename, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := queryLog.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	request(api.query, url.Values{"query": []string{"test_metric{"}})
+	request(api.query, url.Values{"query": []string{"time() + 1"}})
+	if entries := readLog(rotated); len(entries) != 2 {
+		t.Errorf("Expected 2 queries in the rotated log, got %v", entries)
+	}
+	// Queries that fail to parse are not executed and thus not logged.
+	if entries := readLog(filename); len(entries) != 1 || entries[0].Expr != "time() + 1" {
+		t.Errorf("Expected 1 query in the new log, got %v", entries)
+	}
+
+	// Queries faster than the slow threshold are not logged.
+	queryLog.slowThreshold = time.Hour
+	request(api.query, url.Values{"query": []string{"test_metric"}})
+	if entries := readLog(filename); len(entries) != 1 {
+		t.Errorf("Expected fast query not to be logged, got %v", entries)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// The counter endpoints let integration tests assert on the internal counters
+// of a Prometheus server without computing deltas of /metrics themselves.
+// They are only registered if Prometheus is built with the testapi build tag
+// and the admin API is enabled, see counterAPIEnabled. Resetting a counter
+// does not change the counter itself, it only moves the baseline the values
+// returned by the endpoints are relative to.
+
+// counterBaselines holds the values counters had when they were last reset
+// via the API. The zero value is ready to use.
+type counterBaselines struct {
+	mtx    sync.Mutex
+	values map[model.Fingerprint]model.SampleValue
+}
+
+// relative returns the counters relative to their baselines. Counters that
+// went below their baseline have been recreated since and are returned
+// unchanged.
+func (cb *counterBaselines) relative(counters model.Vector) model.Vector {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	res := make(model.Vector, 0, len(counters))
+	for _, s := range counters {
+		v := s.Value
+		if base, ok := cb.values[s.Metric.Fingerprint()]; ok && base <= v {
+			v -= base
+		}
+		res = append(res, &model.Sample{Metric: s.Metric, Value: v, Timestamp: s.Timestamp})
+	}
+	return res
+}
+
+// reset makes the current values of the given counters their new baselines.
+func (cb *counterBaselines) reset(counters model.Vector) {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	if cb.values == nil {
+		cb.values = map[model.Fingerprint]model.SampleValue{}
+	}
+	for _, s := range counters {
+		cb.values[s.Metric.Fingerprint()] = s.Value
+	}
+}
+
+// familyBuffer is an http.ResponseWriter buffering the metric families written
+// by a registry.
+type familyBuffer struct {
+	bytes.Buffer
+	header http.Header
+	code   int
+}
+
+func (b *familyBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *familyBuffer) WriteHeader(code int) {
+	b.code = code
+}
+
+// gatherMetricFamilies returns the metric families collected by the default
+// Prometheus registry. The vendored client library provides no direct access
+// to the registry, so the families are requested from it in the delimited
+// protocol buffer format and decoded without going through the text format.
+func gatherMetricFamilies() ([]*dto.MetricFamily, error) {
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", string(expfmt.FmtProtoDelim))
+	buf := &familyBuffer{header: http.Header{}, code: http.StatusOK}
+	prometheus.UninstrumentedHandler().ServeHTTP(buf, req)
+	if buf.code != http.StatusOK {
+		return nil, fmt.Errorf("error collecting metrics: %s", bytes.TrimSpace(buf.Bytes()))
+	}
+
+	var families []*dto.MetricFamily
+	dec := expfmt.NewDecoder(buf, expfmt.FmtProtoDelim)
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); err == io.EOF {
+			return families, nil
+		} else if err != nil {
+			return nil, err
+		}
+		families = append(families, mf)
+	}
+}
+
+// gatherCounters returns the current values of all counters registered with
+// the default Prometheus registry.
+func gatherCounters() (model.Vector, error) {
+	families, err := gatherMetricFamilies()
+	if err != nil {
+		return nil, err
+	}
+
+	now := model.Now()
+	var counters model.Vector
+	for _, mf := range families {
+		if mf.GetType() != dto.MetricType_COUNTER {
+			continue
+		}
+		for _, m := range mf.Metric {
+			met := model.Metric{model.MetricNameLabel: model.LabelValue(mf.GetName())}
+			for _, lp := range m.Label {
+				met[model.LabelName(lp.GetName())] = model.LabelValue(lp.GetValue())
+			}
+			counters = append(counters, &model.Sample{
+				Metric:    met,
+				Value:     model.SampleValue(m.GetCounter().GetValue()),
+				Timestamp: now,
+			})
+		}
+	}
+	return counters, nil
+}
+
+// selectCounters returns the current counters matching any of the match[]
+// selectors of the request, or all counters if there are none.
+func (api *API) selectCounters(r *http.Request) (model.Vector, *apiError) {
+	r.ParseForm()
+	var matcherSets []metric.LabelMatchers
+	for _, s := range r.Form["match[]"] {
+		matchers, err := promql.ParseMetricSelector(s)
+		if err != nil {
+			return nil, &apiError{errorBadData, err}
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+
+	counters, err := api.counters()
+	if err != nil {
+		return nil, &apiError{errorExec, fmt.Errorf("error gathering counters: %s", err)}
+	}
+	if len(matcherSets) == 0 {
+		return counters, nil
+	}
+
+	var res model.Vector
+	for _, s := range counters {
+		for _, matchers := range matcherSets {
+			if matchesAll(s.Metric, matchers) {
+				res = append(res, s)
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
+func matchesAll(m model.Metric, matchers metric.LabelMatchers) bool {
+	for _, lm := range matchers {
+		if !lm.Match(m[lm.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (api *API) listCounters(r *http.Request) (interface{}, *apiError) {
+	counters, apiErr := api.selectCounters(r)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	res := api.counterBaselines.relative(counters)
+	sort.Sort(res)
+	return res, nil
+}
+
+func (api *API) resetCounters(r *http.Request) (interface{}, *apiError) {
+	counters, apiErr := api.selectCounters(r)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	api.counterBaselines.reset(counters)
+	return nil, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/promql"
+)
+
+// queryLogEntry is a line of the query log.
+type queryLogEntry struct {
+	Time     time.Time  `json:"time"`
+	Client   string     `json:"client"`
+	Expr     string     `json:"expr"`
+	Start    model.Time `json:"start"`
+	End      model.Time `json:"end"`
+	Step     float64    `json:"stepSeconds,omitempty"`
+	Duration float64    `json:"durationSeconds"`
+	Series   int        `json:"series"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// A QueryLog writes the queries executed via the API to a file, one JSON
+// object per line. It is goroutine-safe.
+type QueryLog struct {
+	filename      string
+	slowThreshold time.Duration
+
+	mtx  sync.Mutex
+	file *os.File
+}
+
+// NewQueryLog opens the query log file with the given name for appending.
+// Only queries taking at least slowThreshold are logged.
+func NewQueryLog(filename string, slowThreshold time.Duration) (*QueryLog, error) {
+	f, err := openQueryLogFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &QueryLog{
+		filename:      filename,
+		slowThreshold: slowThreshold,
+		file:          f,
+	}, nil
+}
+
+func openQueryLogFile(filename string) (*os.File, error) {
+	return os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+}
+
+// Reopen closes and reopens the query log file, e.g. after it has been
+// rotated. The old file is kept in use if the file cannot be opened.
+func (l *QueryLog) Reopen() error {
+	f, err := openQueryLogFile(l.filename)
+	if err != nil {
+		return err
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	old := l.file
+	l.file = f
+	return old.Close()
+}
+
+// Close closes the query log file.
+func (l *QueryLog) Close() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.file.Close()
+}
+
+// log logs the query with the given expression, issued by the given request,
+// if it took at least the slow threshold.
+func (l *QueryLog) log(qry promql.Query, expr string, took time.Duration, res *promql.Result, r *http.Request) {
+	if took < l.slowThreshold {
+		return
+	}
+	entry := queryLogEntry{
+		Time:     time.Now().UTC(),
+		Client:   r.RemoteAddr,
+		Expr:     expr,
+		Duration: took.Seconds(),
+	}
+	if s, ok := qry.Statement().(*promql.EvalStmt); ok {
+		entry.Start, entry.End = s.Start, s.End
+		entry.Step = s.Interval.Seconds()
+	}
+	if res.Err != nil {
+		entry.Error = res.Err.Error()
+	} else {
+		switch v := res.Value.(type) {
+		case model.Vector:
+			entry.Series = len(v)
+		case model.Matrix:
+			entry.Series = len(v)
+		default:
+			entry.Series = 1
+		}
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("Error encoding query log entry: %s", err)
+		return
+	}
+	b = append(b, '\n')
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if _, err := l.file.Write(b); err != nil {
+		log.Errorf("Error writing to query log %s: %s", l.filename, err)
+	}
+}
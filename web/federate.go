@@ -60,11 +60,15 @@ func (h *Handler) federation(w http.ResponseWriter, req *http.Request) {
 		Type:   dto.MetricType_UNTYPED.Enum(),
 	}
 
+	// Like in an instant vector evaluated now, series without samples
+	// within the staleness delta or marked stale are left out.
+	minTimestamp := model.Now().Add(-promql.StalenessDelta)
+
 	for fp, met := range metrics {
 		globalUsed := map[model.LabelName]struct{}{}
 
 		sp := h.storage.LastSamplePairForFingerprint(fp)
-		if sp == nil {
+		if sp == nil || sp.Timestamp.Before(minTimestamp) || metric.IsStaleNaN(sp.Value) {
 			continue
 		}
 
@@ -0,0 +1,136 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/storage/local"
+)
+
+func TestFederation(t *testing.T) {
+	st, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+
+	now := model.Now()
+	samples := []*model.Sample{
+		{
+			Metric:    model.Metric{model.MetricNameLabel: "test_metric", "foo": "bar"},
+			Timestamp: now.Add(-time.Minute),
+			Value:     1,
+		},
+		{
+			Metric:    model.Metric{model.MetricNameLabel: "test_metric", "foo": "baz", "zone": "b"},
+			Timestamp: now.Add(-2 * time.Minute),
+			Value:     2,
+		},
+		// Stale series are not federated.
+		{
+			Metric:    model.Metric{model.MetricNameLabel: "test_metric", "foo": "stale"},
+			Timestamp: now.Add(-time.Hour),
+			Value:     3,
+		},
+		{
+			Metric:    model.Metric{model.MetricNameLabel: "other_metric"},
+			Timestamp: now.Add(-time.Minute),
+			Value:     4,
+		},
+	}
+	for _, s := range samples {
+		st.Append(s)
+	}
+	st.WaitForIndexing()
+
+	h := &Handler{
+		storage:        st,
+		externalLabels: model.LabelSet{"zone": "a"},
+	}
+
+	scenarios := []struct {
+		params   string
+		code     int
+		expected []string
+	}{
+		{
+			params: "match[]=test_metric",
+			code:   http.StatusOK,
+			expected: []string{
+				fmt.Sprintf(`test_metric{foo="bar", zone="a"} 1 %d`, now.Add(-time.Minute)),
+				// External labels do not override the labels of series.
+				fmt.Sprintf(`test_metric{foo="baz", zone="b"} 2 %d`, now.Add(-2*time.Minute)),
+			},
+		},
+		{
+			params: "match[]=test_metric{foo=\"bar\"}&match[]=other_metric",
+			code:   http.StatusOK,
+			expected: []string{
+				fmt.Sprintf(`other_metric{zone="a"} 4 %d`, now.Add(-time.Minute)),
+				fmt.Sprintf(`test_metric{foo="bar", zone="a"} 1 %d`, now.Add(-time.Minute)),
+			},
+		},
+		{
+			params: "match[]=invalid{",
+			code:   http.StatusBadRequest,
+		},
+	}
+
+	for i, s := range scenarios {
+		req, err := http.NewRequest("GET", "/federate?"+s.params, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		h.federation(rec, req)
+
+		if rec.Code != s.code {
+			t.Errorf("%d. expected status code %d, got %d", i, s.code, rec.Code)
+			continue
+		}
+		if s.code != http.StatusOK {
+			continue
+		}
+		// Labels are exposed in no particular order, so compare the
+		// parsed samples. Every series is exposed as its own metric
+		// family, so parse them one by one.
+		var got []string
+		for _, l := range strings.Split(rec.Body.String(), "\n") {
+			if l == "" || strings.HasPrefix(l, "#") {
+				continue
+			}
+			var parser expfmt.TextParser
+			families, err := parser.TextToMetricFamilies(strings.NewReader(l + "\n"))
+			if err != nil {
+				t.Fatalf("%d. error parsing federated series %q: %s", i, l, err)
+			}
+			for _, mf := range families {
+				for _, s := range expfmt.ExtractSamples(&expfmt.DecodeOptions{}, mf) {
+					got = append(got, fmt.Sprintf("%s %v %d", s.Metric, s.Value, s.Timestamp))
+				}
+			}
+		}
+		sort.Strings(got)
+		if strings.Join(got, "\n") != strings.Join(s.expected, "\n") {
+			t.Errorf("%d. expected series\n%s\ngot\n%s", i, strings.Join(s.expected, "\n"), strings.Join(got, "\n"))
+		}
+	}
+}
@@ -119,7 +119,7 @@ func webUiTemplates_baseHtml() (*asset, error) {
 	return a, nil
 }
 
-var _webUiTemplatesAlertsHtml = []byte("\x1f\x8b\x08\x00\x00\x09\x6e\x88\x00\xff\x8c\x54\x4d\x8f\x9b\x30\x10\xbd\xef\xaf\xb0\xd0\x1e\x5a\xa9\x80\xd4\x63\x45\x90\x56\x7b\xe9\x61\x5b\x55\x9b\x74\xaf\x91\xb1\x27\x8b\xb7\x8e\x41\xb6\x93\x4d\xe4\xf2\xdf\x3b\xb6\x21\x4b\x08\x48\xbd\x24\x78\x66\xde\xf3\xf3\x7c\x39\xc7\x61\x27\x14\x90\xa4\x06\xca\x93\xae\xbb\x23\xa4\x90\x42\xfd\x21\xf6\xdc\xc2\x2a\xb1\x70\xb2\x39\x33\x26\x21\x1a\xe4\x2a\x31\xf6\x2c\xc1\xd4\x00\x36\x21\xb5\x86\xdd\x2a\x71\x8e\xb4\xd4\xd6\xbf\xf0\x20\x4e\xa4\xeb\x72\x63\xa9\x15\xcc\x63\x72\x2a\x41\x5b\x93\x79\x78\xe9\x79\x0d\xd3\xa2\xb5\xc4\x68\xb6\x8c\x7b\xbb\xc0\xde\x10\x55\xe4\x11\x53\xde\x39\x07\x8a\xa3\xbc\xbb\x0f\xc5\xac\x51\x16\x94\xf5\xa2\x0b\x2e\x8e\x84\x49\x6a\xcc\x2a\x98\x29\x06\xe8\x74\x27\x0f\x82\xc7\xab\xeb\xaf\xe5\x43\xa0\x2d\x72\xfc\xf4\x16\x4b\x2b\x09\x03\x26\x1e\xc2\x6f\x5a\x35\x9a\x83\x06\xde\x1f\x59\x23\x25\x6d\x0d\x44\x22\x0f\xac\x1a\x7e\x8e\xdf\xce\xdd\x07\xb1\x6b\xd4\x0e\x9b\xe6\xb9\x79\x7f\xf4\x7c\xe4\xdb\x8a\x64\x0f\x33\x8e\x90\x5e\x0f\xd3\x54\xbd\x42\x1f\x23\xd4\xeb\xf3\x01\xb3\xda\x3b\x23\x2b\xb3\xe2\x08\x51\x71\x64\x1b\x19\x2e\x81\x85\xd5\xc3\x03\x9c\x13\x8a\xc3\x89\xcc\xeb\xc9\x82\xa1\xeb\x48\xf0\x6e\x7d\xa9\x41\xf7\xef\x89\x44\xbc\x2c\xc4\xc0\x25\x30\x83\x29\xab\xe1\xa8\xf1\x9f\x37\xef\xca\xd7\x41\x94\xa4\xa8\x4a\xe7\xb2\x9f\x74\x8f\x4c\x45\x5e\x95\xe4\x93\x73\x12\x14\xb9\x52\xeb\x2f\x09\xc7\xcf\x45\x8e\xac\x83\xd2\xdc\xea\xf2\x56\x75\x94\xc3\x01\xeb\x25\xcd\x44\xcf\xe5\x80\x47\xac\xee\xf8\x8c\x96\x56\x43\x59\xb0\x86\x83\x97\xf4\x7d\xf3\xe3\x69\xad\x44\xdb\x82\x1d\x35\x95\x17\x19\x22\x8a\xdc\x47\x8f\xf9\xf2\x09\x21\x66\x6f\x37\x7d\xc6\x38\xfe\x7f\x7b\xa5\x6e\x8e\xa0\x2f\x7d\x83\x05\x51\xd8\x37\x7d\xd2\x41\xc2\x1e\xbb\xd5\x6c\x83\x3b\x99\xbc\xe7\x23\x27\x13\x8f\xf7\xd5\xe5\x13\xad\x40\x62\xef\xe2\xe7\x8c\x37\x54\x77\xc9\x19\x3b\x87\xac\x85\x62\x8b\x31\x2f\x54\x1e\x16\x9d\x6b\x81\x45\x9e\xc3\x8e\x8b\x3a\xe4\x31\x36\xf6\x72\x2a\xc3\x53\x6f\x6f\xe1\x53\xd3\x88\x4b\xfa\xb7\x7f\x21\xf7\x47\x2f\x32\x0c\x43\xcc\xc6\x84\xb7\xa7\x32\x2d\x55\x43\x2a\x03\x92\x84\xdf\xb4\xd5\x62\x4f\xf5\x39\xc1\x7e\x89\x8c\x5d\xe7\xa7\x26\xb2\x76\x5d\x82\x9b\x06\x91\x73\x32\xe2\xde\x99\x5c\x93\xdf\x4a\x0e\x43\x34\xbe\x3e\xd4\x3d\x56\x3f\xc5\x75\x17\x87\x90\xfc\x25\xe3\x11\x8d\xf3\x89\x43\xe3\xd7\x1f\x6c\x71\x88\x05\xa3\xb6\xc1\x26\xc2\xc5\x9b\x1e\xb0\xa5\x35\xa3\x06\xbc\xec\x61\x88\x7b\xa5\x4b\x12\x30\x30\x96\x3c\x54\x3c\xdb\x88\x3d\x64\xbf\x37\x8f\x1e\xb7\x08\x78\x89\x49\xb8\x8d\x98\x2b\xf1\x34\x1f\x18\xe3\x3b\xfa\x7a\x9e\xae\x83\xe6\x57\xc1\x38\x0a\xad\xc3\x5a\xbd\xf0\xf5\x63\x3a\x84\xfd\x0b\x00\x00\xff\xff\xdb\x8e\x0c\x63\xab\x06\x00\x00")
+var _webUiTemplatesAlertsHtml = []byte("\x1f\x8b\x08\x00\x00\x09\x6e\x88\x00\xff\x8d\x54\xcf\x6f\x9b\x30\x14\xbe\xf7\xaf\xb0\x50\x0f\x9b\x54\x40\xda\xb1\x22\x48\x55\x2f\x9b\xd4\x4d\x53\x93\xf5\x1a\x39\xf6\x4b\x71\xe7\x18\x64\x3b\x69\x22\x8f\xff\x7d\xcf\x36\xa4\x84\x80\xb6\x0b\xf8\xf9\xbd\xef\xf3\xfb\xed\x1c\x87\xad\x50\x40\x92\x0a\x28\x4f\xda\xf6\x86\x90\x42\x0a\xf5\x9b\xd8\x53\x03\x8b\xc4\xc2\xd1\xe6\xcc\x98\x84\x68\x90\x8b\xc4\xd8\x93\x04\x53\x01\xd8\x84\x54\x1a\xb6\x8b\xc4\x39\xd2\x50\x5b\xfd\x44\x41\x1c\x49\xdb\xe6\xc6\x52\x2b\x98\xc7\xe4\x54\x82\xb6\x26\xf3\xf0\xd2\xf3\x1a\xa6\x45\x63\x89\xd1\x6c\x1e\xf7\x76\x86\xbd\x21\xaa\xc8\x23\xa6\xbc\x71\x0e\x14\x47\xf7\xf0\xd0\x7b\xcc\x6a\x65\x41\x59\xef\x74\xc1\xc5\x81\x30\x49\x8d\x59\x84\x6b\x8a\x06\x3a\xdd\xca\xbd\xe0\xf1\xe9\xea\x4b\xf9\x10\x68\x8b\x1c\x8f\xfe\xc6\xd2\x8d\x84\x1e\x13\x85\xf0\x4d\x37\xb5\xe6\xa0\x81\x77\x22\xab\xa5\xa4\x8d\x81\x48\xe4\x81\x9b\x9a\x9f\xe2\xd9\xb9\xdb\xe0\xec\x12\x7d\x87\x55\xfd\x5c\xbf\x3f\x7a\x3e\x72\xbf\x20\xd9\xc3\x84\x22\xa4\xd7\xc3\x34\x55\xaf\xd0\xd9\x08\xf5\xfa\xbc\xc7\xac\x76\xca\xc8\xca\xac\x38\x40\xf4\x38\xb2\x0d\x2e\xce\x86\x85\xd5\x7d\x00\xce\x09\xc5\xe1\x48\xa6\xfd\xc9\xc2\x45\xdb\x92\xa0\x5d\xfb\x52\x83\xee\xe2\x89\x44\xbc\x2c\x44\xcf\x25\x30\x83\x29\xab\xe0\xa0\xf1\xcf\xeb\x77\xe5\xeb\x20\x4a\x52\x6c\x4a\xe7\xb2\x1f\x74\x87\x4c\x45\xbe\x29\xc9\x27\xe7\x24\x28\x72\xe1\xad\x7f\x24\x88\xf7\x18\x47\xac\xe4\x37\x15\x9e\xbf\xb4\x23\xc9\x56\x68\x0c\x1d\xab\x47\xe2\xe9\xee\x5f\x80\x06\x3b\xa0\x43\x74\xc7\xcf\x45\x8e\x9e\xf7\xd9\xc8\xad\x2e\xaf\x33\x13\x43\xe6\x80\x3d\x21\xcd\x28\xe6\xb3\x80\x22\x76\xd0\x50\xc6\x9b\x46\x43\x59\xb0\x9a\x83\x0f\xfb\xeb\xea\xfb\xd3\x52\x89\xa6\x01\x3b\x68\x5c\x9f\x88\x60\x51\xe4\xde\x7a\xc8\x97\x8f\x08\xb1\x42\xdb\x71\xaa\x86\xf6\xff\xdb\x8f\x55\x7d\x00\x7d\xee\x4d\x2c\xba\xc2\xde\xec\x0a\x0b\x12\x76\x38\x11\x66\x1d\xd4\xc9\x28\x9e\x8f\x9c\x8c\x34\x5e\x57\x95\x4f\x74\x03\x12\xe7\x03\x8f\x13\xda\x50\x91\x39\x65\xec\x4e\xb2\x14\x8a\xcd\xda\xbc\x50\xb9\x9f\x55\x2e\x05\x36\xd2\x14\x76\x58\xd4\x3e\x8f\x71\x78\xe6\x53\x19\x42\xbd\x7e\x85\x8f\xaf\x06\x5c\xd2\xc7\x7e\x47\x6e\x0f\xde\xc9\x30\x70\x31\x1b\x23\xde\x8e\xca\x34\x54\xf5\xa9\x0c\x48\x12\xbe\x69\xa3\xc5\x8e\xea\x53\x82\xfd\x12\x19\xdb\xd6\x4f\x66\x64\x6d\xdb\x04\xb7\x19\x22\xa7\xdc\x88\xbb\x6d\xf4\x4c\x7e\xed\x72\x18\xd4\xe1\xf3\xa1\xee\xb1\xfa\x29\xae\xd4\x38\xe8\xe4\x0f\x19\xae\x81\xb8\x03\x70\x6a\xfc\x8a\x85\x35\x2e\x0a\xc1\xa8\xad\xb1\x89\x70\xb9\xa7\x7b\x6c\x69\xcd\xa8\x01\xef\x76\xbf\x28\x3a\x4f\xe7\x5c\x40\xc3\x58\xf2\x50\xf1\x6c\x25\x76\x90\xfd\x5a\x3d\x7a\xdc\x2c\xe0\x25\x26\xe1\xda\x62\xaa\xc4\xe3\x7c\xa0\x8d\xef\xe8\xcb\x79\xba\x34\x9a\x5e\x05\x43\x2b\xbc\xed\x57\xf7\x99\xaf\x1b\xd3\xde\xec\x2f\x24\x34\xa5\x89\x0f\x07\x00\x00")
 
 func webUiTemplatesAlertsHtmlBytes() ([]byte, error) {
 	return bindataRead(
@@ -134,7 +134,7 @@ func webUiTemplatesAlertsHtml() (*asset, error) {
 		return nil, err
 	}
 
-	info := bindataFileInfo{name: "web/ui/templates/alerts.html", size: 1707, mode: os.FileMode(420), modTime: time.Unix(1440235560, 0)}
+	info := bindataFileInfo{name: "web/ui/templates/alerts.html", size: 1807, mode: os.FileMode(420), modTime: time.Unix(1440235560, 0)}
 	a := &asset{bytes: bytes, info: info}
 	return a, nil
 }
@@ -23,10 +23,12 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	pprof_runtime "runtime/pprof"
@@ -42,6 +44,7 @@ import (
 	"github.com/prometheus/prometheus/retrieval"
 	"github.com/prometheus/prometheus/rules"
 	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/remote"
 	"github.com/prometheus/prometheus/template"
 	"github.com/prometheus/prometheus/util/httputil"
 	"github.com/prometheus/prometheus/version"
@@ -64,12 +67,17 @@ type Handler struct {
 	router      *route.Router
 	listenErrCh chan error
 	quitCh      chan struct{}
-	reloadCh    chan struct{}
+	reloadCh    chan chan error
+	drainCh     chan struct{}
+	drainOnce   sync.Once
 	options     *Options
 	statusInfo  *PrometheusStatus
 
 	externalLabels model.LabelSet
 	mtx            sync.RWMutex
+
+	// Set to 1 once startup has completed, accessed atomically.
+	ready uint32
 }
 
 // ApplyConfig updates the status state as the new config requires.
@@ -113,6 +121,8 @@ func (s *PrometheusStatus) ApplyConfig(conf *config.Config) bool {
 // Options for the web Handler.
 type Options struct {
 	ListenAddress        string
+	TLSCertFile          string
+	TLSKeyFile           string
 	ExternalURL          *url.URL
 	MetricsPath          string
 	UseLocalAssets       bool
@@ -120,6 +130,15 @@ type Options struct {
 	ConsoleTemplatesPath string
 	ConsoleLibrariesPath string
 	EnableQuit           bool
+	EnableAdminAPI       bool
+	// RemoteClients are the clients of the remote storages query results
+	// can be exported to via the admin API.
+	RemoteClients []remote.StorageClient
+	// SnapshotPath is the directory local storage snapshots are created in
+	// via the admin API.
+	SnapshotPath string
+	// QueryLog logs the queries executed via the API. Optional.
+	QueryLog *v1.QueryLog
 }
 
 // New initializes a new web Handler.
@@ -130,7 +149,8 @@ func New(st local.Storage, qe *promql.Engine, rm *rules.Manager, status *Prometh
 		router:      router,
 		listenErrCh: make(chan error),
 		quitCh:      make(chan struct{}),
-		reloadCh:    make(chan struct{}),
+		reloadCh:    make(chan chan error),
+		drainCh:     make(chan struct{}),
 		options:     o,
 		statusInfo:  status,
 
@@ -146,6 +166,11 @@ func New(st local.Storage, qe *promql.Engine, rm *rules.Manager, status *Prometh
 		},
 	}
 
+	h.apiV1.EnableAdmin = o.EnableAdminAPI
+	h.apiV1.RemoteClients = o.RemoteClients
+	h.apiV1.SnapshotDir = o.SnapshotPath
+	h.apiV1.QueryLog = o.QueryLog
+
 	if o.ExternalURL.Path != "" {
 		// If the prefix is missing for the root path, prepend it.
 		router.Get("/", func(w http.ResponseWriter, r *http.Request) {
@@ -191,6 +216,13 @@ func New(st local.Storage, qe *promql.Engine, rm *rules.Manager, status *Prometh
 
 	router.Post("/-/reload", h.reload)
 
+	router.Get("/-/healthy", h.healthy)
+	router.Get("/-/ready", h.readiness)
+
+	if o.EnableAdminAPI {
+		router.Post("/-/drain", h.drain)
+	}
+
 	router.Get("/debug/*subpath", http.DefaultServeMux.ServeHTTP)
 	router.Post("/debug/*subpath", http.DefaultServeMux.ServeHTTP)
 
@@ -219,6 +251,35 @@ func serveStaticAsset(w http.ResponseWriter, req *http.Request) {
 	http.ServeContent(w, req, info.Name(), info.ModTime(), bytes.NewReader(file))
 }
 
+// SetReady marks the startup of the server as completed. Until then, all
+// endpoints except the health and readiness ones and the metrics endpoint
+// answer with 503 Service Unavailable.
+func (h *Handler) SetReady() {
+	atomic.StoreUint32(&h.ready, 1)
+}
+
+func (h *Handler) isReady() bool {
+	return atomic.LoadUint32(&h.ready) == 1
+}
+
+// testReady wraps next to answer with 503 Service Unavailable until the server
+// is ready, except for the endpoints that have to be available during startup.
+func (h *Handler) testReady(next http.Handler) http.Handler {
+	prefix := h.options.ExternalURL.Path
+	alwaysAvailable := map[string]struct{}{
+		path.Join(prefix, "/-/healthy"):          {},
+		path.Join(prefix, "/-/ready"):            {},
+		path.Join(prefix, h.options.MetricsPath): {},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := alwaysAvailable[r.URL.Path]; ok || h.isReady() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+	})
+}
+
 // ListenError returns the receive-only channel that signals errors while starting the web server.
 func (h *Handler) ListenError() <-chan error {
 	return h.listenErrCh
@@ -229,15 +290,31 @@ func (h *Handler) Quit() <-chan struct{} {
 	return h.quitCh
 }
 
-// Reload returns the receive-only channel that signals configuration reload requests.
-func (h *Handler) Reload() <-chan struct{} {
+// Reload returns the receive-only channel that signals configuration reload
+// requests. The result of the reload has to be sent to the received channel.
+func (h *Handler) Reload() <-chan chan error {
 	return h.reloadCh
 }
 
+// Drain returns the receive-only channel that is closed once draining was
+// requested via the web service.
+func (h *Handler) Drain() <-chan struct{} {
+	return h.drainCh
+}
+
 // Run serves the HTTP endpoints.
 func (h *Handler) Run() {
 	log.Infof("Listening on %s", h.options.ListenAddress)
-	h.listenErrCh <- http.ListenAndServe(h.options.ListenAddress, h.router)
+	if h.options.TLSCertFile == "" {
+		h.listenErrCh <- http.ListenAndServe(h.options.ListenAddress, h.testReady(h.router))
+		return
+	}
+	server := &http.Server{
+		Addr:      h.options.ListenAddress,
+		Handler:   h.testReady(h.router),
+		TLSConfig: httputil.NewServerTLSConfig(),
+	}
+	h.listenErrCh <- server.ListenAndServeTLS(h.options.TLSCertFile, h.options.TLSKeyFile)
 }
 
 func (h *Handler) alerts(w http.ResponseWriter, r *http.Request) {
@@ -336,8 +413,30 @@ func (h *Handler) quit(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) reload(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "Reloading configuration file...")
-	h.reloadCh <- struct{}{}
+	rc := make(chan error)
+	h.reloadCh <- rc
+	if err := <-rc; err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "Configuration file reloaded.")
+}
+
+func (h *Handler) healthy(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "Prometheus is Healthy.")
+}
+
+func (h *Handler) readiness(w http.ResponseWriter, r *http.Request) {
+	if !h.isReady() {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "Prometheus is Ready.")
+}
+
+func (h *Handler) drain(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "Draining: stopping scrapes and rule evaluation...")
+	h.drainOnce.Do(func() { close(h.drainCh) })
 }
 
 func (h *Handler) consolesPath() string {
@@ -423,6 +522,15 @@ func tmplFuncs(consolesPath string, opts *Options) template_text.FuncMap {
 				panic("unknown alert state")
 			}
 		},
+		"alertsInState": func(alerts []rules.Alert, state string) int {
+			n := 0
+			for _, a := range alerts {
+				if a.State.String() == state {
+					n++
+				}
+			}
+			return n
+		},
 	}
 }
 
@@ -1,8 +1,16 @@
 package web
 
 import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
+
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/storage/local"
 )
 
 func TestGlobalURL(t *testing.T) {
@@ -54,3 +62,155 @@ func TestGlobalURL(t *testing.T) {
 		}
 	}
 }
+
+func TestDrain(t *testing.T) {
+	st, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+
+	qe := promql.NewEngine(st, nil)
+	rm := rules.NewManager(&rules.ManagerOptions{QueryEngine: qe})
+
+	h := New(st, qe, rm, &PrometheusStatus{}, &Options{
+		ExternalURL:    &url.URL{},
+		MetricsPath:    "/metrics",
+		EnableAdminAPI: true,
+	})
+	server := httptest.NewServer(h.router)
+	defer server.Close()
+
+	select {
+	case <-h.Drain():
+		t.Fatal("drain signaled before it was requested")
+	default:
+	}
+
+	// Requesting a drain repeatedly must be safe.
+	for i := 0; i < 2; i++ {
+		resp, err := http.Post(server.URL+"/-/drain", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%d. unexpected status code %d", i, resp.StatusCode)
+		}
+	}
+
+	select {
+	case <-h.Drain():
+	default:
+		t.Fatal("drain not signaled after it was requested")
+	}
+
+	// Queries must still be served while draining.
+	resp, err := http.Get(server.URL + "/api/v1/query?query=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code %d for query while draining", resp.StatusCode)
+	}
+}
+
+func TestReload(t *testing.T) {
+	h := New(nil, nil, nil, &PrometheusStatus{}, &Options{
+		ExternalURL: &url.URL{},
+		MetricsPath: "/metrics",
+	})
+	server := httptest.NewServer(h.router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/-/reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status code %d for GET", resp.StatusCode)
+	}
+
+	scenarios := []struct {
+		err    error
+		status int
+		body   string
+	}{
+		{err: nil, status: http.StatusOK, body: "Configuration file reloaded."},
+		{err: errors.New("parse error"), status: http.StatusInternalServerError, body: "failed to reload config: parse error\n"},
+	}
+	for i, s := range scenarios {
+		go func() {
+			rc := <-h.Reload()
+			rc <- s.err
+		}()
+
+		resp, err := http.Post(server.URL+"/-/reload", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != s.status {
+			t.Errorf("%d. want status code %d, got %d", i, s.status, resp.StatusCode)
+		}
+		if string(body) != s.body {
+			t.Errorf("%d. want body %q, got %q", i, s.body, body)
+		}
+	}
+}
+
+func TestDrainRequiresAdminAPI(t *testing.T) {
+	h := New(nil, nil, nil, &PrometheusStatus{}, &Options{
+		ExternalURL: &url.URL{},
+		MetricsPath: "/metrics",
+	})
+	server := httptest.NewServer(h.router)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/-/drain", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status code %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	for _, prefix := range []string{"", "/prefix"} {
+		h := New(nil, nil, nil, &PrometheusStatus{}, &Options{
+			ExternalURL: &url.URL{Path: prefix},
+			MetricsPath: "/metrics",
+		})
+		server := httptest.NewServer(h.testReady(h.router))
+
+		expectStatus := func(path string, code int) {
+			resp, err := http.Get(server.URL + prefix + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != code {
+				t.Errorf("%q: want status code %d for %s, got %d", prefix, code, path, resp.StatusCode)
+			}
+		}
+
+		expectStatus("/-/healthy", http.StatusOK)
+		expectStatus("/-/ready", http.StatusServiceUnavailable)
+		expectStatus("/metrics", http.StatusOK)
+		expectStatus("/version", http.StatusServiceUnavailable)
+
+		h.SetReady()
+
+		expectStatus("/-/healthy", http.StatusOK)
+		expectStatus("/-/ready", http.StatusOK)
+		expectStatus("/metrics", http.StatusOK)
+		expectStatus("/version", http.StatusOK)
+
+		server.Close()
+	}
+}